@@ -0,0 +1,131 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "net/http"
+    "text/template"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+)
+
+type AdminData struct {
+    Username string
+    Users []security.UserInfo
+    Roles []string
+    Log []db.ModerationEntry
+    Posts []db.Post
+    Search string
+    Page int
+    PrevPage int
+    NextPage int
+    Message string
+    Error string
+}
+
+// Returns the logged in user if they are an admin, otherwise responds and returns false
+func adminUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return "", false
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return "", false
+    }
+    if !security.Can(username, security.PermManageUsers) {
+        http.Error(w, security.ErrPermissionDenied.Error(), http.StatusForbidden)
+        return "", false
+    }
+    return username, true
+}
+
+// Lists and searches users and applies admin actions to them
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+    admin, ok := adminUser(w, r)
+    if !ok {
+        return
+    }
+    data := AdminData{Username: admin, Roles: security.Roles}
+    data.Search = r.FormValue("q")
+    data.Page, _ = strconv.Atoi(r.FormValue("page"))
+    if data.Page < 0 {
+        data.Page = 0
+    }
+
+    if r.Method == "POST" {
+        var err error
+        username := r.FormValue("username")
+        switch r.FormValue("action") {
+        case "lock":
+            err = security.SetLocked(admin, username, true)
+        case "unlock":
+            err = security.SetLocked(admin, username, false)
+        case "logout":
+            err = security.LogoutUser(admin, username)
+        case "role":
+            err = security.SetRole(admin, username, r.FormValue("role"))
+        case "reset":
+            var password string
+            password, err = security.ResetPassword(admin, username)
+            if err == nil {
+                data.Message = "Temporary password for "+username+": "+password
+            }
+        default:
+            err = fmt.Errorf("Unknown action %q", r.FormValue("action"))
+        }
+        if err != nil {
+            data.Error = err.Error()
+        } else if data.Message == "" {
+            data.Message = "Updated "+username
+        }
+    }
+
+    var err error
+    data.Users, err = security.ListUsers(admin, data.Search, data.Page)
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.PrevPage = data.Page - 1
+    if len(data.Users) == security.UsersPerPage {
+        data.NextPage = data.Page + 1
+    }
+    data.Log, err = security.ModerationLog(admin, 50)
+    if err != nil {
+        fmt.Println(err)
+    }
+    t, _ := template.ParseFiles("assets/admin.html")
+    t.Execute(w, data)
+}
+
+// Lists every post and comment, including hidden ones, and deletes them
+func adminContent(w http.ResponseWriter, r *http.Request) {
+    admin, ok := adminUser(w, r)
+    if !ok {
+        return
+    }
+    if r.Method == "POST" {
+        entity, err := db.ParseEntity(r.FormValue("entity"))
+        if err == nil {
+            err = security.DeleteContent(admin, entity, r.FormValue("id"))
+        }
+        if err != nil {
+            fmt.Println(err)
+        }
+        http.Redirect(w, r, "https://localhost/admin/content", 303)
+        return
+    }
+
+    data := AdminData{Username: admin}
+    posts, err := db.GetAllPosts()
+    if err != nil {
+        fmt.Println(err)
+    }
+    for _, post := range posts {
+        post.Comments, _ = db.GetComments(post.Id)
+        data.Posts = append(data.Posts, post)
+    }
+    t, _ := template.ParseFiles("assets/admin_content.html")
+    t.Execute(w, data)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+    "time"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+)
+
+type roleChange struct {
+    Role string `json:"role"`
+}
+
+// Temporary password set by an admin
+type resetPassword struct {
+    Password string `json:"password"`
+}
+
+type logEntry struct {
+    Id string `json:"id"`
+    Actor string `json:"actor"`
+    Action string `json:"action"`
+    Entity string `json:"entity"`
+    EntityId string `json:"entity_id"`
+    Author string `json:"author"`
+    Detail string `json:"detail"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Returns the caller if they are an admin, otherwise responds and returns false
+func adminUser(c *gin.Context) (string, bool) {
+    if !authorized(c, security.ScopeAdmin) {
+        return "", false
+    }
+    username := getUsername(c)
+    if !security.Can(username, security.PermManageUsers) {
+        c.IndentedJSON(http.StatusForbidden, gin.H{"error": security.ErrPermissionDenied.Error()})
+        return "", false
+    }
+    return username, true
+}
+
+// Responds to the result of an admin action
+func adminResult(c *gin.Context, err error) {
+    if err == security.ErrPermissionDenied {
+        c.IndentedJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Lists users, filtered by the q query parameter
+func adminGetUsers(c *gin.Context) {
+    admin, ok := adminUser(c)
+    if !ok {
+        return
+    }
+    page, _ := strconv.Atoi(c.Query("page"))
+    users, err := security.ListUsers(admin, c.Query("q"), page)
+    if err != nil {
+        adminResult(c, err)
+        return
+    }
+    c.IndentedJSON(http.StatusOK, users)
+}
+
+// Returns a handler that locks or unlocks a user
+func adminLockUser(locked bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        admin, ok := adminUser(c)
+        if !ok {
+            return
+        }
+        adminResult(c, security.SetLocked(admin, c.Param("username"), locked))
+    }
+}
+
+// Resets a user's password, returning the temporary password
+func adminResetPassword(c *gin.Context) {
+    admin, ok := adminUser(c)
+    if !ok {
+        return
+    }
+    password, err := security.ResetPassword(admin, c.Param("username"))
+    if err != nil {
+        adminResult(c, err)
+        return
+    }
+    c.IndentedJSON(http.StatusOK, resetPassword{password})
+}
+
+// Ends all of a user's sessions and API tokens
+func adminLogoutUser(c *gin.Context) {
+    admin, ok := adminUser(c)
+    if !ok {
+        return
+    }
+    adminResult(c, security.LogoutUser(admin, c.Param("username")))
+}
+
+// Changes a user's role
+func adminSetRole(c *gin.Context) {
+    admin, ok := adminUser(c)
+    if !ok {
+        return
+    }
+    var req roleChange
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    adminResult(c, security.SetRole(admin, c.Param("username"), req.Role))
+}
+
+// Lists every post with its comments, including hidden ones
+func adminGetPosts(c *gin.Context) {
+    if _, ok := adminUser(c); !ok {
+        return
+    }
+    db_posts, err := db.GetAllPosts()
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    posts := []post{}
+    for _, db_post := range db_posts {
+        db_post.Comments, _ = db.GetComments(db_post.Id)
+        posts = append(posts, apiPost(db_post))
+    }
+    c.IndentedJSON(http.StatusOK, posts)
+}
+
+// Returns a handler that deletes any post or comment
+func adminDeleteContent(entity db.Entity) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        admin, ok := adminUser(c)
+        if !ok {
+            return
+        }
+        adminResult(c, security.DeleteContent(admin, entity, c.Param("id")))
+    }
+}
+
+// Lists the most recent moderation and admin actions
+func adminGetLog(c *gin.Context) {
+    admin, ok := adminUser(c)
+    if !ok {
+        return
+    }
+    entries, err := security.ModerationLog(admin, 200)
+    if err != nil {
+        adminResult(c, err)
+        return
+    }
+    log := []logEntry{}
+    for _, e := range entries {
+        log = append(log, logEntry{e.Id, e.Actor, e.Action, e.Entity, e.EntityId, e.Author, e.Detail, e.CreatedAt})
+    }
+    c.IndentedJSON(http.StatusOK, log)
+}
+
+// Registers the /api/admin endpoints
+func adminRoutes(router *gin.Engine) {
+    router.GET("/api/admin/users", adminGetUsers)
+    router.POST("/api/admin/users/:username/lock", adminLockUser(true))
+    router.DELETE("/api/admin/users/:username/lock", adminLockUser(false))
+    router.POST("/api/admin/users/:username/password", adminResetPassword)
+    router.DELETE("/api/admin/users/:username/sessions", adminLogoutUser)
+    router.PUT("/api/admin/users/:username/role", adminSetRole)
+
+    router.GET("/api/admin/posts", adminGetPosts)
+    router.DELETE("/api/admin/post/:id", adminDeleteContent(db.PostEntity))
+    router.DELETE("/api/admin/comment/:id", adminDeleteContent(db.CommentEntity))
+
+    router.GET("/api/admin/log", adminGetLog)
+}
@@ -1,8 +1,10 @@
 package api
 
 import (
+    "os"
     "fmt"
     "time"
+    "strconv"
     "net/http"
     "strings"
     "encoding/json"
@@ -19,10 +21,122 @@ type post struct {
     Author string `json:"author"`
     Date string `json:"date"`
     Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+    Reactions []reaction `json:"reactions"`
     Comments string `json:"comments"`
+    // Cursor of the comments following those in Comments, see GET /api/post/:id/comments
+    CommentsCursor string `json:"comments_cursor,omitempty"`
+    Hidden bool `json:"hidden"`
+    Edited bool `json:"edited"`
+    EditedAt string `json:"edited_at,omitempty"`
+    EditedBy string `json:"edited_by,omitempty"`
     Id  string `json:"id"`
 }
 
+type comment struct {
+    Content string `json:"content"`
+    Author string `json:"author"`
+    Date string `json:"date"`
+    Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+    Reactions []reaction `json:"reactions"`
+    Hidden bool `json:"hidden"`
+    Edited bool `json:"edited"`
+    EditedAt string `json:"edited_at,omitempty"`
+    EditedBy string `json:"edited_by,omitempty"`
+    Id  string `json:"id"`
+}
+
+type reaction struct {
+    Emoji string `json:"emoji"`
+    Count int `json:"count"`
+    Users []string `json:"users"`
+    Reacted bool `json:"reacted"`
+}
+
+type newReaction struct {
+    Emoji string `json:"emoji"`
+}
+
+// Converts emoji reactions to the API representation
+func apiReactions(db_reactions []db.Reaction) []reaction {
+    reactions := []reaction{}
+    for _, r := range db_reactions {
+        reactions = append(reactions, reaction{Emoji: r.Emoji, Count: r.Count, Users: r.Users, Reacted: r.Reacted})
+    }
+    return reactions
+}
+
+type revision struct {
+    Version int `json:"version"`
+    Content string `json:"content"`
+    Editor string `json:"editor"`
+    CreatedAt string `json:"created_at"`
+}
+
+// Converts a post and its comments to the API representation
+func apiPost(db_post db.Post) post {
+    edited := ""
+    if !db_post.EditedAt.IsZero() {
+        edited = db_post.EditedAt.String()
+    }
+    return post{
+        Content: db_post.Content,
+        Author: db_post.Author,
+        Date: db_post.Date.String(),
+        Likes: db_post.Likes,
+        Dislikes: db_post.Dislikes,
+        Liked: db_post.Vote == db.Liked,
+        Disliked: db_post.Vote == db.Disliked,
+        Reactions: apiReactions(db_post.Reactions),
+        Comments: fmt.Sprintf("%#v", db_post.Comments),
+        Hidden: db_post.Hidden,
+        Edited: edited != "",
+        EditedAt: edited,
+        EditedBy: db_post.EditedBy,
+        Id: db_post.Id,
+    }
+}
+
+// Converts a comment to the API representation
+func apiComment(db_comment db.Comment) comment {
+    edited := ""
+    if !db_comment.EditedAt.IsZero() {
+        edited = db_comment.EditedAt.String()
+    }
+    return comment{
+        Content: db_comment.Content,
+        Author: db_comment.Author,
+        Date: db_comment.Date.String(),
+        Likes: db_comment.Likes,
+        Dislikes: db_comment.Dislikes,
+        Liked: db_comment.Vote == db.Liked,
+        Disliked: db_comment.Vote == db.Disliked,
+        Reactions: apiReactions(db_comment.Reactions),
+        Hidden: db_comment.Hidden,
+        Edited: edited != "",
+        EditedAt: edited,
+        EditedBy: db_comment.EditedBy,
+        Id: db_comment.Id,
+    }
+}
+
+// Reads the limit query parameter, zero when it is missing
+func pageLimit(c *gin.Context) (int, error) {
+    if c.Query("limit") == "" {
+        return 0, nil
+    }
+    limit, err := strconv.Atoi(c.Query("limit"))
+    if err != nil {
+        return 0, fmt.Errorf("Invalid limit %q", c.Query("limit"))
+    }
+    return limit, nil
+}
+
 type credentials struct {
     Username string `json:"username"`
     Password string `json:"password"`
@@ -37,8 +151,78 @@ type newContent struct {
     Content string `json:"content"`
 }
 
+// Body of every error response
+type apiError struct {
+    Error string `json:"error"`
+}
+
+// Body of responses to requests that only report success
+type apiMessage struct {
+    Message string `json:"message"`
+}
+
+type createdPost struct {
+    Message string `json:"message"`
+    PostId string `json:"post_id"`
+}
+
+type createdComment struct {
+    Message string `json:"message"`
+    CommentId string `json:"comment_id"`
+}
+
+// Page of posts or comments with the cursor of the next page, empty on the last page
+type postsPage struct {
+    Posts []post `json:"posts"`
+    NextCursor string `json:"next_cursor"`
+}
+
+type commentsPage struct {
+    Comments []comment `json:"comments"`
+    NextCursor string `json:"next_cursor"`
+}
+
+type searchResult struct {
+    // post or comment
+    Type string `json:"type"`
+    Id int64 `json:"id"`
+    // The post itself or the post commented on
+    PostId int64 `json:"post_id"`
+    Author string `json:"author"`
+    Content string `json:"content"`
+    Date string `json:"date"`
+    Score float64 `json:"score"`
+    // HTML excerpt with the matches in <mark> tags
+    Highlight string `json:"highlight"`
+}
+
+type searchResults struct {
+    Results []searchResult `json:"results"`
+}
+
+type tagCount struct {
+    Tag string `json:"tag"`
+    Count int `json:"count"`
+}
+
+type trashItem struct {
+    Entity string `json:"entity"`
+    Id string `json:"id"`
+    PostId string `json:"post_id"`
+    Content string `json:"content"`
+    Author string `json:"author"`
+    DeletedAt time.Time `json:"deleted_at"`
+    DeletedBy string `json:"deleted_by"`
+}
+
+// Likes and dislikes of a post or comment after a vote
+type votes struct {
+    Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+}
 
-var signingKey = []byte(uuid.NewString())
 
 // Generates a new JWT
 func generateJWT(c *gin.Context) {
@@ -53,146 +237,372 @@ func generateJWT(c *gin.Context) {
     }
 
     // Check user is verified
-    _, err = security.Authenticate(creds.Username, creds.Password)
+    err = security.VerifyCredentials(creds.Username, creds.Password)
     if err != nil {
         fmt.Println(err)
         c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
 
-    // Make JWT
-    expirationTime := time.Now().Add(time.Hour * 168)
-    claim := &claims {
-        Username: creds.Username,
-        StandardClaims: jwt.StandardClaims {
-            ExpiresAt: expirationTime.Unix()},
-    }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS512, claim)
-    tokenString, err := token.SignedString(signingKey)
+    // Make JWT and the refresh token paired with it
+    jti := uuid.NewString()
+    refreshToken, err := security.NewRefreshToken(creds.Username, jti)
     if err != nil {
         fmt.Println(err)
-        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    c.IndentedJSON(http.StatusOK, gin.H{"key": tokenString})
+    issueTokens(c, creds.Username, jti, refreshToken)
 }
 
-// Determines if a request is authorized
-func authorized(c *gin.Context) bool {
+// Determines if a request is authorized and allowed scope. JWTs and session
+// cookies carry every scope, personal access tokens only the ones they were
+// created with. An empty scope only requires authentication. Responds with the
+// error when it is not, so callers only need to return.
+func authorized(c *gin.Context, scope string) bool {
     authHeader := c.Request.Header["Authorization"]
     if len(authHeader) > 0 {
-        jwtString := strings.Fields(authHeader[0])[1]
+        fields := strings.Fields(authHeader[0])
+        if len(fields) != 2 {
+            unauthorized(c)
+            return false
+        }
+        if strings.HasPrefix(fields[1], security.PersonalTokenPrefix) {
+            username, scopes, err := security.AuthenticatePersonalToken(fields[1])
+            if err != nil {
+                c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+                return false
+            }
+            if scope != "" && !security.HasScope(scopes, scope) {
+                c.IndentedJSON(http.StatusForbidden, gin.H{"error":
+                    "Token is missing the "+scope+" scope"})
+                return false
+            }
+            c.Set("username", username)
+            return true
+        }
+        jwtString := fields[1]
         claims := &claims{}
-        tkn, err := jwt.ParseWithClaims(jwtString, claims,
-            func(t *jwt.Token) (interface{}, error) {
-                return signingKey, nil
-            })
+        tkn, err := jwt.ParseWithClaims(jwtString, claims, keys.verificationKey)
         if err != nil {
             c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Error parsing JWT Claims: "+err.Error()})
             return false
         }
         if !tkn.Valid {
-            fmt.Println()
             c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
                 "jwt is not valid"})
             return false
         }
+        revoked, err := security.TokenRevoked(claims.Id)
+        if claims.Id == "" || revoked || err != nil {
+            c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
+                "jwt has been revoked"})
+            return false
+        }
+        c.Set("username", claims.Username)
         return true
     } else {
         cookie, _ := c.Request.Cookie("sessionid")
         if cookie == nil {
+            unauthorized(c)
             return false
         }
         uuid := cookie.Value
         authorized, _ := security.IsAuthenticated(uuid)
+        if !authorized {
+            unauthorized(c)
+        }
         return authorized
     }
-    return false
 }
 
-// Return username from encoded JWT
+// Responds to a request without valid credentials
+func unauthorized(c *gin.Context) {
+    c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
+        "You are not authorized, ensure your JWT is presented correctly"})
+}
+
+// Returns the session uuid of a cookie authenticated request
+func getSessionID(c *gin.Context) string {
+    cookie, err := c.Request.Cookie("sessionid")
+    if err != nil {
+        return ""
+    }
+    return cookie.Value
+}
+
+// Return username of the token checked by authorized, from encoded JWT, or from the session cookie
 func getUsername(c *gin.Context) string {
+    if username := c.GetString("username"); username != "" {
+        return username
+    }
     authHeader := c.Request.Header["Authorization"]
-    jwtString := strings.Fields(authHeader[0])[1]
+    if len(authHeader) == 0 {
+        username, _ := db.GetUsername(getSessionID(c))
+        return username
+    }
+    fields := strings.Fields(authHeader[0])
+    if len(fields) != 2 {
+        return ""
+    }
+    jwtString := fields[1]
     claims := &claims{}
-    jwt.ParseWithClaims(jwtString, claims,
-        func(t *jwt.Token) (interface{}, error) {
-            return signingKey, nil
-    })
+    jwt.ParseWithClaims(jwtString, claims, keys.verificationKey)
     return claims.Username
 }
 
 // Landing page for API
 func apiLanding(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, "") {
         return
     }
     c.String(http.StatusOK, "Welcome to kind-app API")
 }
 
-// Gets a post by id
-func getPost(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
-        return
+// Loads a post visible to username with its first page of comments, returning
+// the cursor of the next page of comments
+func loadPost(username string, id string) (db.Post, string, error) {
+    db_post, err := db.GetPost(id)
+    if err == nil && db_post.Hidden && !security.Can(username, security.PermViewHidden) {
+        err = fmt.Errorf("Post %s does not exist.", id)
+    }
+    if err != nil {
+        return db_post, "", err
+    }
+    comments, next, _ := db.GetCommentsPage(db_post.Id, "", 0)
+    db_post.Comments = security.VisibleComments(username, comments)
+    posts := []db.Post{db_post}
+    err = db.MarkVotes(username, posts)
+    if err == nil {
+        err = db.LoadReactions(username, posts)
+    }
+    if err != nil {
+        fmt.Println(err)
     }
-    var post post
+    return posts[0], next, nil
+}
 
-    id := c.Param("id")
+// Loads a page of the posts visible to username, only those using tag unless it
+// is empty, with the first page of each post's comments. Returns the cursor of each post's next page of comments, by
+// post id, and the cursor of the next page of posts.
+func loadPosts(username string, tag string, cursor string, limit int) ([]db.Post, map[string]string, string, error) {
+    var db_posts []db.Post
+    var next string
+    var err error
+    if tag == "" {
+        db_posts, next, err = db.GetPostsPage(cursor, limit)
+    } else {
+        db_posts, next, err = db.GetTagPostsPage(tag, cursor, limit)
+    }
+    if err != nil {
+        return nil, nil, "", err
+    }
+    commentsCursors := make(map[string]string)
+    for i := range db_posts {
+        db_posts[i].Comments, commentsCursors[db_posts[i].Id], _ = db.GetCommentsPage(db_posts[i].Id, "", 0)
+    }
+    db_posts = security.VisiblePosts(username, db_posts)
+    err = db.MarkVotes(username, db_posts)
+    if err == nil {
+        err = db.LoadReactions(username, db_posts)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    return db_posts, commentsCursors, next, nil
+}
+
+// Loads a page of the comments visible to username on a post they can see
+func loadComments(username string, id string, cursor string, limit int) ([]db.Comment, string, error) {
     db_post, err := db.GetPost(id)
+    if err == nil && db_post.Hidden && !security.Can(username, security.PermViewHidden) {
+        err = fmt.Errorf("Post %s does not exist.", id)
+    }
+    if err != nil {
+        return nil, "", err
+    }
+    db_comments, next, err := db.GetCommentsPage(id, cursor, limit)
+    if err != nil {
+        return nil, "", err
+    }
+    db_comments = security.VisibleComments(username, db_comments)
+    err = db.MarkCommentVotes(username, db_comments)
+    if err == nil {
+        err = db.LoadCommentReactions(username, db_comments)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    return db_comments, next, nil
+}
+
+// Marks a response as deprecated in favour of the endpoint at successor
+func deprecated(c *gin.Context, successor string) {
+    c.Header("Deprecation", "true")
+    c.Header("Link", "<"+successor+">; rel=\"successor-version\"")
+}
+
+// Gets a post by id. Deprecated by GET /api/v2/post/:id.
+func getPost(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    deprecated(c, "/api/v2/post/"+c.Param("id"))
+    db_post, next, err := loadPost(getUsername(c), c.Param("id"))
     if err != nil {
         fmt.Println(err)
         c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
+    p := apiPost(db_post)
+    p.CommentsCursor = next
+    c.IndentedJSON(http.StatusOK, p)
+}
 
-    post.Content = db_post.Content
-    post.Author = db_post.Author
-    post.Date = db_post.Date.String()
-    post.Likes = db_post.Likes
-    post.Id = db_post.Id
-
-    comments, _ := db.GetComments(post.Id)
-    post.Comments = fmt.Sprintf("%#v", comments)
-    c.IndentedJSON(http.StatusOK, post)
+// Loads every post visible to username, newest first, with all of their comments
+func loadAllPosts(username string) ([]db.Post, error) {
+    db_posts, err := db.GetAllPosts()
+    if err != nil {
+        return nil, err
+    }
+    for i := range db_posts {
+        db_posts[i].Comments, _ = db.GetComments(db_posts[i].Id)
+    }
+    db_posts = security.VisiblePosts(username, db_posts)
+    err = db.MarkVotes(username, db_posts)
+    if err == nil {
+        err = db.LoadReactions(username, db_posts)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    return db_posts, nil
 }
 
-// Get all posts in the system
+// Gets a page of posts, newest first, with the first page of each post's comments.
+// Without limit, cursor or tag it responds as it did before pagination, with a
+// bare array of every post and all of their comments, for older clients.
+// Deprecated by GET /api/v2/posts.
 func getPosts(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, security.ScopePostsRead) {
         return
     }
-    var posts []post
-    db_posts, err := db.GetAllPosts()
+    deprecated(c, "/api/v2/posts")
+    if c.Query("limit") == "" && c.Query("cursor") == "" && c.Query("tag") == "" {
+        db_posts, err := loadAllPosts(getUsername(c))
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        posts := []post{}
+        for _, db_post := range db_posts {
+            posts = append(posts, apiPost(db_post))
+        }
+        c.IndentedJSON(http.StatusOK, posts)
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    db_posts, commentsCursors, next, err := loadPosts(getUsername(c), c.Query("tag"), c.Query("cursor"), limit)
     if err != nil {
         c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
+    posts := []post{}
     for _, db_post := range db_posts {
-        var post post
-        post.Content = db_post.Content
-        post.Author = db_post.Author
-        post.Date = db_post.Date.String()
-        post.Likes = db_post.Likes
-        post.Id = db_post.Id
+        p := apiPost(db_post)
+        p.CommentsCursor = commentsCursors[db_post.Id]
+        posts = append(posts, p)
+    }
+    c.IndentedJSON(http.StatusOK, postsPage{posts, next})
+}
+
+// Gets a page of a post's comments, newest first. Deprecated by GET /api/v2/post/:id/comments.
+func getComments(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    deprecated(c, "/api/v2/post/"+c.Param("id")+"/comments")
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    db_comments, next, err := loadComments(getUsername(c), c.Param("id"), c.Query("cursor"), limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    comments := []comment{}
+    for _, db_comment := range db_comments {
+        comments = append(comments, apiComment(db_comment))
+    }
+    c.IndentedJSON(http.StatusOK, commentsPage{comments, next})
+}
+
+// Searches posts and comments, best match first
+func search(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    results, err := security.Search(getUsername(c), c.Query("q"), limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    matches := []searchResult{}
+    for _, r := range results {
+        matches = append(matches, searchResult{
+            Type: r.Entity.String(),
+            Id: idV2(r.Id),
+            PostId: idV2(r.PostId),
+            Author: r.Author,
+            Content: r.Content,
+            Date: dateV2(r.Date),
+            Score: r.Score,
+            Highlight: r.Highlight,
+        })
+    }
+    c.IndentedJSON(http.StatusOK, searchResults{matches})
+}
 
-        comments, _ := db.GetComments(post.Id)
-        post.Comments = fmt.Sprintf("%#v", comments)
-        posts = append(posts, post)
+// Returns a handler that lists hashtags with the number of posts using them,
+// every tag or the trending ones
+func getTags(trending bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, security.ScopePostsRead) {
+            return
+        }
+        var tags []db.TagCount
+        var err error
+        if trending {
+            tags, err = security.TrendingTags()
+        } else {
+            tags, err = db.GetTags()
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            return
+        }
+        counts := []tagCount{}
+        for _, tag := range tags {
+            counts = append(counts, tagCount{tag.Tag, tag.Count})
+        }
+        c.IndentedJSON(http.StatusOK, counts)
     }
-    c.IndentedJSON(http.StatusOK, posts)
 }
 
 // Creates a post with content and author
 func postPost(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, security.ScopePostsWrite) {
         return
     }
     var p newContent
@@ -204,19 +614,18 @@ func postPost(c *gin.Context) {
     username := getUsername(c)
     if strings.TrimSpace(p.Content) == "" {
         c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Content field cannot be empty"})
+        return
     }
     id, err := db.AddPost(p.Content, username)
     if err != nil {
         c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success", "post_id": id})
+    c.IndentedJSON(http.StatusOK, createdPost{"Success", id})
 }
 
 func postComment(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, security.ScopeCommentsWrite) {
         return
     }
 
@@ -239,33 +648,23 @@ func postComment(c *gin.Context) {
         c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success", "comment_id": id})
+    c.IndentedJSON(http.StatusOK, createdComment{"Success", id})
 }
 
 
 // Deletes a post
 func deletePost(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, security.ScopePostsWrite) {
         return
     }
-    username := getUsername(c)
-    id := c.Param("id")
-
-    author, err := db.GetAuthor("post", id)
-    if err != nil {
-        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-    if username != author {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
+    err := security.DeleteContent(getUsername(c), db.PostEntity, c.Param("id"))
+    if err == security.ErrPermissionDenied {
+        c.IndentedJSON(http.StatusForbidden, gin.H{"error":
             "You do not have permission to delete a post that is not yours"})
         return
     }
-    err = db.DeletePost(id)
     if err != nil {
-        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
     c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
@@ -273,35 +672,229 @@ func deletePost(c *gin.Context) {
 
 // Deletes a comment
 func deleteComment(c *gin.Context) {
-    if !authorized(c) {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "You are not authorized, ensure your JWT is presented correctly"})
+    if !authorized(c, security.ScopeCommentsWrite) {
         return
     }
     username := getUsername(c)
-    id := c.Param("id")
-
-    postID, err := db.GetPostIDFromCommentID(id)
+    err := security.DeleteContent(username, db.CommentEntity, c.Param("id"))
+    if err == security.ErrPermissionDenied {
+        c.IndentedJSON(http.StatusForbidden, gin.H{"error":
+            "User: "+username+" is not authorized to delete this comment"})
+        return
+    }
     if err != nil {
         fmt.Println(err)
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Returns a handler that edits a post or comment
+func editContent(entity db.Entity, scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, scope) {
+            return
+        }
+        var p newContent
+        err := json.NewDecoder(c.Request.Body).Decode(&p)
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Error reading json body: "+err.Error()})
+            return
+        }
+        err = security.EditContent(getUsername(c), entity, c.Param("id"), p.Content)
+        if err == security.ErrPermissionDenied {
+            c.IndentedJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+    }
+}
+
+// Returns a handler that lists every version of a post or comment, oldest first
+func getRevisions(entity db.Entity) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, security.ScopePostsRead) {
+            return
+        }
+        db_revisions, err := security.Revisions(getUsername(c), entity, c.Param("id"))
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        revisions := []revision{}
+        for i, r := range db_revisions {
+            revisions = append(revisions, revision{
+                Version: i + 1,
+                Content: r.Content,
+                Editor: r.Editor,
+                CreatedAt: r.CreatedAt.String(),
+            })
+        }
+        c.IndentedJSON(http.StatusOK, revisions)
+    }
+}
+
+// Lists the deleted posts and comments the caller may restore
+func getTrash(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
         return
     }
-    postAuthor, err := db.GetAuthor("post", postID)
+    items, err := security.ListTrash(getUsername(c))
     if err != nil {
         c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    commentAuthor, err := db.GetAuthor("comment", id)
+    trash := []trashItem{}
+    for _, item := range items {
+        trash = append(trash, trashItem{
+            Entity: item.Entity.String(),
+            Id: item.Id,
+            PostId: item.PostId,
+            Content: item.Content,
+            Author: item.Author,
+            DeletedAt: item.DeletedAt,
+            DeletedBy: item.DeletedBy,
+        })
+    }
+    c.IndentedJSON(http.StatusOK, trash)
+}
+
+// Returns a handler that takes a post or comment out of the trash
+func restoreContent(entity db.Entity, scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, scope) {
+            return
+        }
+        err := security.RestoreContent(getUsername(c), entity, c.Param("id"))
+        if err == security.ErrPermissionDenied {
+            c.IndentedJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+    }
+}
+
+// Returns a handler that hides or shows a post or comment, for moderators
+func hideContent(entity db.Entity, scope string, hidden bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, scope) {
+            return
+        }
+        err := security.SetHidden(getUsername(c), entity, c.Param("id"), hidden)
+        if err == security.ErrPermissionDenied {
+            c.IndentedJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+            return
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+    }
+}
+
+// Returns a handler that likes (1) or dislikes (-1) a post or comment as the
+// caller, or takes back the caller's vote when it is repeated
+func vote(entity db.Entity, scope string, value int) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, scope) {
+            return
+        }
+        username := getUsername(c)
+        var counts db.Votes
+        var err error
+        if value == db.Liked {
+            counts, err = db.Like(username, entity, c.Param("id"))
+        } else {
+            counts, err = db.Dislike(username, entity, c.Param("id"))
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.IndentedJSON(http.StatusOK, votes{counts.Likes, counts.Dislikes, counts.Vote == db.Liked,
+            counts.Vote == db.Disliked})
+    }
+}
+
+// Returns a handler that adds or removes the caller's emoji reaction to a post
+// or comment and responds with its reactions
+func react(entity db.Entity, scope string, add bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !authorized(c, scope) {
+            return
+        }
+        // DELETE requests may name the emoji in the query instead of a body
+        req := newReaction{Emoji: c.Query("emoji")}
+        if req.Emoji == "" {
+            err := json.NewDecoder(c.Request.Body).Decode(&req)
+            if err != nil {
+                c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Error reading json body: "+err.Error()})
+                return
+            }
+        }
+        username := getUsername(c)
+        id := c.Param("id")
+        var err error
+        if add {
+            err = security.React(username, entity, id, req.Emoji)
+        } else {
+            err = security.Unreact(username, entity, id, req.Emoji)
+        }
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        reactions, err := db.GetReactions(entity, id)
+        if err != nil {
+            c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            return
+        }
+        c.IndentedJSON(http.StatusOK, apiReactions(db.MarkReacted(username, reactions)))
+    }
+}
+
+// Lists the caller's active web sessions
+func getSessions(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    sessions, err := security.ListSessions(getUsername(c), getSessionID(c))
     if err != nil {
         c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    if postAuthor != username && commentAuthor != username {
-        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error":
-            "User: "+username+" is not authorized to delete "+commentAuthor+"'s comment"})
+    c.IndentedJSON(http.StatusOK, sessions)
+}
+
+// Ends one of the caller's web sessions
+func deleteSession(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
         return
     }
-    err = db.DeleteComment(id)
+    err := security.RevokeSession(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Ends all of the caller's web sessions
+func deleteSessions(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    err := security.RevokeSessions(getUsername(c), "")
     if err != nil {
         c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
@@ -309,22 +902,110 @@ func deleteComment(c *gin.Context) {
     c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
 }
 
-// Initialize GIN API and expose endpoints
-func StartAPI() {
+// Publishes the public keys that verify API tokens
+func getJWKS(c *gin.Context) {
+    c.IndentedJSON(http.StatusOK, jwkSet{keys.jwks()})
+}
+
+// Builds the GIN router with every API endpoint
+func newRouter() *gin.Engine {
     router := gin.Default()
 
     router.GET("", apiLanding)
     router.POST("/api/jwt", generateJWT)
+    router.POST("/api/token/refresh", refreshJWT)
+    router.POST("/api/token/revoke", revokeJWT)
+    router.POST("/api/password", changePassword)
+
+    router.GET("/api/tokens", getPersonalTokens)
+    router.POST("/api/tokens", postPersonalToken)
+    router.DELETE("/api/tokens/:id", deletePersonalToken)
+    router.GET("/.well-known/jwks.json", getJWKS)
+
+    docs := &apiDocs{}
+    router.GET("/api/openapi.json", docs.getSpec)
+    router.GET("/api/docs/*file", docs.getUI)
+
+    adminRoutes(router)
+    v2Routes(router)
 
     router.GET("/api/posts", getPosts)
     router.GET("/api/post/:id", getPost)
+    router.GET("/api/post/:id/comments", getComments)
+    router.GET("/api/post/:id/live", getLive)
+    router.GET("/api/search", search)
+    router.GET("/api/tags", getTags(false))
+    router.GET("/api/tags/trending", getTags(true))
+    router.GET("/api/stream", getStream)
+    router.GET("/api/notifications", getNotifications)
+    router.POST("/api/notifications/read", readNotifications)
+    router.POST("/api/notifications/:id/read", readNotification)
+    router.GET("/api/notifications/preferences", getNotificationPreferences)
+    router.PUT("/api/notifications/preferences", putNotificationPreferences)
+
+    router.GET("/api/webhooks", getWebhooks)
+    router.POST("/api/webhooks", postWebhook)
+    router.GET("/api/webhooks/:id", getWebhook)
+    router.PATCH("/api/webhooks/:id", patchWebhook)
+    router.DELETE("/api/webhooks/:id", deleteWebhook)
+    router.GET("/api/webhooks/:id/deliveries", getDeliveries)
+    router.POST("/api/webhooks/:id/deliveries/:delivery/redeliver", redeliver)
 
     router.POST("/api/post", postPost)
     router.POST("/api/comment/:id", postComment)
 
+    router.PATCH("/api/post/:id", editContent(db.PostEntity, security.ScopePostsWrite))
+    router.PATCH("/api/comment/:id", editContent(db.CommentEntity, security.ScopeCommentsWrite))
+    router.GET("/api/post/:id/revisions", getRevisions(db.PostEntity))
+    router.GET("/api/comment/:id/revisions", getRevisions(db.CommentEntity))
+
     router.DELETE("/api/post/:id", deletePost)
     router.DELETE("/api/comment/:id", deleteComment)
+    router.GET("/api/trash", getTrash)
+    router.POST("/api/post/:id/restore", restoreContent(db.PostEntity, security.ScopePostsWrite))
+    router.POST("/api/comment/:id/restore", restoreContent(db.CommentEntity, security.ScopeCommentsWrite))
+
+    router.POST("/api/post/:id/hide", hideContent(db.PostEntity, security.ScopePostsWrite, true))
+    router.DELETE("/api/post/:id/hide", hideContent(db.PostEntity, security.ScopePostsWrite, false))
+    router.POST("/api/comment/:id/hide", hideContent(db.CommentEntity, security.ScopeCommentsWrite, true))
+    router.DELETE("/api/comment/:id/hide", hideContent(db.CommentEntity, security.ScopeCommentsWrite, false))
+
+    router.POST("/api/post/:id/like", vote(db.PostEntity, security.ScopePostsWrite, db.Liked))
+    router.POST("/api/post/:id/dislike", vote(db.PostEntity, security.ScopePostsWrite, db.Disliked))
+    router.POST("/api/comment/:id/like", vote(db.CommentEntity, security.ScopeCommentsWrite, db.Liked))
+    router.POST("/api/comment/:id/dislike", vote(db.CommentEntity, security.ScopeCommentsWrite, db.Disliked))
+
+    router.POST("/api/post/:id/reactions", react(db.PostEntity, security.ScopePostsWrite, true))
+    router.DELETE("/api/post/:id/reactions", react(db.PostEntity, security.ScopePostsWrite, false))
+    router.POST("/api/comment/:id/reactions", react(db.CommentEntity, security.ScopeCommentsWrite, true))
+    router.DELETE("/api/comment/:id/reactions", react(db.CommentEntity, security.ScopeCommentsWrite, false))
+
+    router.GET("/api/sessions", getSessions)
+    router.DELETE("/api/sessions", deleteSessions)
+    router.DELETE("/api/sessions/:id", deleteSession)
+
+    // Documents every route above, see openapi.go
+    err := docs.build(router.Routes())
+    if err != nil {
+        panic(err)
+    }
+    return router
+}
 
+// Initialize GIN API and expose endpoints
+func StartAPI() {
+    // Load signing keys shared by every replica, see README
+    if source := os.Getenv("JWT_KEYS"); source != "" {
+        loaded, err := loadKeys(source, os.Getenv("JWT_SIGNING_KID"))
+        if err != nil {
+            panic(err)
+        }
+        keys = loaded
+        go keys.watch(os.Getenv("JWT_SIGNING_KID"), time.Minute)
+    } else {
+        fmt.Println("JWT_KEYS is not set, API tokens will not survive a restart")
+    }
+    router := newRouter()
     router.RunTLS(":8080", "security/server.crt", "security/server.key")
 }
 
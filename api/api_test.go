@@ -0,0 +1,267 @@
+package api
+
+import (
+    "bytes"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "net/url"
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+    "path/filepath"
+    "github.com/gin-gonic/gin"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+)
+
+// Classic SQL injection payloads thrown at every route
+var payloads = []string{
+    "' OR '1'='1",
+    "' OR 1=1 --",
+    "admin'--",
+    "1 OR 1=1",
+    "1' OR '1'='1",
+    "1; DROP TABLE post; --",
+    "1'; DROP TABLE user; --",
+    "'; DELETE FROM session; --",
+    "post SET likes=9999 WHERE 1=1; --",
+    "1 UNION SELECT username, password, salt, 1, 1, 1 FROM user --",
+}
+
+func init() {
+    gin.SetMode(gin.TestMode)
+}
+
+// Opens a fresh SQLite store with user alice and one post, returning alice's JWT
+func setup(t *testing.T) (router *gin.Engine, key string, postID string) {
+    s, err := db.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    db.Use(s)
+
+    err = security.Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    postID, err = db.AddPost("original post", "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    router = newRouter()
+    w := do(router, "POST", "/api/jwt", credentials{"alice", "password"}, "")
+    var body map[string]string
+    json.Unmarshal(w.Body.Bytes(), &body)
+    if w.Code != http.StatusOK || body["key"] == "" {
+        t.Fatalf("POST /api/jwt returned %d: %s", w.Code, w.Body)
+    }
+    return router, body["key"], postID
+}
+
+// Sends a JSON request to the API, optionally with a bearer token
+func do(router *gin.Engine, method string, target string, body interface{}, key string) *httptest.ResponseRecorder {
+    var buf bytes.Buffer
+    if body != nil {
+        json.NewEncoder(&buf).Encode(body)
+    }
+    r := httptest.NewRequest(method, target, &buf)
+    if key != "" {
+        r.Header.Set("Authorization", "Bearer "+key)
+    }
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, r)
+    return w
+}
+
+// Fails if alice or her post were changed
+func assertIntact(t *testing.T, postID string, payload string) {
+    t.Helper()
+    if hash, _, err := db.GetCreds("alice"); err != nil || hash == "" {
+        t.Fatalf("payload %q: user table changed: %v", payload, err)
+    }
+    post, err := db.GetPost(postID)
+    if err != nil || post.Content != "original post" || post.Likes != 0 || post.NumComments != 0 {
+        t.Fatalf("payload %q: post table changed: %+v %v", payload, post, err)
+    }
+    posts, err := db.GetAllPosts()
+    if err != nil || len(posts) != 1 {
+        t.Fatalf("payload %q: expected 1 post, found %d: %v", payload, len(posts), err)
+    }
+}
+
+func TestRoutesRejectInjectionPayloads(t *testing.T) {
+    router, key, postID := setup(t)
+
+    for _, p := range payloads {
+        // Credentials
+        for _, creds := range []credentials{{p, p}, {"alice", p}, {p, "password"}} {
+            w := do(router, "POST", "/api/jwt", creds, "")
+            if w.Code == http.StatusOK {
+                t.Errorf("POST /api/jwt with %+v issued a key", creds)
+            }
+        }
+
+        // Bearer token and session cookie
+        w := do(router, "GET", "/api/posts", nil, p)
+        if w.Code == http.StatusOK {
+            t.Errorf("GET /api/posts with bearer %q was authorized", p)
+        }
+        r := httptest.NewRequest("GET", "/api/posts", nil)
+        r.AddCookie(&http.Cookie{Name: "sessionid", Value: p})
+        w = httptest.NewRecorder()
+        router.ServeHTTP(w, r)
+        if w.Code == http.StatusOK {
+            t.Errorf("GET /api/posts with sessionid %q was authorized", p)
+        }
+
+        // Path parameters
+        escaped := url.PathEscape(p)
+        for _, req := range []struct{ method, path string }{
+            {"GET", "/api/post/"+escaped},
+            {"DELETE", "/api/post/"+escaped},
+            {"DELETE", "/api/comment/"+escaped},
+            {"POST", "/api/comment/"+escaped},
+        } {
+            w = do(router, req.method, req.path, newContent{"comment"}, key)
+            if w.Code == http.StatusOK {
+                t.Errorf("%s %s succeeded: %s", req.method, req.path, w.Body)
+            }
+            if strings.Contains(strings.ToLower(w.Body.String()), "syntax") {
+                t.Errorf("%s %s leaked a SQL error: %s", req.method, req.path, w.Body)
+            }
+        }
+        assertIntact(t, postID, p)
+
+        // Content is stored verbatim
+        w = do(router, "POST", "/api/post", newContent{p}, key)
+        var body map[string]string
+        json.Unmarshal(w.Body.Bytes(), &body)
+        post, err := db.GetPost(body["post_id"])
+        if w.Code != http.StatusOK || err != nil || post.Content != p {
+            t.Errorf("POST /api/post with %q stored %+v, %v", p, post, err)
+        }
+        w = do(router, "DELETE", "/api/post/"+body["post_id"], nil, key)
+        if w.Code != http.StatusOK {
+            t.Errorf("DELETE /api/post/%s returned %d: %s", body["post_id"], w.Code, w.Body)
+        }
+        assertIntact(t, postID, p)
+    }
+}
+
+// Fails unless a response holds exactly one JSON error document
+func assertOneError(t *testing.T, name string, w *httptest.ResponseRecorder, status int) {
+    t.Helper()
+    if w.Code != status {
+        t.Errorf("%s: expected %d, got %d: %s", name, status, w.Code, w.Body)
+    }
+    decoder := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+    var body apiError
+    err := decoder.Decode(&body)
+    if err != nil || body.Error == "" {
+        t.Errorf("%s: body is not an error: %v", name, err)
+    }
+    if decoder.More() {
+        t.Errorf("%s: more than one document in the body", name)
+    }
+}
+
+func TestAuthorizationFailuresRespondOnce(t *testing.T) {
+    router, _, _ := setup(t)
+    token, _, err := security.CreatePersonalToken("alice", "ci", []string{security.ScopePostsRead}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    w := do(router, "POST", "/api/post", newContent{"not allowed"}, token)
+    assertOneError(t, "token missing the scope", w, http.StatusForbidden)
+    if !strings.Contains(w.Body.String(), security.ScopePostsWrite) {
+        t.Errorf("Error does not name the missing scope: %s", w.Body)
+    }
+    w = do(router, "GET", "/api/posts", nil, token)
+    if w.Code != http.StatusOK {
+        t.Errorf("Token with the scope was refused with %d: %s", w.Code, w.Body)
+    }
+
+    assertOneError(t, "no credentials", do(router, "POST", "/api/post", newContent{"anonymous"}, ""), http.StatusUnauthorized)
+    assertOneError(t, "unknown token", do(router, "POST", "/api/post", newContent{"unknown"}, security.PersonalTokenPrefix+"x"), http.StatusUnauthorized)
+    assertOneError(t, "malformed JWT", do(router, "POST", "/api/post", newContent{"malformed"}, "x.y.z"), http.StatusBadRequest)
+    r := httptest.NewRequest("GET", "/api/posts", nil)
+    r.AddCookie(&http.Cookie{Name: "sessionid", Value: "expired"})
+    w = httptest.NewRecorder()
+    router.ServeHTTP(w, r)
+    assertOneError(t, "unknown session", w, http.StatusUnauthorized)
+}
+
+func TestPostsWithoutPagingReturnsEverything(t *testing.T) {
+    router, key, postID := setup(t)
+    for i := 0; i < db.DefaultPageSize; i++ {
+        _, err := db.AddPost("post "+strconv.Itoa(i), "alice")
+        if err != nil {
+            t.Fatal(err)
+        }
+        _, err = db.AddComment("comment "+strconv.Itoa(i), "alice", postID)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    var posts []post
+    decode(t, do(router, "GET", "/api/posts", nil, key), &posts)
+    if len(posts) != db.DefaultPageSize+1 || posts[len(posts)-1].Id != postID {
+        t.Fatalf("GET /api/posts returned %d posts, expected every one of %d", len(posts), db.DefaultPageSize+1)
+    }
+    if !strings.Contains(posts[len(posts)-1].Comments, "comment 0") || posts[len(posts)-1].CommentsCursor != "" {
+        t.Errorf("GET /api/posts left out comments: %s", posts[len(posts)-1].Comments)
+    }
+
+    var page postsPage
+    decode(t, do(router, "GET", "/api/posts?limit=5", nil, key), &page)
+    if len(page.Posts) != 5 || page.NextCursor == "" {
+        t.Errorf("GET /api/posts?limit=5 returned %d posts and cursor %q", len(page.Posts), page.NextCursor)
+    }
+}
+
+func TestV2ReturnsStructuredComments(t *testing.T) {
+    router, key, postID := setup(t)
+    commentID, err := db.AddComment("a comment", "alice", postID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if w := do(router, "POST", "/api/comment/"+commentID+"/like", nil, key); w.Code != http.StatusOK {
+        t.Fatalf("Like failed with %d: %s", w.Code, w.Body)
+    }
+
+    var p postV2
+    w := do(router, "GET", "/api/v2/post/"+postID, nil, key)
+    decode(t, w, &p)
+    if w.Header().Get("Deprecation") != "" {
+        t.Error("GET /api/v2/post/:id is marked deprecated")
+    }
+    if strconv.FormatInt(p.Id, 10) != postID || p.NumComments != 1 || len(p.Comments) != 1 {
+        t.Fatalf("GET /api/v2/post/:id returned %+v", p)
+    }
+    c := p.Comments[0]
+    if strconv.FormatInt(c.Id, 10) != commentID || c.PostId != p.Id || c.Content != "a comment" || c.Likes != 1 || !c.Liked {
+        t.Errorf("Comment is %+v", c)
+    }
+    for _, date := range []string{p.Date, c.Date} {
+        if _, err := time.Parse(time.RFC3339, date); err != nil {
+            t.Errorf("Date %q is not RFC 3339", date)
+        }
+    }
+
+    for target, successor := range map[string]string{
+        "/api/posts": "/api/v2/posts",
+        "/api/post/" + postID: "/api/v2/post/" + postID,
+        "/api/post/" + postID + "/comments": "/api/v2/post/" + postID + "/comments",
+    } {
+        w = do(router, "GET", target, nil, key)
+        if w.Header().Get("Deprecation") != "true" || !strings.Contains(w.Header().Get("Link"), "<"+successor+">") {
+            t.Errorf("GET %s answered Deprecation %q and Link %q", target, w.Header().Get("Deprecation"), w.Header().Get("Link"))
+        }
+    }
+}
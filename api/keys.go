@@ -0,0 +1,251 @@
+package api
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "strings"
+    "math/big"
+    "crypto/rsa"
+    "crypto/x509"
+    "crypto/ed25519"
+    "encoding/pem"
+    "encoding/base64"
+    "path/filepath"
+    "github.com/google/uuid"
+    "github.com/golang-jwt/jwt"
+)
+
+// A JWT key identified by its kid. Public-only keys can verify but not sign.
+type signingKey struct {
+    id string
+    method jwt.SigningMethod
+    private interface{}
+    public interface{}
+}
+
+// Set of keys used to sign and verify API tokens
+type keyManager struct {
+    mu sync.RWMutex
+    // File or directory the keys were loaded from, empty for an ephemeral key
+    source string
+    keys map[string]*signingKey
+    current *signingKey
+}
+
+// Keys used by the API, loaded from JWT_KEYS by StartAPI
+var keys = ephemeralKeys()
+
+// Creates a manager holding a random HS512 key that lives as long as the process.
+// Tokens signed with it are rejected by other replicas and after a restart.
+func ephemeralKeys() *keyManager {
+    key := &signingKey{
+        id: uuid.NewString(),
+        method: jwt.SigningMethodHS512,
+        private: []byte(uuid.NewString() + uuid.NewString()),
+    }
+    key.public = key.private
+    return &keyManager{keys: map[string]*signingKey{key.id: key}, current: key}
+}
+
+// Loads keys from a file or a directory such as a mounted Kubernetes secret.
+// Each file holds one key and its name without extension is the kid. Files may
+// contain a PEM encoded Ed25519 or RSA private key, a PEM public key that is only
+// used for verification, or at least 32 bytes of HMAC secret. New tokens are
+// signed with the key named by signingKID, or the last private key by name.
+func loadKeys(source string, signingKID string) (*keyManager, error) {
+    m := &keyManager{source: source}
+    err := m.load(signingKID)
+    if err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// Re-reads the key source every interval so rotated secrets are picked up.
+// Invalid sources are logged and the previous keys stay in use.
+func (m *keyManager) watch(signingKID string, interval time.Duration) {
+    for range time.Tick(interval) {
+        err := m.load(signingKID)
+        if err != nil {
+            fmt.Println(err)
+        }
+    }
+}
+
+func (m *keyManager) load(signingKID string) error {
+    info, err := os.Stat(m.source)
+    if err != nil {
+        return fmt.Errorf("Error reading JWT keys: %v", err)
+    }
+    paths := []string{m.source}
+    if info.IsDir() {
+        entries, err := os.ReadDir(m.source)
+        if err != nil {
+            return fmt.Errorf("Error reading JWT keys: %v", err)
+        }
+        paths = nil
+        for _, entry := range entries {
+            // Skip the ..data bookkeeping entries of Kubernetes volumes
+            if strings.HasPrefix(entry.Name(), ".") {
+                continue
+            }
+            path := filepath.Join(m.source, entry.Name())
+            if info, err := os.Stat(path); err != nil || info.IsDir() {
+                continue
+            }
+            paths = append(paths, path)
+        }
+    }
+
+    keys := make(map[string]*signingKey)
+    var ids []string
+    for _, path := range paths {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return fmt.Errorf("Error reading JWT key %s: %v", path, err)
+        }
+        id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+        key, err := parseKey(id, data)
+        if err != nil {
+            return fmt.Errorf("Error reading JWT key %s: %v", path, err)
+        }
+        keys[id] = key
+        ids = append(ids, id)
+    }
+
+    var current *signingKey
+    if signingKID != "" {
+        current = keys[signingKID]
+        if current == nil || current.private == nil {
+            return fmt.Errorf("JWT signing key %q is not a private key in %s", signingKID, m.source)
+        }
+    } else {
+        sort.Strings(ids)
+        for _, id := range ids {
+            if keys[id].private != nil {
+                current = keys[id]
+            }
+        }
+        if current == nil {
+            return fmt.Errorf("No private JWT keys in %s", m.source)
+        }
+    }
+
+    m.mu.Lock()
+    m.keys = keys
+    m.current = current
+    m.mu.Unlock()
+    return nil
+}
+
+// Parses the contents of a key file
+func parseKey(id string, data []byte) (*signingKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        secret := bytes.TrimSpace(data)
+        if len(secret) < 32 {
+            return nil, fmt.Errorf("HMAC secrets must be at least 32 bytes")
+        }
+        return &signingKey{id: id, method: jwt.SigningMethodHS512, private: secret, public: secret}, nil
+    }
+
+    var parsed interface{}
+    var err error
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PRIVATE KEY":
+        parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PUBLIC KEY":
+        parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+    case "PUBLIC KEY":
+        parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    key := &signingKey{id: id}
+    switch k := parsed.(type) {
+    case ed25519.PrivateKey:
+        key.method, key.private, key.public = jwt.SigningMethodEdDSA, k, k.Public()
+    case ed25519.PublicKey:
+        key.method, key.public = jwt.SigningMethodEdDSA, k
+    case *rsa.PrivateKey:
+        key.method, key.private, key.public = jwt.SigningMethodRS256, k, &k.PublicKey
+    case *rsa.PublicKey:
+        key.method, key.public = jwt.SigningMethodRS256, k
+    default:
+        return nil, fmt.Errorf("Unsupported key type %T", parsed)
+    }
+    return key, nil
+}
+
+// Signs claims with the current key, setting the kid header
+func (m *keyManager) sign(claims jwt.Claims) (string, error) {
+    m.mu.RLock()
+    key := m.current
+    m.mu.RUnlock()
+    token := jwt.NewWithClaims(key.method, claims)
+    token.Header["kid"] = key.id
+    return token.SignedString(key.private)
+}
+
+// Returns the verification key for a token, used as a jwt.Keyfunc
+func (m *keyManager) verificationKey(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    m.mu.RLock()
+    key, ok := m.keys[kid]
+    m.mu.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("Unknown signing key %q", kid)
+    }
+    // Never let the token choose the algorithm for a key
+    if token.Method.Alg() != key.method.Alg() {
+        return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+    }
+    return key.public, nil
+}
+
+// JSON Web Key as published in the JWKS document
+type jwk struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    Crv string `json:"crv,omitempty"`
+    X string `json:"x,omitempty"`
+    N string `json:"n,omitempty"`
+    E string `json:"e,omitempty"`
+}
+
+// JSON Web Key Set, see GET /.well-known/jwks.json
+type jwkSet struct {
+    Keys []jwk `json:"keys"`
+}
+
+// Returns the public asymmetric keys. HMAC secrets are never published.
+func (m *keyManager) jwks() []jwk {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    enc := base64.RawURLEncoding
+    set := []jwk{}
+    for _, key := range m.keys {
+        switch k := key.public.(type) {
+        case ed25519.PublicKey:
+            set = append(set, jwk{Kty: "OKP", Kid: key.id, Use: "sig", Alg: key.method.Alg(),
+                Crv: "Ed25519", X: enc.EncodeToString(k)})
+        case *rsa.PublicKey:
+            set = append(set, jwk{Kty: "RSA", Kid: key.id, Use: "sig", Alg: key.method.Alg(),
+                N: enc.EncodeToString(k.N.Bytes()), E: enc.EncodeToString(big.NewInt(int64(k.E)).Bytes())})
+        }
+    }
+    sort.Slice(set, func(i, j int) bool { return set[i].Kid < set[j].Kid })
+    return set
+}
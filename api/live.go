@@ -0,0 +1,372 @@
+package api
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+const (
+    // Time allowed to write a message before the connection is dropped
+    liveWriteWait = 10 * time.Second
+    // Time allowed between pongs before a client is considered dead
+    livePongWait = 60 * time.Second
+    // Time between pings, less than livePongWait
+    livePingPeriod = 30 * time.Second
+    // Largest message accepted from a client
+    liveMessageLimit = 512
+    // Messages queued for a client that is not keeping up before it is dropped
+    liveBuffer = 64
+    // Least time between typing signals relayed for a client
+    liveTypingInterval = 2 * time.Second
+)
+
+// Checks the Origin header matches the host, so other sites cannot connect with the session cookie
+var upgrader = websocket.Upgrader{}
+
+// Likes, dislikes and emoji reactions of a post or comment as the viewer sees them
+type liveCounts struct {
+    Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+    Reactions []reaction `json:"reactions"`
+}
+
+// Message sent to the viewers of a post
+type liveMessage struct {
+    Type string `json:"type"`
+    // Post that was edited
+    Post *postV2 `json:"post,omitempty"`
+    // Comment that was written or edited
+    Comment *commentV2 `json:"comment,omitempty"`
+    // Post or comment that was deleted or reacted to
+    Entity string `json:"entity,omitempty"`
+    Id int64 `json:"id,omitempty"`
+    Counts *liveCounts `json:"counts,omitempty"`
+    // Users viewing the post, for presence
+    Viewers []string `json:"viewers,omitempty"`
+    // User typing a comment, for typing
+    Username string `json:"username,omitempty"`
+}
+
+// Message received from a viewer
+type liveSignal struct {
+    Type string `json:"type"`
+}
+
+// WebSocket connection of a user viewing a post
+type liveClient struct {
+    username string
+    postID string
+    conn *websocket.Conn
+    send chan []byte
+    done chan struct{}
+    mu sync.Mutex
+    closed bool
+    closeCode int
+    closeText string
+    // Guarded by rooms.mu
+    lastTyping time.Time
+}
+
+// Viewers of each post connected to this instance
+type liveRooms struct {
+    mu sync.Mutex
+    posts map[string]map[*liveClient]bool
+}
+
+var rooms = &liveRooms{posts: make(map[string]map[*liveClient]bool)}
+
+// Adds a viewer to its post and tells every viewer who is there
+func (r *liveRooms) join(c *liveClient) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.posts[c.postID] == nil {
+        r.posts[c.postID] = make(map[*liveClient]bool)
+    }
+    r.posts[c.postID][c] = true
+    r.presence(c.postID)
+}
+
+// Removes a viewer from its post and tells the others who is left
+func (r *liveRooms) leave(c *liveClient) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.posts[c.postID], c)
+    if len(r.posts[c.postID]) == 0 {
+        delete(r.posts, c.postID)
+        return
+    }
+    r.presence(c.postID)
+}
+
+// Sends the distinct users viewing a post to its viewers. Called with mu held.
+func (r *liveRooms) presence(postID string) {
+    seen := make(map[string]bool)
+    viewers := []string{}
+    for c := range r.posts[postID] {
+        if !seen[c.username] {
+            seen[c.username] = true
+            viewers = append(viewers, c.username)
+        }
+    }
+    sort.Strings(viewers)
+    r.broadcast(postID, liveMessage{Type: "presence", Viewers: viewers}, nil)
+}
+
+// Sends a message to the viewers of a post other than except. Called with mu held.
+func (r *liveRooms) broadcast(postID string, msg liveMessage, except *liveClient) {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        fmt.Println("Error encoding message:", err)
+        return
+    }
+    for c := range r.posts[postID] {
+        if c != except {
+            c.queue(data)
+        }
+    }
+}
+
+// Relays a typing signal to the other viewers, at most once per liveTypingInterval
+func (r *liveRooms) typing(c *liveClient) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if time.Since(c.lastTyping) < liveTypingInterval {
+        return
+    }
+    c.lastTyping = time.Now()
+    r.broadcast(c.postID, liveMessage{Type: "typing", Username: c.username}, c)
+}
+
+// Queues a message for the client, dropping the client when its queue is full
+func (c *liveClient) queue(data []byte) {
+    select {
+    case <-c.done:
+    case c.send <- data:
+    default:
+        c.close(websocket.CloseTryAgainLater, "Too slow, reconnect to continue")
+    }
+}
+
+// Sends a close message with code and text, then closes the connection
+func (c *liveClient) close(code int, text string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return
+    }
+    c.closed = true
+    c.closeCode = code
+    c.closeText = text
+    close(c.done)
+}
+
+// Writes queued messages and pings until the client is closed
+func (c *liveClient) write() {
+    ping := time.NewTicker(livePingPeriod)
+    defer func() {
+        ping.Stop()
+        c.conn.Close()
+    }()
+    for {
+        select {
+        case data := <-c.send:
+            c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+            err := c.conn.WriteMessage(websocket.TextMessage, data)
+            if err != nil {
+                c.close(websocket.CloseAbnormalClosure, "")
+                return
+            }
+        case <-ping.C:
+            c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+            err := c.conn.WriteMessage(websocket.PingMessage, nil)
+            if err != nil {
+                c.close(websocket.CloseAbnormalClosure, "")
+                return
+            }
+        case <-c.done:
+            c.mu.Lock()
+            message := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+            c.mu.Unlock()
+            c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(liveWriteWait))
+            return
+        }
+    }
+}
+
+// Reads signals from the client until it disconnects or stops answering pings
+func (c *liveClient) read() {
+    c.conn.SetReadLimit(liveMessageLimit)
+    c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+    c.conn.SetPongHandler(func(string) error {
+        return c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+    })
+    for {
+        _, data, err := c.conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+        var signal liveSignal
+        if json.Unmarshal(data, &signal) != nil {
+            continue
+        }
+        if signal.Type == "typing" {
+            rooms.typing(c)
+        }
+    }
+}
+
+// Sends the client the events about its post, as its user sees them
+func (c *liveClient) forward(subscription *db.Subscription) {
+    for e := range subscription.Events {
+        if e.PostId != c.postID {
+            continue
+        }
+        msg, ok := c.render(e)
+        if !ok {
+            continue
+        }
+        data, err := json.Marshal(msg)
+        if err != nil {
+            fmt.Println("Error encoding message:", err)
+            continue
+        }
+        c.queue(data)
+    }
+    // Closed by the handler, or dropped by the event bus for falling behind
+    c.close(websocket.CloseTryAgainLater, "Too slow, reconnect to continue")
+}
+
+// Converts an event to the message for the client, false when there is nothing to send
+func (c *liveClient) render(e db.Event) (liveMessage, bool) {
+    deleted := liveMessage{Type: e.Entity.String()+".deleted", Entity: e.Entity.String(), Id: idV2(e.EntityId)}
+    switch e.Type {
+    case db.PostDeleted, db.CommentDeleted:
+        return deleted, true
+    case db.PostCreated, db.PostUpdated:
+        post, ok := c.post()
+        if !ok {
+            return deleted, true
+        }
+        msg := apiPostV2(post, "")
+        return liveMessage{Type: db.PostUpdated, Post: &msg}, true
+    case db.CommentCreated, db.CommentUpdated:
+        comment, ok := c.comment(e.EntityId)
+        if !ok {
+            return deleted, e.Type == db.CommentUpdated
+        }
+        msg := apiCommentV2(comment, c.postID)
+        return liveMessage{Type: e.Type, Comment: &msg}, true
+    case db.ReactionChanged:
+        var counts liveCounts
+        if e.Entity == db.CommentEntity {
+            comment, ok := c.comment(e.EntityId)
+            if !ok {
+                return liveMessage{}, false
+            }
+            counts = liveCounts{comment.Likes, comment.Dislikes, comment.Vote == db.Liked,
+                comment.Vote == db.Disliked, apiReactions(comment.Reactions)}
+        } else {
+            post, ok := c.post()
+            if !ok {
+                return liveMessage{}, false
+            }
+            counts = liveCounts{post.Likes, post.Dislikes, post.Vote == db.Liked,
+                post.Vote == db.Disliked, apiReactions(post.Reactions)}
+        }
+        return liveMessage{Type: e.Type, Entity: e.Entity.String(), Id: idV2(e.EntityId), Counts: &counts}, true
+    }
+    return liveMessage{}, false
+}
+
+// Reads the client's post with its user's votes and reactions, false if they may not see it
+func (c *liveClient) post() (db.Post, bool) {
+    post, err := db.GetPost(c.postID)
+    if err != nil {
+        return post, false
+    }
+    posts := security.VisiblePosts(c.username, []db.Post{post})
+    if len(posts) == 0 {
+        return post, false
+    }
+    err = db.MarkVotes(c.username, posts)
+    if err == nil {
+        err = db.LoadReactions(c.username, posts)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    return posts[0], true
+}
+
+// Reads a comment with the user's votes and reactions, false if they may not see it
+func (c *liveClient) comment(id string) (db.Comment, bool) {
+    comment, err := db.GetComment(id)
+    if err != nil {
+        return comment, false
+    }
+    comments := security.VisibleComments(c.username, []db.Comment{comment})
+    if len(comments) == 0 {
+        return comment, false
+    }
+    err = db.MarkCommentVotes(c.username, comments)
+    if err == nil {
+        err = db.LoadCommentReactions(c.username, comments)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    return comments[0], true
+}
+
+// Upgrades the request to a WebSocket streaming the comments, edits, deletions and
+// reaction counts of a post, with the users viewing it and typing signals. The
+// caller authenticates username.
+func ServeLive(w http.ResponseWriter, r *http.Request, username string, postID string) {
+    client := &liveClient{
+        username: username,
+        postID: postID,
+        send: make(chan []byte, liveBuffer),
+        done: make(chan struct{}),
+    }
+    post, ok := client.post()
+    if !ok {
+        http.Error(w, "Post "+postID+" does not exist.", http.StatusNotFound)
+        return
+    }
+    // Events carry the id as stored
+    client.postID = post.Id
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // The upgrader has responded with the error
+        return
+    }
+    client.conn = conn
+    subscription := db.Subscribe(0)
+    go client.write()
+    go client.forward(subscription)
+    rooms.join(client)
+
+    client.read()
+    rooms.leave(client)
+    client.close(websocket.CloseNormalClosure, "")
+    subscription.Close()
+}
+
+// Streams a post to API clients, see ServeLive
+func getLive(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    ServeLive(c.Writer, c.Request, getUsername(c), c.Param("id"))
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+)
+
+// Notification as returned by the API, with version 2 ids and dates
+type notification struct {
+    Id int64 `json:"id"`
+    Type string `json:"type"`
+    Actor string `json:"actor"`
+    Entity string `json:"entity"`
+    EntityId int64 `json:"entity_id"`
+    PostId int64 `json:"post_id"`
+    // Emoji of a reaction, like for likes, or the moderation action
+    Detail string `json:"detail,omitempty"`
+    CreatedAt string `json:"created_at"`
+    Read bool `json:"read"`
+    ReadAt string `json:"read_at,omitempty"`
+}
+
+type notificationsPage struct {
+    Notifications []notification `json:"notifications"`
+    Unread int `json:"unread"`
+}
+
+func apiNotification(n db.Notification) notification {
+    return notification{
+        Id: idV2(n.Id),
+        Type: n.Kind,
+        Actor: n.Actor,
+        Entity: n.Entity.String(),
+        EntityId: idV2(n.EntityId),
+        PostId: idV2(n.PostId),
+        Detail: n.Detail,
+        CreatedAt: dateV2(n.CreatedAt),
+        Read: !n.ReadAt.IsZero(),
+        ReadAt: dateV2(n.ReadAt),
+    }
+}
+
+// Lists the user's most recent notifications, newest first, with the number unread.
+// unread=true leaves out those already read.
+func getNotifications(c *gin.Context) {
+    if !authorized(c, security.ScopeNotificationsRead) {
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    username := getUsername(c)
+    db_notifications, err := db.GetNotifications(username, c.Query("unread") == "true", limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    unread, err := db.CountUnread(username)
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    notifications := []notification{}
+    for _, n := range db_notifications {
+        notifications = append(notifications, apiNotification(n))
+    }
+    c.IndentedJSON(http.StatusOK, notificationsPage{notifications, unread})
+}
+
+// Marks one of the user's notifications read
+func readNotification(c *gin.Context) {
+    if !authorized(c, security.ScopeNotificationsWrite) {
+        return
+    }
+    err := db.ReadNotification(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Notification marked read"})
+}
+
+// Marks every notification of the user read
+func readNotifications(c *gin.Context) {
+    if !authorized(c, security.ScopeNotificationsWrite) {
+        return
+    }
+    err := db.ReadNotifications(getUsername(c))
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "All notifications marked read"})
+}
+
+// Returns whether the user receives each type of notification
+func getNotificationPreferences(c *gin.Context) {
+    if !authorized(c, security.ScopeNotificationsRead) {
+        return
+    }
+    preferences, err := db.GetNotificationPreferences(getUsername(c))
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, preferences)
+}
+
+// Turns types of notification on or off, given as {"type": bool}, and returns
+// the resulting preferences
+func putNotificationPreferences(c *gin.Context) {
+    if !authorized(c, security.ScopeNotificationsWrite) {
+        return
+    }
+    var changes map[string]bool
+    err := json.NewDecoder(c.Request.Body).Decode(&changes)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    username := getUsername(c)
+    preferences, err := db.GetNotificationPreferences(username)
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    for kind := range changes {
+        if _, ok := preferences[kind]; !ok {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Unknown notification type "+kind})
+            return
+        }
+    }
+    for kind, enabled := range changes {
+        err = db.SetNotificationPreference(username, kind, enabled)
+        if err != nil {
+            c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            return
+        }
+        preferences[kind] = enabled
+    }
+    c.IndentedJSON(http.StatusOK, preferences)
+}
@@ -0,0 +1,934 @@
+package api
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "strings"
+    "reflect"
+    "net/http"
+    "encoding/json"
+    _ "embed"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+    swaggerFiles "github.com/swaggo/files"
+)
+
+// Swagger UI page showing /api/openapi.json, served with the Swagger UI assets
+//go:embed swagger.html
+var swaggerPage []byte
+
+// JSON object of the OpenAPI document
+type object = map[string]interface{}
+
+// Response that is one of several types, such as a bare array for older clients
+type oneOf []interface{}
+
+// Query or header parameter of an endpoint
+type param struct {
+    in string
+    name string
+    // string, integer or boolean
+    kind string
+    description string
+}
+
+func query(name string, kind string, description string) param {
+    return param{"query", name, kind, description}
+}
+
+// Parameters of paged lists
+var limitParam = query("limit", "integer", "Page size, 1 to 100, default 20")
+var cursorParam = query("cursor", "string", "next_cursor of the previous page")
+
+// Documentation of an endpoint, joined with its route to build the OpenAPI document
+type endpoint struct {
+    summary string
+    description string
+    group string
+    // Scope a personal access token needs, empty when any credentials will do
+    scope string
+    // Called without credentials
+    public bool
+    deprecated bool
+    params []param
+    // Request body and successful response, nil when there is none
+    body interface{}
+    optionalBody bool
+    response interface{}
+    // Content type of a successful response that is not JSON
+    contentType string
+    // Status of a successful response, 200 when zero
+    status int
+    // Statuses of error responses besides those of authentication, with an
+    // apiError body or, for textErrors, a plain text one
+    errors []int
+    textErrors []int
+}
+
+// Every API endpoint, by method and route
+var endpoints = map[string]endpoint{
+    "GET /": {
+        summary: "API landing page",
+        group: "Authentication",
+        contentType: "text/plain",
+    },
+    "POST /api/jwt": {
+        summary: "Log in",
+        description: "Receive an API key to be used in future API requests, along with a refresh token.",
+        group: "Authentication",
+        public: true,
+        body: credentials{},
+        response: tokenPair{},
+        errors: []int{400, 500},
+    },
+    "POST /api/token/refresh": {
+        summary: "Refresh an API key",
+        description: "Exchange a refresh token for a new API key and refresh token. Each refresh token works " +
+            "once, reusing one revokes every token issued since the original login.",
+        group: "Authentication",
+        public: true,
+        body: refreshRequest{},
+        response: tokenPair{},
+        errors: []int{400, 401, 500},
+    },
+    "POST /api/token/revoke": {
+        summary: "Revoke an API key",
+        description: "Revoke the API key presented in the Authorization header and/or a refresh token.",
+        group: "Authentication",
+        public: true,
+        body: refreshRequest{},
+        optionalBody: true,
+        response: apiMessage{},
+        errors: []int{400, 500},
+    },
+    "POST /api/password": {
+        summary: "Change password",
+        description: "Change the user's password. All of the user's API keys, refresh tokens and personal access " +
+            "tokens are revoked, and every session is ended except the one making a cookie authenticated request.",
+        group: "Authentication",
+        scope: security.ScopeAdmin,
+        body: passwordChange{},
+        response: apiMessage{},
+    },
+    "GET /api/tokens": {
+        summary: "List personal access tokens",
+        description: "The tokens themselves are never returned.",
+        group: "Authentication",
+        scope: security.ScopeAdmin,
+        response: []security.PersonalTokenInfo{},
+        errors: []int{500},
+    },
+    "POST /api/tokens": {
+        summary: "Create a personal access token",
+        description: fmt.Sprintf("The token is only included in this response. It expires after " +
+            "expires_in_days, %d when omitted and at most %d.", security.DefaultPersonalTokenTTL / (24 * time.Hour),
+            security.MaxPersonalTokenTTL / (24 * time.Hour)),
+        group: "Authentication",
+        scope: security.ScopeAdmin,
+        body: newPersonalToken{},
+        response: createdToken{},
+    },
+    "DELETE /api/tokens/:id": {
+        summary: "Revoke a personal access token",
+        group: "Authentication",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+        errors: []int{404},
+    },
+    "GET /.well-known/jwks.json": {
+        summary: "Public keys that verify API keys",
+        description: "JSON Web Key Set of the asymmetric signing keys. HMAC secrets are not published.",
+        group: "Authentication",
+        public: true,
+        response: jwkSet{},
+    },
+    "GET /api/openapi.json": {
+        summary: "This OpenAPI document",
+        group: "Documentation",
+        public: true,
+        response: object{},
+    },
+    "GET /api/docs/*file": {
+        summary: "Swagger UI",
+        description: "Browse and try the API. /api/docs/ serves the page, other files are its assets.",
+        group: "Documentation",
+        public: true,
+        contentType: "text/html",
+        textErrors: []int{404},
+    },
+
+    "GET /api/posts": {
+        summary: "List posts",
+        description: "A page of posts, newest first, each with its newest page of comments as a Go formatted " +
+            "string. Without limit, cursor or tag every post is returned in a bare array, each with all of " +
+            "its comments.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        deprecated: true,
+        params: []param{limitParam, cursorParam, query("tag", "string", "Only posts using this hashtag")},
+        response: oneOf{[]post{}, postsPage{}},
+    },
+    "GET /api/post/:id": {
+        summary: "Get a post",
+        description: "The post with its newest page of comments as a Go formatted string.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        deprecated: true,
+        response: post{},
+    },
+    "GET /api/post/:id/comments": {
+        summary: "List a post's comments",
+        description: "A page of a post's comments, newest first.",
+        group: "Comments",
+        scope: security.ScopePostsRead,
+        deprecated: true,
+        params: []param{limitParam, query("cursor", "string", "comments_cursor of the post or next_cursor of the previous page")},
+        response: commentsPage{},
+    },
+    "GET /api/v2/posts": {
+        summary: "List posts",
+        description: "A page of posts, newest first, each with its newest page of comments.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        params: []param{limitParam, cursorParam, query("tag", "string", "Only posts using this hashtag")},
+        response: postsPageV2{},
+    },
+    "GET /api/v2/post/:id": {
+        summary: "Get a post",
+        description: "The post with its newest page of comments.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        response: postV2{},
+        errors: []int{404},
+    },
+    "GET /api/v2/post/:id/comments": {
+        summary: "List a post's comments",
+        description: "A page of a post's comments, newest first.",
+        group: "Comments",
+        scope: security.ScopePostsRead,
+        params: []param{limitParam, query("cursor", "string", "comments_cursor of the post or next_cursor of the previous page")},
+        response: commentsPageV2{},
+    },
+    "GET /api/search": {
+        summary: "Search posts and comments",
+        description: "Best match first.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        params: []param{
+            query("q", "string", `Words, "phrases", author:name, before:YYYY-MM-DD and after:YYYY-MM-DD`),
+            limitParam,
+        },
+        response: searchResults{},
+    },
+    "GET /api/tags": {
+        summary: "List tags",
+        description: "Every hashtag with the number of posts using it, most used first.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        response: []tagCount{},
+        errors: []int{500},
+    },
+    "GET /api/tags/trending": {
+        summary: "List trending tags",
+        description: "The hashtags used most by posts written in the last TRENDING_WINDOW, most used first.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        response: []tagCount{},
+        errors: []int{500},
+    },
+    "POST /api/post": {
+        summary: "Write a post",
+        group: "Posts",
+        scope: security.ScopePostsWrite,
+        body: newContent{},
+        response: createdPost{},
+        errors: []int{500},
+    },
+    "PATCH /api/post/:id": {
+        summary: "Edit a post",
+        description: "Replace the content of a post, keeping the previous version. Authors only, or " +
+            "moderators and admins.",
+        group: "Posts",
+        scope: security.ScopePostsWrite,
+        body: newContent{},
+        response: apiMessage{},
+    },
+    "GET /api/post/:id/revisions": {
+        summary: "List a post's versions",
+        description: "Every version of a post, oldest first and ending with the current content.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        response: []revision{},
+    },
+    "DELETE /api/post/:id": {
+        summary: "Delete a post",
+        description: "Move a post to the trash. Moderators and admins may delete any post.",
+        group: "Posts",
+        scope: security.ScopePostsWrite,
+        response: apiMessage{},
+    },
+    "POST /api/post/:id/restore": {
+        summary: "Restore a post",
+        description: "Take a post out of the trash. Authors only, or admins.",
+        group: "Posts",
+        scope: security.ScopePostsWrite,
+        response: apiMessage{},
+    },
+    "GET /api/trash": {
+        summary: "List the trash",
+        description: "The caller's deleted posts and comments, or everyone's for admins, most recently " +
+            "deleted first.",
+        group: "Posts",
+        scope: security.ScopePostsRead,
+        response: []trashItem{},
+        errors: []int{500},
+    },
+
+    "POST /api/comment/:id": {
+        summary: "Comment on a post",
+        group: "Comments",
+        scope: security.ScopeCommentsWrite,
+        body: newContent{},
+        response: createdComment{},
+        errors: []int{500},
+    },
+    "PATCH /api/comment/:id": {
+        summary: "Edit a comment",
+        description: "Replace the content of a comment, keeping the previous version. Authors only, or " +
+            "moderators and admins.",
+        group: "Comments",
+        scope: security.ScopeCommentsWrite,
+        body: newContent{},
+        response: apiMessage{},
+    },
+    "GET /api/comment/:id/revisions": {
+        summary: "List a comment's versions",
+        description: "Every version of a comment, oldest first and ending with the current content.",
+        group: "Comments",
+        scope: security.ScopePostsRead,
+        response: []revision{},
+    },
+    "DELETE /api/comment/:id": {
+        summary: "Delete a comment",
+        description: "Move a comment to the trash. Moderators and admins may delete any comment.",
+        group: "Comments",
+        scope: security.ScopeCommentsWrite,
+        response: apiMessage{},
+    },
+    "POST /api/comment/:id/restore": {
+        summary: "Restore a comment",
+        description: "Take a comment out of the trash. Authors only, or admins.",
+        group: "Comments",
+        scope: security.ScopeCommentsWrite,
+        response: apiMessage{},
+    },
+
+    "POST /api/post/:id/hide": {
+        summary: "Hide a post",
+        description: "Hide a post from users who are not moderators or admins. Moderators and admins only.",
+        group: "Moderation",
+        scope: security.ScopePostsWrite,
+        response: apiMessage{},
+    },
+    "DELETE /api/post/:id/hide": {
+        summary: "Show a hidden post",
+        description: "Moderators and admins only.",
+        group: "Moderation",
+        scope: security.ScopePostsWrite,
+        response: apiMessage{},
+    },
+    "POST /api/comment/:id/hide": {
+        summary: "Hide a comment",
+        description: "Hide a comment from users who are not moderators or admins. Moderators and admins only.",
+        group: "Moderation",
+        scope: security.ScopeCommentsWrite,
+        response: apiMessage{},
+    },
+    "DELETE /api/comment/:id/hide": {
+        summary: "Show a hidden comment",
+        description: "Moderators and admins only.",
+        group: "Moderation",
+        scope: security.ScopeCommentsWrite,
+        response: apiMessage{},
+    },
+
+    "POST /api/post/:id/like": {
+        summary: "Like a post",
+        description: "Liking it again takes the like back, and a like replaces a dislike.",
+        group: "Reactions",
+        scope: security.ScopePostsWrite,
+        response: votes{},
+    },
+    "POST /api/post/:id/dislike": {
+        summary: "Dislike a post",
+        description: "Disliking it again takes the dislike back, and a dislike replaces a like.",
+        group: "Reactions",
+        scope: security.ScopePostsWrite,
+        response: votes{},
+    },
+    "POST /api/comment/:id/like": {
+        summary: "Like a comment",
+        description: "Liking it again takes the like back, and a like replaces a dislike.",
+        group: "Reactions",
+        scope: security.ScopeCommentsWrite,
+        response: votes{},
+    },
+    "POST /api/comment/:id/dislike": {
+        summary: "Dislike a comment",
+        description: "Disliking it again takes the dislike back, and a dislike replaces a like.",
+        group: "Reactions",
+        scope: security.ScopeCommentsWrite,
+        response: votes{},
+    },
+    "POST /api/post/:id/reactions": {
+        summary: "React to a post",
+        description: "React with one of the REACTION_EMOJI.",
+        group: "Reactions",
+        scope: security.ScopePostsWrite,
+        body: newReaction{},
+        response: []reaction{},
+        errors: []int{500},
+    },
+    "DELETE /api/post/:id/reactions": {
+        summary: "Remove a reaction to a post",
+        group: "Reactions",
+        scope: security.ScopePostsWrite,
+        params: []param{query("emoji", "string", "Emoji to remove, or given in the body")},
+        body: newReaction{},
+        optionalBody: true,
+        response: []reaction{},
+        errors: []int{500},
+    },
+    "POST /api/comment/:id/reactions": {
+        summary: "React to a comment",
+        description: "React with one of the REACTION_EMOJI.",
+        group: "Reactions",
+        scope: security.ScopeCommentsWrite,
+        body: newReaction{},
+        response: []reaction{},
+        errors: []int{500},
+    },
+    "DELETE /api/comment/:id/reactions": {
+        summary: "Remove a reaction to a comment",
+        group: "Reactions",
+        scope: security.ScopeCommentsWrite,
+        params: []param{query("emoji", "string", "Emoji to remove, or given in the body")},
+        body: newReaction{},
+        optionalBody: true,
+        response: []reaction{},
+        errors: []int{500},
+    },
+
+    "GET /api/stream": {
+        summary: "Stream events",
+        description: "Post, comment and reaction events as Server-Sent Events. Each event's data is an " +
+            "Event. A reset event is sent when the missed events are no longer known and everything " +
+            "should be fetched again, and a comment every 30 seconds keeps the connection open.",
+        group: "Live",
+        scope: security.ScopePostsRead,
+        params: []param{
+            {"header", "Last-Event-ID", "integer", "Resume after this event"},
+            query("last_event_id", "integer", "Resume after this event when the header cannot be set"),
+        },
+        contentType: "text/event-stream",
+        textErrors: []int{400, 500},
+    },
+    "GET /api/post/:id/live": {
+        summary: "Watch a post over a WebSocket",
+        description: "Streams the changes to a post as LiveMessages, with the users viewing it and those " +
+            `typing a comment. Send {"type": "typing"} while typing a comment. Answer pings within 60 ` +
+            "seconds and read messages as they arrive, or the connection is closed, with code 1013 when too " +
+            "far behind. Browsers must connect from https://localhost.",
+        group: "Live",
+        scope: security.ScopePostsRead,
+        status: http.StatusSwitchingProtocols,
+        textErrors: []int{400, 403, 404},
+    },
+
+    "GET /api/notifications": {
+        summary: "List notifications",
+        description: "The user's notifications, newest first, with the number still unread.",
+        group: "Notifications",
+        scope: security.ScopeNotificationsRead,
+        params: []param{limitParam, query("unread", "boolean", "Only unread notifications")},
+        response: notificationsPage{},
+        errors: []int{500},
+    },
+    "POST /api/notifications/read": {
+        summary: "Mark every notification read",
+        group: "Notifications",
+        scope: security.ScopeNotificationsWrite,
+        response: apiMessage{},
+        errors: []int{500},
+    },
+    "POST /api/notifications/:id/read": {
+        summary: "Mark a notification read",
+        group: "Notifications",
+        scope: security.ScopeNotificationsWrite,
+        response: apiMessage{},
+        errors: []int{404},
+    },
+    "GET /api/notifications/preferences": {
+        summary: "Get notification preferences",
+        description: "Whether the user is notified of each type of notification.",
+        group: "Notifications",
+        scope: security.ScopeNotificationsRead,
+        response: map[string]bool{},
+        errors: []int{500},
+    },
+    "PUT /api/notifications/preferences": {
+        summary: "Change notification preferences",
+        description: "Turn types of notification on or off, leaving the others unchanged.",
+        group: "Notifications",
+        scope: security.ScopeNotificationsWrite,
+        body: map[string]bool{},
+        response: map[string]bool{},
+        errors: []int{500},
+    },
+
+    "GET /api/webhooks": {
+        summary: "List webhooks",
+        description: "The user's webhooks, or every user's with all=true for admins. Secrets are never returned.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksRead,
+        params: []param{query("all", "boolean", "Every user's webhooks, admins only")},
+        response: []security.WebhookInfo{},
+        errors: []int{500},
+    },
+    "POST /api/webhooks": {
+        summary: "Register a webhook",
+        description: "The secret its payloads are signed with is only included in this response.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksWrite,
+        body: newWebhook{},
+        response: createdWebhook{},
+    },
+    "GET /api/webhooks/:id": {
+        summary: "Get a webhook",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksRead,
+        response: security.WebhookInfo{},
+        errors: []int{404},
+    },
+    "PATCH /api/webhooks/:id": {
+        summary: "Change a webhook",
+        description: "Change the URL or events of a webhook, or disable or enable it. Enabling it resets " +
+            "its failures. Omitted fields are unchanged.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksWrite,
+        body: webhookChange{},
+        response: security.WebhookInfo{},
+        errors: []int{404},
+    },
+    "DELETE /api/webhooks/:id": {
+        summary: "Delete a webhook",
+        description: "Delete a webhook and its delivery log.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksWrite,
+        response: apiMessage{},
+        errors: []int{404},
+    },
+    "GET /api/webhooks/:id/deliveries": {
+        summary: "List a webhook's deliveries",
+        description: "Newest first.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksRead,
+        params: []param{limitParam},
+        response: []security.DeliveryInfo{},
+        errors: []int{404},
+    },
+    "POST /api/webhooks/:id/deliveries/:delivery/redeliver": {
+        summary: "Redeliver",
+        description: "Send the payload of a delivery again, as a new delivery.",
+        group: "Webhooks",
+        scope: security.ScopeWebhooksWrite,
+        response: security.DeliveryInfo{},
+        errors: []int{404},
+    },
+
+    "GET /api/sessions": {
+        summary: "List web sessions",
+        description: "The active web sessions of the user.",
+        group: "Sessions",
+        scope: security.ScopeAdmin,
+        response: []security.SessionInfo{},
+        errors: []int{500},
+    },
+    "DELETE /api/sessions": {
+        summary: "End every web session",
+        group: "Sessions",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+        errors: []int{500},
+    },
+    "DELETE /api/sessions/:id": {
+        summary: "End a web session",
+        group: "Sessions",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+        errors: []int{404},
+    },
+
+    "GET /api/admin/users": {
+        summary: "List users",
+        description: "50 per page. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        params: []param{
+            query("q", "string", "Part of the username"),
+            query("page", "integer", "Page, from 0"),
+        },
+        response: []security.UserInfo{},
+    },
+    "POST /api/admin/users/:username/lock": {
+        summary: "Lock a user",
+        description: "Lock a user's account, ending their sessions and API tokens. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+    },
+    "DELETE /api/admin/users/:username/lock": {
+        summary: "Unlock a user",
+        description: "Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+    },
+    "POST /api/admin/users/:username/password": {
+        summary: "Reset a user's password",
+        description: "Reset a user's password to a random one, end their sessions and API tokens and delete their " +
+            "personal access tokens. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: resetPassword{},
+    },
+    "DELETE /api/admin/users/:username/sessions": {
+        summary: "Log a user out",
+        description: "End a user's sessions and API tokens on every device. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+    },
+    "PUT /api/admin/users/:username/role": {
+        summary: "Change a user's role",
+        description: "The role is user, moderator or admin. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        body: roleChange{},
+        response: apiMessage{},
+    },
+    "GET /api/admin/posts": {
+        summary: "List every post",
+        description: "Every post with its comments, including hidden ones. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: []post{},
+        errors: []int{500},
+    },
+    "DELETE /api/admin/post/:id": {
+        summary: "Delete any post",
+        description: "Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+    },
+    "DELETE /api/admin/comment/:id": {
+        summary: "Delete any comment",
+        description: "Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: apiMessage{},
+    },
+    "GET /api/admin/log": {
+        summary: "Moderation log",
+        description: "The 200 most recent moderation and admin actions. Admins only.",
+        group: "Admin",
+        scope: security.ScopeAdmin,
+        response: []logEntry{},
+    },
+}
+
+// Types documented without an endpoint returning them as JSON
+var extraSchemas = []interface{}{event{}, liveMessage{}, liveSignal{}}
+
+// Builds JSON schemas of Go types from their json tags, collecting named
+// structs as components
+type schemaBuilder struct {
+    components object
+    types map[string]reflect.Type
+}
+
+// Returns the schema of v, or of the alternatives of a oneOf
+func (b *schemaBuilder) value(v interface{}) object {
+    if alternatives, ok := v.(oneOf); ok {
+        schemas := []interface{}{}
+        for _, alternative := range alternatives {
+            schemas = append(schemas, b.value(alternative))
+        }
+        return object{"oneOf": schemas}
+    }
+    return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) object {
+    if t == reflect.TypeOf(time.Time{}) {
+        return object{"type": "string", "format": "date-time"}
+    }
+    switch t.Kind() {
+    case reflect.Ptr:
+        schema := b.schema(t.Elem())
+        if _, ok := schema["$ref"]; ok {
+            return object{"allOf": []interface{}{schema}, "nullable": true}
+        }
+        schema["nullable"] = true
+        return schema
+    case reflect.Slice, reflect.Array:
+        return object{"type": "array", "items": b.schema(t.Elem())}
+    case reflect.Map:
+        return object{"type": "object", "additionalProperties": b.schema(t.Elem())}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return b.object(t)
+        }
+        return b.ref(t)
+    case reflect.String:
+        return object{"type": "string"}
+    case reflect.Bool:
+        return object{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16,
+        reflect.Uint32:
+        return object{"type": "integer"}
+    case reflect.Int64, reflect.Uint64:
+        return object{"type": "integer", "format": "int64"}
+    case reflect.Float32, reflect.Float64:
+        return object{"type": "number"}
+    }
+    // Interfaces may hold anything
+    return object{}
+}
+
+// Returns a reference to the component of a named struct, adding it when missing
+func (b *schemaBuilder) ref(t reflect.Type) object {
+    name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+    if seen, ok := b.types[name]; !ok {
+        b.types[name] = t
+        b.components[name] = b.object(t)
+    } else if seen != t {
+        panic(fmt.Sprintf("Schemas of %v and %v are both named %s", seen, t, name))
+    }
+    return object{"$ref": "#/components/schemas/"+name}
+}
+
+// Describes the exported fields of a struct as properties, required unless omitempty
+func (b *schemaBuilder) object(t reflect.Type) object {
+    properties := object{}
+    required := []string{}
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := strings.Split(field.Tag.Get("json"), ",")
+        if field.PkgPath != "" || tag[0] == "-" {
+            continue
+        }
+        name := tag[0]
+        if name == "" {
+            name = field.Name
+        }
+        properties[name] = b.schema(field.Type)
+        omitempty := false
+        for _, option := range tag[1:] {
+            omitempty = omitempty || option == "omitempty"
+        }
+        if !omitempty {
+            required = append(required, name)
+        }
+    }
+    schema := object{"type": "object", "properties": properties, "additionalProperties": false}
+    if len(required) > 0 {
+        schema["required"] = required
+    }
+    return schema
+}
+
+// Converts a gin route to an OpenAPI path and its path parameters
+func openAPIPath(route string) (string, []param) {
+    var params []param
+    segments := strings.Split(route, "/")
+    for i, segment := range segments {
+        if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+            params = append(params, param{"path", segment[1:], "string", ""})
+            segments[i] = "{"+segment[1:]+"}"
+        }
+    }
+    return strings.Join(segments, "/"), params
+}
+
+// Builds an OpenAPI operation from an endpoint
+func (b *schemaBuilder) operation(e endpoint, pathParams []param) object {
+    op := object{"summary": e.summary, "tags": []string{e.group}}
+    description := e.description
+    if e.scope != "" {
+        description = strings.TrimSpace(description+" Personal access tokens need the `"+e.scope+"` scope.")
+        op["x-scope"] = e.scope
+    }
+    if description != "" {
+        op["description"] = description
+    }
+    if e.deprecated {
+        op["deprecated"] = true
+    }
+    if e.public {
+        op["security"] = []interface{}{}
+    }
+
+    params := []interface{}{}
+    for _, p := range append(pathParams, e.params...) {
+        parameter := object{"in": p.in, "name": p.name, "schema": object{"type": p.kind}}
+        if p.in == "path" {
+            parameter["required"] = true
+        }
+        if p.description != "" {
+            parameter["description"] = p.description
+        }
+        params = append(params, parameter)
+    }
+    if len(params) > 0 {
+        op["parameters"] = params
+    }
+    if e.body != nil {
+        op["requestBody"] = object{
+            "required": !e.optionalBody,
+            "content": object{"application/json": object{"schema": b.value(e.body)}},
+        }
+    }
+
+    status := e.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    success := object{"description": http.StatusText(status)}
+    if e.contentType != "" {
+        success["content"] = object{e.contentType: object{"schema": object{"type": "string"}}}
+    } else if e.response != nil {
+        success["content"] = object{"application/json": object{"schema": b.value(e.response)}}
+    }
+    responses := object{fmt.Sprint(status): success}
+
+    apiError := object{"schema": b.value(apiError{})}
+    errors := e.errors
+    if !e.public {
+        // Malformed JWT, missing or invalid credentials, and tokens without the scope
+        errors = append([]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden}, errors...)
+    }
+    for _, code := range errors {
+        responses[fmt.Sprint(code)] = object{
+            "description": http.StatusText(code),
+            "content": object{"application/json": apiError},
+        }
+    }
+    for _, code := range e.textErrors {
+        text := object{"schema": object{"type": "string"}}
+        if response, ok := responses[fmt.Sprint(code)].(object); ok {
+            response["content"].(object)["text/plain"] = text
+            continue
+        }
+        responses[fmt.Sprint(code)] = object{
+            "description": http.StatusText(code),
+            "content": object{"text/plain": text},
+        }
+    }
+    op["responses"] = responses
+    return op
+}
+
+// Builds the OpenAPI 3 document of the API from its routes and the endpoints
+// documenting them. Every route must be documented, and every endpoint routed.
+func openAPI(routes gin.RoutesInfo) (object, error) {
+    b := &schemaBuilder{components: object{}, types: make(map[string]reflect.Type)}
+    paths := object{}
+    routed := make(map[string]bool)
+    var undocumented []string
+    for _, route := range routes {
+        key := route.Method+" "+route.Path
+        routed[key] = true
+        e, ok := endpoints[key]
+        if !ok {
+            undocumented = append(undocumented, key)
+            continue
+        }
+        path, pathParams := openAPIPath(route.Path)
+        if paths[path] == nil {
+            paths[path] = object{}
+        }
+        paths[path].(object)[strings.ToLower(route.Method)] = b.operation(e, pathParams)
+    }
+    for key := range endpoints {
+        if !routed[key] {
+            undocumented = append(undocumented, key+" (not routed)")
+        }
+    }
+    if len(undocumented) > 0 {
+        sort.Strings(undocumented)
+        return nil, fmt.Errorf("Error documenting the API, endpoints do not match the routes: %s",
+            strings.Join(undocumented, ", "))
+    }
+    for _, v := range extraSchemas {
+        b.value(v)
+    }
+
+    return object{
+        "openapi": "3.0.3",
+        "info": object{
+            "title": "Kind App API",
+            "version": "2",
+            "description": "Authenticate with a JWT from POST /api/jwt, a personal access token starting " +
+                "kat_ or the sessionid cookie of the web application. JWTs and cookies may call every " +
+                "endpoint, personal access tokens only those their scopes allow.",
+        },
+        "servers": []object{{"url": "https://localhost:8080"}},
+        "security": []object{{"bearerAuth": []string{}}, {"sessionCookie": []string{}}},
+        "paths": paths,
+        "components": object{
+            "schemas": b.components,
+            "securitySchemes": object{
+                "bearerAuth": object{"type": "http", "scheme": "bearer",
+                    "description": "JWT from POST /api/jwt or a personal access token"},
+                "sessionCookie": object{"type": "apiKey", "in": "cookie", "name": "sessionid"},
+            },
+        },
+    }, nil
+}
+
+// Serves the OpenAPI document and Swagger UI
+type apiDocs struct {
+    spec []byte
+}
+
+// Builds the document of the routes of router, which must all be registered
+func (d *apiDocs) build(routes gin.RoutesInfo) error {
+    spec, err := openAPI(routes)
+    if err != nil {
+        return err
+    }
+    d.spec, err = json.MarshalIndent(spec, "", "    ")
+    return err
+}
+
+// Returns the OpenAPI document of the API
+func (d *apiDocs) getSpec(c *gin.Context) {
+    c.Data(http.StatusOK, "application/json; charset=utf-8", d.spec)
+}
+
+// Serves Swagger UI at /api/docs/, with its assets
+func (d *apiDocs) getUI(c *gin.Context) {
+    file := c.Param("file")
+    if file == "/" || file == "/index.html" {
+        c.Data(http.StatusOK, "text/html; charset=utf-8", swaggerPage)
+        return
+    }
+    if _, err := swaggerFiles.ReadFile(file); err != nil {
+        c.String(http.StatusNotFound, "404 page not found")
+        return
+    }
+    c.FileFromFS(file, swaggerFiles.HTTP)
+}
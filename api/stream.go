@@ -0,0 +1,106 @@
+package api
+
+import (
+    "fmt"
+    "time"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+)
+
+// Time between comments sent to keep idle streams open through proxies
+const streamHeartbeat = 30 * time.Second
+
+// Event as sent on the stream, with version 2 ids and dates
+type event struct {
+    Id int64 `json:"id"`
+    Type string `json:"type"`
+    Entity string `json:"entity"`
+    EntityId int64 `json:"entity_id"`
+    PostId int64 `json:"post_id"`
+    Actor string `json:"actor,omitempty"`
+    Date string `json:"date"`
+}
+
+func apiEvent(e db.Event) event {
+    return event{
+        Id: e.Id,
+        Type: e.Type,
+        Entity: e.Entity.String(),
+        EntityId: idV2(e.EntityId),
+        PostId: idV2(e.PostId),
+        Actor: e.Actor,
+        Date: dateV2(e.Date),
+    }
+}
+
+// Streams post, comment and reaction events as Server-Sent Events until the
+// client disconnects. Clients resume after the event in the Last-Event-ID
+// header, or the last_event_id query parameter, and are sent a reset event when
+// the missed events are no longer known.
+func ServeEvents(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+        return
+    }
+    lastID := r.Header.Get("Last-Event-ID")
+    if lastID == "" {
+        lastID = r.URL.Query().Get("last_event_id")
+    }
+    var after int64
+    if lastID != "" {
+        var err error
+        after, err = strconv.ParseInt(lastID, 10, 64)
+        if err != nil || after < 0 {
+            http.Error(w, "Last event id must be a number", http.StatusBadRequest)
+            return
+        }
+    }
+    subscription := db.Subscribe(after)
+    defer subscription.Close()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprint(w, "retry: 3000\n\n")
+    if subscription.Reset {
+        fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+    }
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(streamHeartbeat)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": ping\n\n")
+        case e, ok := <-subscription.Events:
+            if !ok {
+                // Dropped for falling behind, the client reconnects and resumes
+                return
+            }
+            data, err := json.Marshal(apiEvent(e))
+            if err != nil {
+                fmt.Println("Error encoding event:", err)
+                continue
+            }
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+        }
+        flusher.Flush()
+    }
+}
+
+// Streams events to API clients, see ServeEvents
+func getStream(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    ServeEvents(c.Writer, c.Request)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/google/uuid"
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt"
+)
+
+type refreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+type newPersonalToken struct {
+    Name string `json:"name"`
+    Scopes []string `json:"scopes"`
+    // Lifetime in days, 90 when omitted
+    ExpiresInDays int `json:"expires_in_days"`
+}
+
+// API key with its refresh token and lifetime in seconds
+type tokenPair struct {
+    Key string `json:"key"`
+    RefreshToken string `json:"refresh_token"`
+    ExpiresIn int `json:"expires_in"`
+}
+
+// Personal access token, only returned when created
+type createdToken struct {
+    Token string `json:"token"`
+    Info security.PersonalTokenInfo `json:"info"`
+}
+
+type passwordChange struct {
+    Password string `json:"password"`
+    NewPassword string `json:"new_password"`
+}
+
+// Signs a short-lived access token with id jti and responds with it and its refresh token
+func issueTokens(c *gin.Context, username string, jti string, refreshToken string) {
+    now := time.Now()
+    claim := &claims {
+        Username: username,
+        StandardClaims: jwt.StandardClaims {
+            Id: jti,
+            IssuedAt: now.Unix(),
+            ExpiresAt: now.Add(security.AccessTokenTTL).Unix()},
+    }
+    tokenString, err := keys.sign(claim)
+    if err != nil {
+        fmt.Println(err)
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, tokenPair{tokenString, refreshToken, int(security.AccessTokenTTL.Seconds())})
+}
+
+// Exchanges a refresh token for a new access token and refresh token
+func refreshJWT(c *gin.Context) {
+    var req refreshRequest
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil || req.RefreshToken == "" {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "A refresh_token is required"})
+        return
+    }
+    jti := uuid.NewString()
+    username, refreshToken, err := security.RotateRefreshToken(req.RefreshToken, jti)
+    if err != nil {
+        c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+        return
+    }
+    issueTokens(c, username, jti, refreshToken)
+}
+
+// Revokes the presented access token and, if given, a refresh token with
+// every token rotated from the same login
+func revokeJWT(c *gin.Context) {
+    var req refreshRequest
+    json.NewDecoder(c.Request.Body).Decode(&req)
+
+    revoked := false
+    authHeader := c.Request.Header["Authorization"]
+    if len(authHeader) > 0 {
+        fields := strings.Fields(authHeader[0])
+        claims := &claims{}
+        if len(fields) == 2 {
+            tkn, err := jwt.ParseWithClaims(fields[1], claims, keys.verificationKey)
+            if err == nil && tkn.Valid && claims.Id != "" {
+                err = security.RevokeAccessToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+                if err != nil {
+                    c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+                    return
+                }
+                revoked = true
+            }
+        }
+    }
+    if req.RefreshToken != "" {
+        err := security.RevokeRefreshToken(req.RefreshToken)
+        if err != nil {
+            c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        revoked = true
+    }
+    if !revoked {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error":
+            "Present a valid JWT or a refresh_token to revoke"})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Changes the caller's password, revoking all of their API and personal access
+// tokens and ending their other sessions
+func changePassword(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    var req passwordChange
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil || req.NewPassword == "" {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "password and new_password are required"})
+        return
+    }
+    // Only a session cookie that authorized the request is kept
+    session := ""
+    if len(c.Request.Header["Authorization"]) == 0 {
+        session = getSessionID(c)
+    }
+    err = security.ChangePassword(getUsername(c), req.Password, req.NewPassword, session)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Lists the caller's personal access tokens
+func getPersonalTokens(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    tokens, err := security.ListPersonalTokens(getUsername(c))
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, tokens)
+}
+
+// Creates a personal access token, the only response that includes the token
+func postPersonalToken(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    var req newPersonalToken
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+    if req.ExpiresInDays < 0 || req.ExpiresInDays > 1000 {
+        // Out of range, rejected without risking overflow
+        ttl = -1
+    }
+    token, info, err := security.CreatePersonalToken(getUsername(c), req.Name, req.Scopes, ttl)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, createdToken{token, info})
+}
+
+// Deletes one of the caller's personal access tokens
+func deletePersonalToken(c *gin.Context) {
+    if !authorized(c, security.ScopeAdmin) {
+        return
+    }
+    err := security.RevokePersonalToken(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+    "time"
+    "strconv"
+    "net/http"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+)
+
+// Version 2 of the post and comment models. Ids are numbers, dates are RFC 3339
+// and comments are nested objects rather than a string.
+type postV2 struct {
+    Id int64 `json:"id"`
+    Author string `json:"author"`
+    Content string `json:"content"`
+    Date string `json:"date"`
+    Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+    Reactions []reaction `json:"reactions"`
+    Tags []string `json:"tags"`
+    NumComments int `json:"num_comments"`
+    Comments []commentV2 `json:"comments"`
+    // Cursor of the comments following those in Comments
+    CommentsCursor string `json:"comments_cursor,omitempty"`
+    Hidden bool `json:"hidden"`
+    EditedAt string `json:"edited_at,omitempty"`
+    EditedBy string `json:"edited_by,omitempty"`
+}
+
+type commentV2 struct {
+    Id int64 `json:"id"`
+    PostId int64 `json:"post_id"`
+    Author string `json:"author"`
+    Content string `json:"content"`
+    Date string `json:"date"`
+    Likes int `json:"likes"`
+    Dislikes int `json:"dislikes"`
+    Liked bool `json:"liked"`
+    Disliked bool `json:"disliked"`
+    Reactions []reaction `json:"reactions"`
+    Hidden bool `json:"hidden"`
+    EditedAt string `json:"edited_at,omitempty"`
+    EditedBy string `json:"edited_by,omitempty"`
+}
+
+type postsPageV2 struct {
+    Posts []postV2 `json:"posts"`
+    NextCursor string `json:"next_cursor"`
+}
+
+type commentsPageV2 struct {
+    Comments []commentV2 `json:"comments"`
+    NextCursor string `json:"next_cursor"`
+}
+
+// Converts a database id to the number used by version 2
+func idV2(id string) int64 {
+    n, _ := strconv.ParseInt(id, 10, 64)
+    return n
+}
+
+// Formats a date as RFC 3339, empty when it is zero
+func dateV2(date time.Time) string {
+    if date.IsZero() {
+        return ""
+    }
+    return date.UTC().Format(time.RFC3339)
+}
+
+// Converts a comment on the post postID to the version 2 representation
+func apiCommentV2(db_comment db.Comment, postID string) commentV2 {
+    return commentV2{
+        Id: idV2(db_comment.Id),
+        PostId: idV2(postID),
+        Author: db_comment.Author,
+        Content: db_comment.Content,
+        Date: dateV2(db_comment.Date),
+        Likes: db_comment.Likes,
+        Dislikes: db_comment.Dislikes,
+        Liked: db_comment.Vote == db.Liked,
+        Disliked: db_comment.Vote == db.Disliked,
+        Reactions: apiReactions(db_comment.Reactions),
+        Hidden: db_comment.Hidden,
+        EditedAt: dateV2(db_comment.EditedAt),
+        EditedBy: db_comment.EditedBy,
+    }
+}
+
+// Converts a post and its comments to the version 2 representation
+func apiPostV2(db_post db.Post, commentsCursor string) postV2 {
+    comments := []commentV2{}
+    for _, db_comment := range db_post.Comments {
+        comments = append(comments, apiCommentV2(db_comment, db_post.Id))
+    }
+    return postV2{
+        Id: idV2(db_post.Id),
+        Author: db_post.Author,
+        Content: db_post.Content,
+        Date: dateV2(db_post.Date),
+        Likes: db_post.Likes,
+        Dislikes: db_post.Dislikes,
+        Liked: db_post.Vote == db.Liked,
+        Disliked: db_post.Vote == db.Disliked,
+        Reactions: apiReactions(db_post.Reactions),
+        Tags: db.ParseTags(db_post.Content),
+        NumComments: db_post.NumComments,
+        Comments: comments,
+        CommentsCursor: commentsCursor,
+        Hidden: db_post.Hidden,
+        EditedAt: dateV2(db_post.EditedAt),
+        EditedBy: db_post.EditedBy,
+    }
+}
+
+// Gets a page of posts, newest first, with the first page of each post's comments.
+// The tag query parameter limits them to posts using a hashtag.
+func getPostsV2(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    db_posts, commentsCursors, next, err := loadPosts(getUsername(c), c.Query("tag"), c.Query("cursor"), limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    posts := []postV2{}
+    for _, db_post := range db_posts {
+        posts = append(posts, apiPostV2(db_post, commentsCursors[db_post.Id]))
+    }
+    c.IndentedJSON(http.StatusOK, postsPageV2{posts, next})
+}
+
+// Gets a post by id with the first page of its comments
+func getPostV2(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    db_post, next, err := loadPost(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, apiPostV2(db_post, next))
+}
+
+// Gets a page of a post's comments, newest first
+func getCommentsV2(c *gin.Context) {
+    if !authorized(c, security.ScopePostsRead) {
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    id := c.Param("id")
+    db_comments, next, err := loadComments(getUsername(c), id, c.Query("cursor"), limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    comments := []commentV2{}
+    for _, db_comment := range db_comments {
+        comments = append(comments, apiCommentV2(db_comment, id))
+    }
+    c.IndentedJSON(http.StatusOK, commentsPageV2{comments, next})
+}
+
+// Registers the /api/v2 endpoints
+func v2Routes(router *gin.Engine) {
+    router.GET("/api/v2/posts", getPostsV2)
+    router.GET("/api/v2/post/:id", getPostV2)
+    router.GET("/api/v2/post/:id/comments", getCommentsV2)
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "gitlab.sas.com/lomich/kind-app/security"
+    "github.com/gin-gonic/gin"
+)
+
+type newWebhook struct {
+    URL string `json:"url"`
+    Events []string `json:"events"`
+}
+
+// Webhook with its signing secret, only returned when registered
+type createdWebhook struct {
+    Secret string `json:"secret"`
+    Webhook security.WebhookInfo `json:"webhook"`
+}
+
+// Changes to a webhook, omitted fields are left as they are
+type webhookChange struct {
+    URL string `json:"url"`
+    Events []string `json:"events"`
+    Enabled *bool `json:"enabled"`
+}
+
+// Lists the caller's webhooks, or everybody's with all=true for admins
+func getWebhooks(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksRead) {
+        return
+    }
+    webhooks, err := security.ListWebhooks(getUsername(c), c.Query("all") == "true")
+    if err == security.ErrPermissionDenied {
+        c.IndentedJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, webhooks)
+}
+
+// Returns one webhook
+func getWebhook(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksRead) {
+        return
+    }
+    webhook, err := security.GetWebhook(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, webhook)
+}
+
+// Registers a webhook, the only response that includes its signing secret
+func postWebhook(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksWrite) {
+        return
+    }
+    var req newWebhook
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    secret, webhook, err := security.CreateWebhook(getUsername(c), req.URL, req.Events)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, createdWebhook{secret, webhook})
+}
+
+// Changes the URL or events of a webhook, or enables or disables it
+func patchWebhook(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksWrite) {
+        return
+    }
+    var req webhookChange
+    err := json.NewDecoder(c.Request.Body).Decode(&req)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    username := getUsername(c)
+    _, err = security.GetWebhook(username, c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    webhook, err := security.UpdateWebhook(username, c.Param("id"), req.URL, req.Events, req.Enabled)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, webhook)
+}
+
+// Deletes a webhook and its delivery log
+func deleteWebhook(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksWrite) {
+        return
+    }
+    err := security.DeleteWebhook(getUsername(c), c.Param("id"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, gin.H{"message": "Success"})
+}
+
+// Lists the most recent deliveries of a webhook, newest first
+func getDeliveries(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksRead) {
+        return
+    }
+    limit, err := pageLimit(c)
+    if err != nil {
+        c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    deliveries, err := security.ListDeliveries(getUsername(c), c.Param("id"), limit)
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, deliveries)
+}
+
+// Sends the payload of a delivery again, as a new delivery
+func redeliver(c *gin.Context) {
+    if !authorized(c, security.ScopeWebhooksWrite) {
+        return
+    }
+    delivery, err := security.Redeliver(getUsername(c), c.Param("id"), c.Param("delivery"))
+    if err != nil {
+        c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+        return
+    }
+    c.IndentedJSON(http.StatusOK, delivery)
+}
@@ -9,6 +9,12 @@ docker build . -t kind-app
 kind create cluster --config=config/cluster.yml
 kind load docker-image kind-app:latest
 kubectl apply -f config/mysql-secret.yml
+if [ ! -d "security/jwt" ]
+then
+    mkdir -p security/jwt
+    openssl genpkey -algorithm ed25519 -out security/jwt/$(date +%Y%m%d).pem
+fi
+kubectl create secret generic jwt-keys --from-file=security/jwt --dry-run=client -o yaml | kubectl apply -f -
 kubectl apply -f config/mysql.yml
 kubectl apply -f config/app.yml
 
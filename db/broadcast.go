@@ -0,0 +1,287 @@
+package db
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "encoding/json"
+    "github.com/go-redis/redis/v8"
+)
+
+// Carries events between the replicas of the application. Every replica publishes
+// to it and has every event, including its own, delivered back with an id that
+// increases across replicas.
+type Broadcaster interface {
+    // Publishes an event to every replica listening
+    Publish(e Event) error
+    // Calls deliver with each event published from now on, returning the id of
+    // the last event published before
+    Listen(deliver func(Event)) (int64, error)
+    // Stops listening
+    Close() error
+}
+
+// Connects to the broadcaster named by EVENT_BROADCAST: local for a single
+// replica, outbox to poll the database, or redis to use the server at REDIS_URL
+func ConnBroadcaster() error {
+    kind := os.Getenv("EVENT_BROADCAST")
+    var b Broadcaster
+    switch kind {
+    case "", "local":
+        return nil
+    case "outbox":
+        interval := outboxPollInterval
+        if value := os.Getenv("EVENT_POLL_INTERVAL"); value != "" {
+            d, err := time.ParseDuration(value)
+            if err != nil || d <= 0 {
+                return fmt.Errorf("Invalid EVENT_POLL_INTERVAL %q", value)
+            }
+            interval = d
+        }
+        b = NewOutboxBroadcaster(interval)
+    case "redis":
+        var err error
+        b, err = NewRedisBroadcaster(os.Getenv("REDIS_URL"))
+        if err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("Unknown EVENT_BROADCAST %q, expected local, outbox or redis", kind)
+    }
+    err := UseBroadcaster(b)
+    if err != nil {
+        return err
+    }
+    fmt.Println("Broadcasting events with", kind)
+    return nil
+}
+
+// In-process broadcaster hub. A hub with one broadcaster serves a single
+// replica; tests stand in for several replicas with a broadcaster each.
+type LocalHub struct {
+    mu sync.Mutex
+    lastID int64
+    listeners map[*localBroadcaster]func(Event)
+}
+
+type localBroadcaster struct {
+    hub *LocalHub
+}
+
+// Creates a hub with no broadcasters
+func NewLocalHub() *LocalHub {
+    return &LocalHub{listeners: make(map[*localBroadcaster]func(Event))}
+}
+
+// Creates a broadcaster connected to the others of the hub
+func (h *LocalHub) Broadcaster() Broadcaster {
+    return &localBroadcaster{hub: h}
+}
+
+// Delivers an event to every listening broadcaster of the hub, in the order published
+func (b *localBroadcaster) Publish(e Event) error {
+    b.hub.mu.Lock()
+    defer b.hub.mu.Unlock()
+    b.hub.lastID++
+    e.Id = b.hub.lastID
+    for _, deliver := range b.hub.listeners {
+        deliver(e)
+    }
+    return nil
+}
+
+func (b *localBroadcaster) Listen(deliver func(Event)) (int64, error) {
+    b.hub.mu.Lock()
+    defer b.hub.mu.Unlock()
+    b.hub.listeners[b] = deliver
+    return b.hub.lastID, nil
+}
+
+func (b *localBroadcaster) Close() error {
+    b.hub.mu.Lock()
+    defer b.hub.mu.Unlock()
+    delete(b.hub.listeners, b)
+    return nil
+}
+
+const (
+    // Default time between polls of the outbox
+    outboxPollInterval = time.Second
+    // Most events read from the outbox by one poll
+    outboxBatch = 500
+    // Time an outbox id is waited for when later ones were read, as inserts
+    // can commit out of order. It is skipped after.
+    outboxGapWait = 5 * time.Second
+    // Time events are kept in the outbox, and between deletions of older ones
+    outboxRetention = time.Hour
+    outboxPruneInterval = 10 * time.Minute
+)
+
+// Broadcaster writing events to the event_outbox table, which every replica
+// polls. Needs no infrastructure beyond the shared database.
+type outboxBroadcaster struct {
+    interval time.Duration
+    stop chan struct{}
+    once sync.Once
+}
+
+// Creates a broadcaster polling the outbox of the store in use every interval
+func NewOutboxBroadcaster(interval time.Duration) Broadcaster {
+    return &outboxBroadcaster{interval: interval, stop: make(chan struct{})}
+}
+
+func (b *outboxBroadcaster) Publish(e Event) error {
+    _, err := store.AddOutboxEvent(e)
+    return err
+}
+
+func (b *outboxBroadcaster) Listen(deliver func(Event)) (int64, error) {
+    last, err := store.LastOutboxEventID()
+    if err != nil {
+        return 0, err
+    }
+    go b.poll(last, deliver)
+    return last, nil
+}
+
+// Delivers the events added to the outbox after last until closed, deleting old ones
+func (b *outboxBroadcaster) poll(last int64, deliver func(Event)) {
+    ticker := time.NewTicker(b.interval)
+    defer ticker.Stop()
+    pruned := time.Now()
+    for {
+        select {
+        case <-b.stop:
+            return
+        case <-ticker.C:
+        }
+        events, err := store.GetOutboxEvents(last, outboxBatch)
+        if err != nil {
+            fmt.Println(err)
+            continue
+        }
+        for _, e := range events {
+            if e.Id != last + 1 && time.Since(e.Date) < outboxGapWait {
+                break
+            }
+            deliver(e)
+            last = e.Id
+        }
+        if time.Since(pruned) >= outboxPruneInterval {
+            pruned = time.Now()
+            _, err = store.PruneOutbox(time.Now().Add(-outboxRetention))
+            if err != nil {
+                fmt.Println(err)
+            }
+        }
+    }
+}
+
+func (b *outboxBroadcaster) Close() error {
+    b.once.Do(func() { close(b.stop) })
+    return nil
+}
+
+const (
+    // Redis channel events are published on
+    redisEventChannel = "kind-app:events"
+    // Redis key counting the events published, giving their ids
+    redisEventIDKey = "kind-app:event-id"
+    // Time allowed for a Redis command
+    redisTimeout = 5 * time.Second
+)
+
+// Broadcaster publishing events on a Redis pub/sub channel
+type redisBroadcaster struct {
+    client *redis.Client
+    pubsub *redis.PubSub
+}
+
+// Event as published on Redis
+type redisEvent struct {
+    Id int64 `json:"id"`
+    Type string `json:"type"`
+    Entity string `json:"entity"`
+    EntityId string `json:"entity_id"`
+    PostId string `json:"post_id"`
+    Actor string `json:"actor"`
+    Date time.Time `json:"date"`
+}
+
+// Connects to the Redis server at url, such as redis://:password@redis:6379/0
+func NewRedisBroadcaster(url string) (Broadcaster, error) {
+    options, err := redis.ParseURL(url)
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing REDIS_URL: %v", err)
+    }
+    client := redis.NewClient(options)
+    ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+    defer cancel()
+    err = client.Ping(ctx).Err()
+    if err != nil {
+        client.Close()
+        return nil, fmt.Errorf("Error connecting to Redis: %v", err)
+    }
+    return &redisBroadcaster{client: client}, nil
+}
+
+func (b *redisBroadcaster) Publish(e Event) error {
+    ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+    defer cancel()
+    id, err := b.client.Incr(ctx, redisEventIDKey).Result()
+    if err != nil {
+        return fmt.Errorf("Error numbering event: %v", err)
+    }
+    data, err := json.Marshal(redisEvent{id, e.Type, e.Entity.name, e.EntityId, e.PostId, e.Actor, e.Date})
+    if err != nil {
+        return err
+    }
+    err = b.client.Publish(ctx, redisEventChannel, data).Err()
+    if err != nil {
+        return fmt.Errorf("Error publishing event: %v", err)
+    }
+    return nil
+}
+
+func (b *redisBroadcaster) Listen(deliver func(Event)) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+    defer cancel()
+    b.pubsub = b.client.Subscribe(context.Background(), redisEventChannel)
+    // Waits for the subscription so no event is missed after the id is read
+    _, err := b.pubsub.Receive(ctx)
+    if err != nil {
+        return 0, fmt.Errorf("Error subscribing to events: %v", err)
+    }
+    last, err := b.client.Get(ctx, redisEventIDKey).Int64()
+    if err != nil && err != redis.Nil {
+        return 0, fmt.Errorf("Error reading event id: %v", err)
+    }
+    messages := b.pubsub.Channel()
+    go func() {
+        for message := range messages {
+            var received redisEvent
+            err := json.Unmarshal([]byte(message.Payload), &received)
+            if err != nil {
+                fmt.Println("Error decoding event:", err)
+                continue
+            }
+            entity, err := ParseEntity(received.Entity)
+            if err != nil {
+                fmt.Println("Error decoding event:", err)
+                continue
+            }
+            deliver(Event{received.Id, received.Type, entity, received.EntityId, received.PostId,
+                received.Actor, received.Date})
+        }
+    }()
+    return last, nil
+}
+
+func (b *redisBroadcaster) Close() error {
+    if b.pubsub != nil {
+        b.pubsub.Close()
+    }
+    return b.client.Close()
+}
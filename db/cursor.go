@@ -0,0 +1,88 @@
+package db
+
+import (
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "encoding/base64"
+)
+
+const (
+    // Number of posts or comments on a page when none is requested
+    DefaultPageSize = 20
+    // Largest page of posts or comments that may be requested
+    MaxPageSize = 100
+)
+
+// Position in a list of posts or comments ordered newest first. A page after a
+// cursor starts with the item following the one the cursor was made from, so
+// pages stay stable while new posts are added. The zero Cursor is the start.
+type Cursor struct {
+    Date time.Time
+    Id int64
+}
+
+// Returns the cursor of the page following item
+func cursorAfter(date time.Time, id string) Cursor {
+    n, _ := parseID(id)
+    return Cursor{date.UTC().Truncate(time.Second), n}
+}
+
+// Encodes the cursor for clients, who treat it as opaque
+func (c Cursor) String() string {
+    if c.IsZero() {
+        return ""
+    }
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Date.Unix(), c.Id)))
+}
+
+// Reports whether the cursor is the start of the list
+func (c Cursor) IsZero() bool {
+    return c.Date.IsZero() && c.Id == 0
+}
+
+// Reports whether an item comes after the cursor, newest first
+func (c Cursor) before(date time.Time, id string) bool {
+    if c.IsZero() {
+        return true
+    }
+    n, _ := parseID(id)
+    date = date.UTC().Truncate(time.Second)
+    return date.Before(c.Date) || (date.Equal(c.Date) && n < c.Id)
+}
+
+// Decodes a cursor returned by String. The empty string is the start of the list.
+func ParseCursor(s string) (Cursor, error) {
+    if s == "" {
+        return Cursor{}, nil
+    }
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return Cursor{}, fmt.Errorf("Invalid cursor %q", s)
+    }
+    parts := strings.Split(string(b), ".")
+    if len(parts) != 2 {
+        return Cursor{}, fmt.Errorf("Invalid cursor %q", s)
+    }
+    unix, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return Cursor{}, fmt.Errorf("Invalid cursor %q", s)
+    }
+    id, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || id <= 0 {
+        return Cursor{}, fmt.Errorf("Invalid cursor %q", s)
+    }
+    return Cursor{time.Unix(unix, 0).UTC(), id}, nil
+}
+
+// Clamps a requested page size, zero meaning DefaultPageSize
+func pageSize(limit int) (int, error) {
+    if limit == 0 {
+        return DefaultPageSize, nil
+    }
+    if limit < 0 || limit > MaxPageSize {
+        return 0, fmt.Errorf("Page size must be between 1 and %d", MaxPageSize)
+    }
+    return limit, nil
+}
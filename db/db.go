@@ -3,15 +3,10 @@ package db
 import (
     "os"
     "fmt"
+    "sort"
     "time"
-    "strconv"
-    "database/sql"
-    "github.com/google/uuid"
-    "github.com/go-sql-driver/mysql"
 )
 
-var db *sql.DB
-
 type Person struct {
     First string
     Last string
@@ -22,6 +17,42 @@ type User struct {
     Username string
     Password string
     Salt []byte
+    Role string
+    Locked bool
+}
+
+type Session struct {
+    Id string
+    Username string
+    CreatedAt time.Time
+    LastSeen time.Time
+    ExpiresAt time.Time
+    UserAgent string
+    IP string
+}
+
+// Hashed API refresh token. Id is the sha256 of the token handed to the client.
+type RefreshToken struct {
+    Id string
+    Family string
+    Username string
+    AccessJTI string
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    Used bool
+}
+
+// Named API token of a user. Hash is the sha256 of the token, Scopes is space
+// separated and a zero LastUsed means the token was never used.
+type PersonalToken struct {
+    Id string
+    Name string
+    Username string
+    Hash string
+    Scopes string
+    CreatedAt time.Time
+    LastUsed time.Time
+    ExpiresAt time.Time
 }
 
 type Post struct {
@@ -29,8 +60,23 @@ type Post struct {
     Author string
     Date time.Time
     Likes int
+    Dislikes int
+    // The viewing user's vote, set by MarkVotes
+    Vote int
+    // Emoji reactions, set by LoadReactions
+    Reactions []Reaction
+    // Users mentioned, set by LoadMentions
+    Mentions []string
     NumComments int
     Comments []Comment
+    Hidden bool
+    HiddenBy string
+    // Zero unless the post was edited
+    EditedAt time.Time
+    EditedBy string
+    // Zero unless the post is in the trash
+    DeletedAt time.Time
+    DeletedBy string
     Id string
 }
 
@@ -39,417 +85,851 @@ type Comment struct {
     Author string
     Date time.Time
     Likes int
+    Dislikes int
+    // The viewing user's vote, set by MarkVotes
+    Vote int
+    // Emoji reactions, set by LoadReactions
+    Reactions []Reaction
+    // Users mentioned, set by LoadMentions
+    Mentions []string
+    Hidden bool
+    HiddenBy string
+    // Zero unless the comment was edited
+    EditedAt time.Time
+    EditedBy string
+    // Zero unless the comment is in the trash
+    DeletedAt time.Time
+    DeletedBy string
     Id string
 }
 
-// Try to connect to database 10 times
+// Values of a user's vote on a post or comment, 0 meaning no vote
+const (
+    Liked = 1
+    Disliked = -1
+)
+
+// Like and dislike counts of a post or comment along with one user's vote
+type Votes struct {
+    Likes int
+    Dislikes int
+    Vote int
+}
+
+// Version of a post or comment's content, written by Editor at CreatedAt
+type Revision struct {
+    Content string
+    Editor string
+    CreatedAt time.Time
+}
+
+// Post or comment in the trash. PostId is the post itself or the post a comment is on.
+type TrashItem struct {
+    Entity Entity
+    Id string
+    PostId string
+    Content string
+    Author string
+    DeletedAt time.Time
+    DeletedBy string
+}
+
+// Users who reacted to a post or comment with one emoji, in the order they reacted
+type Reaction struct {
+    Emoji string
+    Count int
+    Users []string
+    // Whether the viewing user is one of Users
+    Reacted bool
+}
+
+// Record of a moderator or admin acting on someone else's content or account.
+// EntityId is a post or comment id, or a username for role changes.
+type ModerationEntry struct {
+    Id string
+    Actor string
+    Action string
+    Entity string
+    EntityId string
+    Author string
+    Detail string
+    CreatedAt time.Time
+}
+
+// Store is the persistence layer used by the rest of the application
+type Store interface {
+    // Users
+    Adduser(user User) error
+    GetCreds(username string) (string, []byte, error)
+    UpdatePassword(username string, password string) error
+    GetRole(username string) (string, error)
+    SetRole(username string, role string) error
+    GetUser(username string) (User, error)
+    GetUsers(search string, limit int, offset int) ([]User, error)
+    SetLocked(username string, locked bool) error
+
+    // Sessions
+    GetUsername(uuid string) (string, error)
+    AddSession(session Session) (string, error)
+    GetSession(uuid string) (Session, error)
+    GetSessions(username string) ([]Session, error)
+    TouchSession(uuid string, lastSeen time.Time) error
+    DeleteSession(uuid string) error
+    DeleteSessions(username string) error
+    DeleteExpiredSessions(expiredBefore time.Time, idleBefore time.Time) (int64, error)
+    ValidSession(uuid string) (bool, error)
+
+    // API tokens
+    AddRefreshToken(token RefreshToken) error
+    GetRefreshToken(id string) (RefreshToken, error)
+    GetRefreshTokens(username string) ([]RefreshToken, error)
+    UseRefreshToken(id string) (bool, error)
+    DeleteRefreshTokenFamily(family string) error
+    DeleteRefreshTokens(username string) error
+    RevokeToken(jti string, expiresAt time.Time) error
+    TokenRevoked(jti string) (bool, error)
+    DeleteExpiredTokens(before time.Time) (int64, error)
+
+    // Personal access tokens
+    AddPersonalToken(token PersonalToken) (string, error)
+    GetPersonalToken(hash string) (PersonalToken, error)
+    GetPersonalTokens(username string) ([]PersonalToken, error)
+    TouchPersonalToken(id string, lastUsed time.Time) error
+    DeletePersonalToken(username string, id string) error
+    DeletePersonalTokens(username string) error
+
+    // Posts
+    AddPost(content string, author string) (string, error)
+    DeletePost(id string) error
+    GetAllPosts() ([]Post, error)
+    GetPostsAfter(tag string, after Cursor, limit int) ([]Post, error)
+    GetPost(id string) (Post, error)
+
+    // Trash
+    TrashContent(entity Entity, id string, actor string) error
+    RestoreContent(entity Entity, id string) error
+    GetTrash(author string) ([]TrashItem, error)
+    GetTrashItem(entity Entity, id string) (TrashItem, error)
+    PurgeTrash(before time.Time) (int64, error)
+
+    // Edits
+    EditContent(entity Entity, id string, content string, editor string) error
+    GetRevisions(entity Entity, id string) ([]Revision, error)
+
+    // Comments
+    AddComment(content string, author string, post_id string) (string, error)
+    DeleteComment(id string) error
+    GetComments(id string) ([]Comment, error)
+    GetCommentsAfter(postID string, after Cursor, limit int) ([]Comment, error)
+    GetComment(id string) (Comment, error)
+    GetPostIDFromCommentID(commentID string) (string, error)
+
+    // Hashtags
+    SetTags(postID string, tags []string, createdAt time.Time) error
+    GetTags(since time.Time, limit int) ([]TagCount, error)
+
+    // Mentions and notifications
+    AddMentions(entity Entity, id string, usernames []string) ([]string, error)
+    GetMentions(entity Entity, id string) ([]string, error)
+    AddNotification(notification Notification) error
+    GetNotifications(username string, unread bool, limit int) ([]Notification, error)
+    CountUnread(username string) (int, error)
+    ReadNotification(username string, id string, readAt time.Time) error
+    ReadNotifications(username string, readAt time.Time) error
+    PruneNotifications(before time.Time) (int64, error)
+    GetNotificationPreferences(username string) (map[string]bool, error)
+    SetNotificationPreference(username string, kind string, enabled bool) error
+
+    // Event outbox
+    AddOutboxEvent(e Event) (int64, error)
+    GetOutboxEvents(after int64, limit int) ([]Event, error)
+    LastOutboxEventID() (int64, error)
+    PruneOutbox(before time.Time) (int64, error)
+
+    // Webhooks
+    AddWebhook(webhook Webhook) (string, error)
+    GetWebhook(id string) (Webhook, error)
+    GetWebhooks(username string) ([]Webhook, error)
+    UpdateWebhook(webhook Webhook) error
+    RecordWebhookFailure(id string, limit int, now time.Time) (bool, error)
+    ResetWebhookFailures(id string) error
+    DeleteWebhook(id string) error
+    AddWebhookDelivery(delivery WebhookDelivery) (string, error)
+    GetWebhookDelivery(id string) (WebhookDelivery, error)
+    GetWebhookDeliveries(webhookID string, limit int) ([]WebhookDelivery, error)
+    ClaimWebhookDeliveries(due time.Time, until time.Time, limit int) ([]WebhookDelivery, error)
+    UpdateWebhookDelivery(delivery WebhookDelivery) error
+    PruneWebhookDeliveries(before time.Time) (int64, error)
+
+    // Search
+    Search(q SearchQuery, limit int) ([]SearchResult, error)
+
+    // Likes
+    Vote(username string, entity Entity, id string, value int) (Votes, error)
+    GetVotes(username string, entity Entity) (map[string]int, error)
+    GetLikes(entity Entity, id string) (int, error)
+
+    // Emoji reactions
+    AddReaction(username string, entity Entity, id string, emoji string) error
+    RemoveReaction(username string, entity Entity, id string, emoji string) error
+    GetReactions(entity Entity, id string) ([]Reaction, error)
+    GetAuthor(entity Entity, id string) (string, error)
+
+    // Moderation
+    SetHidden(entity Entity, id string, hidden bool, actor string) error
+    AddModerationEntry(entry ModerationEntry) error
+    GetModerationLog(limit int) ([]ModerationEntry, error)
+
+    // People
+    Getpeople() ([]Person, error)
+    Addperson(person Person) error
+
+    Close() error
+}
+
+// Store used by the package level functions
+var store Store
+
+// Sets the store used by the package level functions
+func Use(s Store) {
+    store = s
+}
+
+// Returns the store currently in use
+func Default() Store {
+    return store
+}
+
+// Connects to the backend named by DB_DRIVER (mysql, sqlite or memory)
 func Conn() error {
+    driver := os.Getenv("DB_DRIVER")
+    switch driver {
+    case "", "mysql":
+        return connMySQL()
+    case "sqlite":
+        path := sqlitePath()
+        s, err := NewSQLiteStore(path)
+        if err != nil {
+            return err
+        }
+        Use(s)
+        fmt.Println("Database Connected! (sqlite: "+path+")")
+        return nil
+    case "memory":
+        Use(NewMemoryStore())
+        fmt.Println("Database Connected! (memory)")
+        return nil
+    }
+    return fmt.Errorf("Unknown DB_DRIVER %q, expected mysql, sqlite or memory", driver)
+}
+
+// Current time at the resolution of a SQL DATETIME column
+func now() time.Time {
+    return time.Now().UTC().Truncate(time.Second)
+}
+
+// Location of the SQLite database file
+func sqlitePath() string {
+    path := os.Getenv("SQLITE_PATH")
+    if path == "" {
+        path = "kindapp.db"
+    }
+    return path
+}
+
+// Try to connect to database 10 times
+func connMySQL() error {
     var err error
     for i:= 0; i < 10; i++ {
-        err = initDB()
+        var s Store
+        s, err = NewMySQLStore(os.Getenv("MYSQL_URL")+":3306", "root", os.Getenv("MYSQL_ROOT_PASSWORD"))
         if err != nil {
             time.Sleep(10 * time.Second)
             fmt.Println("Attempting to connect to database for", (i+1)*10, "seconds")
-        } else { return nil }
+        } else {
+            Use(s)
+            fmt.Println("Database Connected!")
+            return nil
+        }
     }
-    return fmt.Errorf("Failed to connect to database after 10 tries", err)
+    return fmt.Errorf("Failed to connect to database after 10 tries: %v", err)
 }
 
+// Adds a user
+func Adduser(user User) error {
+    return store.Adduser(user)
+}
 
-// Initialize database
-func initDB() error {
-    cfg := mysql.Config{
-        User: "root",
-        Passwd: os.Getenv("MYSQL_ROOT_PASSWORD"),
-        Net: "tcp",
-        Addr: os.Getenv("MYSQL_URL")+":3306",
-        ParseTime: true}
-    var err error
-    db, err = sql.Open("mysql", cfg.FormatDSN())
-    if err != nil {
-        return fmt.Errorf("Can't connect to database: ", err)
-    }
-    db.Exec("CREATE DATABASE kindapp")
-    db.Exec("USE kindapp")
-    people := `CREATE TABLE IF NOT EXISTS person(first VARCHAR(50) NOT NULL,
-               last VARCHAR(50) NOT NULL, color VARCHAR(50) NOT NULL,
-               id INTEGER AUTO_INCREMENT, PRIMARY KEY (id))`
-    _, err = db.Exec(people)
-    if err != nil {
-        return fmt.Errorf("Error creating table people: ", err)
-    }
-    user := `CREATE TABLE IF NOT EXISTS user(username VARCHAR(50) NOT NULL,
-             password CHAR(128) NOT NULL, id INTEGER AUTO_INCREMENT,
-             salt BINARY(16) NOT NULL, PRIMARY KEY (id))`
-    _, err = db.Exec(user)
-    if err != nil {
-        return fmt.Errorf("Error creating table user: ", err)
-    }
-    session := `CREATE TABLE IF NOT EXISTS session(uuid VARCHAR(50) NOT NULL,
-                username VARCHAR(50) NOT NULL, PRIMARY KEY (uuid))`
-    _, err = db.Exec(session)
-    if err != nil {
-        return fmt.Errorf("Error creating table session: ", err)
-    }
-    post := `CREATE TABLE IF NOT EXISTS post(content VARCHAR(1000) NOT NULL,
-             author VARCHAR(50) NOT NULL, date DATETIME DEFAULT CURRENT_TIMESTAMP,
-             likes INTEGER NOT NULL DEFAULT 0, numcomments INTEGER NOT NULL DEFAULT 0,
-             id INTEGER AUTO_INCREMENT, PRIMARY KEY (id))`
-    _, err = db.Exec(post)
-    if err != nil {
-        return fmt.Errorf("Error creating table post: ", err)
-    }
-    comment := `CREATE TABLE IF NOT EXISTS comment(content VARCHAR(500) NOT NULL,
-                author VARCHAR(50) NOT NULL, date DATETIME DEFAULT CURRENT_TIMESTAMP,
-                likes INTEGER NOT NULL DEFAULT 0, post_id INT NOT NULL,
-                id INTEGER AUTO_INCREMENT,PRIMARY KEY (id),
-                FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE ON UPDATE CASCADE)`
-    _, err = db.Exec(comment)
-    if err != nil {
-        return fmt.Errorf("Error creating table comment: ", err)
-    }
+// Replaces a user's password hash and clears the legacy salt
+func UpdatePassword(username string, password string) error {
+    return store.UpdatePassword(username, password)
+}
 
-    fmt.Println("Database Connected!")
-    return nil
+// Returns a user's role
+func GetRole(username string) (string, error) {
+    return store.GetRole(username)
 }
 
-// Adds a user
-func Adduser(user User) error {
-    _, err := db.Exec("INSERT INTO user (username, password, salt) VALUES (?, ?, ?)",
-        user.Username, user.Password, user.Salt)
-    if err != nil {
-        return fmt.Errorf("Error inserting into user table: ", err)
-    }
-    return nil
+// Changes a user's role
+func SetRole(username string, role string) error {
+    return store.SetRole(username, role)
 }
 
-// Returns username given a uuid 
+// Returns a user's details without their password
+func GetUser(username string) (User, error) {
+    return store.GetUser(username)
+}
+
+// Lists users whose name contains search, ordered by name, without passwords
+func GetUsers(search string, limit int, offset int) ([]User, error) {
+    return store.GetUsers(search, limit, offset)
+}
+
+// Locks or unlocks a user
+func SetLocked(username string, locked bool) error {
+    return store.SetLocked(username, locked)
+}
+
+// Returns username given a uuid
 func GetUsername(uuid string) (string, error) {
-    var username string
-    row, err := db.Query("SELECT username FROM session WHERE uuid='"+uuid+"'")
-    if err != nil {
-        return "", fmt.Errorf("Error retrieving username from session uuid: ", err)
-    }
-    defer row.Close()
-    if row.Next() {
-        err = row.Scan(&username)
-        if err != nil {
-            return "", fmt.Errorf("Error reading rows from session table", err)
-        }
-        return username, nil
-    } else {
-        return "", fmt.Errorf("Session does not exist")
-    }
+    return store.GetUsername(uuid)
 }
 
 // Get user creds
 func GetCreds(username string) (string, []byte, error) {
-    var password string
-    var hash []byte
-    query := "SELECT password, salt FROM user WHERE username='" + username + "'"
-    rows, err := db.Query(query)
-    if err != nil {
-        return "", nil, fmt.Errorf("Error retrieving from user table: ", err)
-    }
-    defer rows.Close()
-    if rows.Next() {
-        err = rows.Scan(&password, &hash)
-        if err != nil {
-            return "", nil, fmt.Errorf("Error reading rows from user table: ", err)
-        }
-    } else {
-        return "", nil, fmt.Errorf("Username is incorrect.")
-    }
-    return password, hash, nil
+    return store.GetCreds(username)
+}
+
+// Adds a session for session.Username and returns its uuid
+func AddSession(session Session) (string, error) {
+    return store.AddSession(session)
+}
+
+// Retrieves a session by uuid
+func GetSession(uuid string) (Session, error) {
+    return store.GetSession(uuid)
+}
+
+// Lists a user's sessions, most recently used first
+func GetSessions(username string) ([]Session, error) {
+    return store.GetSessions(username)
+}
+
+// Records activity on a session
+func TouchSession(uuid string, lastSeen time.Time) error {
+    return store.TouchSession(uuid, lastSeen)
+}
+
+// Deletes a single session
+func DeleteSession(uuid string) error {
+    return store.DeleteSession(uuid)
+}
+
+// Deletes every session of a user
+func DeleteSessions(username string) error {
+    return store.DeleteSessions(username)
+}
+
+// Deletes sessions past their expiry or last seen before idleBefore
+func DeleteExpiredSessions(expiredBefore time.Time, idleBefore time.Time) (int64, error) {
+    return store.DeleteExpiredSessions(expiredBefore, idleBefore)
+}
+
+// Determines if a session id is valid or not
+func ValidSession(uuid string) (bool, error) {
+    return store.ValidSession(uuid)
+}
+
+// Stores a new refresh token
+func AddRefreshToken(token RefreshToken) error {
+    return store.AddRefreshToken(token)
 }
 
-// Adds a user's session
-func AddSession(username string) (string, error) {
-    err := DeleteSession(username)
+// Retrieves a refresh token by its hash
+func GetRefreshToken(id string) (RefreshToken, error) {
+    return store.GetRefreshToken(id)
+}
+
+// Lists a user's refresh tokens, including used ones
+func GetRefreshTokens(username string) ([]RefreshToken, error) {
+    return store.GetRefreshTokens(username)
+}
+
+// Marks a refresh token used, reporting false if it already was
+func UseRefreshToken(id string) (bool, error) {
+    return store.UseRefreshToken(id)
+}
+
+// Deletes every refresh token rotated from the same login
+func DeleteRefreshTokenFamily(family string) error {
+    return store.DeleteRefreshTokenFamily(family)
+}
+
+// Deletes every refresh token of a user
+func DeleteRefreshTokens(username string) error {
+    return store.DeleteRefreshTokens(username)
+}
+
+// Adds an access token id to the revocation list until it expires
+func RevokeToken(jti string, expiresAt time.Time) error {
+    return store.RevokeToken(jti, expiresAt)
+}
+
+// Determines if an access token id has been revoked
+func TokenRevoked(jti string) (bool, error) {
+    return store.TokenRevoked(jti)
+}
+
+// Deletes refresh tokens, revocations and personal access tokens that expired before a time
+func DeleteExpiredTokens(before time.Time) (int64, error) {
+    return store.DeleteExpiredTokens(before)
+}
+
+// Stores a personal access token and returns its id
+func AddPersonalToken(token PersonalToken) (string, error) {
+    return store.AddPersonalToken(token)
+}
+
+// Retrieves a personal access token by its hash
+func GetPersonalToken(hash string) (PersonalToken, error) {
+    return store.GetPersonalToken(hash)
+}
+
+// Lists a user's personal access tokens, newest first
+func GetPersonalTokens(username string) ([]PersonalToken, error) {
+    return store.GetPersonalTokens(username)
+}
+
+// Records use of a personal access token
+func TouchPersonalToken(id string, lastUsed time.Time) error {
+    return store.TouchPersonalToken(id, lastUsed)
+}
+
+// Deletes one of a user's personal access tokens
+func DeletePersonalToken(username string, id string) error {
+    return store.DeletePersonalToken(username, id)
+}
+
+// Deletes every personal access token of a user
+func DeletePersonalTokens(username string) error {
+    return store.DeletePersonalTokens(username)
+}
+
+// Adds a post, notifying the users it mentions
+func AddPost(content string, author string) (string, error) {
+    id, err := store.AddPost(content, author)
     if err != nil {
         return "", err
     }
-    var id string
-    for ; true; {
-        id = uuid.NewString()
-        row, _ := db.Query("SELECT * FROM session where uuid='"+id+"'")
-        if !row.Next() {
-            break
-        }
-    }
-    _, err = db.Exec("INSERT INTO session (uuid, username) VALUES (?, ?)", id, username)
+    publish(Event{Type: PostCreated, Entity: PostEntity, EntityId: id, PostId: id, Actor: author})
+    _, err = mention(PostEntity, id, id, content, author)
     if err != nil {
-        return "", fmt.Errorf("Error inserting into session table: ", err)
+        fmt.Println(err)
     }
     return id, nil
 }
 
-// Deletes a user's session
-func DeleteSession(username string) error {
-    _, err := db.Exec("DELETE FROM session WHERE username='"+username+"'")
-    if err != nil {
-        return fmt.Errorf("Error removing previous session for user "+username+": ", err)
+// Permanently deletes a post and its comments
+func DeletePost(id string) error {
+    err := store.DeletePost(id)
+    if err == nil {
+        publish(Event{Type: PostDeleted, Entity: PostEntity, EntityId: id, PostId: id})
     }
-    return nil
+    return err
 }
 
-// Determines if a session id is valid or not
-func ValidSession(uuid string) (bool, error) {
-    row, err := db.Query("SELECT uuid FROM session WHERE uuid='"+uuid+"'")
-    if err != nil {
-        return false, fmt.Errorf("Error retrieving session: ", err)
+// Moves a post or comment to the trash, hiding it until it is restored or purged
+func TrashContent(entity Entity, id string, actor string) error {
+    err := store.TrashContent(entity, id, actor)
+    if err == nil {
+        publishChange(changeType(entity, "deleted"), entity, id, actor)
     }
-    defer row.Close()
-    if row.Next() {
-        var id string
-        err = row.Scan(&id)
-        if err != nil {
-            return false, fmt.Errorf("Error reading from session rows: ", err)
-        }
-        if uuid == id {
-            return true, nil
-        }
+    return err
+}
+
+// Takes a post or comment back out of the trash
+func RestoreContent(entity Entity, id string) error {
+    err := store.RestoreContent(entity, id)
+    if err == nil {
+        publishChange(changeType(entity, "created"), entity, id, "")
     }
-    return false, nil
+    return err
 }
 
-// Adds a post
-func AddPost(content string, author string) (string, error) {
-    result, err := db.Exec("INSERT INTO post (content, author) VALUES (?, ?)", content, author)
-    id, _ := result.LastInsertId()
-    return strconv.FormatInt(id, 10), err
+// Returns posts and comments in the trash, most recently deleted first. author
+// limits them to one user's content unless it is empty.
+func GetTrash(author string) ([]TrashItem, error) {
+    return store.GetTrash(author)
 }
 
-// Deletes a post
-func DeletePost(id string) error {
-    _, err := db.Exec("DELETE FROM post WHERE id='"+id+"'")
-    return err
+// Returns a post or comment in the trash
+func GetTrashItem(entity Entity, id string) (TrashItem, error) {
+    return store.GetTrashItem(entity, id)
 }
 
-// Adds a comment to a post
-func AddComment(content string, author string, post_id string) (string, error) {
-    result, err := db.Exec("INSERT INTO comment (content, author, post_id) VALUES (?, ?, ?)",
-        content, author, post_id)
+// Permanently deletes posts and comments that went in the trash before a time
+func PurgeTrash(before time.Time) (int64, error) {
+    return store.PurgeTrash(before)
+}
+
+// Orders trash most recently deleted first
+func sortTrash(items []TrashItem) {
+    sort.SliceStable(items, func(i, j int) bool {
+        return items[i].DeletedAt.After(items[j].DeletedAt)
+    })
+}
+
+// Replaces the content of a post or comment, keeping the previous version as a
+// revision, and notifies the users newly mentioned
+func EditContent(entity Entity, id string, content string, editor string) error {
+    err := store.EditContent(entity, id, content, editor)
     if err != nil {
-        return "", fmt.Errorf("Error inserting into comment table: ", err)
+        return err
+    }
+    postID, err := postOf(entity, id)
+    if err == nil {
+        publish(Event{Type: changeType(entity, "updated"), Entity: entity, EntityId: id, PostId: postID, Actor: editor})
+        _, err = mention(entity, id, postID, content, editor)
     }
-    id, _ := result.LastInsertId()
+    if err != nil {
+        fmt.Println(err)
+    }
+    return nil
+}
+
+// Returns the replaced versions of a post or comment, oldest first
+func GetRevisions(entity Entity, id string) ([]Revision, error) {
+    return store.GetRevisions(entity, id)
+}
 
-    // Update number of comments on post
-    var numComments int
-    row, err := db.Query("SELECT numcomments FROM post WHERE id='"+post_id+"'")
+// Adds a comment to a post, notifying the users it mentions, the post's author
+// and the other commenters
+func AddComment(content string, author string, post_id string) (string, error) {
+    id, err := store.AddComment(content, author, post_id)
     if err != nil {
-        return "", fmt.Errorf("Error inserting into comment table: ", err)
+        return "", err
     }
-    defer row.Close()
-    if row.Next() {
-        row.Scan(&numComments)
+    publish(Event{Type: CommentCreated, Entity: CommentEntity, EntityId: id, PostId: post_id, Actor: author})
+    mentioned, err := mention(CommentEntity, id, post_id, content, author)
+    if err == nil {
+        err = notifyComment(id, post_id, author, mentioned)
     }
-    numComments++
-    db.Exec("USE kindapp")
-    _, err = db.Exec("UPDATE post SET numcomments="+strconv.Itoa(numComments)+
-        " WHERE id='"+post_id+"'")
     if err != nil {
         fmt.Println(err)
     }
-    return strconv.FormatInt(id, 10), err
+    return id, nil
 }
 
-// Deletes a comment from a post
+// Permanently deletes a comment from a post
 func DeleteComment(id string) error {
-    var numComments int
-    postID, err := GetPostIDFromCommentID(id)
+    postID, err := store.GetPostIDFromCommentID(id)
     if err != nil {
         return err
     }
+    err = store.DeleteComment(id)
+    if err == nil {
+        publish(Event{Type: CommentDeleted, Entity: CommentEntity, EntityId: id, PostId: postID})
+    }
+    return err
+}
 
-    post, err := GetPost(postID)
+// Likes a post or comment as username, or takes back their like, notifying
+// the author of new likes
+func Like(username string, entity Entity, id string) (Votes, error) {
+    votes, err := store.Vote(username, entity, id, Liked)
     if err != nil {
-        return err
+        return votes, err
     }
-    numComments = post.NumComments
-    numComments--
-    db.Exec("USE kindapp")
-    _, err = db.Exec("UPDATE post SET numcomments="+strconv.Itoa(numComments)+
-        " WHERE id='"+postID+"'")
-    if err != nil {
-        return fmt.Errorf("Error updating number of comments on post: ", err.Error())
+    publishChange(ReactionChanged, entity, id, username)
+    if votes.Vote != Liked {
+        return votes, nil
     }
-    _, err = db.Exec("DELETE FROM comment WHERE id='"+id+"'")
+    err = notifyAuthor(ReactionNotification, entity, id, username, "like")
     if err != nil {
-        return fmt.Errorf("Error deleting from number of comments on post: ", err.Error())
+        fmt.Println(err)
     }
-    return nil
+    return votes, nil
+}
+
+// Dislikes a post or comment as username, or takes back their dislike
+func Dislike(username string, entity Entity, id string) (Votes, error) {
+    votes, err := store.Vote(username, entity, id, Disliked)
+    if err == nil {
+        publishChange(ReactionChanged, entity, id, username)
+    }
+    return votes, err
 }
 
-// Likes a post or comment
-func Like(entity string, id string) error {
-    num_likes, err := GetLikes(entity, id)
-    num_likes++
+// Returns a user's votes on every post or comment they voted on, keyed by id
+func GetVotes(username string, entity Entity) (map[string]int, error) {
+    return store.GetVotes(username, entity)
+}
+
+// Sets Vote on posts and their comments to username's vote
+func MarkVotes(username string, posts []Post) error {
+    votes, err := store.GetVotes(username, PostEntity)
     if err != nil {
         return err
     }
-    _, err = db.Exec("UPDATE "+entity+" SET likes="+strconv.Itoa(num_likes)+
-        " WHERE id='"+id+"'")
-    return err
+    for i := range posts {
+        posts[i].Vote = votes[posts[i].Id]
+        err = MarkCommentVotes(username, posts[i].Comments)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-// Dislikes a post or comment
-func Dislike(entity string, id string) error {
-    num_likes, err := GetLikes(entity, id)
+// Sets Vote on comments to username's vote
+func MarkCommentVotes(username string, comments []Comment) error {
+    if len(comments) == 0 {
+        return nil
+    }
+    votes, err := store.GetVotes(username, CommentEntity)
     if err != nil {
         return err
     }
-    if num_likes > 0 {
-        num_likes--
+    for i := range comments {
+        comments[i].Vote = votes[comments[i].Id]
     }
-    _, err = db.Exec("UPDATE "+entity+" SET likes="+strconv.Itoa(num_likes)+
-        " WHERE id='"+id+"'")
-    return err
+    return nil
 }
 
 // Get all posts in the system
 func GetAllPosts() ([]Post, error) {
-    var posts []Post
-    rows, err := db.Query("SELECT content, author, date, likes, numcomments, id FROM post ORDER BY date DESC")
-    if err != nil {
-        return nil, fmt.Errorf("Error retrieving from post table: ", err)
-    }
-    defer rows.Close()
-    for rows.Next() {
-        var post Post
-        err = rows.Scan(&post.Content, &post.Author, &post.Date, &post.Likes, &post.NumComments, &post.Id)
-        if err != nil {
-            return nil, fmt.Errorf("Error reading data: ", err)
-        }
-        posts = append(posts, post)
-    }
-    return posts, nil
+    return store.GetAllPosts()
 }
 
 // Get comments for a given post
 func GetComments(id string) ([]Comment, error) {
-    var comments []Comment
-    rows, err := db.Query("SELECT content, author, date, likes, id FROM comment WHERE post_id='"+
-        id+"'"+" ORDER BY date DESC")
+    return store.GetComments(id)
+}
+
+// Gets up to limit posts, newest first, following the page cursor. Returns the
+// cursor of the next page, empty on the last page.
+func GetPostsPage(cursor string, limit int) ([]Post, string, error) {
+    return postsPage("", cursor, limit)
+}
+
+// Gets a page of posts, only those using tag unless it is empty
+func postsPage(tag string, cursor string, limit int) ([]Post, string, error) {
+    after, err := ParseCursor(cursor)
     if err != nil {
-        return nil, fmt.Errorf("Error retrieving from comment table: ", err)
+        return nil, "", err
     }
-    defer rows.Close()
-    for rows.Next() {
-        var comment Comment
-        err = rows.Scan(&comment.Content, &comment.Author, &comment.Date, &comment.Likes, &comment.Id)
-        if err != nil {
-            return nil, fmt.Errorf("Error reading data: ", err)
-        }
-        comments = append(comments, comment)
+    limit, err = pageSize(limit)
+    if err != nil {
+        return nil, "", err
     }
-    return comments, nil
+    posts, err := store.GetPostsAfter(tag, after, limit + 1)
+    if err != nil || len(posts) <= limit {
+        return posts, "", err
+    }
+    posts = posts[:limit]
+    last := posts[limit - 1]
+    return posts, cursorAfter(last.Date, last.Id).String(), nil
 }
 
-// Retrieves a post with a given id
-func GetPost(id string) (Post, error) {
-    var post Post
-    row, err := db.Query("SELECT content, author, date, likes, numcomments, id FROM post WHERE id='"+id+"'")
+// Gets up to limit comments on a post, newest first, following the page cursor.
+// Returns the cursor of the next page, empty on the last page.
+func GetCommentsPage(postID string, cursor string, limit int) ([]Comment, string, error) {
+    after, err := ParseCursor(cursor)
     if err != nil {
-        return post, fmt.Errorf("Error retrieving from post table: ", err)
+        return nil, "", err
     }
-    defer row.Close()
-    if row.Next() {
-        err = row.Scan(&post.Content, &post.Author, &post.Date, &post.Likes, &post.NumComments, &post.Id)
-        if err != nil {
-            return post, fmt.Errorf("Error reading data: ", err)
-        }
-    } else {
-        return post, fmt.Errorf("Post "+id+" does not exist.")
+    limit, err = pageSize(limit)
+    if err != nil {
+        return nil, "", err
     }
-    return post, nil
+    comments, err := store.GetCommentsAfter(postID, after, limit + 1)
+    if err != nil || len(comments) <= limit {
+        return comments, "", err
+    }
+    comments = comments[:limit]
+    last := comments[limit - 1]
+    return comments, cursorAfter(last.Date, last.Id).String(), nil
 }
 
-// Gets the author of a post or comment
-func GetAuthor(entity string, id string) (string, error) {
-    var author string
-    row, err := db.Query("SELECT author FROM "+entity+" WHERE id='"+id+"'")
+// Finds up to limit posts and comments matching a search such as
+// `deploy "release notes" author:alice before:2024-01-01`, best match first and
+// with their matches highlighted
+func Search(q string, limit int) ([]SearchResult, error) {
+    query, err := ParseSearch(q)
     if err != nil {
-        return "", err
+        return nil, err
     }
-    defer row.Close()
-    if row.Next() {
-        err = row.Scan(&author)
-        if err != nil {
-            return "", fmt.Errorf("Error reading from author rows: ", err)
-        }
-    } else {
-        return "", fmt.Errorf(entity+" with id:"+id+" does not exist")
+    limit, err = pageSize(limit)
+    if err != nil {
+        return nil, err
     }
-    return author, nil
+    results, err := store.Search(query, limit)
+    if err != nil {
+        return nil, err
+    }
+    for i := range results {
+        results[i].Highlight = highlight(results[i].Content, query)
+    }
+    return results, nil
+}
+
+// Retrieves a post with a given id
+func GetPost(id string) (Post, error) {
+    return store.GetPost(id)
 }
 
+// Retrieves a comment with a given id
+func GetComment(id string) (Comment, error) {
+    return store.GetComment(id)
+}
+
+// Gets the author of a post or comment
+func GetAuthor(entity Entity, id string) (string, error) {
+    return store.GetAuthor(entity, id)
+}
 
 // Gets the post id from a comment id
 func GetPostIDFromCommentID(commentID string) (string, error) {
-    var postID string
-    row, err := db.Query("SELECT post_id FROM comment WHERE id='"+commentID+"'")
+    return store.GetPostIDFromCommentID(commentID)
+}
+
+// Returns the number of likes associate with a post or comment
+func GetLikes(entity Entity, id string) (int, error) {
+    return store.GetLikes(entity, id)
+}
+
+// Adds a user's emoji reaction to a post or comment, notifying its author
+func AddReaction(username string, entity Entity, id string, emoji string) error {
+    err := store.AddReaction(username, entity, id, emoji)
     if err != nil {
-        return "", err
+        return err
     }
-    defer row.Close()
-    if row.Next() {
-        err = row.Scan(&postID)
-        if err != nil {
-            return "", fmt.Errorf("Error reading from comment rows: ", err)
-        }
-    } else {
-        return "", fmt.Errorf("Comment "+commentID+" cannot be linked to a post")
+    publishChange(ReactionChanged, entity, id, username)
+    err = notifyAuthor(ReactionNotification, entity, id, username, emoji)
+    if err != nil {
+        fmt.Println(err)
     }
-    return postID, nil
+    return nil
 }
 
-// Returns the number of likes associate with a post or comment
-func GetLikes(entity string, id string) (int, error) {
-    var numLikes int
-    row, err := db.Query("SELECT likes FROM "+entity+" WHERE id='"+id+"'")
-    if err != nil {
-        return 0, err
+// Removes a user's emoji reaction from a post or comment
+func RemoveReaction(username string, entity Entity, id string, emoji string) error {
+    err := store.RemoveReaction(username, entity, id, emoji)
+    if err == nil {
+        publishChange(ReactionChanged, entity, id, username)
     }
-    defer row.Close()
-    if row.Next() {
-        err = row.Scan(&numLikes)
+    return err
+}
+
+// Returns the emoji reactions to a post or comment, in the order each emoji was first used
+func GetReactions(entity Entity, id string) ([]Reaction, error) {
+    return store.GetReactions(entity, id)
+}
+
+// Sets Reactions on posts and their comments, marking those by username
+func LoadReactions(username string, posts []Post) error {
+    for i := range posts {
+        reactions, err := store.GetReactions(PostEntity, posts[i].Id)
+        if err != nil {
+            return err
+        }
+        posts[i].Reactions = MarkReacted(username, reactions)
+        err = LoadCommentReactions(username, posts[i].Comments)
         if err != nil {
-            return 0, fmt.Errorf("Error reading from "+entity+" row: ", err)
+            return err
         }
-    } else {
-        return 0, fmt.Errorf(entity+" with id:"+id+" not found")
     }
-    return numLikes, nil
+    return nil
 }
 
-// Gets people
-func Getpeople()([]Person, error) {
-    var people []Person
+// Sets Reactions on comments, marking those by username
+func LoadCommentReactions(username string, comments []Comment) error {
+    for i := range comments {
+        reactions, err := store.GetReactions(CommentEntity, comments[i].Id)
+        if err != nil {
+            return err
+        }
+        comments[i].Reactions = MarkReacted(username, reactions)
+    }
+    return nil
+}
 
-    rows, err := db.Query("SELECT first, last, color FROM person")
-    if err != nil {
-        return nil, fmt.Errorf("Error retrieving from person table: ", err)
+// Sets Reacted on the reactions username is one of the users of
+func MarkReacted(username string, reactions []Reaction) []Reaction {
+    for i := range reactions {
+        for _, user := range reactions[i].Users {
+            reactions[i].Reacted = reactions[i].Reacted || user == username
+        }
     }
-    defer rows.Close()
-    for rows.Next() {
-        var person Person
-        err = rows.Scan(&person.First, &person.Last, &person.Color)
-        if err != nil {
-            return nil, fmt.Errorf("Error reading data: ", err)
+    return reactions
+}
+
+// Groups username and emoji pairs, ordered by when they reacted, into reactions
+func groupReactions(users []string, emoji []string) []Reaction {
+    reactions := []Reaction{}
+    index := make(map[string]int)
+    for i, e := range emoji {
+        n, ok := index[e]
+        if !ok {
+            n = len(reactions)
+            index[e] = n
+            reactions = append(reactions, Reaction{Emoji: e})
         }
-        people = append(people, person)
+        reactions[n].Count++
+        reactions[n].Users = append(reactions[n].Users, users[i])
     }
-    return people, nil
+    return reactions
 }
 
-// Adds a person
-func Addperson(person Person) error {
-    _, err := db.Exec("INSERT INTO person (first, last, color) VALUES (?, ?, ?)",
-        person.First, person.Last, person.Color)
+// Hides or shows a post or comment, recording who hid it
+func SetHidden(entity Entity, id string, hidden bool, actor string) error {
+    err := store.SetHidden(entity, id, hidden, actor)
+    if err == nil {
+        publishChange(changeType(entity, "updated"), entity, id, actor)
+    }
+    return err
+}
+
+// Records a moderation action, notifying the author of the post or comment acted on
+func AddModerationEntry(entry ModerationEntry) error {
+    err := store.AddModerationEntry(entry)
     if err != nil {
-        return fmt.Errorf("Error inserting into person table: ", err)
+        return err
+    }
+    // Actions on accounts rather than content are not notified
+    entity, err := ParseEntity(entry.Entity)
+    if err != nil {
+        return nil
+    }
+    postID, err := postOf(entity, entry.EntityId)
+    if err == nil {
+        err = notify(Notification{
+            Username: entry.Author,
+            Kind: ModerationNotification,
+            Actor: entry.Actor,
+            Entity: entity,
+            EntityId: entry.EntityId,
+            PostId: postID,
+            Detail: entry.Action,
+        })
+    }
+    if err != nil {
+        fmt.Println(err)
     }
     return nil
 }
+
+// Returns the most recent moderation actions, newest first
+func GetModerationLog(limit int) ([]ModerationEntry, error) {
+    return store.GetModerationLog(limit)
+}
+
+// Gets people
+func Getpeople()([]Person, error) {
+    return store.Getpeople()
+}
+
+// Adds a person
+func Addperson(person Person) error {
+    return store.Addperson(person)
+}
@@ -0,0 +1,1202 @@
+package db
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+// Classic SQL injection payloads thrown at every exported function
+var payloads = []string{
+    "' OR '1'='1",
+    "' OR 1=1 --",
+    "\" OR \"\"=\"",
+    "admin'--",
+    "1 OR 1=1",
+    "1' OR '1'='1",
+    "1) OR (1=1",
+    "1; DROP TABLE post; --",
+    "1'; DROP TABLE user; --",
+    "'; DELETE FROM session; --",
+    "'; UPDATE post SET likes=9999; --",
+    "1 UNION SELECT username, password, salt, 1, 1, 1 FROM user --",
+    "post SET likes=9999 WHERE 1=1; --",
+    "comment WHERE 1=1 UNION SELECT password FROM user --",
+    "%' OR 'x' LIKE '%",
+    "\\'; DROP TABLE comment; --",
+    "1 AND SLEEP(5)",
+    "0x27204f52202731273d2731",
+}
+
+// Stores under test, MySQL is included when KINDAPP_TEST_MYSQL_URL is set
+func testStores(t *testing.T) map[string]func() Store {
+    stores := map[string]func() Store{
+        "memory": NewMemoryStore,
+        "sqlite": func() Store {
+            s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            return s
+        },
+    }
+    if addr := os.Getenv("KINDAPP_TEST_MYSQL_URL"); addr != "" {
+        stores["mysql"] = func() Store {
+            s, err := NewMySQLStore(addr, "root", os.Getenv("KINDAPP_TEST_MYSQL_PASSWORD"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            return s
+        }
+    }
+    return stores
+}
+
+// Rows created before the payloads are thrown
+type fixture struct {
+    session string
+    postID string
+    commentID string
+}
+
+func seed(t *testing.T) fixture {
+    var f fixture
+    err := Adduser(User{Username: "alice", Password: "hash", Salt: make([]byte, 16)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.session, err = AddSession(Session{Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.postID, err = AddPost("original post", "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.commentID, err = AddComment("original comment", "alice", f.postID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return f
+}
+
+// Fails if the seeded rows were modified or removed
+func assertIntact(t *testing.T, f fixture, payload string) {
+    t.Helper()
+    password, _, err := GetCreds("alice")
+    if err != nil || password != "hash" {
+        t.Fatalf("payload %q: user table changed: %q %v", payload, password, err)
+    }
+    valid, err := ValidSession(f.session)
+    if err != nil || !valid {
+        t.Fatalf("payload %q: session table changed: %v", payload, err)
+    }
+    post, err := GetPost(f.postID)
+    if err != nil || post.Content != "original post" || post.Likes != 0 {
+        t.Fatalf("payload %q: post table changed: %+v %v", payload, post, err)
+    }
+    likes, err := GetLikes(CommentEntity, f.commentID)
+    if err != nil || likes != 0 {
+        t.Fatalf("payload %q: comment table changed: %d %v", payload, likes, err)
+    }
+}
+
+func TestParseEntityRejectsUnknownNames(t *testing.T) {
+    for _, name := range []string{"post", "comment"} {
+        entity, err := ParseEntity(name)
+        if err != nil || entity.String() != name {
+            t.Errorf("ParseEntity(%q) = %v, %v", name, entity, err)
+        }
+    }
+    for _, name := range append(payloads, "", "user", "session", "Post", "post ") {
+        if _, err := ParseEntity(name); err == nil {
+            t.Errorf("ParseEntity(%q) accepted an unknown entity", name)
+        }
+    }
+    for name, open := range testStores(t) {
+        s := open()
+        if _, err := s.GetLikes(Entity{}, "1"); err == nil {
+            t.Errorf("%s: GetLikes accepted the zero Entity", name)
+        }
+        s.Close()
+    }
+}
+
+func TestInjectionPayloads(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            Use(s)
+            f := seed(t)
+
+            for _, p := range payloads {
+                // Lookups must treat the payload as a literal value
+                if _, err := GetUsername(p); err == nil {
+                    t.Errorf("GetUsername(%q) found a session", p)
+                }
+                if valid, _ := ValidSession(p); valid {
+                    t.Errorf("ValidSession(%q) = true", p)
+                }
+                if _, _, err := GetCreds(p); err == nil {
+                    t.Errorf("GetCreds(%q) found a user", p)
+                }
+                if _, err := GetSession(p); err == nil {
+                    t.Errorf("GetSession(%q) found a session", p)
+                }
+                if sessions, _ := GetSessions(p); len(sessions) > 0 {
+                    t.Errorf("GetSessions(%q) returned %d sessions", p, len(sessions))
+                }
+                TouchSession(p, time.Now())
+                if _, err := GetPost(p); err == nil {
+                    t.Errorf("GetPost(%q) found a post", p)
+                }
+                if comments, err := GetComments(p); err == nil && len(comments) > 0 {
+                    t.Errorf("GetComments(%q) returned %d comments", p, len(comments))
+                }
+                if _, err := GetPostIDFromCommentID(p); err == nil {
+                    t.Errorf("GetPostIDFromCommentID(%q) found a comment", p)
+                }
+                for _, entity := range []Entity{PostEntity, CommentEntity} {
+                    if _, err := GetAuthor(entity, p); err == nil {
+                        t.Errorf("GetAuthor(%v, %q) found an author", entity, p)
+                    }
+                    if _, err := GetLikes(entity, p); err == nil {
+                        t.Errorf("GetLikes(%v, %q) found an entity", entity, p)
+                    }
+                    if _, err := Like("alice", entity, p); err == nil {
+                        t.Errorf("Like(%v, %q) succeeded", entity, p)
+                    }
+                    if _, err := Dislike("alice", entity, p); err == nil {
+                        t.Errorf("Dislike(%v, %q) succeeded", entity, p)
+                    }
+                }
+                assertIntact(t, f, p)
+
+                // Deletes must not match anything
+                DeleteSession(p)
+                DeleteSessions(p)
+                DeletePost(p)
+                DeleteComment(p)
+                assertIntact(t, f, p)
+
+                // Writes must store the payload verbatim
+                if err := Adduser(User{Username: p, Password: p, Salt: make([]byte, 16)}); err != nil {
+                    t.Fatalf("Adduser(%q): %v", p, err)
+                }
+                if password, _, err := GetCreds(p); err != nil || password != p {
+                    t.Errorf("GetCreds(%q) = %q, %v", p, password, err)
+                }
+                session, err := AddSession(Session{Username: p, UserAgent: p, IP: p, ExpiresAt: time.Now().Add(time.Hour)})
+                if err != nil {
+                    t.Fatalf("AddSession(%q): %v", p, err)
+                }
+                if username, err := GetUsername(session); err != nil || username != p {
+                    t.Errorf("GetUsername for %q session = %q, %v", p, username, err)
+                }
+                id, err := AddPost(p, p)
+                if err != nil {
+                    t.Fatalf("AddPost(%q): %v", p, err)
+                }
+                if post, err := GetPost(id); err != nil || post.Content != p || post.Author != p {
+                    t.Errorf("GetPost after AddPost(%q) = %+v, %v", p, post, err)
+                }
+                if _, err := AddComment(p, p, p); err == nil {
+                    t.Errorf("AddComment with post id %q succeeded", p)
+                }
+                commentID, err := AddComment(p, p, id)
+                if err != nil {
+                    t.Fatalf("AddComment(%q): %v", p, err)
+                }
+                if author, err := GetAuthor(CommentEntity, commentID); err != nil || author != p {
+                    t.Errorf("GetAuthor after AddComment(%q) = %q, %v", p, author, err)
+                }
+                if err := Addperson(Person{First: p, Last: p, Color: p}); err != nil {
+                    t.Fatalf("Addperson(%q): %v", p, err)
+                }
+                assertIntact(t, f, p)
+
+                // Clean up through the regular paths
+                if err := DeleteComment(commentID); err != nil {
+                    t.Errorf("DeleteComment(%s): %v", commentID, err)
+                }
+                if err := DeletePost(id); err != nil {
+                    t.Errorf("DeletePost(%s): %v", id, err)
+                }
+                if sessions, err := GetSessions(p); err != nil || len(sessions) != 1 || sessions[0].UserAgent != p {
+                    t.Errorf("GetSessions(%q) = %+v, %v", p, sessions, err)
+                }
+                if err := DeleteSessions(p); err != nil {
+                    t.Errorf("DeleteSessions(%q): %v", p, err)
+                }
+                assertIntact(t, f, p)
+            }
+
+            people, err := Getpeople()
+            if err != nil || len(people) != len(payloads) {
+                t.Errorf("Getpeople() returned %d people, %v", len(people), err)
+            }
+            posts, err := GetAllPosts()
+            if err != nil || len(posts) != 1 {
+                t.Errorf("GetAllPosts() returned %d posts, %v", len(posts), err)
+            }
+        })
+    }
+}
+
+// Publishes one event from each of two replicas and checks both have both
+// delivered with the same ids, in order
+func assertBroadcast(t *testing.T, replicas [2]Broadcaster) {
+    t.Helper()
+    received := [2]chan Event{make(chan Event, 10), make(chan Event, 10)}
+    for i, b := range replicas {
+        events := received[i]
+        _, err := b.Listen(func(e Event) { events <- e })
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer b.Close()
+    }
+    published := []Event{
+        {Type: PostCreated, Entity: PostEntity, EntityId: "1", PostId: "1", Actor: "alice", Date: now()},
+        {Type: CommentCreated, Entity: CommentEntity, EntityId: "2", PostId: "1", Actor: "bob", Date: now()},
+    }
+    for i, e := range published {
+        err := replicas[i].Publish(e)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    var ids [2][]int64
+    for i := range replicas {
+        for j, want := range published {
+            select {
+            case e := <-received[i]:
+                if e.Type != want.Type || e.Entity != want.Entity || e.EntityId != want.EntityId || e.Actor != want.Actor {
+                    t.Fatalf("replica %d received %+v, want %+v", i, e, want)
+                }
+                if j > 0 && e.Id <= ids[i][j-1] {
+                    t.Fatalf("replica %d received id %d after %d", i, e.Id, ids[i][j-1])
+                }
+                ids[i] = append(ids[i], e.Id)
+            case <-time.After(5 * time.Second):
+                t.Fatalf("replica %d did not receive %s", i, want.Type)
+            }
+        }
+    }
+    if ids[0][0] != ids[1][0] || ids[0][1] != ids[1][1] {
+        t.Fatalf("replicas received different ids: %v", ids)
+    }
+}
+
+func TestBroadcastersDeliverToEveryReplica(t *testing.T) {
+    t.Run("local", func(t *testing.T) {
+        hub := NewLocalHub()
+        assertBroadcast(t, [2]Broadcaster{hub.Broadcaster(), hub.Broadcaster()})
+    })
+    for name, open := range testStores(t) {
+        t.Run("outbox/"+name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            interval := 10 * time.Millisecond
+            assertBroadcast(t, [2]Broadcaster{NewOutboxBroadcaster(interval), NewOutboxBroadcaster(interval)})
+        })
+    }
+}
+
+func TestWebhookFailuresKeepOwnerChanges(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+
+            err := Adduser(User{Username: "alice", Password: "x"})
+            if err != nil {
+                t.Fatal(err)
+            }
+            id, err := AddWebhook(Webhook{Username: "alice", URL: "https://example.com/a", Secret: "s",
+                Events: []string{PostCreated}, Enabled: true})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // The owner changes the webhook while an attempt is in flight
+            webhook, err := GetWebhook(id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            webhook.URL = "https://example.com/b"
+            webhook.Events = []string{CommentCreated}
+            err = UpdateWebhook(webhook)
+            if err != nil {
+                t.Fatal(err)
+            }
+            disabled, err := RecordWebhookFailure(id, 2)
+            if err != nil || disabled {
+                t.Fatalf("First failure returned %v, %v", disabled, err)
+            }
+            webhook, _ = GetWebhook(id)
+            if webhook.URL != "https://example.com/b" || len(webhook.Events) != 1 || webhook.Events[0] != CommentCreated ||
+                webhook.Failures != 1 || !webhook.Enabled {
+                t.Fatalf("Failure changed the owner's webhook: %+v", webhook)
+            }
+            disabled, err = RecordWebhookFailure(id, 2)
+            if err != nil || !disabled {
+                t.Fatalf("Failure at the limit returned %v, %v", disabled, err)
+            }
+            webhook, _ = GetWebhook(id)
+            if webhook.Enabled || webhook.DisabledAt.IsZero() || webhook.URL != "https://example.com/b" {
+                t.Fatalf("Webhook was not disabled at the limit: %+v", webhook)
+            }
+            disabled, _ = RecordWebhookFailure(id, 2)
+            if disabled {
+                t.Error("Disabled webhook was reported disabled again")
+            }
+
+            // A webhook the owner turned off stays off, and success only resets failures
+            webhook.Enabled = true
+            webhook.Failures = 0
+            webhook.DisabledAt = time.Time{}
+            UpdateWebhook(webhook)
+            RecordWebhookFailure(id, 2)
+            webhook.Enabled = false
+            UpdateWebhook(webhook)
+            err = ResetWebhookFailures(id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            webhook, _ = GetWebhook(id)
+            if webhook.Enabled || webhook.Failures != 0 {
+                t.Errorf("Reset changed the owner's webhook: %+v", webhook)
+            }
+            if _, err = RecordWebhookFailure("999", 2); err == nil {
+                t.Error("Failure recorded for a missing webhook")
+            }
+        })
+    }
+}
+
+func TestVotesToggleAndSwitch(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            for _, entity := range []Entity{PostEntity, CommentEntity} {
+                id := f.postID
+                if entity == CommentEntity {
+                    id = f.commentID
+                }
+                for _, step := range []struct {
+                    name string
+                    vote func(username string, entity Entity, id string) (Votes, error)
+                    want Votes
+                }{
+                    {"like", Like, Votes{Likes: 1, Vote: Liked}},
+                    {"like again", Like, Votes{}},
+                    {"like", Like, Votes{Likes: 1, Vote: Liked}},
+                    {"dislike", Dislike, Votes{Dislikes: 1, Vote: Disliked}},
+                    {"like", Like, Votes{Likes: 1, Vote: Liked}},
+                    {"dislike", Dislike, Votes{Dislikes: 1, Vote: Disliked}},
+                    {"dislike again", Dislike, Votes{}},
+                } {
+                    votes, err := step.vote("bob", entity, id)
+                    if err != nil || votes != step.want {
+                        t.Fatalf("%s %s returned %+v, %v, expected %+v", step.name, entity, votes, err, step.want)
+                    }
+                }
+
+                // Each user has their own vote
+                Like("bob", entity, id)
+                votes, err := Like("carol", entity, id)
+                if err != nil || votes != (Votes{Likes: 2, Vote: Liked}) {
+                    t.Fatalf("Second like of %s returned %+v, %v", entity, votes, err)
+                }
+                votes, err = Dislike("bob", entity, id)
+                if err != nil || votes != (Votes{Likes: 1, Dislikes: 1, Vote: Disliked}) {
+                    t.Fatalf("Switched vote on %s returned %+v, %v", entity, votes, err)
+                }
+                mine, err := GetVotes("bob", entity)
+                if err != nil || len(mine) != 1 || mine[id] != Disliked {
+                    t.Errorf("GetVotes(bob, %s) returned %v, %v", entity, mine, err)
+                }
+            }
+            post, err := GetPost(f.postID)
+            if err != nil || post.Likes != 1 || post.Dislikes != 1 {
+                t.Errorf("Post counts %d likes and %d dislikes: %v", post.Likes, post.Dislikes, err)
+            }
+            comment, err := GetComment(f.commentID)
+            if err != nil || comment.Likes != 1 || comment.Dislikes != 1 {
+                t.Errorf("Comment counts %d likes and %d dislikes: %v", comment.Likes, comment.Dislikes, err)
+            }
+        })
+    }
+}
+
+func TestEditContentKeepsRevisions(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            err := EditContent(PostEntity, f.postID, "edited post", "bob")
+            if err != nil {
+                t.Fatal(err)
+            }
+            post, _ := GetPost(f.postID)
+            revisions, err := GetRevisions(PostEntity, f.postID)
+            if err != nil || len(revisions) != 1 || revisions[0].Content != "original post" || revisions[0].Editor != "alice" ||
+                !revisions[0].CreatedAt.Equal(post.Date) {
+                t.Fatalf("First edit kept %+v, %v", revisions, err)
+            }
+            if post.Content != "edited post" || post.EditedBy != "bob" || post.EditedAt.IsZero() {
+                t.Fatalf("Edit was not stored: %+v", post)
+            }
+
+            // Saving the same content again, or only changing its case, is an edit too
+            for _, content := range []string{"edited post", "EDITED POST"} {
+                err = EditContent(PostEntity, f.postID, content, "alice")
+                if err != nil {
+                    t.Fatalf("Editing to %q failed: %v", content, err)
+                }
+            }
+            revisions, _ = GetRevisions(PostEntity, f.postID)
+            if len(revisions) != 3 || revisions[1].Content != "edited post" || revisions[1].Editor != "bob" ||
+                revisions[2].Content != "edited post" || revisions[2].Editor != "alice" {
+                t.Fatalf("Revisions of repeated edits are %+v", revisions)
+            }
+            post, _ = GetPost(f.postID)
+            if post.Content != "EDITED POST" {
+                t.Fatalf("Edit changing case stored %q", post.Content)
+            }
+
+            err = EditContent(CommentEntity, f.commentID, "edited comment", "alice")
+            if err != nil {
+                t.Fatal(err)
+            }
+            revisions, _ = GetRevisions(CommentEntity, f.commentID)
+            comment, _ := GetComment(f.commentID)
+            if len(revisions) != 1 || revisions[0].Content != "original comment" || comment.Content != "edited comment" {
+                t.Fatalf("Comment edit kept %+v and stored %+v", revisions, comment)
+            }
+            if err = EditContent(PostEntity, "999", "missing", "alice"); err == nil {
+                t.Error("Edited a missing post")
+            }
+        })
+    }
+}
+
+func TestConcurrentEditsKeepEveryRevision(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            // Every edit either lands, keeping the version it replaced, or is
+            // reported as a conflict
+            var wg sync.WaitGroup
+            var mu sync.Mutex
+            landed := make(map[string]bool)
+            for i := 0; i < 10; i++ {
+                content := fmt.Sprintf("edit %d", i)
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    err := EditContent(PostEntity, f.postID, content, "alice")
+                    if err != nil && !strings.Contains(err.Error(), "edited at the same time") {
+                        t.Errorf("Edit to %q failed: %v", content, err)
+                        return
+                    }
+                    mu.Lock()
+                    defer mu.Unlock()
+                    landed[content] = err == nil
+                }()
+            }
+            wg.Wait()
+
+            revisions, err := GetRevisions(PostEntity, f.postID)
+            if err != nil || len(revisions) == 0 || revisions[0].Content != "original post" {
+                t.Fatalf("Revisions are %+v, %v", revisions, err)
+            }
+            post, _ := GetPost(f.postID)
+            versions := []string{post.Content}
+            for _, revision := range revisions[1:] {
+                versions = append(versions, revision.Content)
+            }
+            for _, content := range versions {
+                if !landed[content] {
+                    t.Errorf("%q was stored but reported as a conflict", content)
+                }
+                delete(landed, content)
+            }
+            for content, ok := range landed {
+                if ok {
+                    t.Errorf("%q succeeded but no revision or content has it", content)
+                }
+            }
+        })
+    }
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            err := TrashContent(CommentEntity, f.commentID, "alice")
+            if err != nil {
+                t.Fatal(err)
+            }
+            post, _ := GetPost(f.postID)
+            comments, _ := GetComments(f.postID)
+            if _, err = GetComment(f.commentID); err == nil || len(comments) != 0 || post.NumComments != 0 {
+                t.Fatalf("Trashed comment is still shown: %+v, %d comments", comments, post.NumComments)
+            }
+            if err = TrashContent(CommentEntity, f.commentID, "alice"); err == nil {
+                t.Error("Comment was trashed twice")
+            }
+            err = RestoreContent(CommentEntity, f.commentID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            post, _ = GetPost(f.postID)
+            if _, err = GetComment(f.commentID); err != nil || post.NumComments != 1 {
+                t.Fatalf("Restored comment is not shown: %v, %d comments", err, post.NumComments)
+            }
+            if err = RestoreContent(CommentEntity, f.commentID); err == nil {
+                t.Error("Restored a comment that is not in the trash")
+            }
+
+            err = TrashContent(PostEntity, f.postID, "bob")
+            if err != nil {
+                t.Fatal(err)
+            }
+            posts, _ := GetAllPosts()
+            if _, err = GetPost(f.postID); err == nil || len(posts) != 0 {
+                t.Fatalf("Trashed post is still shown: %+v", posts)
+            }
+            trash, err := GetTrash("alice")
+            if err != nil || len(trash) != 1 || trash[0].Id != f.postID || trash[0].DeletedBy != "bob" ||
+                trash[0].Content != "original post" {
+                t.Fatalf("Trash of alice is %+v, %v", trash, err)
+            }
+            if trash, _ = GetTrash("bob"); len(trash) != 0 {
+                t.Errorf("Trash of bob has alice's post: %+v", trash)
+            }
+            if _, err = GetTrashItem(PostEntity, f.postID); err != nil {
+                t.Errorf("Trashed post is not in the trash: %v", err)
+            }
+            err = RestoreContent(PostEntity, f.postID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if _, err = GetPost(f.postID); err != nil {
+                t.Fatalf("Restored post is not shown: %v", err)
+            }
+            if trash, _ = GetTrash(""); len(trash) != 0 {
+                t.Errorf("Restored post is still in the trash: %+v", trash)
+            }
+
+            // Purging removes the post with its comments, votes and revisions
+            Like("bob", PostEntity, f.postID)
+            Like("bob", CommentEntity, f.commentID)
+            EditContent(PostEntity, f.postID, "edited post", "alice")
+            TrashContent(PostEntity, f.postID, "alice")
+            purged, err := PurgeTrash(time.Now().Add(-time.Hour))
+            if err != nil || purged != 0 {
+                t.Fatalf("Purged %d items trashed within the retention period: %v", purged, err)
+            }
+            if _, err = GetTrashItem(PostEntity, f.postID); err != nil {
+                t.Fatalf("Post trashed within the retention period was purged: %v", err)
+            }
+            purged, err = PurgeTrash(time.Now().Add(time.Second))
+            if err != nil || purged != 1 {
+                t.Fatalf("Purged %d items trashed before the retention period: %v", purged, err)
+            }
+            if _, err = GetTrashItem(PostEntity, f.postID); err == nil {
+                t.Error("Purged post is still in the trash")
+            }
+            if err = RestoreContent(PostEntity, f.postID); err == nil {
+                t.Error("Restored a purged post")
+            }
+            if _, err = GetPostIDFromCommentID(f.commentID); err == nil {
+                t.Error("Comment of the purged post was kept")
+            }
+            revisions, _ := GetRevisions(PostEntity, f.postID)
+            if len(revisions) != 0 {
+                t.Errorf("Revisions of the purged post were kept: %+v", revisions)
+            }
+            for _, entity := range []Entity{PostEntity, CommentEntity} {
+                if votes, _ := GetVotes("bob", entity); len(votes) != 0 {
+                    t.Errorf("Votes on the purged %s were kept: %v", entity, votes)
+                }
+            }
+        })
+    }
+}
+
+func TestCursorPagesNeitherOverlapNorSkip(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            // Added within a second, so most share a date and are ordered by id
+            for i := 0; i < 7; i++ {
+                _, err := AddPost(fmt.Sprintf("post %d #paged", i), "alice")
+                if err == nil {
+                    _, err = AddComment(fmt.Sprintf("comment %d", i), "alice", f.postID)
+                }
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            posts, _ := GetAllPosts()
+            comments, _ := GetComments(f.postID)
+            var want, wantComments []string
+            for _, post := range posts {
+                want = append(want, post.Id)
+            }
+            for _, comment := range comments {
+                wantComments = append(wantComments, comment.Id)
+            }
+
+            for _, limit := range []int{1, 2, 3, 8} {
+                var got, gotComments []string
+                cursor := ""
+                for pages := 0; pages == 0 || cursor != ""; pages++ {
+                    page, next, err := GetPostsPage(cursor, limit)
+                    if err != nil || len(page) > limit || pages > len(want) {
+                        t.Fatalf("Page %d of %d posts returned %d posts: %v", pages, limit, len(page), err)
+                    }
+                    for _, post := range page {
+                        got = append(got, post.Id)
+                    }
+                    cursor = next
+                }
+                for pages := 0; pages == 0 || cursor != ""; pages++ {
+                    page, next, err := GetCommentsPage(f.postID, cursor, limit)
+                    if err != nil || len(page) > limit || pages > len(wantComments) {
+                        t.Fatalf("Page %d of %d comments returned %d comments: %v", pages, limit, len(page), err)
+                    }
+                    for _, comment := range page {
+                        gotComments = append(gotComments, comment.Id)
+                    }
+                    cursor = next
+                }
+                if fmt.Sprint(got) != fmt.Sprint(want) {
+                    t.Errorf("Pages of %d posts returned %v, expected %v", limit, got, want)
+                }
+                if fmt.Sprint(gotComments) != fmt.Sprint(wantComments) {
+                    t.Errorf("Pages of %d comments returned %v, expected %v", limit, gotComments, wantComments)
+                }
+            }
+
+            var tagged []string
+            page, next, err := GetTagPostsPage("paged", "", 4)
+            for _, post := range page {
+                tagged = append(tagged, post.Id)
+            }
+            page, _, err2 := GetTagPostsPage("paged", next, 4)
+            for _, post := range page {
+                tagged = append(tagged, post.Id)
+            }
+            if err != nil || err2 != nil || fmt.Sprint(tagged) != fmt.Sprint(want[:7]) {
+                t.Errorf("Pages of tagged posts returned %v, expected %v: %v %v", tagged, want[:7], err, err2)
+            }
+            if _, _, err = GetPostsPage("not a cursor", 3); err == nil {
+                t.Error("Invalid cursor was accepted")
+            }
+        })
+    }
+}
+
+func TestParseSearch(t *testing.T) {
+    query, err := ParseSearch(`Deploy "Release  Notes" author:alice before:2024-01-02 after:2023-12-01 tomorrow`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(query.Terms) != "[deploy tomorrow]" || fmt.Sprint(query.Phrases) != "[release notes]" ||
+        query.Author != "alice" || !query.Before.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) ||
+        !query.After.Equal(time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("Parsed %+v", query)
+    }
+    query, err = ParseSearch(`"unclosed phrase`)
+    if err != nil || fmt.Sprint(query.Phrases) != "[unclosed phrase]" {
+        t.Errorf("Unclosed phrase parsed as %+v, %v", query, err)
+    }
+    for _, q := range []string{"", "   ", `""`, "before:yesterday deploy", "after:2024-13-01 deploy", "after:2024-01-01"} {
+        if _, err = ParseSearch(q); err == nil {
+            t.Errorf("ParseSearch(%q) succeeded", q)
+        }
+    }
+}
+
+func TestSearchFiltersRanksAndHighlights(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            ids := make(map[string]string)
+            for _, post := range []struct {
+                name string
+                content string
+                author string
+            }{
+                {"long", "we will deploy the new release to production some time tomorrow morning", "alice"},
+                {"short", "deploy deploy deploy", "alice"},
+                {"bob", "bob can deploy too", "bob"},
+                {"phrase", "the release notes are out", "alice"},
+                {"reversed", "notes about the release", "alice"},
+                {"markup", "<script>alert('deploy')</script> & more", "alice"},
+            } {
+                id, err := AddPost(post.content, post.author)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                ids[post.name] = id
+            }
+            comment, err := AddComment("a comment about the deploy", "bob", f.postID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            ids["comment"] = comment
+
+            // Returns the names of the results of a search, in order
+            search := func(q string) []string {
+                t.Helper()
+                results, err := Search(q, 0)
+                if err != nil {
+                    t.Fatalf("Search(%q): %v", q, err)
+                }
+                var names []string
+                for _, result := range results {
+                    for name, id := range ids {
+                        if id == result.Id && (name == "comment") == (result.Entity == CommentEntity) {
+                            names = append(names, name)
+                        }
+                    }
+                }
+                return names
+            }
+
+            // Denser matches rank first, the author counting as a word
+            if got := search("deploy"); len(got) != 5 || got[0] != "short" || got[1] != "bob" || got[4] != "long" {
+                t.Errorf("deploy ranked %v", got)
+            }
+            if got := fmt.Sprint(search("deploy author:bob")); got != "[bob comment]" {
+                t.Errorf("deploy author:bob found %s", got)
+            }
+            if got := fmt.Sprint(search("author:BOB")); got != "[comment bob]" && got != "[bob comment]" {
+                t.Errorf("author:BOB found %s", got)
+            }
+            if got := fmt.Sprint(search(`"release notes"`)); got != "[phrase]" {
+                t.Errorf(`"release notes" found %s`, got)
+            }
+            if got := fmt.Sprint(search("release notes")); got != "[reversed phrase]" && got != "[phrase reversed]" {
+                t.Errorf("release notes found %s", got)
+            }
+            short, _ := GetPost(ids["short"])
+            today := short.Date.UTC().Format("2006-01-02")
+            tomorrow := short.Date.UTC().Add(24 * time.Hour).Format("2006-01-02")
+            if got := search("deploy before:"+today); len(got) != 0 {
+                t.Errorf("deploy before:%s found %v", today, got)
+            }
+            if got := search("deploy after:"+today+" before:"+tomorrow); len(got) != 5 {
+                t.Errorf("deploy after:%s before:%s found %v", today, tomorrow, got)
+            }
+            if got := search("deploy after:"+tomorrow); len(got) != 0 {
+                t.Errorf("deploy after:%s found %v", tomorrow, got)
+            }
+
+            results, err := Search("deploy", 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, result := range results {
+                if result.Id == ids["markup"] && result.Entity == PostEntity &&
+                    result.Highlight != "&lt;script&gt;alert(&#39;<mark>deploy</mark>&#39;)&lt;/script&gt; &amp; more" {
+                    t.Errorf("Highlight of markup is %s", result.Highlight)
+                }
+                if result.Id == ids["short"] && result.Entity == PostEntity &&
+                    result.Highlight != "<mark>deploy</mark> <mark>deploy</mark> <mark>deploy</mark>" {
+                    t.Errorf("Highlight of repeated matches is %s", result.Highlight)
+                }
+            }
+        })
+    }
+}
+
+func TestSubscribeResumesAfterLastEvent(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            live := Subscribe(0)
+            defer live.Close()
+            postID, err := AddPost("new post", "bob")
+            if err != nil {
+                t.Fatal(err)
+            }
+            AddComment("new comment", "bob", postID)
+            Like("bob", PostEntity, f.postID)
+            var published []Event
+            for len(published) < 3 {
+                select {
+                case e := <-live.Events:
+                    published = append(published, e)
+                case <-time.After(5 * time.Second):
+                    t.Fatalf("Only received %+v", published)
+                }
+            }
+            if published[0].Type != PostCreated || published[1].Type != CommentCreated || published[2].Type != ReactionChanged {
+                t.Fatalf("Received %+v", published)
+            }
+
+            // Resuming after the first event replays only the two missed since
+            resumed := Subscribe(published[0].Id)
+            defer resumed.Close()
+            if resumed.Reset {
+                t.Error("Recent event id was reset")
+            }
+            for _, want := range published[1:] {
+                select {
+                case e := <-resumed.Events:
+                    if e.Id != want.Id || e.Type != want.Type || e.EntityId != want.EntityId {
+                        t.Errorf("Replayed %+v, expected %+v", e, want)
+                    }
+                default:
+                    t.Fatalf("Missed event %+v was not replayed", want)
+                }
+            }
+            select {
+            case e := <-resumed.Events:
+                t.Errorf("Replayed %+v, which was not missed", e)
+            default:
+            }
+
+            current := Subscribe(published[2].Id)
+            defer current.Close()
+            select {
+            case e := <-current.Events:
+                t.Errorf("Subscriber that missed nothing was sent %+v", e)
+            default:
+            }
+            if current.Reset {
+                t.Error("Latest event id was reset")
+            }
+            unknown := Subscribe(published[2].Id + 1000)
+            defer unknown.Close()
+            if !unknown.Reset {
+                t.Error("Id from before a restart was not reset")
+            }
+
+            // Resumed subscribers also receive new events
+            EditContent(PostEntity, postID, "edited post", "bob")
+            select {
+            case e := <-resumed.Events:
+                if e.Type != PostUpdated || e.EntityId != postID {
+                    t.Errorf("Received %+v after resuming", e)
+                }
+            case <-time.After(5 * time.Second):
+                t.Error("Resumed subscriber did not receive a new event")
+            }
+        })
+    }
+}
+
+func TestEmojiReactions(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+
+            for _, r := range []struct{ username, emoji string }{
+                {"bob", "🎉"}, {"carol", "👍"}, {"carol", "🎉"}, {"bob", "🎉"},
+            } {
+                err := AddReaction(r.username, CommentEntity, f.commentID, r.emoji)
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            reactions, err := GetReactions(CommentEntity, f.commentID)
+            if err != nil || len(reactions) != 2 || reactions[0].Emoji != "🎉" || reactions[0].Count != 2 ||
+                fmt.Sprint(reactions[0].Users) != "[bob carol]" || reactions[1].Emoji != "👍" || reactions[1].Count != 1 {
+                t.Fatalf("Reactions are %+v, %v", reactions, err)
+            }
+            marked := MarkReacted("bob", reactions)
+            if !marked[0].Reacted || marked[1].Reacted {
+                t.Errorf("Reactions of bob are marked %+v", marked)
+            }
+            if other, _ := GetReactions(PostEntity, f.postID); len(other) != 0 {
+                t.Errorf("Reactions to the comment were added to the post: %+v", other)
+            }
+
+            err = RemoveReaction("bob", CommentEntity, f.commentID, "🎉")
+            if err != nil {
+                t.Fatal(err)
+            }
+            RemoveReaction("carol", CommentEntity, f.commentID, "👍")
+            reactions, _ = GetReactions(CommentEntity, f.commentID)
+            if len(reactions) != 1 || reactions[0].Count != 1 || fmt.Sprint(reactions[0].Users) != "[carol]" {
+                t.Errorf("Reactions after removal are %+v", reactions)
+            }
+            if err = AddReaction("bob", PostEntity, "999", "🎉"); err == nil {
+                t.Error("Reacted to a missing post")
+            }
+        })
+    }
+}
+
+func TestParseTags(t *testing.T) {
+    for content, want := range map[string]string{
+        "#Go and #go again":            "[go]",
+        "shipping #release_2 #Deploy.": "[release_2 deploy]",
+        "issue #12 in C# at page#top":  "[]",
+        "##double #a#b":                "[a]",
+    } {
+        if got := fmt.Sprint(ParseTags(content)); got != want {
+            t.Errorf("ParseTags(%q) is %s, expected %s", content, got, want)
+        }
+    }
+}
+
+func TestTagCounts(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            seed(t)
+
+            first, _ := AddPost("#go #release", "alice")
+            AddPost("more #Go", "bob")
+            tags, err := GetTags()
+            if err != nil || fmt.Sprint(tags) != "[{go 2} {release 1}]" {
+                t.Fatalf("Tags are %v, %v", tags, err)
+            }
+            trending, err := GetTrendingTags(time.Hour, 1)
+            if err != nil || fmt.Sprint(trending) != "[{go 2}]" {
+                t.Errorf("Trending tags are %v, %v", trending, err)
+            }
+
+            EditContent(PostEntity, first, "now about #testing", "alice")
+            tags, _ = GetTags()
+            if fmt.Sprint(tags) != "[{go 1} {testing 1}]" {
+                t.Errorf("Tags after an edit are %v", tags)
+            }
+            TrashContent(PostEntity, first, "alice")
+            tags, _ = GetTags()
+            if fmt.Sprint(tags) != "[{go 1}]" {
+                t.Errorf("Tags after trashing a post are %v", tags)
+            }
+            if _, _, err = GetTagPostsPage("not a tag!", "", 0); err == nil {
+                t.Error("Invalid tag was accepted")
+            }
+        })
+    }
+}
+
+func TestParseMentions(t *testing.T) {
+    for content, want := range map[string]string{
+        "hi @bob and @carol.":        "[bob carol]",
+        "@bob @bob again":             "[bob]",
+        "mail alice@example.com":      "[]",
+        "@first.last, @snake_case-ok": "[first.last snake_case-ok]",
+    } {
+        if got := fmt.Sprint(ParseMentions(content)); got != want {
+            t.Errorf("ParseMentions(%q) is %s, expected %s", content, got, want)
+        }
+    }
+    linked := LinkMentions("<b>@bob</b> & @nobody", []string{"bob"})
+    want := `&lt;b&gt;<a class="mention" href="https://localhost/search?q=author:bob">@bob</a>&lt;/b&gt; &amp; @nobody`
+    if linked != want {
+        t.Errorf("LinkMentions returned %s", linked)
+    }
+}
+
+func TestMentionsNotifyOnce(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            seed(t)
+            for _, username := range []string{"bob", "carol"} {
+                err := Adduser(User{Username: username, Password: "hash"})
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            postID, err := AddPost("thanks @bob, @nobody and @alice", "alice")
+            if err != nil {
+                t.Fatal(err)
+            }
+            mentions, err := GetMentions(PostEntity, postID)
+            if err != nil || fmt.Sprint(mentions) != "[alice bob]" {
+                t.Fatalf("Mentions are %v, %v", mentions, err)
+            }
+            EditContent(PostEntity, postID, "thanks @bob and @carol", "alice")
+            mentions, _ = GetMentions(PostEntity, postID)
+            if fmt.Sprint(mentions) != "[alice bob carol]" {
+                t.Errorf("Mentions after an edit are %v", mentions)
+            }
+
+            // Only newly mentioned users are notified, and never of their own posts
+            for username, want := range map[string]int{"alice": 0, "bob": 1, "carol": 1} {
+                notifications, err := GetNotifications(username, false, 0)
+                if err != nil || len(notifications) != want {
+                    t.Fatalf("%s has %+v, %v", username, notifications, err)
+                }
+                if want > 0 && (notifications[0].Kind != MentionNotification || notifications[0].EntityId != postID ||
+                    notifications[0].Actor != "alice") {
+                    t.Errorf("%s was notified with %+v", username, notifications[0])
+                }
+            }
+
+            notifications, _ := GetNotifications("bob", true, 0)
+            if unread, _ := CountUnread("bob"); unread != 1 || len(notifications) != 1 {
+                t.Fatalf("bob has %d unread notifications", unread)
+            }
+            if err = ReadNotification("carol", notifications[0].Id); err == nil {
+                t.Error("carol read bob's notification")
+            }
+            err = ReadNotification("bob", notifications[0].Id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            notifications, _ = GetNotifications("bob", true, 0)
+            if unread, _ := CountUnread("bob"); unread != 0 || len(notifications) != 0 {
+                t.Errorf("bob still has %d unread notifications after reading", unread)
+            }
+        })
+    }
+}
+
+func TestActivityNotifications(t *testing.T) {
+    for name, open := range testStores(t) {
+        t.Run(name, func(t *testing.T) {
+            s := open()
+            defer s.Close()
+            previous := store
+            Use(s)
+            defer Use(previous)
+            f := seed(t)
+            for _, username := range []string{"bob", "carol"} {
+                err := Adduser(User{Username: username, Password: "hash"})
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            // Returns the kinds of a user's notifications, oldest first
+            kinds := func(username string) string {
+                t.Helper()
+                notifications, err := GetNotifications(username, false, 0)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                var kinds []string
+                for i := len(notifications) - 1; i >= 0; i-- {
+                    kinds = append(kinds, notifications[i].Kind+":"+notifications[i].Actor)
+                }
+                return fmt.Sprint(kinds)
+            }
+
+            // alice commented on her own post when it was seeded
+            AddComment("first", "bob", f.postID)
+            AddComment("second", "carol", f.postID)
+            if got := kinds("alice"); got != "[comment:bob comment:carol]" {
+                t.Errorf("Post author was notified of %s", got)
+            }
+            if got := kinds("bob"); got != "[reply:carol]" {
+                t.Errorf("Fellow commenter was notified of %s", got)
+            }
+
+            Like("bob", PostEntity, f.postID)
+            Like("bob", PostEntity, f.postID)
+            Dislike("carol", PostEntity, f.postID)
+            AddReaction("carol", CommentEntity, f.commentID, "🎉")
+            AddReaction("alice", CommentEntity, f.commentID, "🎉")
+            notifications, _ := GetNotifications("alice", false, 0)
+            if got := kinds("alice"); got != "[comment:bob comment:carol reaction:bob reaction:carol]" ||
+                notifications[1].Detail != "like" || notifications[0].Detail != "🎉" {
+                t.Errorf("Reactions notified alice of %s: %+v", got, notifications)
+            }
+
+            err := SetNotificationPreference("alice", CommentNotification, false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if err = SetNotificationPreference("alice", "unknown", false); err == nil {
+                t.Error("Unknown notification type was accepted")
+            }
+            AddComment("third", "bob", f.postID)
+            if got := kinds("alice"); got != "[comment:bob comment:carol reaction:bob reaction:carol]" {
+                t.Errorf("Comment notification was sent after it was turned off: %s", got)
+            }
+            if got := kinds("carol"); got != "[reply:bob]" {
+                t.Errorf("Other preferences changed carol's notifications: %s", got)
+            }
+
+            pruned, err := PruneNotifications(time.Now().Add(-time.Hour))
+            if err != nil || pruned != 0 {
+                t.Errorf("Pruned %d recent notifications: %v", pruned, err)
+            }
+            pruned, err = PruneNotifications(time.Now().Add(time.Second))
+            if err != nil || pruned != 6 {
+                t.Errorf("Pruned %d old notifications: %v", pruned, err)
+            }
+        })
+    }
+}
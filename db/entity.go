@@ -0,0 +1,60 @@
+package db
+
+import (
+    "fmt"
+    "strconv"
+)
+
+// Kind of content that can be liked or looked up by id. The set of entities is
+// closed, other packages can only use the values below or ParseEntity.
+type Entity struct {
+    name string
+}
+
+var (
+    PostEntity = Entity{"post"}
+    CommentEntity = Entity{"comment"}
+)
+
+// Resolves a user supplied entity name, such as the entity query parameter
+func ParseEntity(name string) (Entity, error) {
+    switch name {
+    case PostEntity.name:
+        return PostEntity, nil
+    case CommentEntity.name:
+        return CommentEntity, nil
+    }
+    return Entity{}, fmt.Errorf("Unknown entity %q", name)
+}
+
+func (e Entity) String() string {
+    return e.name
+}
+
+// Returns the table holding the entity
+func (e Entity) table() (string, error) {
+    switch e {
+    case PostEntity:
+        return "post", nil
+    case CommentEntity:
+        return "comment", nil
+    }
+    return "", fmt.Errorf("Unknown entity %q", e.name)
+}
+
+// Parses a post or comment id, rejecting anything that is not an integer
+func parseID(id string) (int64, error) {
+    n, err := strconv.ParseInt(id, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid id %q", id)
+    }
+    return n, nil
+}
+
+// Returns 1 if vote is value, for adjusting like and dislike counters
+func count(vote int, value int) int {
+    if vote == value {
+        return 1
+    }
+    return 0
+}
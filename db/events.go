@@ -0,0 +1,180 @@
+package db
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Types of event published when posts, comments and reactions change
+const (
+    PostCreated = "post.created"
+    PostUpdated = "post.updated"
+    PostDeleted = "post.deleted"
+    CommentCreated = "comment.created"
+    CommentUpdated = "comment.updated"
+    CommentDeleted = "comment.deleted"
+    // Likes, dislikes or emoji reactions of a post or comment changed
+    ReactionChanged = "reaction.changed"
+)
+
+// Change to a post or comment. Events only identify what changed, subscribers
+// read it again to see it as their user may. PostId is the post itself or the
+// post a comment is on.
+type Event struct {
+    Id int64
+    Type string
+    Entity Entity
+    EntityId string
+    PostId string
+    Actor string
+    Date time.Time
+}
+
+// Least number of recent events kept for subscribers resuming after a disconnect
+const eventBacklog = 1000
+
+// Events buffered for a subscriber that is not keeping up before it is dropped
+const subscriberBuffer = 64
+
+// Delivers the events published by every replica to this replica's subscribers.
+// Ids are given by the broadcaster and increase, but may skip numbers.
+type eventBus struct {
+    mu sync.Mutex
+    broadcaster Broadcaster
+    // Every event after known was delivered, and is in recent unless it was trimmed
+    known int64
+    lastID int64
+    recent []Event
+    subscribers map[chan Event]bool
+}
+
+var bus = newEventBus()
+
+func newEventBus() *eventBus {
+    b := &eventBus{subscribers: make(map[chan Event]bool)}
+    b.broadcaster = NewLocalHub().Broadcaster()
+    b.broadcaster.Listen(b.deliver)
+    return b
+}
+
+// Publishes and delivers events with a broadcaster, such as one shared with the
+// other replicas, closing the one used until now. Called on startup.
+func UseBroadcaster(b Broadcaster) error {
+    known, err := b.Listen(bus.deliver)
+    if err != nil {
+        return err
+    }
+    bus.mu.Lock()
+    old := bus.broadcaster
+    bus.broadcaster = b
+    // Ids from the old broadcaster mean nothing to the new one
+    bus.known = known
+    bus.lastID = known
+    bus.recent = nil
+    bus.mu.Unlock()
+    return old.Close()
+}
+
+// Subscription to events, created by Subscribe
+type Subscription struct {
+    // Events published after the resumed id, then new events as they are
+    // published. Closed when the subscriber falls too far behind or is closed.
+    Events <-chan Event
+    // Set when the resumed id is too old for the missed events to be sent
+    Reset bool
+    events chan Event
+}
+
+// Subscribes to events published after the event with id after, or only to new
+// events when after is 0
+func Subscribe(after int64) *Subscription {
+    bus.mu.Lock()
+    defer bus.mu.Unlock()
+    var missed []Event
+    reset := false
+    if after > bus.lastID || (after > 0 && after < bus.known) {
+        // Ids restart when the application does, or were not delivered here
+        reset = true
+    } else if after > 0 {
+        for _, e := range bus.recent {
+            if e.Id > after {
+                missed = append(missed, e)
+            }
+        }
+    }
+    events := make(chan Event, len(missed) + subscriberBuffer)
+    for _, e := range missed {
+        events <- e
+    }
+    bus.subscribers[events] = true
+    return &Subscription{Events: events, Reset: reset, events: events}
+}
+
+// Stops receiving events
+func (s *Subscription) Close() {
+    bus.mu.Lock()
+    defer bus.mu.Unlock()
+    if bus.subscribers[s.events] {
+        delete(bus.subscribers, s.events)
+        close(s.events)
+    }
+}
+
+// Publishes an event to the subscribers of every replica and queues it for webhooks
+func publish(e Event) {
+    e.Date = now()
+    err := queueWebhooks(e)
+    if err != nil {
+        fmt.Println("Error queueing webhooks:", err)
+    }
+    bus.mu.Lock()
+    b := bus.broadcaster
+    bus.mu.Unlock()
+    err = b.Publish(e)
+    if err != nil {
+        fmt.Println("Error publishing event:", err)
+    }
+}
+
+// Sends an event from the broadcaster to every subscriber, dropping those that are not keeping up
+func (b *eventBus) deliver(e Event) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if e.Id > b.lastID {
+        b.lastID = e.Id
+    }
+    b.recent = append(b.recent, e)
+    if len(b.recent) > 2 * eventBacklog {
+        trimmed := len(b.recent) - eventBacklog
+        for _, old := range b.recent[:trimmed] {
+            if old.Id > b.known {
+                b.known = old.Id
+            }
+        }
+        b.recent = append([]Event(nil), b.recent[trimmed:]...)
+    }
+    for events := range b.subscribers {
+        select {
+        case events <- e:
+        default:
+            // They resume from the last event they received when they reconnect
+            delete(b.subscribers, events)
+            close(events)
+        }
+    }
+}
+
+// Publishes an event about a post or comment, looking up the post a comment is on
+func publishChange(kind string, entity Entity, id string, actor string) {
+    postID, err := postOf(entity, id)
+    if err != nil {
+        return
+    }
+    publish(Event{Type: kind, Entity: entity, EntityId: id, PostId: postID, Actor: actor})
+}
+
+// Returns the type of a post or comment being created, updated or deleted
+func changeType(entity Entity, action string) string {
+    return entity.name+"."+action
+}
@@ -0,0 +1,1683 @@
+package db
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "strings"
+    "github.com/google/uuid"
+)
+
+// Store kept entirely in process memory, used for tests and throwaway instances
+type memoryStore struct {
+    mu sync.Mutex
+    users map[string]User
+    sessions map[string]Session
+    refreshTokens map[string]RefreshToken
+    revokedTokens map[string]time.Time
+    personalTokens map[int64]PersonalToken
+    posts map[int64]*Post
+    comments map[int64]*memComment
+    people []Person
+    moderationLog []ModerationEntry
+    votes map[voteKey]int
+    emojiReactions []emojiReaction
+    index *searchIndex
+    revisions []memRevision
+    // Hashtags of each post
+    tags map[int64][]string
+    // Users mentioned in each post and comment
+    mentions map[voteKey]bool
+    notifications []Notification
+    // Kinds of notification each user turned on or off
+    preferences map[string]map[string]bool
+    outbox []Event
+    webhooks []Webhook
+    deliveries []WebhookDelivery
+    lastPostID int64
+    lastCommentID int64
+    lastPersonalTokenID int64
+    lastNotificationID int64
+    lastOutboxID int64
+    lastWebhookID int64
+    lastDeliveryID int64
+}
+
+// Identifies one user's vote on, or mention in, a post or comment
+type voteKey struct {
+    username string
+    entity Entity
+    id int64
+}
+
+// One user's emoji reaction to a post or comment
+type emojiReaction struct {
+    voteKey
+    emoji string
+}
+
+// Replaced version of a post or comment
+type memRevision struct {
+    entity Entity
+    id int64
+    Revision
+}
+
+// Comment along with the post it belongs to
+type memComment struct {
+    Comment
+    postID string
+}
+
+// Creates an empty in-memory store
+func NewMemoryStore() Store {
+    return &memoryStore{
+        users: make(map[string]User),
+        sessions: make(map[string]Session),
+        refreshTokens: make(map[string]RefreshToken),
+        revokedTokens: make(map[string]time.Time),
+        personalTokens: make(map[int64]PersonalToken),
+        posts: make(map[int64]*Post),
+        comments: make(map[int64]*memComment),
+        votes: make(map[voteKey]int),
+        index: newSearchIndex(),
+        tags: make(map[int64][]string),
+        mentions: make(map[voteKey]bool),
+        preferences: make(map[string]map[string]bool),
+    }
+}
+
+// Nothing to release for an in-memory store
+func (s *memoryStore) Close() error {
+    return nil
+}
+
+// Adds a user
+func (s *memoryStore) Adduser(user User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.users[user.Username]; ok {
+        return nil
+    }
+    if user.Salt != nil {
+        user.Salt = append([]byte(nil), user.Salt...)
+    }
+    if user.Role == "" {
+        user.Role = "user"
+    }
+    s.users[user.Username] = user
+    return nil
+}
+
+// Returns a user's role
+func (s *memoryStore) GetRole(username string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return "", fmt.Errorf("User %s does not exist", username)
+    }
+    return user.Role, nil
+}
+
+// Changes a user's role
+func (s *memoryStore) SetRole(username string, role string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return fmt.Errorf("User %s does not exist", username)
+    }
+    user.Role = role
+    s.users[username] = user
+    return nil
+}
+
+// Returns a user's details without their password
+func (s *memoryStore) GetUser(username string) (User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return User{Username: username}, fmt.Errorf("User %s does not exist", username)
+    }
+    return User{Username: username, Role: user.Role, Locked: user.Locked}, nil
+}
+
+// Lists users whose name contains search, ordered by name, without passwords
+func (s *memoryStore) GetUsers(search string, limit int, offset int) ([]User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var names []string
+    for name := range s.users {
+        if strings.Contains(strings.ToLower(name), strings.ToLower(search)) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    var users []User
+    for i := offset; i < len(names) && len(users) < limit; i++ {
+        user := s.users[names[i]]
+        users = append(users, User{Username: user.Username, Role: user.Role, Locked: user.Locked})
+    }
+    return users, nil
+}
+
+// Locks or unlocks a user
+func (s *memoryStore) SetLocked(username string, locked bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return fmt.Errorf("User %s does not exist", username)
+    }
+    user.Locked = locked
+    s.users[username] = user
+    return nil
+}
+
+// Returns username given a uuid
+func (s *memoryStore) GetUsername(uuid string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    session, ok := s.sessions[uuid]
+    if !ok {
+        return "", fmt.Errorf("Session does not exist")
+    }
+    return session.Username, nil
+}
+
+// Get user creds
+func (s *memoryStore) GetCreds(username string) (string, []byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return "", nil, fmt.Errorf("Username is incorrect.")
+    }
+    var salt []byte
+    if user.Salt != nil {
+        salt = append([]byte(nil), user.Salt...)
+    }
+    return user.Password, salt, nil
+}
+
+// Replaces a user's password hash and clears the legacy salt
+func (s *memoryStore) UpdatePassword(username string, password string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    user, ok := s.users[username]
+    if !ok {
+        return nil
+    }
+    user.Password = password
+    user.Salt = nil
+    s.users[username] = user
+    return nil
+}
+
+// Adds a session for session.Username and returns its uuid
+func (s *memoryStore) AddSession(session Session) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    id := uuid.NewString()
+    for _, ok := s.sessions[id]; ok; _, ok = s.sessions[id] {
+        id = uuid.NewString()
+    }
+    session.Id = id
+    session.CreatedAt = now()
+    session.LastSeen = session.CreatedAt
+    session.ExpiresAt = session.ExpiresAt.UTC().Truncate(time.Second)
+    s.sessions[id] = session
+    return id, nil
+}
+
+// Retrieves a session by uuid
+func (s *memoryStore) GetSession(uuid string) (Session, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    session, ok := s.sessions[uuid]
+    if !ok {
+        return Session{}, fmt.Errorf("Session does not exist")
+    }
+    return session, nil
+}
+
+// Lists a user's sessions, most recently used first
+func (s *memoryStore) GetSessions(username string) ([]Session, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var sessions []Session
+    for _, session := range s.sessions {
+        if session.Username == username {
+            sessions = append(sessions, session)
+        }
+    }
+    sort.Slice(sessions, func(i, j int) bool {
+        if sessions[i].LastSeen.Equal(sessions[j].LastSeen) {
+            return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+        }
+        return sessions[i].LastSeen.After(sessions[j].LastSeen)
+    })
+    return sessions, nil
+}
+
+// Records activity on a session
+func (s *memoryStore) TouchSession(uuid string, lastSeen time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if session, ok := s.sessions[uuid]; ok {
+        session.LastSeen = lastSeen.UTC().Truncate(time.Second)
+        s.sessions[uuid] = session
+    }
+    return nil
+}
+
+// Deletes a single session
+func (s *memoryStore) DeleteSession(uuid string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.sessions, uuid)
+    return nil
+}
+
+// Deletes every session of a user
+func (s *memoryStore) DeleteSessions(username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, session := range s.sessions {
+        if session.Username == username {
+            delete(s.sessions, id)
+        }
+    }
+    return nil
+}
+
+// Deletes sessions past their expiry or last seen before idleBefore
+func (s *memoryStore) DeleteExpiredSessions(expiredBefore time.Time, idleBefore time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var count int64
+    for id, session := range s.sessions {
+        if !session.ExpiresAt.After(expiredBefore) || !session.LastSeen.After(idleBefore) {
+            delete(s.sessions, id)
+            count++
+        }
+    }
+    return count, nil
+}
+
+// Determines if a session id is valid or not
+func (s *memoryStore) ValidSession(uuid string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, ok := s.sessions[uuid]
+    return ok, nil
+}
+
+// Stores a new refresh token
+func (s *memoryStore) AddRefreshToken(token RefreshToken) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.refreshTokens[token.Id]; ok {
+        return fmt.Errorf("Error inserting into refresh_token table: duplicate id")
+    }
+    token.CreatedAt = now()
+    token.ExpiresAt = token.ExpiresAt.UTC().Truncate(time.Second)
+    token.Used = false
+    s.refreshTokens[token.Id] = token
+    return nil
+}
+
+// Retrieves a refresh token by its hash
+func (s *memoryStore) GetRefreshToken(id string) (RefreshToken, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    token, ok := s.refreshTokens[id]
+    if !ok {
+        return RefreshToken{}, fmt.Errorf("Refresh token does not exist")
+    }
+    return token, nil
+}
+
+// Lists a user's refresh tokens, including used ones
+func (s *memoryStore) GetRefreshTokens(username string) ([]RefreshToken, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var tokens []RefreshToken
+    for _, token := range s.refreshTokens {
+        if token.Username == username {
+            tokens = append(tokens, token)
+        }
+    }
+    sort.Slice(tokens, func(i, j int) bool {
+        return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+    })
+    return tokens, nil
+}
+
+// Marks a refresh token used, reporting false if it already was
+func (s *memoryStore) UseRefreshToken(id string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    token, ok := s.refreshTokens[id]
+    if !ok || token.Used {
+        return false, nil
+    }
+    token.Used = true
+    s.refreshTokens[id] = token
+    return true, nil
+}
+
+// Deletes every refresh token rotated from the same login
+func (s *memoryStore) DeleteRefreshTokenFamily(family string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, token := range s.refreshTokens {
+        if token.Family == family {
+            delete(s.refreshTokens, id)
+        }
+    }
+    return nil
+}
+
+// Deletes every refresh token of a user
+func (s *memoryStore) DeleteRefreshTokens(username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, token := range s.refreshTokens {
+        if token.Username == username {
+            delete(s.refreshTokens, id)
+        }
+    }
+    return nil
+}
+
+// Adds an access token id to the revocation list until it expires
+func (s *memoryStore) RevokeToken(jti string, expiresAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.revokedTokens[jti]; !ok {
+        s.revokedTokens[jti] = expiresAt.UTC().Truncate(time.Second)
+    }
+    return nil
+}
+
+// Determines if an access token id has been revoked
+func (s *memoryStore) TokenRevoked(jti string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, ok := s.revokedTokens[jti]
+    return ok, nil
+}
+
+// Deletes refresh tokens, revocations and personal access tokens that expired before a time
+func (s *memoryStore) DeleteExpiredTokens(before time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var count int64
+    for id, token := range s.refreshTokens {
+        if !token.ExpiresAt.After(before) {
+            delete(s.refreshTokens, id)
+            count++
+        }
+    }
+    for jti, expiresAt := range s.revokedTokens {
+        if !expiresAt.After(before) {
+            delete(s.revokedTokens, jti)
+            count++
+        }
+    }
+    for id, token := range s.personalTokens {
+        if !token.ExpiresAt.After(before) {
+            delete(s.personalTokens, id)
+            count++
+        }
+    }
+    return count, nil
+}
+
+// Stores a personal access token and returns its id
+func (s *memoryStore) AddPersonalToken(token PersonalToken) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, other := range s.personalTokens {
+        if other.Hash == token.Hash {
+            return "", fmt.Errorf("Error inserting into personal_token table: duplicate hash")
+        }
+    }
+    s.lastPersonalTokenID++
+    token.Id = strconv.FormatInt(s.lastPersonalTokenID, 10)
+    token.CreatedAt = now()
+    token.LastUsed = time.Time{}
+    token.ExpiresAt = token.ExpiresAt.UTC().Truncate(time.Second)
+    s.personalTokens[s.lastPersonalTokenID] = token
+    return token.Id, nil
+}
+
+// Retrieves a personal access token by its hash
+func (s *memoryStore) GetPersonalToken(hash string) (PersonalToken, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, token := range s.personalTokens {
+        if token.Hash == hash {
+            return token, nil
+        }
+    }
+    return PersonalToken{}, fmt.Errorf("Personal token does not exist")
+}
+
+// Lists a user's personal access tokens, newest first
+func (s *memoryStore) GetPersonalTokens(username string) ([]PersonalToken, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var ids []int64
+    for id, token := range s.personalTokens {
+        if token.Username == username {
+            ids = append(ids, id)
+        }
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+    var tokens []PersonalToken
+    for _, id := range ids {
+        tokens = append(tokens, s.personalTokens[id])
+    }
+    return tokens, nil
+}
+
+// Records use of a personal access token
+func (s *memoryStore) TouchPersonalToken(id string, lastUsed time.Time) error {
+    tokenID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if token, ok := s.personalTokens[tokenID]; ok {
+        token.LastUsed = lastUsed.UTC().Truncate(time.Second)
+        s.personalTokens[tokenID] = token
+    }
+    return nil
+}
+
+// Deletes one of a user's personal access tokens
+func (s *memoryStore) DeletePersonalToken(username string, id string) error {
+    tokenID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    token, ok := s.personalTokens[tokenID]
+    if !ok || token.Username != username {
+        return fmt.Errorf("Personal token %s does not exist", id)
+    }
+    delete(s.personalTokens, tokenID)
+    return nil
+}
+
+// Deletes every personal access token of a user
+func (s *memoryStore) DeletePersonalTokens(username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, token := range s.personalTokens {
+        if token.Username == username {
+            delete(s.personalTokens, id)
+        }
+    }
+    return nil
+}
+
+// Adds a post
+func (s *memoryStore) AddPost(content string, author string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastPostID++
+    id := strconv.FormatInt(s.lastPostID, 10)
+    s.posts[s.lastPostID] = &Post{
+        Content: content,
+        Author: author,
+        Date: now(),
+        Id: id,
+    }
+    s.tags[s.lastPostID] = ParseTags(content)
+    s.index.add(searchDoc{entity: PostEntity, id: s.lastPostID, postID: id, author: author, content: content, date: now()})
+    return id, nil
+}
+
+// Returns a post unless it is missing or in the trash
+func (s *memoryStore) post(n int64) (*Post, bool) {
+    post, ok := s.posts[n]
+    if !ok || !post.DeletedAt.IsZero() {
+        return nil, false
+    }
+    return post, true
+}
+
+// Returns a comment unless it is missing or in the trash
+func (s *memoryStore) comment(n int64) (*memComment, bool) {
+    comment, ok := s.comments[n]
+    if !ok || !comment.DeletedAt.IsZero() {
+        return nil, false
+    }
+    return comment, true
+}
+
+// Permanently deletes a post and its comments
+func (s *memoryStore) DeletePost(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    delete(s.posts, n)
+    delete(s.tags, n)
+    s.deleteRelated(PostEntity, n)
+    for cid, comment := range s.comments {
+        if comment.postID == id {
+            delete(s.comments, cid)
+            s.deleteRelated(CommentEntity, cid)
+        }
+    }
+    s.index.invalidate()
+    return nil
+}
+
+// Moves a post or comment to the trash
+func (s *memoryStore) TrashContent(entity Entity, id string, actor string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    switch entity {
+    case PostEntity:
+        if post, ok := s.post(n); ok {
+            post.DeletedAt, post.DeletedBy = now(), actor
+            s.index.invalidate()
+            return nil
+        }
+    case CommentEntity:
+        if comment, ok := s.comment(n); ok {
+            comment.DeletedAt, comment.DeletedBy = now(), actor
+            pid, _ := parseID(comment.postID)
+            if post, ok := s.posts[pid]; ok && post.NumComments > 0 {
+                post.NumComments--
+            }
+            s.index.invalidate()
+            return nil
+        }
+    }
+    return fmt.Errorf("%s with id:%s does not exist", entity, id)
+}
+
+// Takes a post or comment back out of the trash
+func (s *memoryStore) RestoreContent(entity Entity, id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    switch entity {
+    case PostEntity:
+        if post, ok := s.posts[n]; ok && !post.DeletedAt.IsZero() {
+            post.DeletedAt, post.DeletedBy = time.Time{}, ""
+            s.index.invalidate()
+            return nil
+        }
+    case CommentEntity:
+        if comment, ok := s.comments[n]; ok && !comment.DeletedAt.IsZero() {
+            comment.DeletedAt, comment.DeletedBy = time.Time{}, ""
+            pid, _ := parseID(comment.postID)
+            if post, ok := s.posts[pid]; ok {
+                post.NumComments++
+            }
+            s.index.invalidate()
+            return nil
+        }
+    }
+    return fmt.Errorf("%s with id:%s is not in the trash", entity, id)
+}
+
+// Returns posts and comments in the trash, most recently deleted first. author
+// limits them to one user's content unless it is empty.
+func (s *memoryStore) GetTrash(author string) ([]TrashItem, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    items := []TrashItem{}
+    for _, post := range s.posts {
+        if !post.DeletedAt.IsZero() && (author == "" || post.Author == author) {
+            items = append(items, TrashItem{PostEntity, post.Id, post.Id, post.Content, post.Author, post.DeletedAt, post.DeletedBy})
+        }
+    }
+    for _, c := range s.comments {
+        if !c.DeletedAt.IsZero() && (author == "" || c.Author == author) {
+            items = append(items, TrashItem{CommentEntity, c.Id, c.postID, c.Content, c.Author, c.DeletedAt, c.DeletedBy})
+        }
+    }
+    sortTrash(items)
+    return items, nil
+}
+
+// Returns a post or comment in the trash
+func (s *memoryStore) GetTrashItem(entity Entity, id string) (TrashItem, error) {
+    items, err := s.GetTrash("")
+    if err != nil {
+        return TrashItem{}, err
+    }
+    for _, item := range items {
+        if item.Entity == entity && item.Id == id {
+            return item, nil
+        }
+    }
+    return TrashItem{}, fmt.Errorf("%s with id:%s is not in the trash", entity, id)
+}
+
+// Permanently deletes posts and comments that went in the trash before a time
+func (s *memoryStore) PurgeTrash(before time.Time) (int64, error) {
+    items, err := s.GetTrash("")
+    if err != nil {
+        return 0, err
+    }
+    // Comments first, as purging a post also removes its comments
+    var purged int64
+    for _, entity := range []Entity{CommentEntity, PostEntity} {
+        for _, item := range items {
+            if item.Entity != entity || !item.DeletedAt.Before(before) {
+                continue
+            }
+            if entity == PostEntity {
+                err = s.DeletePost(item.Id)
+            } else {
+                err = s.DeleteComment(item.Id)
+            }
+            if err != nil {
+                return purged, err
+            }
+            purged++
+        }
+    }
+    return purged, nil
+}
+
+// Replaces the content of a post or comment, keeping the previous version as a
+// revision credited to whoever wrote it
+func (s *memoryStore) EditContent(entity Entity, id string, content string, editor string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    var previous Revision
+    switch entity {
+    case PostEntity:
+        post, ok := s.post(n)
+        if !ok {
+            return fmt.Errorf("%s with id:%s does not exist", entity, id)
+        }
+        previous = Revision{post.Content, post.Author, post.Date}
+        if !post.EditedAt.IsZero() {
+            previous.Editor, previous.CreatedAt = post.EditedBy, post.EditedAt
+        }
+        post.Content, post.EditedAt, post.EditedBy = content, now(), editor
+        s.tags[n] = ParseTags(content)
+    case CommentEntity:
+        comment, ok := s.comment(n)
+        if !ok {
+            return fmt.Errorf("%s with id:%s does not exist", entity, id)
+        }
+        previous = Revision{comment.Content, comment.Author, comment.Date}
+        if !comment.EditedAt.IsZero() {
+            previous.Editor, previous.CreatedAt = comment.EditedBy, comment.EditedAt
+        }
+        comment.Content, comment.EditedAt, comment.EditedBy = content, now(), editor
+    }
+    s.revisions = append(s.revisions, memRevision{entity, n, previous})
+    s.index.edit(entity, id, content)
+    return nil
+}
+
+// Returns the replaced versions of a post or comment, oldest first
+func (s *memoryStore) GetRevisions(entity Entity, id string) ([]Revision, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    revisions := []Revision{}
+    for _, r := range s.revisions {
+        if r.entity == entity && r.id == n {
+            revisions = append(revisions, r.Revision)
+        }
+    }
+    return revisions, nil
+}
+
+// Adds a comment to a post
+func (s *memoryStore) AddComment(content string, author string, post_id string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(post_id)
+    if err != nil {
+        return "", err
+    }
+    post, exists := s.post(n)
+    if !exists {
+        return "", fmt.Errorf("Error inserting into comment table: post %s does not exist", post_id)
+    }
+    s.lastCommentID++
+    id := strconv.FormatInt(s.lastCommentID, 10)
+    s.comments[s.lastCommentID] = &memComment{
+        Comment: Comment{
+            Content: content,
+            Author: author,
+            Date: now(),
+            Id: id,
+        },
+        postID: post.Id,
+    }
+    post.NumComments++
+    s.index.add(searchDoc{entity: CommentEntity, id: s.lastCommentID, postID: post.Id, author: author, content: content, date: now()})
+    return id, nil
+}
+
+// Permanently deletes a comment from a post
+func (s *memoryStore) DeleteComment(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    comment, exists := s.comments[n]
+    if !exists {
+        return fmt.Errorf("Comment %s cannot be linked to a post", id)
+    }
+    // Comments in the trash were already taken off the count
+    pid, _ := parseID(comment.postID)
+    if post, ok := s.posts[pid]; ok && post.NumComments > 0 && comment.DeletedAt.IsZero() {
+        post.NumComments--
+    }
+    delete(s.comments, n)
+    s.deleteRelated(CommentEntity, n)
+    s.index.invalidate()
+    return nil
+}
+
+// Returns pointers to the like and dislike counters of a post or comment
+func (s *memoryStore) counters(entity Entity, id string) (*int, *int, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, nil, err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return nil, nil, err
+    }
+    switch entity {
+    case PostEntity:
+        if post, ok := s.post(n); ok {
+            return &post.Likes, &post.Dislikes, nil
+        }
+    case CommentEntity:
+        if comment, ok := s.comment(n); ok {
+            return &comment.Likes, &comment.Dislikes, nil
+        }
+    }
+    return nil, nil, fmt.Errorf("%s with id:%s not found", entity, id)
+}
+
+// Records a user's like (1) or dislike (-1) of a post or comment. Repeating a
+// vote takes it back and the opposite vote replaces it.
+func (s *memoryStore) Vote(username string, entity Entity, id string, value int) (Votes, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if value != Liked && value != Disliked {
+        return Votes{}, fmt.Errorf("Invalid vote %d", value)
+    }
+    likes, dislikes, err := s.counters(entity, id)
+    if err != nil {
+        return Votes{}, err
+    }
+    n, _ := parseID(id)
+    key := voteKey{username, entity, n}
+    previous := s.votes[key]
+    vote := value
+    if previous == value {
+        vote = 0
+        delete(s.votes, key)
+    } else {
+        s.votes[key] = vote
+    }
+    *likes += count(vote, Liked) - count(previous, Liked)
+    *dislikes += count(vote, Disliked) - count(previous, Disliked)
+    return Votes{Likes: *likes, Dislikes: *dislikes, Vote: vote}, nil
+}
+
+// Returns a user's votes on posts or comments, keyed by id
+func (s *memoryStore) GetVotes(username string, entity Entity) (map[string]int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    votes := make(map[string]int)
+    for key, vote := range s.votes {
+        if key.username == username && key.entity == entity {
+            votes[strconv.FormatInt(key.id, 10)] = vote
+        }
+    }
+    return votes, nil
+}
+
+// Forgets every vote, emoji reaction, revision, mention and notification of a
+// deleted post or comment
+func (s *memoryStore) deleteRelated(entity Entity, id int64) {
+    for key := range s.votes {
+        if key.entity == entity && key.id == id {
+            delete(s.votes, key)
+        }
+    }
+    for key := range s.mentions {
+        if key.entity == entity && key.id == id {
+            delete(s.mentions, key)
+        }
+    }
+    var notifications []Notification
+    for _, notification := range s.notifications {
+        if notification.Entity != entity || notification.EntityId != strconv.FormatInt(id, 10) {
+            notifications = append(notifications, notification)
+        }
+    }
+    s.notifications = notifications
+    var kept []emojiReaction
+    for _, r := range s.emojiReactions {
+        if r.entity != entity || r.id != id {
+            kept = append(kept, r)
+        }
+    }
+    s.emojiReactions = kept
+    var revisions []memRevision
+    for _, r := range s.revisions {
+        if r.entity != entity || r.id != id {
+            revisions = append(revisions, r)
+        }
+    }
+    s.revisions = revisions
+}
+
+// Adds a user's emoji reaction to a post or comment, doing nothing if they already reacted with it
+func (s *memoryStore) AddReaction(username string, entity Entity, id string, emoji string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, _, err := s.counters(entity, id); err != nil {
+        return err
+    }
+    n, _ := parseID(id)
+    reaction := emojiReaction{voteKey{username, entity, n}, emoji}
+    for _, r := range s.emojiReactions {
+        if r == reaction {
+            return nil
+        }
+    }
+    s.emojiReactions = append(s.emojiReactions, reaction)
+    return nil
+}
+
+// Removes a user's emoji reaction from a post or comment
+func (s *memoryStore) RemoveReaction(username string, entity Entity, id string, emoji string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    reaction := emojiReaction{voteKey{username, entity, n}, emoji}
+    for i, r := range s.emojiReactions {
+        if r == reaction {
+            s.emojiReactions = append(s.emojiReactions[:i], s.emojiReactions[i+1:]...)
+            break
+        }
+    }
+    return nil
+}
+
+// Returns the emoji reactions to a post or comment, in the order each emoji was first used
+func (s *memoryStore) GetReactions(entity Entity, id string) ([]Reaction, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    var users, emoji []string
+    for _, r := range s.emojiReactions {
+        if r.entity == entity && r.id == n {
+            users = append(users, r.username)
+            emoji = append(emoji, r.emoji)
+        }
+    }
+    return groupReactions(users, emoji), nil
+}
+
+// Get all posts in the system
+func (s *memoryStore) GetAllPosts() ([]Post, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var posts []Post
+    for _, post := range s.posts {
+        if post.DeletedAt.IsZero() {
+            posts = append(posts, *post)
+        }
+    }
+    sort.Slice(posts, func(i, j int) bool {
+        if posts[i].Date.Equal(posts[j].Date) {
+            a, _ := parseID(posts[i].Id)
+            b, _ := parseID(posts[j].Id)
+            return a > b
+        }
+        return posts[i].Date.After(posts[j].Date)
+    })
+    return posts, nil
+}
+
+// Get comments for a given post
+func (s *memoryStore) GetComments(id string) ([]Comment, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := parseID(id); err != nil {
+        return nil, err
+    }
+    var comments []Comment
+    for _, comment := range s.comments {
+        if comment.postID == id && comment.DeletedAt.IsZero() {
+            comments = append(comments, comment.Comment)
+        }
+    }
+    sort.Slice(comments, func(i, j int) bool {
+        if comments[i].Date.Equal(comments[j].Date) {
+            a, _ := parseID(comments[i].Id)
+            b, _ := parseID(comments[j].Id)
+            return a > b
+        }
+        return comments[i].Date.After(comments[j].Date)
+    })
+    return comments, nil
+}
+
+// Gets up to limit posts, newest first, following a cursor. Only posts using tag
+// are included unless it is empty.
+func (s *memoryStore) GetPostsAfter(tag string, after Cursor, limit int) ([]Post, error) {
+    all, err := s.GetAllPosts()
+    if err != nil {
+        return nil, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    posts := []Post{}
+    for _, post := range all {
+        if len(posts) == limit {
+            break
+        }
+        n, _ := parseID(post.Id)
+        if after.before(post.Date, post.Id) && (tag == "" || contains(s.tags[n], tag)) {
+            posts = append(posts, post)
+        }
+    }
+    return posts, nil
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Replaces the hashtags of a post. They are counted from when the post was
+// written, so createdAt is not needed.
+func (s *memoryStore) SetTags(postID string, tags []string, createdAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(postID)
+    if err != nil {
+        return err
+    }
+    if _, ok := s.posts[n]; !ok {
+        return fmt.Errorf("Post %s does not exist.", postID)
+    }
+    s.tags[n] = tags
+    return nil
+}
+
+// Counts the visible posts using each hashtag since a time, or ever when it is
+// zero. Returns the limit most used tags, or all of them when limit is zero.
+func (s *memoryStore) GetTags(since time.Time, limit int) ([]TagCount, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    counts := make(map[string]int)
+    for n, tags := range s.tags {
+        post, ok := s.post(n)
+        if !ok || post.Hidden || post.Date.Before(since) {
+            continue
+        }
+        for _, tag := range tags {
+            counts[tag]++
+        }
+    }
+    tags := []TagCount{}
+    for tag, count := range counts {
+        tags = append(tags, TagCount{tag, count})
+    }
+    sortTags(tags)
+    if limit > 0 && len(tags) > limit {
+        tags = tags[:limit]
+    }
+    return tags, nil
+}
+
+// Gets up to limit comments on a post, newest first, following a cursor
+func (s *memoryStore) GetCommentsAfter(postID string, after Cursor, limit int) ([]Comment, error) {
+    all, err := s.GetComments(postID)
+    if err != nil {
+        return nil, err
+    }
+    comments := []Comment{}
+    for _, comment := range all {
+        if len(comments) == limit {
+            break
+        }
+        if after.before(comment.Date, comment.Id) {
+            comments = append(comments, comment)
+        }
+    }
+    return comments, nil
+}
+
+// Finds up to limit posts and comments matching a search, best match first
+func (s *memoryStore) Search(q SearchQuery, limit int) ([]SearchResult, error) {
+    return s.index.search(q, limit, s.searchDocs)
+}
+
+// Copies every post and comment outside the trash into search documents
+func (s *memoryStore) searchDocs() ([]searchDoc, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var docs []searchDoc
+    for n, post := range s.posts {
+        if post.DeletedAt.IsZero() {
+            docs = append(docs, searchDoc{entity: PostEntity, id: n, postID: post.Id, author: post.Author,
+                content: post.Content, date: post.Date, hidden: post.Hidden})
+        }
+    }
+    for n, comment := range s.comments {
+        pid, _ := parseID(comment.postID)
+        if _, ok := s.post(pid); ok && comment.DeletedAt.IsZero() {
+            docs = append(docs, searchDoc{entity: CommentEntity, id: n, postID: comment.postID, author: comment.Author,
+                content: comment.Content, date: comment.Date, hidden: comment.Hidden})
+        }
+    }
+    return docs, nil
+}
+
+// Retrieves a post with a given id
+func (s *memoryStore) GetPost(id string) (Post, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(id)
+    if err != nil {
+        return Post{}, err
+    }
+    post, ok := s.post(n)
+    if !ok {
+        return Post{}, fmt.Errorf("Post %s does not exist.", id)
+    }
+    return *post, nil
+}
+
+// Retrieves a comment with a given id
+func (s *memoryStore) GetComment(id string) (Comment, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(id)
+    if err != nil {
+        return Comment{}, err
+    }
+    comment, ok := s.comment(n)
+    if !ok {
+        return Comment{}, fmt.Errorf("Comment %s does not exist.", id)
+    }
+    return comment.Comment, nil
+}
+
+// Gets the author of a post or comment
+func (s *memoryStore) GetAuthor(entity Entity, id string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return "", err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return "", err
+    }
+    switch entity {
+    case PostEntity:
+        if post, ok := s.post(n); ok {
+            return post.Author, nil
+        }
+    case CommentEntity:
+        if comment, ok := s.comment(n); ok {
+            return comment.Author, nil
+        }
+    }
+    return "", fmt.Errorf("%s with id:%s does not exist", entity, id)
+}
+
+// Gets the post id from a comment id
+func (s *memoryStore) GetPostIDFromCommentID(commentID string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, err := parseID(commentID)
+    if err != nil {
+        return "", err
+    }
+    comment, ok := s.comments[n]
+    if !ok {
+        return "", fmt.Errorf("Comment %s cannot be linked to a post", commentID)
+    }
+    return comment.postID, nil
+}
+
+// Returns the number of likes associate with a post or comment
+func (s *memoryStore) GetLikes(entity Entity, id string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    likes, _, err := s.counters(entity, id)
+    if err != nil {
+        return 0, err
+    }
+    return *likes, nil
+}
+
+// Hides or shows a post or comment, recording who hid it
+func (s *memoryStore) SetHidden(entity Entity, id string, hidden bool, actor string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    if !hidden {
+        actor = ""
+    }
+    switch entity {
+    case PostEntity:
+        if post, ok := s.post(n); ok {
+            post.Hidden, post.HiddenBy = hidden, actor
+            s.index.setHidden(entity, id, hidden)
+            return nil
+        }
+    case CommentEntity:
+        if comment, ok := s.comment(n); ok {
+            comment.Hidden, comment.HiddenBy = hidden, actor
+            s.index.setHidden(entity, id, hidden)
+            return nil
+        }
+    }
+    return fmt.Errorf("%s with id:%s does not exist", entity, id)
+}
+
+// Resolves names against the users and records the users a post or comment
+// mentions. Returns the users that were not mentioned in it before.
+func (s *memoryStore) AddMentions(entity Entity, id string, usernames []string) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    mentioned := []string{}
+    for _, username := range usernames {
+        key := voteKey{username, entity, n}
+        if _, ok := s.users[username]; !ok || s.mentions[key] {
+            continue
+        }
+        s.mentions[key] = true
+        mentioned = append(mentioned, username)
+    }
+    return mentioned, nil
+}
+
+// Returns the users mentioned in a post or comment, ordered by name
+func (s *memoryStore) GetMentions(entity Entity, id string) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    n, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    mentions := []string{}
+    for key := range s.mentions {
+        if key.entity == entity && key.id == n {
+            mentions = append(mentions, key.username)
+        }
+    }
+    sort.Strings(mentions)
+    return mentions, nil
+}
+
+// Stores a notification, created now
+func (s *memoryStore) AddNotification(notification Notification) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastNotificationID++
+    notification.Id = strconv.FormatInt(s.lastNotificationID, 10)
+    notification.CreatedAt = now()
+    notification.ReadAt = time.Time{}
+    s.notifications = append(s.notifications, notification)
+    return nil
+}
+
+// Returns a user's most recent notifications, newest first, only unread ones if unread is set
+func (s *memoryStore) GetNotifications(username string, unread bool, limit int) ([]Notification, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    notifications := []Notification{}
+    for i := len(s.notifications) - 1; i >= 0 && len(notifications) < limit; i-- {
+        notification := s.notifications[i]
+        if notification.Username == username && (!unread || notification.ReadAt.IsZero()) {
+            notifications = append(notifications, notification)
+        }
+    }
+    return notifications, nil
+}
+
+// Counts a user's unread notifications
+func (s *memoryStore) CountUnread(username string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    count := 0
+    for _, notification := range s.notifications {
+        if notification.Username == username && notification.ReadAt.IsZero() {
+            count++
+        }
+    }
+    return count, nil
+}
+
+// Marks one of a user's notifications read at readAt, if it is unread
+func (s *memoryStore) ReadNotification(username string, id string, readAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.notifications {
+        if s.notifications[i].Id == id && s.notifications[i].Username == username {
+            if s.notifications[i].ReadAt.IsZero() {
+                s.notifications[i].ReadAt = readAt
+            }
+            return nil
+        }
+    }
+    return fmt.Errorf("Notification %s does not exist", id)
+}
+
+// Marks every unread notification of a user read at readAt
+func (s *memoryStore) ReadNotifications(username string, readAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.notifications {
+        if s.notifications[i].Username == username && s.notifications[i].ReadAt.IsZero() {
+            s.notifications[i].ReadAt = readAt
+        }
+    }
+    return nil
+}
+
+// Permanently deletes notifications created before a time
+func (s *memoryStore) PruneNotifications(before time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var kept []Notification
+    for _, notification := range s.notifications {
+        if !notification.CreatedAt.Before(before) {
+            kept = append(kept, notification)
+        }
+    }
+    pruned := int64(len(s.notifications) - len(kept))
+    s.notifications = kept
+    return pruned, nil
+}
+
+// Returns the kinds of notification a user turned on or off
+func (s *memoryStore) GetNotificationPreferences(username string) (map[string]bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    preferences := make(map[string]bool)
+    for kind, enabled := range s.preferences[username] {
+        preferences[kind] = enabled
+    }
+    return preferences, nil
+}
+
+// Turns a kind of notification on or off for a user
+func (s *memoryStore) SetNotificationPreference(username string, kind string, enabled bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.preferences[username] == nil {
+        s.preferences[username] = make(map[string]bool)
+    }
+    s.preferences[username][kind] = enabled
+    return nil
+}
+
+// Records a moderation action
+func (s *memoryStore) AddModerationEntry(entry ModerationEntry) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry.Id = strconv.Itoa(len(s.moderationLog) + 1)
+    entry.CreatedAt = now()
+    s.moderationLog = append(s.moderationLog, entry)
+    return nil
+}
+
+// Returns the most recent moderation actions, newest first
+func (s *memoryStore) GetModerationLog(limit int) ([]ModerationEntry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var entries []ModerationEntry
+    for i := len(s.moderationLog) - 1; i >= 0 && len(entries) < limit; i-- {
+        entries = append(entries, s.moderationLog[i])
+    }
+    return entries, nil
+}
+
+// Gets people
+func (s *memoryStore) Getpeople() ([]Person, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]Person(nil), s.people...), nil
+}
+
+// Adds a person
+func (s *memoryStore) Addperson(person Person) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.people = append(s.people, person)
+    return nil
+}
+
+// Adds an event to the outbox, returning its id
+func (s *memoryStore) AddOutboxEvent(e Event) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastOutboxID++
+    e.Id = s.lastOutboxID
+    s.outbox = append(s.outbox, e)
+    return e.Id, nil
+}
+
+// Gets up to limit events from the outbox with ids after after, in order of id
+func (s *memoryStore) GetOutboxEvents(after int64, limit int) ([]Event, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    events := []Event{}
+    for _, e := range s.outbox {
+        if e.Id > after && len(events) < limit {
+            events = append(events, e)
+        }
+    }
+    return events, nil
+}
+
+// Returns the id of the last event added to the outbox, 0 if there are none
+func (s *memoryStore) LastOutboxEventID() (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.lastOutboxID, nil
+}
+
+// Deletes the outbox events published before a time
+func (s *memoryStore) PruneOutbox(before time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var kept []Event
+    for _, e := range s.outbox {
+        if !e.Date.Before(before) {
+            kept = append(kept, e)
+        }
+    }
+    pruned := int64(len(s.outbox) - len(kept))
+    s.outbox = kept
+    return pruned, nil
+}
+
+// Registers a webhook, returning its id
+func (s *memoryStore) AddWebhook(webhook Webhook) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastWebhookID++
+    webhook.Id = strconv.FormatInt(s.lastWebhookID, 10)
+    webhook.Events = append([]string(nil), webhook.Events...)
+    s.webhooks = append(s.webhooks, webhook)
+    return webhook.Id, nil
+}
+
+// Retrieves a webhook with a given id
+func (s *memoryStore) GetWebhook(id string) (Webhook, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, webhook := range s.webhooks {
+        if webhook.Id == id {
+            return webhook, nil
+        }
+    }
+    return Webhook{}, fmt.Errorf("Webhook %s does not exist.", id)
+}
+
+// Lists a user's webhooks, or every webhook when username is empty, oldest first
+func (s *memoryStore) GetWebhooks(username string) ([]Webhook, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    webhooks := []Webhook{}
+    for _, webhook := range s.webhooks {
+        if username == "" || webhook.Username == username {
+            webhooks = append(webhooks, webhook)
+        }
+    }
+    return webhooks, nil
+}
+
+// Saves the URL, events, state and failure count of a webhook
+func (s *memoryStore) UpdateWebhook(webhook Webhook) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.webhooks {
+        if s.webhooks[i].Id == webhook.Id {
+            s.webhooks[i].URL = webhook.URL
+            s.webhooks[i].Events = append([]string(nil), webhook.Events...)
+            s.webhooks[i].Enabled = webhook.Enabled
+            s.webhooks[i].Failures = webhook.Failures
+            s.webhooks[i].DisabledAt = webhook.DisabledAt
+            return nil
+        }
+    }
+    return fmt.Errorf("Webhook %s does not exist.", webhook.Id)
+}
+
+// Counts a failure against a webhook and disables it at limit failures in a row
+func (s *memoryStore) RecordWebhookFailure(id string, limit int, now time.Time) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.webhooks {
+        if s.webhooks[i].Id == id {
+            webhook := &s.webhooks[i]
+            webhook.Failures++
+            if webhook.Enabled && webhook.Failures >= limit {
+                webhook.Enabled = false
+                webhook.DisabledAt = now
+                return true, nil
+            }
+            return false, nil
+        }
+    }
+    return false, fmt.Errorf("Webhook %s does not exist.", id)
+}
+
+// Forgets a webhook's failures
+func (s *memoryStore) ResetWebhookFailures(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.webhooks {
+        if s.webhooks[i].Id == id {
+            s.webhooks[i].Failures = 0
+            return nil
+        }
+    }
+    return fmt.Errorf("Webhook %s does not exist.", id)
+}
+
+// Deletes a webhook and its deliveries
+func (s *memoryStore) DeleteWebhook(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    found := false
+    var webhooks []Webhook
+    for _, webhook := range s.webhooks {
+        if webhook.Id == id {
+            found = true
+        } else {
+            webhooks = append(webhooks, webhook)
+        }
+    }
+    if !found {
+        return fmt.Errorf("Webhook %s does not exist.", id)
+    }
+    s.webhooks = webhooks
+    var deliveries []WebhookDelivery
+    for _, delivery := range s.deliveries {
+        if delivery.WebhookId != id {
+            deliveries = append(deliveries, delivery)
+        }
+    }
+    s.deliveries = deliveries
+    return nil
+}
+
+// Queues a delivery, returning its id
+func (s *memoryStore) AddWebhookDelivery(delivery WebhookDelivery) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastDeliveryID++
+    delivery.Id = strconv.FormatInt(s.lastDeliveryID, 10)
+    s.deliveries = append(s.deliveries, delivery)
+    return delivery.Id, nil
+}
+
+// Retrieves a delivery with a given id
+func (s *memoryStore) GetWebhookDelivery(id string) (WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, delivery := range s.deliveries {
+        if delivery.Id == id {
+            return delivery, nil
+        }
+    }
+    return WebhookDelivery{}, fmt.Errorf("Delivery %s does not exist.", id)
+}
+
+// Returns up to limit of a webhook's deliveries, newest first
+func (s *memoryStore) GetWebhookDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    deliveries := []WebhookDelivery{}
+    for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+        if s.deliveries[i].WebhookId == webhookID {
+            deliveries = append(deliveries, s.deliveries[i])
+        }
+    }
+    return deliveries, nil
+}
+
+// Claims up to limit pending deliveries due by due, for enabled webhooks, by
+// putting their next attempt off until until
+func (s *memoryStore) ClaimWebhookDeliveries(due time.Time, until time.Time, limit int) ([]WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    enabled := make(map[string]bool)
+    for _, webhook := range s.webhooks {
+        enabled[webhook.Id] = webhook.Enabled
+    }
+    claimed := []WebhookDelivery{}
+    for i := range s.deliveries {
+        delivery := &s.deliveries[i]
+        if len(claimed) < limit && delivery.Status == DeliveryPending && enabled[delivery.WebhookId] &&
+            !delivery.NextAttemptAt.After(due) {
+            delivery.NextAttemptAt = until
+            claimed = append(claimed, *delivery)
+        }
+    }
+    return claimed, nil
+}
+
+// Saves the status and outcome of the last attempt of a delivery
+func (s *memoryStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := range s.deliveries {
+        if s.deliveries[i].Id == delivery.Id {
+            s.deliveries[i] = delivery
+            return nil
+        }
+    }
+    return fmt.Errorf("Delivery %s does not exist.", delivery.Id)
+}
+
+// Deletes deliveries created before a time that are no longer pending
+func (s *memoryStore) PruneWebhookDeliveries(before time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var kept []WebhookDelivery
+    for _, delivery := range s.deliveries {
+        if delivery.Status == DeliveryPending || !delivery.CreatedAt.Before(before) {
+            kept = append(kept, delivery)
+        }
+    }
+    pruned := int64(len(s.deliveries) - len(kept))
+    s.deliveries = kept
+    return pruned, nil
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+    "html"
+    "strings"
+    "unicode"
+    "net/url"
+    "unicode/utf8"
+)
+
+func mentionRune(r rune) bool {
+    return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// Byte offsets of the @ and the end of the name of each mention in content. An @
+// only starts a mention at the beginning of a word, so email addresses are not
+// mentions, and a trailing full stop ends the sentence rather than the name.
+func findMentions(content string) [][2]int {
+    var found [][2]int
+    prev := ' '
+    for i, r := range content {
+        if r == '@' && !mentionRune(prev) && prev != '@' {
+            end := i + 1
+            for end < len(content) {
+                next, size := utf8.DecodeRuneInString(content[end:])
+                if !mentionRune(next) {
+                    break
+                }
+                end += size
+            }
+            for end > i + 1 && content[end-1] == '.' {
+                end--
+            }
+            if end > i + 1 && end - i - 1 <= 50 {
+                found = append(found, [2]int{i, end})
+            }
+        }
+        prev = r
+    }
+    return found
+}
+
+// Returns the distinct names mentioned with @name in content, in order of first use
+func ParseMentions(content string) []string {
+    names := []string{}
+    seen := make(map[string]bool)
+    for _, m := range findMentions(content) {
+        name := content[m[0]+1:m[1]]
+        if !seen[name] {
+            seen[name] = true
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// Returns content as HTML with the mentions of users in mentions linked to their posts
+func LinkMentions(content string, mentions []string) string {
+    var b strings.Builder
+    at := 0
+    for _, m := range findMentions(content) {
+        name := content[m[0]+1:m[1]]
+        for _, username := range mentions {
+            if strings.EqualFold(name, username) {
+                b.WriteString(html.EscapeString(content[at:m[0]]))
+                b.WriteString(`<a class="mention" href="https://localhost/search?q=author:`+url.QueryEscape(username)+`">`)
+                b.WriteString(html.EscapeString(content[m[0]:m[1]])+"</a>")
+                at = m[1]
+                break
+            }
+        }
+    }
+    b.WriteString(html.EscapeString(content[at:]))
+    return b.String()
+}
+
+// Records the users mentioned in a post or comment and notifies those not
+// mentioned in it before. postID is the post itself or the post a comment is on.
+// Returns the users notified.
+func mention(entity Entity, id string, postID string, content string, author string) ([]string, error) {
+    names := ParseMentions(content)
+    if len(names) == 0 {
+        return nil, nil
+    }
+    mentioned, err := store.AddMentions(entity, id, names)
+    if err != nil {
+        return nil, err
+    }
+    for _, username := range mentioned {
+        err = notify(Notification{
+            Username: username,
+            Kind: MentionNotification,
+            Actor: author,
+            Entity: entity,
+            EntityId: id,
+            PostId: postID,
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return mentioned, nil
+}
+
+// Returns the users mentioned in a post or comment
+func GetMentions(entity Entity, id string) ([]string, error) {
+    return store.GetMentions(entity, id)
+}
+
+// Sets Mentions on posts and their comments
+func LoadMentions(posts []Post) error {
+    for i := range posts {
+        mentions, err := store.GetMentions(PostEntity, posts[i].Id)
+        if err != nil {
+            return err
+        }
+        posts[i].Mentions = mentions
+        err = LoadCommentMentions(posts[i].Comments)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Sets Mentions on comments
+func LoadCommentMentions(comments []Comment) error {
+    for i := range comments {
+        mentions, err := store.GetMentions(CommentEntity, comments[i].Id)
+        if err != nil {
+            return err
+        }
+        comments[i].Mentions = mentions
+    }
+    return nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+    "os"
+    "fmt"
+    "database/sql"
+    "gitlab.sas.com/lomich/kind-app/db/migrations"
+)
+
+// Applies pending migrations to a freshly opened database
+func migrate(conn *sql.DB, dialect string) error {
+    m, err := migrations.New(conn, dialect)
+    if err != nil {
+        return err
+    }
+    _, err = m.Up()
+    return err
+}
+
+// Opens the database named by DB_DRIVER for the migrate command.
+// The returned function closes the connection.
+func OpenMigrator() (*migrations.Migrator, func() error, error) {
+    var conn *sql.DB
+    var dialect string
+    var err error
+    switch driver := os.Getenv("DB_DRIVER"); driver {
+    case "", "mysql":
+        dialect = migrations.MySQL
+        conn, err = openMySQL(os.Getenv("MYSQL_URL")+":3306", "root", os.Getenv("MYSQL_ROOT_PASSWORD"))
+    case "sqlite":
+        dialect = migrations.SQLite
+        conn, err = openSQLite(sqlitePath())
+    case "memory":
+        return nil, nil, fmt.Errorf("The memory store has no schema to migrate")
+    default:
+        return nil, nil, fmt.Errorf("Unknown DB_DRIVER %q, expected mysql, sqlite or memory", driver)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    m, err := migrations.New(conn, dialect)
+    if err != nil {
+        conn.Close()
+        return nil, nil, err
+    }
+    return m, conn.Close, nil
+}
@@ -0,0 +1,54 @@
+package migrations
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "database/sql"
+)
+
+// Name of the MySQL advisory lock held while migrating
+const lockName = "kindapp_schema_migrations"
+
+// Takes the migration lock on conn so that only one replica migrates at a time.
+// The returned function releases it, committing the work when ok is true.
+func lock(ctx context.Context, conn *sql.Conn, dialect string, timeout time.Duration) (func(ok bool) error, error) {
+    switch dialect {
+    case MySQL:
+        // Advisory lock shared by every replica connected to the server
+        var acquired sql.NullInt64
+        err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(timeout.Seconds())).Scan(&acquired)
+        if err != nil {
+            return nil, fmt.Errorf("Error acquiring migration lock: %v", err)
+        }
+        if !acquired.Valid || acquired.Int64 != 1 {
+            return nil, fmt.Errorf("Timed out after %v waiting for migration lock", timeout)
+        }
+        return func(ok bool) error {
+            _, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", lockName)
+            if err != nil {
+                return fmt.Errorf("Error releasing migration lock: %v", err)
+            }
+            return nil
+        }, nil
+    case SQLite:
+        // SQLite DDL is transactional, an immediate transaction holds the
+        // database write lock and rolls back every statement on failure
+        _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+        if err != nil {
+            return nil, fmt.Errorf("Error acquiring migration lock: %v", err)
+        }
+        return func(ok bool) error {
+            end := "COMMIT"
+            if !ok {
+                end = "ROLLBACK"
+            }
+            _, err := conn.ExecContext(context.Background(), end)
+            if err != nil {
+                return fmt.Errorf("Error releasing migration lock: %v", err)
+            }
+            return nil
+        }, nil
+    }
+    return nil, fmt.Errorf("Unknown dialect %q", dialect)
+}
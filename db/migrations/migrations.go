@@ -0,0 +1,297 @@
+// Package migrations applies versioned schema changes to the MySQL and SQLite backends.
+//
+// Migrations live in <dialect>/NNNN_name.up.sql and NNNN_name.down.sql, are
+// applied in version order and recorded with a checksum of their up script in
+// the schema_migrations table.
+package migrations
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "embed"
+    "context"
+    "strconv"
+    "strings"
+    "io/fs"
+    "database/sql"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql
+var files embed.FS
+
+const (
+    MySQL = "mysql"
+    SQLite = "sqlite"
+)
+
+type Migration struct {
+    Version int
+    Name string
+    Up string
+    Down string
+    Checksum string
+}
+
+// State of a single migration in a database
+type Status struct {
+    Migration
+    Applied bool
+    AppliedAt time.Time
+    // Set when the applied checksum no longer matches the migration file
+    Modified bool
+}
+
+type Migrator struct {
+    db *sql.DB
+    dialect string
+    migrations []Migration
+    // Maximum time to wait for another replica to release the migration lock
+    LockTimeout time.Duration
+}
+
+// Creates a migrator for a database of the given dialect
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+    migrations, err := Load(dialect)
+    if err != nil {
+        return nil, err
+    }
+    return &Migrator{db: db, dialect: dialect, migrations: migrations, LockTimeout: time.Minute}, nil
+}
+
+// Loads the embedded migrations for a dialect in version order
+func Load(dialect string) ([]Migration, error) {
+    entries, err := fs.ReadDir(files, dialect)
+    if err != nil {
+        return nil, fmt.Errorf("No migrations for dialect %q: %v", dialect, err)
+    }
+    byVersion := make(map[int]*Migration)
+    for _, entry := range entries {
+        name := entry.Name()
+        var direction string
+        switch {
+        case strings.HasSuffix(name, ".up.sql"):
+            direction = "up"
+        case strings.HasSuffix(name, ".down.sql"):
+            direction = "down"
+        default:
+            continue
+        }
+        base := strings.TrimSuffix(name, "."+direction+".sql")
+        parts := strings.SplitN(base, "_", 2)
+        version, err := strconv.Atoi(parts[0])
+        if err != nil || len(parts) != 2 {
+            return nil, fmt.Errorf("Invalid migration file name %s", name)
+        }
+        content, err := files.ReadFile(dialect+"/"+name)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading migration %s: %v", name, err)
+        }
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: parts[1]}
+            byVersion[version] = m
+        } else if m.Name != parts[1] {
+            return nil, fmt.Errorf("Migration %d has conflicting names %s and %s", version, m.Name, parts[1])
+        }
+        if direction == "up" {
+            m.Up = string(content)
+            sum := sha256.Sum256(content)
+            m.Checksum = hex.EncodeToString(sum[:])
+        } else {
+            m.Down = string(content)
+        }
+    }
+    var migrations []Migration
+    for _, m := range byVersion {
+        if m.Checksum == "" {
+            return nil, fmt.Errorf("Migration %d_%s has no up script", m.Version, m.Name)
+        }
+        migrations = append(migrations, *m)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    return migrations, nil
+}
+
+// Splits a script into individual statements on semicolons ending a line
+func statements(script string) []string {
+    var stmts []string
+    var current []string
+    for _, line := range strings.Split(script, "\n") {
+        trimmed := strings.TrimSpace(line)
+        if strings.HasPrefix(trimmed, "--") {
+            continue
+        }
+        if strings.HasSuffix(trimmed, ";") {
+            current = append(current, strings.TrimSuffix(trimmed, ";"))
+            stmt := strings.TrimSpace(strings.Join(current, "\n"))
+            if stmt != "" {
+                stmts = append(stmts, stmt)
+            }
+            current = nil
+        } else {
+            current = append(current, line)
+        }
+    }
+    if stmt := strings.TrimSpace(strings.Join(current, "\n")); stmt != "" {
+        stmts = append(stmts, stmt)
+    }
+    return stmts
+}
+
+// Creates the table recording applied migrations
+func ensureTable(ctx context.Context, conn *sql.Conn) error {
+    _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+        version BIGINT NOT NULL, name VARCHAR(255) NOT NULL, checksum CHAR(64) NOT NULL,
+        applied_at DATETIME DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (version))`)
+    if err != nil {
+        return fmt.Errorf("Error creating table schema_migrations: %v", err)
+    }
+    return nil
+}
+
+// Applied migration as recorded in schema_migrations
+type record struct {
+    checksum string
+    appliedAt time.Time
+}
+
+// Reads the applied migrations
+func applied(ctx context.Context, conn *sql.Conn) (map[int]record, error) {
+    rows, err := conn.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from schema_migrations table: %v", err)
+    }
+    defer rows.Close()
+    records := make(map[int]record)
+    for rows.Next() {
+        var version int
+        var r record
+        err = rows.Scan(&version, &r.checksum, &r.appliedAt)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from schema_migrations rows: %v", err)
+        }
+        records[version] = r
+    }
+    return records, rows.Err()
+}
+
+// Runs fn on a dedicated connection while holding the migration lock
+func (m *Migrator) locked(fn func(ctx context.Context, conn *sql.Conn) error) error {
+    ctx := context.Background()
+    conn, err := m.db.Conn(ctx)
+    if err != nil {
+        return fmt.Errorf("Error acquiring database connection: %v", err)
+    }
+    defer conn.Close()
+
+    unlock, err := lock(ctx, conn, m.dialect, m.LockTimeout)
+    if err != nil {
+        return err
+    }
+    err = ensureTable(ctx, conn)
+    if err == nil {
+        err = fn(ctx, conn)
+    }
+    unlockErr := unlock(err == nil)
+    if err != nil {
+        return err
+    }
+    return unlockErr
+}
+
+// Returns the state of every known migration
+func (m *Migrator) Status() ([]Status, error) {
+    var statuses []Status
+    err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+        records, err := applied(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, migration := range m.migrations {
+            r, ok := records[migration.Version]
+            statuses = append(statuses, Status{
+                Migration: migration,
+                Applied: ok,
+                AppliedAt: r.appliedAt,
+                Modified: ok && r.checksum != migration.Checksum,
+            })
+        }
+        return nil
+    })
+    return statuses, err
+}
+
+// Applies all pending migrations and returns the number applied
+func (m *Migrator) Up() (int, error) {
+    count := 0
+    err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+        records, err := applied(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, migration := range m.migrations {
+            r, ok := records[migration.Version]
+            if ok {
+                if r.checksum != migration.Checksum {
+                    return fmt.Errorf("Migration %d_%s was modified after it was applied",
+                        migration.Version, migration.Name)
+                }
+                continue
+            }
+            for _, stmt := range statements(migration.Up) {
+                _, err = conn.ExecContext(ctx, stmt)
+                if err != nil {
+                    return fmt.Errorf("Error applying migration %d_%s: %v", migration.Version, migration.Name, err)
+                }
+            }
+            _, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)",
+                migration.Version, migration.Name, migration.Checksum)
+            if err != nil {
+                return fmt.Errorf("Error recording migration %d_%s: %v", migration.Version, migration.Name, err)
+            }
+            fmt.Printf("Applied migration %d_%s\n", migration.Version, migration.Name)
+            count++
+        }
+        return nil
+    })
+    return count, err
+}
+
+// Rolls back the most recently applied steps migrations
+func (m *Migrator) Down(steps int) (int, error) {
+    count := 0
+    err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+        records, err := applied(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+            migration := m.migrations[i]
+            if _, ok := records[migration.Version]; !ok {
+                continue
+            }
+            if strings.TrimSpace(migration.Down) == "" {
+                return fmt.Errorf("Migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+            }
+            for _, stmt := range statements(migration.Down) {
+                _, err = conn.ExecContext(ctx, stmt)
+                if err != nil {
+                    return fmt.Errorf("Error rolling back migration %d_%s: %v", migration.Version, migration.Name, err)
+                }
+            }
+            _, err = conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+            if err != nil {
+                return fmt.Errorf("Error removing migration record %d_%s: %v", migration.Version, migration.Name, err)
+            }
+            fmt.Printf("Rolled back migration %d_%s\n", migration.Version, migration.Name)
+            count++
+        }
+        return nil
+    })
+    return count, err
+}
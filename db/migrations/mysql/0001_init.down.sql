@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS comment;
+DROP TABLE IF EXISTS post;
+DROP TABLE IF EXISTS session;
+DROP TABLE IF EXISTS user;
+DROP TABLE IF EXISTS person;
@@ -0,0 +1,22 @@
+-- Baseline schema, matches the tables previously created by initDB
+CREATE TABLE IF NOT EXISTS person(first VARCHAR(50) NOT NULL,
+    last VARCHAR(50) NOT NULL, color VARCHAR(50) NOT NULL,
+    id INTEGER AUTO_INCREMENT, PRIMARY KEY (id));
+
+CREATE TABLE IF NOT EXISTS user(username VARCHAR(50) NOT NULL,
+    password CHAR(128) NOT NULL, id INTEGER AUTO_INCREMENT,
+    salt BINARY(16) NOT NULL, PRIMARY KEY (id));
+
+CREATE TABLE IF NOT EXISTS session(uuid VARCHAR(50) NOT NULL,
+    username VARCHAR(50) NOT NULL, PRIMARY KEY (uuid));
+
+CREATE TABLE IF NOT EXISTS post(content VARCHAR(1000) NOT NULL,
+    author VARCHAR(50) NOT NULL, date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    likes INTEGER NOT NULL DEFAULT 0, numcomments INTEGER NOT NULL DEFAULT 0,
+    id INTEGER AUTO_INCREMENT, PRIMARY KEY (id));
+
+CREATE TABLE IF NOT EXISTS comment(content VARCHAR(500) NOT NULL,
+    author VARCHAR(50) NOT NULL, date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    likes INTEGER NOT NULL DEFAULT 0, post_id INT NOT NULL,
+    id INTEGER AUTO_INCREMENT, PRIMARY KEY (id),
+    FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE ON UPDATE CASCADE);
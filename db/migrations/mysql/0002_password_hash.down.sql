@@ -0,0 +1,2 @@
+UPDATE user SET salt = '' WHERE salt IS NULL;
+ALTER TABLE user MODIFY password CHAR(128) NOT NULL, MODIFY salt BINARY(16) NOT NULL;
@@ -0,0 +1,2 @@
+-- Room for PHC formatted hashes, the salt column is only used by legacy SHA-512 hashes
+ALTER TABLE user MODIFY password VARCHAR(255) NOT NULL, MODIFY salt VARBINARY(16) NULL;
@@ -0,0 +1,7 @@
+ALTER TABLE session
+    DROP INDEX session_username,
+    DROP COLUMN created_at,
+    DROP COLUMN last_seen,
+    DROP COLUMN expires_at,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip;
@@ -0,0 +1,9 @@
+-- Session timestamps and client metadata. Sessions created before this
+-- migration have no timestamps and expire immediately.
+ALTER TABLE session
+    ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN last_seen DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN expires_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+    ADD INDEX session_username (username);
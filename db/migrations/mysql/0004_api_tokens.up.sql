@@ -0,0 +1,11 @@
+-- Server-side API refresh tokens, stored as sha256 hashes. Tokens rotated from the
+-- same login share a family so reuse of a rotated token revokes the whole family.
+CREATE TABLE refresh_token(id CHAR(64) NOT NULL, family CHAR(36) NOT NULL,
+    username VARCHAR(50) NOT NULL, access_jti CHAR(36) NOT NULL,
+    created_at DATETIME NOT NULL, expires_at DATETIME NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT FALSE, PRIMARY KEY (id),
+    INDEX refresh_token_family (family), INDEX refresh_token_username (username));
+
+-- Access token ids revoked before their expiry
+CREATE TABLE revoked_token(jti CHAR(36) NOT NULL, expires_at DATETIME NOT NULL,
+    PRIMARY KEY (jti));
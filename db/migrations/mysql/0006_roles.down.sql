@@ -0,0 +1,4 @@
+DROP TABLE moderation_log;
+ALTER TABLE comment DROP COLUMN hidden, DROP COLUMN hidden_by;
+ALTER TABLE post DROP COLUMN hidden, DROP COLUMN hidden_by;
+ALTER TABLE user DROP COLUMN role;
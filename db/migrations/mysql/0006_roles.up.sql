@@ -0,0 +1,16 @@
+-- User roles, hidden content and a log of moderator and admin actions
+ALTER TABLE user ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
+
+ALTER TABLE post
+    ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN hidden_by VARCHAR(50) NOT NULL DEFAULT '';
+
+ALTER TABLE comment
+    ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN hidden_by VARCHAR(50) NOT NULL DEFAULT '';
+
+CREATE TABLE moderation_log(id INTEGER AUTO_INCREMENT, actor VARCHAR(50) NOT NULL,
+    action VARCHAR(20) NOT NULL, entity VARCHAR(20) NOT NULL,
+    entity_id VARCHAR(50) NOT NULL, author VARCHAR(50) NOT NULL,
+    detail VARCHAR(1000) NOT NULL DEFAULT '', created_at DATETIME NOT NULL,
+    PRIMARY KEY (id));
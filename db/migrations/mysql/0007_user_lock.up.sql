@@ -0,0 +1,2 @@
+-- Locked users cannot log in or use API tokens
+ALTER TABLE user ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
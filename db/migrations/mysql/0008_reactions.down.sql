@@ -0,0 +1,3 @@
+DROP TABLE reaction;
+ALTER TABLE comment DROP COLUMN dislikes;
+ALTER TABLE post DROP COLUMN dislikes;
@@ -0,0 +1,6 @@
+-- Emoji reactions, one row per user and emoji on each post and comment.
+-- utf8mb4 is needed to store emoji outside the basic multilingual plane.
+CREATE TABLE emoji_reaction(username VARCHAR(50) NOT NULL, entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL, emoji VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    created_at DATETIME NOT NULL, PRIMARY KEY (username, entity, entity_id, emoji),
+    INDEX emoji_reaction_entity (entity, entity_id));
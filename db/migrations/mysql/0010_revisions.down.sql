@@ -0,0 +1,3 @@
+DROP TABLE revision;
+ALTER TABLE comment DROP COLUMN edited_at, DROP COLUMN edited_by;
+ALTER TABLE post DROP COLUMN edited_at, DROP COLUMN edited_by;
@@ -0,0 +1,5 @@
+-- Trashed content would reappear, so it is purged first
+DELETE FROM comment WHERE deleted_at IS NOT NULL;
+DELETE FROM post WHERE deleted_at IS NOT NULL;
+ALTER TABLE comment DROP INDEX comment_deleted_at, DROP COLUMN deleted_at, DROP COLUMN deleted_by;
+ALTER TABLE post DROP INDEX post_deleted_at, DROP COLUMN deleted_at, DROP COLUMN deleted_by;
@@ -0,0 +1,10 @@
+-- Deleted posts and comments stay in the trash until they are restored or purged
+ALTER TABLE post
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD COLUMN deleted_by VARCHAR(50) NOT NULL DEFAULT '',
+    ADD INDEX post_deleted_at (deleted_at);
+
+ALTER TABLE comment
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD COLUMN deleted_by VARCHAR(50) NOT NULL DEFAULT '',
+    ADD INDEX comment_deleted_at (deleted_at);
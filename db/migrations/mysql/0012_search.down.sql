@@ -0,0 +1,2 @@
+ALTER TABLE comment DROP INDEX comment_search;
+ALTER TABLE post DROP INDEX post_search;
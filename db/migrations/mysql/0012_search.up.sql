@@ -0,0 +1,4 @@
+-- Full text search over the content and author of posts and comments
+ALTER TABLE post ADD FULLTEXT INDEX post_search (content, author);
+
+ALTER TABLE comment ADD FULLTEXT INDEX comment_search (content, author);
@@ -0,0 +1,7 @@
+-- Hashtags used in each post, created_at being when the post was written.
+-- Posts written before this migration are tagged by running `tags rebuild`.
+CREATE TABLE post_tag(post_id INTEGER NOT NULL,
+    tag VARCHAR(50) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    created_at DATETIME NOT NULL, PRIMARY KEY (post_id, tag),
+    INDEX post_tag_tag (tag, created_at),
+    FOREIGN KEY (post_id) REFERENCES post(id) ON DELETE CASCADE ON UPDATE CASCADE);
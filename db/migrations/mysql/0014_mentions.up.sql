@@ -0,0 +1,12 @@
+-- Users mentioned with @username in a post or comment, resolved when it is written
+CREATE TABLE mention(entity VARCHAR(20) NOT NULL, entity_id INTEGER NOT NULL,
+    username VARCHAR(50) NOT NULL, PRIMARY KEY (entity, entity_id, username));
+
+-- Notifications of users, such as being mentioned. entity and entity_id are
+-- the post or comment the notification is about, read_at is NULL until it is read.
+CREATE TABLE notification(id INTEGER AUTO_INCREMENT, username VARCHAR(50) NOT NULL,
+    kind VARCHAR(20) NOT NULL, actor VARCHAR(50) NOT NULL, entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL, post_id INTEGER NOT NULL, created_at DATETIME NOT NULL,
+    read_at DATETIME NULL, PRIMARY KEY (id),
+    INDEX notification_username (username, id),
+    INDEX notification_entity (entity, entity_id));
@@ -0,0 +1,2 @@
+DROP TABLE notification_preference;
+ALTER TABLE notification DROP INDEX notification_created_at, DROP COLUMN detail;
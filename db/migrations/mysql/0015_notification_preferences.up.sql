@@ -0,0 +1,9 @@
+-- What a notification is about beyond its kind, such as the emoji of a reaction
+-- or the moderation action taken
+ALTER TABLE notification
+    ADD COLUMN detail VARCHAR(50) NOT NULL DEFAULT '',
+    ADD INDEX notification_created_at (created_at);
+
+-- Kinds of notification a user turned on or off, every kind is on without a row
+CREATE TABLE notification_preference(username VARCHAR(50) NOT NULL, kind VARCHAR(20) NOT NULL,
+    enabled BOOLEAN NOT NULL, PRIMARY KEY (username, kind));
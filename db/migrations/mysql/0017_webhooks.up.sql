@@ -0,0 +1,18 @@
+-- Endpoints users registered to be sent post and comment events. events is a
+-- space separated list of event types, failures counts the failed attempts since
+-- the last success and the webhook is disabled when there are too many.
+CREATE TABLE webhook(id INTEGER AUTO_INCREMENT, username VARCHAR(50) NOT NULL,
+    url VARCHAR(2000) NOT NULL, secret VARCHAR(100) NOT NULL, events VARCHAR(255) NOT NULL,
+    enabled BOOLEAN NOT NULL, failures INTEGER NOT NULL DEFAULT 0, created_at DATETIME NOT NULL,
+    disabled_at DATETIME NULL, PRIMARY KEY (id),
+    INDEX webhook_username (username));
+
+-- Events queued for a webhook and the outcome of the last attempt to send them.
+-- Pending deliveries are sent once next_attempt_at has passed.
+CREATE TABLE webhook_delivery(id INTEGER AUTO_INCREMENT, webhook_id INTEGER NOT NULL,
+    event VARCHAR(30) NOT NULL, payload TEXT NOT NULL, status VARCHAR(20) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0, next_attempt_at DATETIME NOT NULL,
+    response_code INTEGER NOT NULL DEFAULT 0, error VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL, delivered_at DATETIME NULL, PRIMARY KEY (id),
+    INDEX webhook_delivery_due (status, next_attempt_at),
+    INDEX webhook_delivery_webhook (webhook_id, id));
@@ -0,0 +1,6 @@
+CREATE TABLE user_old(username VARCHAR(50) NOT NULL,
+    password CHAR(128) NOT NULL, id INTEGER PRIMARY KEY AUTOINCREMENT,
+    salt BINARY(16) NOT NULL);
+INSERT INTO user_old (username, password, id, salt) SELECT username, password, id, COALESCE(salt, X'') FROM user;
+DROP TABLE user;
+ALTER TABLE user_old RENAME TO user;
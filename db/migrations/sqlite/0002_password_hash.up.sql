@@ -0,0 +1,7 @@
+-- Room for PHC formatted hashes, the salt column is only used by legacy SHA-512 hashes
+CREATE TABLE user_new(username VARCHAR(50) NOT NULL,
+    password VARCHAR(255) NOT NULL, id INTEGER PRIMARY KEY AUTOINCREMENT,
+    salt BINARY(16));
+INSERT INTO user_new (username, password, id, salt) SELECT username, password, id, salt FROM user;
+DROP TABLE user;
+ALTER TABLE user_new RENAME TO user;
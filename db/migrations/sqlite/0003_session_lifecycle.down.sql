@@ -0,0 +1,6 @@
+DROP INDEX session_username;
+ALTER TABLE session DROP COLUMN created_at;
+ALTER TABLE session DROP COLUMN last_seen;
+ALTER TABLE session DROP COLUMN expires_at;
+ALTER TABLE session DROP COLUMN user_agent;
+ALTER TABLE session DROP COLUMN ip;
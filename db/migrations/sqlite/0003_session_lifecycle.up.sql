@@ -0,0 +1,8 @@
+-- Session timestamps and client metadata. Sessions created before this
+-- migration have no timestamps and expire immediately.
+ALTER TABLE session ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE session ADD COLUMN last_seen DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE session ADD COLUMN expires_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE session ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '';
+CREATE INDEX session_username ON session(username);
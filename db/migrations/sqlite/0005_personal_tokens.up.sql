@@ -0,0 +1,8 @@
+-- Named long-lived API tokens for automation, stored as sha256 hashes.
+-- scopes is a space separated list such as "posts:read comments:write".
+CREATE TABLE personal_token(id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(50) NOT NULL,
+    username VARCHAR(50) NOT NULL, token_hash CHAR(64) NOT NULL,
+    scopes VARCHAR(255) NOT NULL, created_at DATETIME NOT NULL,
+    last_used DATETIME NULL, expires_at DATETIME NOT NULL);
+CREATE UNIQUE INDEX personal_token_hash ON personal_token(token_hash);
+CREATE INDEX personal_token_username ON personal_token(username);
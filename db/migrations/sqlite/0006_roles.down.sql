@@ -0,0 +1,6 @@
+DROP TABLE moderation_log;
+ALTER TABLE comment DROP COLUMN hidden_by;
+ALTER TABLE comment DROP COLUMN hidden;
+ALTER TABLE post DROP COLUMN hidden_by;
+ALTER TABLE post DROP COLUMN hidden;
+ALTER TABLE user DROP COLUMN role;
@@ -0,0 +1,9 @@
+-- One like or dislike per user on each post and comment. value is 1 for a like
+-- and -1 for a dislike; the likes and dislikes columns count them.
+ALTER TABLE post ADD COLUMN dislikes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE comment ADD COLUMN dislikes INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE reaction(username VARCHAR(50) NOT NULL, entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL, value INTEGER NOT NULL, created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, entity, entity_id));
+CREATE INDEX reaction_entity ON reaction(entity, entity_id);
@@ -0,0 +1,5 @@
+-- Emoji reactions, one row per user and emoji on each post and comment
+CREATE TABLE emoji_reaction(username VARCHAR(50) NOT NULL, entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL, emoji VARCHAR(32) NOT NULL, created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, entity, entity_id, emoji));
+CREATE INDEX emoji_reaction_entity ON emoji_reaction(entity, entity_id);
@@ -0,0 +1,5 @@
+DROP TABLE revision;
+ALTER TABLE comment DROP COLUMN edited_by;
+ALTER TABLE comment DROP COLUMN edited_at;
+ALTER TABLE post DROP COLUMN edited_by;
+ALTER TABLE post DROP COLUMN edited_at;
@@ -0,0 +1,12 @@
+-- Edits to posts and comments. Every replaced version is kept in revision along
+-- with who wrote it and when.
+ALTER TABLE post ADD COLUMN edited_at DATETIME NULL;
+ALTER TABLE post ADD COLUMN edited_by VARCHAR(50) NOT NULL DEFAULT '';
+
+ALTER TABLE comment ADD COLUMN edited_at DATETIME NULL;
+ALTER TABLE comment ADD COLUMN edited_by VARCHAR(50) NOT NULL DEFAULT '';
+
+CREATE TABLE revision(id INTEGER PRIMARY KEY AUTOINCREMENT, entity VARCHAR(20) NOT NULL,
+    entity_id INTEGER NOT NULL, content VARCHAR(1000) NOT NULL,
+    editor VARCHAR(50) NOT NULL, created_at DATETIME NOT NULL);
+CREATE INDEX revision_entity ON revision(entity, entity_id);
@@ -0,0 +1,9 @@
+-- Trashed content would reappear, so it is purged first
+DELETE FROM comment WHERE deleted_at IS NOT NULL;
+DELETE FROM post WHERE deleted_at IS NOT NULL;
+DROP INDEX comment_deleted_at;
+ALTER TABLE comment DROP COLUMN deleted_by;
+ALTER TABLE comment DROP COLUMN deleted_at;
+DROP INDEX post_deleted_at;
+ALTER TABLE post DROP COLUMN deleted_by;
+ALTER TABLE post DROP COLUMN deleted_at;
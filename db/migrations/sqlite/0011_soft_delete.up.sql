@@ -0,0 +1,8 @@
+-- Deleted posts and comments stay in the trash until they are restored or purged
+ALTER TABLE post ADD COLUMN deleted_at DATETIME NULL;
+ALTER TABLE post ADD COLUMN deleted_by VARCHAR(50) NOT NULL DEFAULT '';
+CREATE INDEX post_deleted_at ON post(deleted_at);
+
+ALTER TABLE comment ADD COLUMN deleted_at DATETIME NULL;
+ALTER TABLE comment ADD COLUMN deleted_by VARCHAR(50) NOT NULL DEFAULT '';
+CREATE INDEX comment_deleted_at ON comment(deleted_at);
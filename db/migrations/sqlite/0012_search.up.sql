@@ -0,0 +1,2 @@
+-- Nothing to do, SQLite is searched through an in-process index built from the
+-- post and comment tables. Kept so versions match the MySQL migrations.
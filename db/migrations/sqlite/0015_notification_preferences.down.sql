@@ -0,0 +1,3 @@
+DROP TABLE notification_preference;
+DROP INDEX notification_created_at;
+ALTER TABLE notification DROP COLUMN detail;
@@ -0,0 +1,6 @@
+-- Events published by every replica, polled by each of them when EVENT_BROADCAST
+-- is outbox. Rows are deleted an hour after they are written.
+CREATE TABLE event_outbox(id INTEGER PRIMARY KEY AUTOINCREMENT, type VARCHAR(30) NOT NULL,
+    entity VARCHAR(20) NOT NULL, entity_id INTEGER NOT NULL, post_id INTEGER NOT NULL,
+    actor VARCHAR(50) NOT NULL, created_at DATETIME NOT NULL);
+CREATE INDEX event_outbox_created_at ON event_outbox(created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE comment DROP COLUMN version;
+ALTER TABLE post DROP COLUMN version;
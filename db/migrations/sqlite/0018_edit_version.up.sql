@@ -0,0 +1,4 @@
+-- Counts the edits of a post or comment so that an edit based on an older
+-- version is detected as a conflict
+ALTER TABLE post ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE comment ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,50 @@
+package db
+
+import (
+    "fmt"
+    "database/sql"
+    "github.com/go-sql-driver/mysql"
+    "gitlab.sas.com/lomich/kind-app/db/migrations"
+)
+
+// Opens the kindapp database on a MySQL server, creating it if needed
+func openMySQL(addr string, user string, password string) (*sql.DB, error) {
+    cfg := mysql.Config{
+        User: user,
+        Passwd: password,
+        Net: "tcp",
+        Addr: addr,
+        ParseTime: true,
+        // Report rows matched rather than changed, as SQLite does
+        ClientFoundRows: true}
+    conn, err := sql.Open("mysql", cfg.FormatDSN())
+    if err != nil {
+        return nil, fmt.Errorf("Can't connect to database: %v", err)
+    }
+    _, err = conn.Exec("CREATE DATABASE IF NOT EXISTS kindapp")
+    conn.Close()
+    if err != nil {
+        return nil, fmt.Errorf("Error creating database kindapp: %v", err)
+    }
+
+    cfg.DBName = "kindapp"
+    conn, err = sql.Open("mysql", cfg.FormatDSN())
+    if err != nil {
+        return nil, fmt.Errorf("Can't connect to database: %v", err)
+    }
+    return conn, nil
+}
+
+// Opens the kindapp database on a MySQL server and migrates it to the latest schema
+func NewMySQLStore(addr string, user string, password string) (Store, error) {
+    conn, err := openMySQL(addr, user, password)
+    if err != nil {
+        return nil, err
+    }
+    err = migrate(conn, migrations.MySQL)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return newSQLStore(conn), nil
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+    "fmt"
+    "time"
+)
+
+// Kinds of notification
+const (
+    // Someone mentioned the user with @username
+    MentionNotification = "mention"
+    // Someone commented on the user's post
+    CommentNotification = "comment"
+    // Someone commented on a post the user commented on
+    ReplyNotification = "reply"
+    // Someone liked or reacted to the user's post or comment
+    ReactionNotification = "reaction"
+    // A moderator edited, hid, deleted or restored the user's post or comment
+    ModerationNotification = "moderation"
+)
+
+// Every kind of notification, in display order
+var NotificationKinds = []string{CommentNotification, ReplyNotification, MentionNotification,
+    ReactionNotification, ModerationNotification}
+
+// Notification of a user about a post or comment. PostId is the post itself or
+// the post a comment is on.
+type Notification struct {
+    Id string
+    Username string
+    Kind string
+    Actor string
+    Entity Entity
+    EntityId string
+    PostId string
+    // The emoji of a reaction or the action of a moderator
+    Detail string
+    CreatedAt time.Time
+    // Zero until the notification is read
+    ReadAt time.Time
+}
+
+// Checks that kind is one of NotificationKinds
+func validNotificationKind(kind string) error {
+    for _, k := range NotificationKinds {
+        if k == kind {
+            return nil
+        }
+    }
+    return fmt.Errorf("Unknown notification type %q", kind)
+}
+
+// Stores a notification unless it is about the user's own action or they turned
+// its kind off
+func notify(notification Notification) error {
+    if notification.Username == notification.Actor {
+        return nil
+    }
+    preferences, err := store.GetNotificationPreferences(notification.Username)
+    if err != nil {
+        return err
+    }
+    if enabled, ok := preferences[notification.Kind]; ok && !enabled {
+        return nil
+    }
+    err = store.AddNotification(notification)
+    if err != nil {
+        return fmt.Errorf("Error notifying %s: %v", notification.Username, err)
+    }
+    return nil
+}
+
+// Returns the post itself or the post a comment is on
+func postOf(entity Entity, id string) (string, error) {
+    if entity == CommentEntity {
+        return store.GetPostIDFromCommentID(id)
+    }
+    return id, nil
+}
+
+// Notifies the author of a post or comment of something actor did to it
+func notifyAuthor(kind string, entity Entity, id string, actor string, detail string) error {
+    author, err := store.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    postID, err := postOf(entity, id)
+    if err != nil {
+        return err
+    }
+    return notify(Notification{
+        Username: author,
+        Kind: kind,
+        Actor: actor,
+        Entity: entity,
+        EntityId: id,
+        PostId: postID,
+        Detail: detail,
+    })
+}
+
+// Notifies the author of a post of a new comment on it and the other commenters
+// of the reply, except the users in skip, who were already notified
+func notifyComment(id string, postID string, author string, skip []string) error {
+    post, err := store.GetPost(postID)
+    if err != nil {
+        return err
+    }
+    comments, err := store.GetComments(postID)
+    if err != nil {
+        return err
+    }
+    notified := map[string]bool{author: true}
+    for _, username := range skip {
+        notified[username] = true
+    }
+    kind := CommentNotification
+    recipients := []string{post.Author}
+    for _, comment := range comments {
+        recipients = append(recipients, comment.Author)
+    }
+    for _, username := range recipients {
+        if !notified[username] {
+            notified[username] = true
+            err = notify(Notification{
+                Username: username,
+                Kind: kind,
+                Actor: author,
+                Entity: CommentEntity,
+                EntityId: id,
+                PostId: postID,
+            })
+            if err != nil {
+                return err
+            }
+        }
+        // Everybody after the post author is a fellow commenter
+        kind = ReplyNotification
+    }
+    return nil
+}
+
+// Returns up to limit of a user's most recent notifications, newest first, only
+// unread ones if unread is set. A limit of 0 uses the default page size.
+func GetNotifications(username string, unread bool, limit int) ([]Notification, error) {
+    limit, err := pageSize(limit)
+    if err != nil {
+        return nil, err
+    }
+    return store.GetNotifications(username, unread, limit)
+}
+
+// Counts a user's unread notifications
+func CountUnread(username string) (int, error) {
+    return store.CountUnread(username)
+}
+
+// Marks one of a user's notifications read
+func ReadNotification(username string, id string) error {
+    return store.ReadNotification(username, id, now())
+}
+
+// Marks every notification of a user read
+func ReadNotifications(username string) error {
+    return store.ReadNotifications(username, now())
+}
+
+// Permanently deletes notifications created before a time, read or not
+func PruneNotifications(before time.Time) (int64, error) {
+    return store.PruneNotifications(before)
+}
+
+// Returns whether a user receives each kind of notification
+func GetNotificationPreferences(username string) (map[string]bool, error) {
+    stored, err := store.GetNotificationPreferences(username)
+    if err != nil {
+        return nil, err
+    }
+    preferences := make(map[string]bool)
+    for _, kind := range NotificationKinds {
+        enabled, ok := stored[kind]
+        preferences[kind] = enabled || !ok
+    }
+    return preferences, nil
+}
+
+// Turns a kind of notification on or off for a user
+func SetNotificationPreference(username string, kind string, enabled bool) error {
+    err := validNotificationKind(kind)
+    if err != nil {
+        return err
+    }
+    return store.SetNotificationPreference(username, kind, enabled)
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+    "fmt"
+    "html"
+    "math"
+    "sort"
+    "sync"
+    "time"
+    "strings"
+    "unicode"
+)
+
+// Parsed search query. Every term and phrase must match the content or author
+// of a result, which must also pass the filters.
+type SearchQuery struct {
+    Terms []string
+    Phrases []string
+    // Only content written by Author, when set
+    Author string
+    // Only content written before Before and on or after After, when set
+    Before time.Time
+    After time.Time
+}
+
+// Post or comment matching a search. PostId is the post itself or the post a
+// comment is on, Highlight the matching part of Content as HTML with the
+// matches in <mark> tags.
+type SearchResult struct {
+    Entity Entity
+    Id string
+    PostId string
+    Author string
+    Content string
+    Date time.Time
+    // Whether the post or comment, or the post a comment is on, is hidden
+    Hidden bool
+    Score float64
+    Highlight string
+}
+
+// Splits text into lower case words
+func tokenize(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+// Parses a search such as `deploy "release notes" author:alice after:2024-01-01`.
+// before: and after: take dates as YYYY-MM-DD, after: includes the day itself.
+func ParseSearch(q string) (SearchQuery, error) {
+    var query SearchQuery
+    for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+        if q[0] == '"' {
+            end := strings.IndexByte(q[1:], '"')
+            if end < 0 {
+                end = len(q) - 1
+            }
+            if words := tokenize(q[1:end+1]); len(words) > 0 {
+                query.Phrases = append(query.Phrases, strings.Join(words, " "))
+            }
+            q = q[end+1:]
+            q = strings.TrimPrefix(q, "\"")
+            continue
+        }
+        word := q
+        if i := strings.IndexAny(q, " \t\n"); i >= 0 {
+            word = q[:i]
+        }
+        q = q[len(word):]
+
+        name, value, filter := strings.Cut(word, ":")
+        switch {
+        case filter && name == "author":
+            query.Author = value
+        case filter && (name == "before" || name == "after"):
+            date, err := time.Parse("2006-01-02", value)
+            if err != nil {
+                return query, fmt.Errorf("Invalid date %q, use YYYY-MM-DD", value)
+            }
+            if name == "before" {
+                query.Before = date
+            } else {
+                query.After = date
+            }
+        default:
+            query.Terms = append(query.Terms, tokenize(word)...)
+        }
+    }
+    if len(query.Terms) == 0 && len(query.Phrases) == 0 && query.Author == "" {
+        return query, fmt.Errorf("Search for at least one word, phrase or author")
+    }
+    return query, nil
+}
+
+// Reports whether a post or comment passes the query's author and date filters
+func (q SearchQuery) filters(author string, date time.Time) bool {
+    if q.Author != "" && !strings.EqualFold(q.Author, author) {
+        return false
+    }
+    if !q.Before.IsZero() && !date.Before(q.Before) {
+        return false
+    }
+    return q.After.IsZero() || !date.Before(q.After)
+}
+
+// Words of the query's terms and phrases
+func (q SearchQuery) words() []string {
+    words := append([]string{}, q.Terms...)
+    for _, phrase := range q.Phrases {
+        words = append(words, strings.Fields(phrase)...)
+    }
+    return words
+}
+
+// Length of the text shown around the first match of a highlight
+const highlightLength = 160
+
+// Returns an HTML excerpt of content around its first match with every match marked
+func highlight(content string, q SearchQuery) string {
+    match := make(map[string]bool)
+    for _, word := range q.words() {
+        match[word] = true
+    }
+    type span struct{ start, end int }
+    var spans []span
+    start := -1
+    for i, r := range content + " " {
+        letter := unicode.IsLetter(r) || unicode.IsDigit(r)
+        if letter && start < 0 {
+            start = i
+        } else if !letter && start >= 0 {
+            if match[strings.ToLower(content[start:i])] {
+                spans = append(spans, span{start, i})
+            }
+            start = -1
+        }
+    }
+
+    from, to := 0, len(content)
+    if len(content) > highlightLength {
+        if len(spans) > 0 {
+            from = spans[0].start - highlightLength / 4
+        }
+        if from < 0 {
+            from = 0
+        }
+        to = from + highlightLength
+        if to > len(content) {
+            from, to = len(content) - highlightLength, len(content)
+        }
+        // Keep whole runes
+        for from > 0 && !utf8Start(content[from]) {
+            from--
+        }
+        for to < len(content) && !utf8Start(content[to]) {
+            to++
+        }
+    }
+
+    var b strings.Builder
+    if from > 0 {
+        b.WriteString("…")
+    }
+    at := from
+    for _, s := range spans {
+        if s.start < from || s.end > to {
+            continue
+        }
+        b.WriteString(html.EscapeString(content[at:s.start]))
+        b.WriteString("<mark>"+html.EscapeString(content[s.start:s.end])+"</mark>")
+        at = s.end
+    }
+    b.WriteString(html.EscapeString(content[at:to]))
+    if to < len(content) {
+        b.WriteString("…")
+    }
+    return b.String()
+}
+
+func utf8Start(b byte) bool {
+    return b & 0xC0 != 0x80
+}
+
+// Orders search results by score, then newest first
+func sortResults(results []SearchResult) {
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        if !results[i].Date.Equal(results[j].Date) {
+            return results[i].Date.After(results[j].Date)
+        }
+        a, _ := parseID(results[i].Id)
+        b, _ := parseID(results[j].Id)
+        return a > b
+    })
+}
+
+// Post or comment in a searchIndex
+type searchDoc struct {
+    entity Entity
+    id int64
+    postID string
+    author string
+    content string
+    date time.Time
+    hidden bool
+    words []string
+}
+
+type docKey struct {
+    entity Entity
+    id int64
+}
+
+// Inverted index of post and comment words, used by the backends without full
+// text search of their own. It is loaded from the store on the first search and
+// kept up to date by the store's writes, or reloaded after writes that affect
+// many documents such as trashing a post with its comments.
+type searchIndex struct {
+    mu sync.Mutex
+    loaded bool
+    // Changed by every write, so a load that raced with a write is retried
+    generation int
+    docs map[docKey]*searchDoc
+    // Number of times each word appears in each document
+    postings map[string]map[docKey]int
+}
+
+func newSearchIndex() *searchIndex {
+    return &searchIndex{}
+}
+
+// Adds or replaces a document. Ignored while the index is not loaded, since
+// loading reads every document. Every method does nothing on a nil index.
+func (x *searchIndex) add(doc searchDoc) {
+    if x == nil {
+        return
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.generation++
+    if x.loaded {
+        x.put(&doc)
+    }
+}
+
+func (x *searchIndex) put(doc *searchDoc) {
+    key := docKey{doc.entity, doc.id}
+    x.drop(key)
+    doc.words = tokenize(doc.content+" "+doc.author)
+    x.docs[key] = doc
+    for _, word := range doc.words {
+        if x.postings[word] == nil {
+            x.postings[word] = make(map[docKey]int)
+        }
+        x.postings[word][key]++
+    }
+}
+
+func (x *searchIndex) drop(key docKey) {
+    doc, ok := x.docs[key]
+    if !ok {
+        return
+    }
+    for _, word := range doc.words {
+        delete(x.postings[word], key)
+        if len(x.postings[word]) == 0 {
+            delete(x.postings, word)
+        }
+    }
+    delete(x.docs, key)
+}
+
+// Replaces the content of a document after an edit
+func (x *searchIndex) edit(entity Entity, id string, content string) {
+    if x == nil {
+        return
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.generation++
+    n, _ := parseID(id)
+    if doc, ok := x.docs[docKey{entity, n}]; ok {
+        edited := *doc
+        edited.content = content
+        x.put(&edited)
+    }
+}
+
+// Records that a document was hidden or shown
+func (x *searchIndex) setHidden(entity Entity, id string, hidden bool) {
+    if x == nil {
+        return
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.generation++
+    n, _ := parseID(id)
+    if doc, ok := x.docs[docKey{entity, n}]; ok {
+        doc.hidden = hidden
+    }
+}
+
+// Reloads the index on the next search
+func (x *searchIndex) invalidate() {
+    if x == nil {
+        return
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.generation++
+    x.loaded = false
+    x.docs, x.postings = nil, nil
+}
+
+// Returns up to limit matching documents, loading the index with load first if
+// needed. load is called without holding the index lock, since stores update the
+// index while holding their own locks.
+func (x *searchIndex) search(q SearchQuery, limit int, load func() ([]searchDoc, error)) ([]SearchResult, error) {
+    x.mu.Lock()
+    for !x.loaded {
+        generation := x.generation
+        x.mu.Unlock()
+        docs, err := load()
+        if err != nil {
+            return nil, err
+        }
+        x.mu.Lock()
+        if x.generation == generation {
+            x.docs = make(map[docKey]*searchDoc)
+            x.postings = make(map[string]map[docKey]int)
+            for i := range docs {
+                x.put(&docs[i])
+            }
+            x.loaded = true
+        }
+    }
+    defer x.mu.Unlock()
+
+    // Candidates contain every word, phrases are checked below
+    words := q.words()
+    candidates := make(map[docKey]bool)
+    if len(words) == 0 {
+        for key := range x.docs {
+            candidates[key] = true
+        }
+    } else {
+        for key := range x.postings[words[0]] {
+            candidates[key] = true
+        }
+        for _, word := range words[1:] {
+            for key := range candidates {
+                if x.postings[word][key] == 0 {
+                    delete(candidates, key)
+                }
+            }
+        }
+    }
+
+    results := []SearchResult{}
+    for key := range candidates {
+        doc := x.docs[key]
+        if !q.filters(doc.author, doc.date) || !containsPhrases(doc.words, q.Phrases) {
+            continue
+        }
+        // tf-idf, normalized by document length
+        score := 0.0
+        for _, word := range words {
+            idf := math.Log(1 + float64(len(x.docs)) / float64(len(x.postings[word])))
+            score += float64(x.postings[word][key]) * idf
+        }
+        score /= math.Sqrt(float64(len(doc.words)))
+        hidden := doc.hidden
+        if doc.entity == CommentEntity {
+            // A comment on a hidden post is hidden with it
+            postID, err := parseID(doc.postID)
+            if err != nil {
+                return nil, err
+            }
+            if post, ok := x.docs[docKey{PostEntity, postID}]; ok {
+                hidden = hidden || post.hidden
+            }
+        }
+        results = append(results, SearchResult{
+            Entity: doc.entity,
+            Id: fmt.Sprint(doc.id),
+            PostId: doc.postID,
+            Author: doc.author,
+            Content: doc.content,
+            Date: doc.date,
+            Hidden: hidden,
+            Score: score,
+        })
+    }
+    sortResults(results)
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results, nil
+}
+
+// Reports whether words contains each phrase as consecutive words
+func containsPhrases(words []string, phrases []string) bool {
+    for _, phrase := range phrases {
+        want := strings.Fields(phrase)
+        found := false
+        for i := 0; i + len(want) <= len(words) && !found; i++ {
+            found = true
+            for j, w := range want {
+                if words[i+j] != w {
+                    found = false
+                    break
+                }
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,2155 @@
+package db
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "strconv"
+    "strings"
+    "database/sql"
+    "github.com/google/uuid"
+)
+
+// Store backed by a database/sql connection, shared by the MySQL and SQLite backends.
+// Every query is a constant string with ? placeholders and is prepared once.
+type sqlStore struct {
+    db *sql.DB
+    mu sync.Mutex
+    stmts map[string]*sql.Stmt
+    // Search index for databases without full text search, nil on MySQL
+    index *searchIndex
+}
+
+func newSQLStore(conn *sql.DB) *sqlStore {
+    return &sqlStore{db: conn, stmts: make(map[string]*sql.Stmt)}
+}
+
+// Returns the prepared statement for query, preparing it on first use
+func (s *sqlStore) prepare(query string) (*sql.Stmt, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if stmt, ok := s.stmts[query]; ok {
+        return stmt, nil
+    }
+    stmt, err := s.db.Prepare(query)
+    if err != nil {
+        return nil, err
+    }
+    s.stmts[query] = stmt
+    return stmt, nil
+}
+
+// Executes a prepared statement
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+    stmt, err := s.prepare(query)
+    if err != nil {
+        return nil, err
+    }
+    return stmt.Exec(args...)
+}
+
+// Runs a prepared query
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+    stmt, err := s.prepare(query)
+    if err != nil {
+        return nil, err
+    }
+    return stmt.Query(args...)
+}
+
+// Runs a prepared query returning at most one row
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+    stmt, err := s.prepare(query)
+    if err != nil {
+        // Surface the prepare error through Row.Scan
+        return s.db.QueryRow(query, args...)
+    }
+    return stmt.QueryRow(args...)
+}
+
+// Starts a transaction and returns the prepared statements for queries bound to
+// it. The statements are prepared first as the transaction holds a connection
+// until it ends and SQLite only has one.
+func (s *sqlStore) begin(queries ...string) (*sql.Tx, []*sql.Stmt, error) {
+    stmts := make([]*sql.Stmt, len(queries))
+    for i, query := range queries {
+        stmt, err := s.prepare(query)
+        if err != nil {
+            return nil, nil, err
+        }
+        stmts[i] = stmt
+    }
+    tx, err := s.db.Begin()
+    if err != nil {
+        return nil, nil, fmt.Errorf("Error starting transaction: %v", err)
+    }
+    for i := range stmts {
+        stmts[i] = tx.Stmt(stmts[i])
+    }
+    return tx, stmts, nil
+}
+
+// Closes the prepared statements and the underlying connection pool
+func (s *sqlStore) Close() error {
+    s.mu.Lock()
+    for _, stmt := range s.stmts {
+        stmt.Close()
+    }
+    s.stmts = make(map[string]*sql.Stmt)
+    s.mu.Unlock()
+    return s.db.Close()
+}
+
+// Adds a user
+func (s *sqlStore) Adduser(user User) error {
+    _, err := s.exec("INSERT INTO user (username, password, salt) VALUES (?, ?, ?)",
+        user.Username, user.Password, user.Salt)
+    if err != nil {
+        return fmt.Errorf("Error inserting into user table: %v", err)
+    }
+    return nil
+}
+
+// Returns username given a uuid
+func (s *sqlStore) GetUsername(uuid string) (string, error) {
+    var username string
+    err := s.queryRow("SELECT username FROM session WHERE uuid = ?", uuid).Scan(&username)
+    if err == sql.ErrNoRows {
+        return "", fmt.Errorf("Session does not exist")
+    }
+    if err != nil {
+        return "", fmt.Errorf("Error retrieving username from session uuid: %v", err)
+    }
+    return username, nil
+}
+
+// Get user creds
+func (s *sqlStore) GetCreds(username string) (string, []byte, error) {
+    var password string
+    var salt []byte
+    err := s.queryRow("SELECT password, salt FROM user WHERE username = ?", username).Scan(&password, &salt)
+    if err == sql.ErrNoRows {
+        return "", nil, fmt.Errorf("Username is incorrect.")
+    }
+    if err != nil {
+        return "", nil, fmt.Errorf("Error retrieving from user table: %v", err)
+    }
+    return password, salt, nil
+}
+
+// Replaces a user's password hash and clears the legacy salt
+func (s *sqlStore) UpdatePassword(username string, password string) error {
+    _, err := s.exec("UPDATE user SET password = ?, salt = NULL WHERE username = ?", password, username)
+    if err != nil {
+        return fmt.Errorf("Error updating user table: %v", err)
+    }
+    return nil
+}
+
+// Returns a user's role
+func (s *sqlStore) GetRole(username string) (string, error) {
+    var role string
+    err := s.queryRow("SELECT role FROM user WHERE username = ?", username).Scan(&role)
+    if err == sql.ErrNoRows {
+        return "", fmt.Errorf("User %s does not exist", username)
+    }
+    if err != nil {
+        return "", fmt.Errorf("Error retrieving from user table: %v", err)
+    }
+    return role, nil
+}
+
+// Changes a user's role
+func (s *sqlStore) SetRole(username string, role string) error {
+    result, err := s.exec("UPDATE user SET role = ? WHERE username = ?", role, username)
+    if err != nil {
+        return fmt.Errorf("Error updating user table: %v", err)
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        // Setting the current role again also affects no rows
+        _, err = s.GetRole(username)
+        return err
+    }
+    return nil
+}
+
+// Returns a user's details without their password
+func (s *sqlStore) GetUser(username string) (User, error) {
+    user := User{Username: username}
+    err := s.queryRow("SELECT role, locked FROM user WHERE username = ?", username).Scan(&user.Role, &user.Locked)
+    if err == sql.ErrNoRows {
+        return user, fmt.Errorf("User %s does not exist", username)
+    }
+    if err != nil {
+        return user, fmt.Errorf("Error retrieving from user table: %v", err)
+    }
+    return user, nil
+}
+
+// Escapes the LIKE wildcards in a search term, using ! as the escape character
+func likePattern(search string) string {
+    r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+    return "%"+r.Replace(search)+"%"
+}
+
+// Lists users whose name contains search, ordered by name, without passwords
+func (s *sqlStore) GetUsers(search string, limit int, offset int) ([]User, error) {
+    rows, err := s.query("SELECT username, role, locked FROM user WHERE username LIKE ? ESCAPE '!' ORDER BY username LIMIT ? OFFSET ?",
+        likePattern(search), limit, offset)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from user table: %v", err)
+    }
+    defer rows.Close()
+    var users []User
+    for rows.Next() {
+        var user User
+        err = rows.Scan(&user.Username, &user.Role, &user.Locked)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from user rows: %v", err)
+        }
+        users = append(users, user)
+    }
+    return users, rows.Err()
+}
+
+// Locks or unlocks a user
+func (s *sqlStore) SetLocked(username string, locked bool) error {
+    _, err := s.GetUser(username)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("UPDATE user SET locked = ? WHERE username = ?", locked, username)
+    if err != nil {
+        return fmt.Errorf("Error updating user table: %v", err)
+    }
+    return nil
+}
+
+// Columns read into a Session, in scanSession order
+const sessionColumns = "uuid, username, created_at, last_seen, expires_at, user_agent, ip"
+
+// Scans a row selected with sessionColumns
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+    var session Session
+    err := row.Scan(&session.Id, &session.Username, &session.CreatedAt, &session.LastSeen,
+        &session.ExpiresAt, &session.UserAgent, &session.IP)
+    return session, err
+}
+
+// Adds a session for session.Username and returns its uuid
+func (s *sqlStore) AddSession(session Session) (string, error) {
+    var id string
+    for {
+        id = uuid.NewString()
+        exists, err := s.ValidSession(id)
+        if err != nil {
+            return "", err
+        }
+        if !exists {
+            break
+        }
+    }
+    created := now()
+    _, err := s.exec("INSERT INTO session (uuid, username, created_at, last_seen, expires_at, user_agent, ip) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        id, session.Username, created, created, session.ExpiresAt.UTC().Truncate(time.Second), session.UserAgent, session.IP)
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into session table: %v", err)
+    }
+    return id, nil
+}
+
+// Retrieves a session by uuid
+func (s *sqlStore) GetSession(uuid string) (Session, error) {
+    session, err := scanSession(s.queryRow("SELECT "+sessionColumns+" FROM session WHERE uuid = ?", uuid))
+    if err == sql.ErrNoRows {
+        return session, fmt.Errorf("Session does not exist")
+    }
+    if err != nil {
+        return session, fmt.Errorf("Error retrieving session: %v", err)
+    }
+    return session, nil
+}
+
+// Lists a user's sessions, most recently used first
+func (s *sqlStore) GetSessions(username string) ([]Session, error) {
+    rows, err := s.query("SELECT "+sessionColumns+" FROM session WHERE username = ? ORDER BY last_seen DESC, created_at DESC",
+        username)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from session table: %v", err)
+    }
+    defer rows.Close()
+    var sessions []Session
+    for rows.Next() {
+        session, err := scanSession(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from session rows: %v", err)
+        }
+        sessions = append(sessions, session)
+    }
+    return sessions, rows.Err()
+}
+
+// Records activity on a session
+func (s *sqlStore) TouchSession(uuid string, lastSeen time.Time) error {
+    _, err := s.exec("UPDATE session SET last_seen = ? WHERE uuid = ?", lastSeen.UTC().Truncate(time.Second), uuid)
+    if err != nil {
+        return fmt.Errorf("Error updating session: %v", err)
+    }
+    return nil
+}
+
+// Deletes a single session
+func (s *sqlStore) DeleteSession(uuid string) error {
+    _, err := s.exec("DELETE FROM session WHERE uuid = ?", uuid)
+    if err != nil {
+        return fmt.Errorf("Error removing session: %v", err)
+    }
+    return nil
+}
+
+// Deletes every session of a user
+func (s *sqlStore) DeleteSessions(username string) error {
+    _, err := s.exec("DELETE FROM session WHERE username = ?", username)
+    if err != nil {
+        return fmt.Errorf("Error removing sessions for user %s: %v", username, err)
+    }
+    return nil
+}
+
+// Deletes sessions past their expiry or last seen before idleBefore
+func (s *sqlStore) DeleteExpiredSessions(expiredBefore time.Time, idleBefore time.Time) (int64, error) {
+    result, err := s.exec("DELETE FROM session WHERE expires_at <= ? OR last_seen <= ?",
+        expiredBefore.UTC().Truncate(time.Second), idleBefore.UTC().Truncate(time.Second))
+    if err != nil {
+        return 0, fmt.Errorf("Error removing expired sessions: %v", err)
+    }
+    return result.RowsAffected()
+}
+
+// Determines if a session id is valid or not
+func (s *sqlStore) ValidSession(uuid string) (bool, error) {
+    var id string
+    err := s.queryRow("SELECT uuid FROM session WHERE uuid = ?", uuid).Scan(&id)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("Error retrieving session: %v", err)
+    }
+    return uuid == id, nil
+}
+
+// Columns read into a RefreshToken, in scanRefreshToken order
+const refreshTokenColumns = "id, family, username, access_jti, created_at, expires_at, used"
+
+// Scans a row selected with refreshTokenColumns
+func scanRefreshToken(row interface{ Scan(...interface{}) error }) (RefreshToken, error) {
+    var token RefreshToken
+    err := row.Scan(&token.Id, &token.Family, &token.Username, &token.AccessJTI,
+        &token.CreatedAt, &token.ExpiresAt, &token.Used)
+    return token, err
+}
+
+// Stores a new refresh token
+func (s *sqlStore) AddRefreshToken(token RefreshToken) error {
+    _, err := s.exec("INSERT INTO refresh_token (id, family, username, access_jti, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+        token.Id, token.Family, token.Username, token.AccessJTI, now(), token.ExpiresAt.UTC().Truncate(time.Second))
+    if err != nil {
+        return fmt.Errorf("Error inserting into refresh_token table: %v", err)
+    }
+    return nil
+}
+
+// Retrieves a refresh token by its hash
+func (s *sqlStore) GetRefreshToken(id string) (RefreshToken, error) {
+    token, err := scanRefreshToken(s.queryRow("SELECT "+refreshTokenColumns+" FROM refresh_token WHERE id = ?", id))
+    if err == sql.ErrNoRows {
+        return token, fmt.Errorf("Refresh token does not exist")
+    }
+    if err != nil {
+        return token, fmt.Errorf("Error retrieving refresh token: %v", err)
+    }
+    return token, nil
+}
+
+// Lists a user's refresh tokens, including used ones
+func (s *sqlStore) GetRefreshTokens(username string) ([]RefreshToken, error) {
+    rows, err := s.query("SELECT "+refreshTokenColumns+" FROM refresh_token WHERE username = ? ORDER BY created_at DESC",
+        username)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from refresh_token table: %v", err)
+    }
+    defer rows.Close()
+    var tokens []RefreshToken
+    for rows.Next() {
+        token, err := scanRefreshToken(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from refresh_token rows: %v", err)
+        }
+        tokens = append(tokens, token)
+    }
+    return tokens, rows.Err()
+}
+
+// Marks a refresh token used, reporting false if it already was
+func (s *sqlStore) UseRefreshToken(id string) (bool, error) {
+    result, err := s.exec("UPDATE refresh_token SET used = TRUE WHERE id = ? AND used = FALSE", id)
+    if err != nil {
+        return false, fmt.Errorf("Error updating refresh token: %v", err)
+    }
+    n, err := result.RowsAffected()
+    return n == 1, err
+}
+
+// Deletes every refresh token rotated from the same login
+func (s *sqlStore) DeleteRefreshTokenFamily(family string) error {
+    _, err := s.exec("DELETE FROM refresh_token WHERE family = ?", family)
+    if err != nil {
+        return fmt.Errorf("Error removing refresh tokens: %v", err)
+    }
+    return nil
+}
+
+// Deletes every refresh token of a user
+func (s *sqlStore) DeleteRefreshTokens(username string) error {
+    _, err := s.exec("DELETE FROM refresh_token WHERE username = ?", username)
+    if err != nil {
+        return fmt.Errorf("Error removing refresh tokens for user %s: %v", username, err)
+    }
+    return nil
+}
+
+// Adds an access token id to the revocation list until it expires
+func (s *sqlStore) RevokeToken(jti string, expiresAt time.Time) error {
+    revoked, err := s.TokenRevoked(jti)
+    if err != nil || revoked {
+        return err
+    }
+    _, err = s.exec("INSERT INTO revoked_token (jti, expires_at) VALUES (?, ?)",
+        jti, expiresAt.UTC().Truncate(time.Second))
+    if err != nil {
+        return fmt.Errorf("Error inserting into revoked_token table: %v", err)
+    }
+    return nil
+}
+
+// Determines if an access token id has been revoked
+func (s *sqlStore) TokenRevoked(jti string) (bool, error) {
+    var id string
+    err := s.queryRow("SELECT jti FROM revoked_token WHERE jti = ?", jti).Scan(&id)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("Error retrieving revoked token: %v", err)
+    }
+    return true, nil
+}
+
+// Deletes refresh tokens, revocations and personal access tokens that expired before a time
+func (s *sqlStore) DeleteExpiredTokens(before time.Time) (int64, error) {
+    before = before.UTC().Truncate(time.Second)
+    refreshed, err := s.exec("DELETE FROM refresh_token WHERE expires_at <= ?", before)
+    if err != nil {
+        return 0, fmt.Errorf("Error removing expired refresh tokens: %v", err)
+    }
+    revoked, err := s.exec("DELETE FROM revoked_token WHERE expires_at <= ?", before)
+    if err != nil {
+        return 0, fmt.Errorf("Error removing expired revoked tokens: %v", err)
+    }
+    personal, err := s.exec("DELETE FROM personal_token WHERE expires_at <= ?", before)
+    if err != nil {
+        return 0, fmt.Errorf("Error removing expired personal tokens: %v", err)
+    }
+    a, _ := refreshed.RowsAffected()
+    b, _ := revoked.RowsAffected()
+    c, _ := personal.RowsAffected()
+    return a + b + c, nil
+}
+
+// Columns read into a PersonalToken, in scanPersonalToken order
+const personalTokenColumns = "id, name, username, token_hash, scopes, created_at, last_used, expires_at"
+
+// Scans a row selected with personalTokenColumns
+func scanPersonalToken(row interface{ Scan(...interface{}) error }) (PersonalToken, error) {
+    var token PersonalToken
+    var id int64
+    var lastUsed sql.NullTime
+    err := row.Scan(&id, &token.Name, &token.Username, &token.Hash, &token.Scopes,
+        &token.CreatedAt, &lastUsed, &token.ExpiresAt)
+    token.Id = strconv.FormatInt(id, 10)
+    token.LastUsed = lastUsed.Time
+    return token, err
+}
+
+// Stores a personal access token and returns its id
+func (s *sqlStore) AddPersonalToken(token PersonalToken) (string, error) {
+    result, err := s.exec("INSERT INTO personal_token (name, username, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+        token.Name, token.Username, token.Hash, token.Scopes, now(), token.ExpiresAt.UTC().Truncate(time.Second))
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into personal_token table: %v", err)
+    }
+    id, _ := result.LastInsertId()
+    return strconv.FormatInt(id, 10), nil
+}
+
+// Retrieves a personal access token by its hash
+func (s *sqlStore) GetPersonalToken(hash string) (PersonalToken, error) {
+    token, err := scanPersonalToken(s.queryRow("SELECT "+personalTokenColumns+" FROM personal_token WHERE token_hash = ?", hash))
+    if err == sql.ErrNoRows {
+        return token, fmt.Errorf("Personal token does not exist")
+    }
+    if err != nil {
+        return token, fmt.Errorf("Error retrieving personal token: %v", err)
+    }
+    return token, nil
+}
+
+// Lists a user's personal access tokens, newest first
+func (s *sqlStore) GetPersonalTokens(username string) ([]PersonalToken, error) {
+    rows, err := s.query("SELECT "+personalTokenColumns+" FROM personal_token WHERE username = ? ORDER BY id DESC",
+        username)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from personal_token table: %v", err)
+    }
+    defer rows.Close()
+    var tokens []PersonalToken
+    for rows.Next() {
+        token, err := scanPersonalToken(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from personal_token rows: %v", err)
+        }
+        tokens = append(tokens, token)
+    }
+    return tokens, rows.Err()
+}
+
+// Records use of a personal access token
+func (s *sqlStore) TouchPersonalToken(id string, lastUsed time.Time) error {
+    tokenID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("UPDATE personal_token SET last_used = ? WHERE id = ?", lastUsed.UTC().Truncate(time.Second), tokenID)
+    if err != nil {
+        return fmt.Errorf("Error updating personal token: %v", err)
+    }
+    return nil
+}
+
+// Deletes one of a user's personal access tokens
+func (s *sqlStore) DeletePersonalToken(username string, id string) error {
+    tokenID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    result, err := s.exec("DELETE FROM personal_token WHERE id = ? AND username = ?", tokenID, username)
+    if err != nil {
+        return fmt.Errorf("Error removing personal token: %v", err)
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        return fmt.Errorf("Personal token %s does not exist", id)
+    }
+    return nil
+}
+
+// Deletes every personal access token of a user
+func (s *sqlStore) DeletePersonalTokens(username string) error {
+    _, err := s.exec("DELETE FROM personal_token WHERE username = ?", username)
+    if err != nil {
+        return fmt.Errorf("Error removing personal tokens for user %s: %v", username, err)
+    }
+    return nil
+}
+
+// Adds a post
+func (s *sqlStore) AddPost(content string, author string) (string, error) {
+    tx, stmts, err := s.begin(
+        "INSERT INTO post (content, author) VALUES (?, ?)",
+        "INSERT INTO post_tag (post_id, tag, created_at) VALUES (?, ?, ?)")
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+    result, err := stmts[0].Exec(content, author)
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into post table: %v", err)
+    }
+    id, _ := result.LastInsertId()
+    for _, tag := range ParseTags(content) {
+        _, err = stmts[1].Exec(id, tag, now())
+        if err != nil {
+            return "", fmt.Errorf("Error inserting into post_tag table: %v", err)
+        }
+    }
+    err = tx.Commit()
+    if err != nil {
+        return "", err
+    }
+    s.index.add(searchDoc{entity: PostEntity, id: id, postID: strconv.FormatInt(id, 10), author: author, content: content, date: now()})
+    return strconv.FormatInt(id, 10), nil
+}
+
+// Permanently deletes a post and its comments
+func (s *sqlStore) DeletePost(id string) error {
+    postID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    // Votes, emoji reactions, revisions, mentions and notifications are not tied
+    // to the post by a foreign key
+    tables := []string{"reaction", "emoji_reaction", "revision", "mention", "notification"}
+    var queries []string
+    for _, table := range tables {
+        queries = append(queries,
+            "DELETE FROM "+table+" WHERE entity = ? AND entity_id IN (SELECT id FROM comment WHERE post_id = ?)",
+            "DELETE FROM "+table+" WHERE entity = ? AND entity_id = ?")
+    }
+    tx, stmts, err := s.begin(append(queries, "DELETE FROM post WHERE id = ?")...)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for i, table := range tables {
+        _, err = stmts[2*i].Exec(CommentEntity.name, postID)
+        if err == nil {
+            _, err = stmts[2*i+1].Exec(PostEntity.name, postID)
+        }
+        if err != nil {
+            return fmt.Errorf("Error deleting from %s table: %v", table, err)
+        }
+    }
+    _, err = stmts[len(stmts)-1].Exec(postID)
+    if err != nil {
+        return fmt.Errorf("Error deleting from post table: %v", err)
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    s.index.invalidate()
+    return nil
+}
+
+// Replaces the content of a post or comment, keeping the previous version as a
+// revision credited to whoever wrote it
+func (s *sqlStore) EditContent(entity Entity, id string, content string, editor string) error {
+    table, err := entity.table()
+    if err != nil {
+        return err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    tx, stmts, err := s.begin(
+        "SELECT content, author, date, edited_at, edited_by, version FROM "+table+" WHERE id = ? AND deleted_at IS NULL",
+        "INSERT INTO revision (entity, entity_id, content, editor, created_at) VALUES (?, ?, ?, ?, ?)",
+        "UPDATE "+table+" SET content = ?, edited_at = ?, edited_by = ?, version = version + 1 WHERE id = ? AND version = ?",
+        "DELETE FROM post_tag WHERE post_id = ?",
+        "INSERT INTO post_tag (post_id, tag, created_at) VALUES (?, ?, ?)")
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var previous Revision
+    var date time.Time
+    var editedAt sql.NullTime
+    var editedBy string
+    var version int64
+    err = stmts[0].QueryRow(entityID).Scan(&previous.Content, &previous.Editor, &date, &editedAt, &editedBy, &version)
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("%s with id:%s does not exist", entity, id)
+    }
+    if err != nil {
+        return fmt.Errorf("Error reading from %s row: %v", entity, err)
+    }
+    previous.CreatedAt = date
+    if editedAt.Valid {
+        previous.Editor, previous.CreatedAt = editedBy, editedAt.Time
+    }
+    _, err = stmts[1].Exec(entity.name, entityID, previous.Content, previous.Editor, previous.CreatedAt)
+    if err != nil {
+        return fmt.Errorf("Error inserting into revision table: %v", err)
+    }
+    // Fails rather than losing a revision if it was edited since it was read
+    result, err := stmts[2].Exec(content, now(), editor, entityID, version)
+    if err == nil {
+        err = affected(result)
+    }
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("%s %s was edited at the same time, try again", entity, id)
+    }
+    if err != nil {
+        return fmt.Errorf("Error updating %s: %v", entity, err)
+    }
+    if entity == PostEntity {
+        _, err = stmts[3].Exec(entityID)
+        for _, tag := range ParseTags(content) {
+            if err == nil {
+                _, err = stmts[4].Exec(entityID, tag, date)
+            }
+        }
+        if err != nil {
+            return fmt.Errorf("Error updating post_tag table: %v", err)
+        }
+    }
+    err = tx.Commit()
+    if err == nil {
+        s.index.edit(entity, id, content)
+    }
+    return err
+}
+
+// Returns the replaced versions of a post or comment, oldest first
+func (s *sqlStore) GetRevisions(entity Entity, id string) ([]Revision, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.query("SELECT content, editor, created_at FROM revision WHERE entity = ? AND entity_id = ? ORDER BY id",
+        entity.name, entityID)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from revision table: %v", err)
+    }
+    defer rows.Close()
+    revisions := []Revision{}
+    for rows.Next() {
+        var revision Revision
+        err = rows.Scan(&revision.Content, &revision.Editor, &revision.CreatedAt)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        revisions = append(revisions, revision)
+    }
+    return revisions, nil
+}
+
+// Adds a comment to a post
+func (s *sqlStore) AddComment(content string, author string, post_id string) (string, error) {
+    postID, err := parseID(post_id)
+    if err != nil {
+        return "", err
+    }
+    // Posts in the trash cannot be commented on
+    if _, err = s.GetPost(post_id); err != nil {
+        return "", err
+    }
+    result, err := s.exec("INSERT INTO comment (content, author, post_id) VALUES (?, ?, ?)",
+        content, author, postID)
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into comment table: %v", err)
+    }
+    id, _ := result.LastInsertId()
+    s.index.add(searchDoc{entity: CommentEntity, id: id, postID: post_id, author: author, content: content, date: now()})
+
+    // Update number of comments on post
+    _, err = s.exec("UPDATE post SET numcomments = numcomments + 1 WHERE id = ?", postID)
+    if err != nil {
+        fmt.Println(err)
+    }
+    return strconv.FormatInt(id, 10), err
+}
+
+// Permanently deletes a comment from a post
+func (s *sqlStore) DeleteComment(id string) error {
+    commentID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    postID, err := s.GetPostIDFromCommentID(id)
+    if err != nil {
+        return err
+    }
+    tables := []string{"reaction", "emoji_reaction", "revision", "mention", "notification"}
+    queries := []string{
+        "UPDATE post SET numcomments = numcomments - 1 WHERE id = ? AND numcomments > 0 AND EXISTS (SELECT 1 FROM comment WHERE id = ? AND deleted_at IS NULL)",
+        "DELETE FROM comment WHERE id = ?",
+    }
+    for _, table := range tables {
+        queries = append(queries, "DELETE FROM "+table+" WHERE entity = ? AND entity_id = ?")
+    }
+    tx, stmts, err := s.begin(queries...)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    // Comments in the trash were already taken off the count
+    _, err = stmts[0].Exec(postID, commentID)
+    if err != nil {
+        return fmt.Errorf("Error updating number of comments on post: %v", err)
+    }
+    _, err = stmts[1].Exec(commentID)
+    if err != nil {
+        return fmt.Errorf("Error deleting from comment table: %v", err)
+    }
+    for i, table := range tables {
+        _, err = stmts[2+i].Exec(CommentEntity.name, commentID)
+        if err != nil {
+            return fmt.Errorf("Error deleting from %s table: %v", table, err)
+        }
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    s.index.invalidate()
+    return nil
+}
+
+// Moves a post or comment to the trash
+func (s *sqlStore) TrashContent(entity Entity, id string, actor string) error {
+    table, err := entity.table()
+    if err != nil {
+        return err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    result, err := s.exec("UPDATE "+table+" SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL",
+        now(), actor, entityID)
+    if err == nil {
+        err = affected(result)
+    }
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("%s with id:%s does not exist", entity, id)
+    }
+    if err != nil {
+        return fmt.Errorf("Error updating %s: %v", entity, err)
+    }
+    s.index.invalidate()
+    if entity == CommentEntity {
+        _, err = s.exec("UPDATE post SET numcomments = numcomments - 1 WHERE id = (SELECT post_id FROM comment WHERE id = ?) AND numcomments > 0",
+            entityID)
+        if err != nil {
+            return fmt.Errorf("Error updating number of comments on post: %v", err)
+        }
+    }
+    return nil
+}
+
+// Takes a post or comment back out of the trash
+func (s *sqlStore) RestoreContent(entity Entity, id string) error {
+    table, err := entity.table()
+    if err != nil {
+        return err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    result, err := s.exec("UPDATE "+table+" SET deleted_at = NULL, deleted_by = '' WHERE id = ? AND deleted_at IS NOT NULL",
+        entityID)
+    if err == nil {
+        err = affected(result)
+    }
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("%s with id:%s is not in the trash", entity, id)
+    }
+    if err != nil {
+        return fmt.Errorf("Error updating %s: %v", entity, err)
+    }
+    s.index.invalidate()
+    if entity == CommentEntity {
+        _, err = s.exec("UPDATE post SET numcomments = numcomments + 1 WHERE id = (SELECT post_id FROM comment WHERE id = ?)",
+            entityID)
+        if err != nil {
+            return fmt.Errorf("Error updating number of comments on post: %v", err)
+        }
+    }
+    return nil
+}
+
+const trashColumns = "content, author, deleted_at, deleted_by, id"
+
+// Returns posts and comments in the trash, most recently deleted first. author
+// limits them to one user's content unless it is empty.
+func (s *sqlStore) GetTrash(author string) ([]TrashItem, error) {
+    items := []TrashItem{}
+    for _, entity := range []Entity{PostEntity, CommentEntity} {
+        table, _ := entity.table()
+        postID := "id"
+        if entity == CommentEntity {
+            postID = "post_id"
+        }
+        rows, err := s.query("SELECT "+trashColumns+", "+postID+" FROM "+table+
+            " WHERE deleted_at IS NOT NULL AND (? = '' OR author = ?)", author, author)
+        if err != nil {
+            return nil, fmt.Errorf("Error retrieving from %s table: %v", table, err)
+        }
+        for rows.Next() {
+            item := TrashItem{Entity: entity}
+            err = rows.Scan(&item.Content, &item.Author, &item.DeletedAt, &item.DeletedBy, &item.Id, &item.PostId)
+            if err != nil {
+                rows.Close()
+                return nil, fmt.Errorf("Error reading data: %v", err)
+            }
+            items = append(items, item)
+        }
+        rows.Close()
+    }
+    sortTrash(items)
+    return items, nil
+}
+
+// Returns a post or comment in the trash
+func (s *sqlStore) GetTrashItem(entity Entity, id string) (TrashItem, error) {
+    item := TrashItem{Entity: entity}
+    table, err := entity.table()
+    if err != nil {
+        return item, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return item, err
+    }
+    postID := "id"
+    if entity == CommentEntity {
+        postID = "post_id"
+    }
+    err = s.queryRow("SELECT "+trashColumns+", "+postID+" FROM "+table+" WHERE id = ? AND deleted_at IS NOT NULL", entityID).
+        Scan(&item.Content, &item.Author, &item.DeletedAt, &item.DeletedBy, &item.Id, &item.PostId)
+    if err == sql.ErrNoRows {
+        return item, fmt.Errorf("%s with id:%s is not in the trash", entity, id)
+    }
+    if err != nil {
+        return item, fmt.Errorf("Error reading from %s row: %v", entity, err)
+    }
+    return item, nil
+}
+
+// Permanently deletes posts and comments that went in the trash before a time
+func (s *sqlStore) PurgeTrash(before time.Time) (int64, error) {
+    // Comments first, as purging a post also removes its comments
+    var purged int64
+    for _, entity := range []Entity{CommentEntity, PostEntity} {
+        table, _ := entity.table()
+        rows, err := s.query("SELECT id FROM "+table+" WHERE deleted_at < ?", before.UTC())
+        if err != nil {
+            return purged, fmt.Errorf("Error retrieving from %s table: %v", table, err)
+        }
+        var ids []string
+        for rows.Next() {
+            var id string
+            if err = rows.Scan(&id); err != nil {
+                rows.Close()
+                return purged, fmt.Errorf("Error reading data: %v", err)
+            }
+            ids = append(ids, id)
+        }
+        rows.Close()
+        for _, id := range ids {
+            if entity == PostEntity {
+                err = s.DeletePost(id)
+            } else {
+                err = s.DeleteComment(id)
+            }
+            if err != nil {
+                return purged, err
+            }
+            purged++
+        }
+    }
+    return purged, nil
+}
+
+// Records a user's like (1) or dislike (-1) of a post or comment. Repeating a
+// vote takes it back and the opposite vote replaces it. The vote and the counters
+// change in one transaction, and each step matches on the stored vote so that
+// concurrent votes by the same user cannot be counted twice.
+func (s *sqlStore) Vote(username string, entity Entity, id string, value int) (Votes, error) {
+    var votes Votes
+    table, err := entity.table()
+    if err != nil {
+        return votes, err
+    }
+    if value != Liked && value != Disliked {
+        return votes, fmt.Errorf("Invalid vote %d", value)
+    }
+    // Also checks that the entity exists
+    _, err = s.GetLikes(entity, id)
+    if err != nil {
+        return votes, err
+    }
+    entityID, _ := parseID(id)
+
+    tx, stmts, err := s.begin(
+        "DELETE FROM reaction WHERE username = ? AND entity = ? AND entity_id = ? AND value = ?",
+        "UPDATE reaction SET value = ?, created_at = ? WHERE username = ? AND entity = ? AND entity_id = ? AND value = ?",
+        "INSERT INTO reaction (username, entity, entity_id, value, created_at) VALUES (?, ?, ?, ?, ?)",
+        "UPDATE "+table+" SET likes = likes + ?, dislikes = dislikes + ? WHERE id = ?",
+        "SELECT likes, dislikes FROM "+table+" WHERE id = ?")
+    if err != nil {
+        return votes, err
+    }
+    defer tx.Rollback()
+
+    // Withdraw a repeated vote, else flip an opposite one, else add it
+    previous, vote := value, 0
+    result, err := stmts[0].Exec(username, entity.name, entityID, value)
+    if err == nil {
+        err = affected(result)
+        if err == sql.ErrNoRows {
+            previous, vote = -value, value
+            result, err = stmts[1].Exec(value, now(), username, entity.name, entityID, -value)
+            if err == nil {
+                err = affected(result)
+            }
+        }
+        if err == sql.ErrNoRows {
+            previous, vote = 0, value
+            _, err = stmts[2].Exec(username, entity.name, entityID, value, now())
+        }
+    }
+    if err != nil {
+        return votes, fmt.Errorf("Error updating reaction table: %v", err)
+    }
+
+    _, err = stmts[3].Exec(count(vote, Liked) - count(previous, Liked),
+        count(vote, Disliked) - count(previous, Disliked), entityID)
+    if err != nil {
+        return votes, fmt.Errorf("Error updating %s likes: %v", entity, err)
+    }
+    err = stmts[4].QueryRow(entityID).Scan(&votes.Likes, &votes.Dislikes)
+    if err != nil {
+        return votes, fmt.Errorf("Error reading from %s row: %v", entity, err)
+    }
+    votes.Vote = vote
+    return votes, tx.Commit()
+}
+
+// Returns sql.ErrNoRows when a statement changed nothing
+func affected(result sql.Result) error {
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
+}
+
+// Returns a user's votes on posts or comments, keyed by id
+func (s *sqlStore) GetVotes(username string, entity Entity) (map[string]int, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    rows, err := s.query("SELECT entity_id, value FROM reaction WHERE username = ? AND entity = ?",
+        username, entity.name)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from reaction table: %v", err)
+    }
+    defer rows.Close()
+    votes := make(map[string]int)
+    for rows.Next() {
+        var id string
+        var value int
+        err = rows.Scan(&id, &value)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        votes[id] = value
+    }
+    return votes, nil
+}
+
+// Get all posts in the system
+func (s *sqlStore) GetAllPosts() ([]Post, error) {
+    var posts []Post
+    rows, err := s.query("SELECT content, author, date, likes, dislikes, numcomments, hidden, hidden_by, edited_at, edited_by, id FROM post WHERE deleted_at IS NULL ORDER BY date DESC, id DESC")
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from post table: %v", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var post Post
+        var editedAt sql.NullTime
+        err = rows.Scan(&post.Content, &post.Author, &post.Date, &post.Likes, &post.Dislikes, &post.NumComments,
+            &post.Hidden, &post.HiddenBy, &editedAt, &post.EditedBy, &post.Id)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        post.EditedAt = editedAt.Time
+        posts = append(posts, post)
+    }
+    return posts, nil
+}
+
+// Dates are compared as text on SQLite, so cursors are bound in the format
+// CURRENT_TIMESTAMP stores, which MySQL also accepts
+const cursorDateFormat = "2006-01-02 15:04:05"
+
+// Gets up to limit posts, newest first, following a cursor. Only posts using tag
+// are included unless it is empty.
+func (s *sqlStore) GetPostsAfter(tag string, after Cursor, limit int) ([]Post, error) {
+    query := "SELECT content, author, date, likes, dislikes, numcomments, hidden, hidden_by, edited_at, edited_by, id FROM post WHERE deleted_at IS NULL"
+    args := []interface{}{}
+    if tag != "" {
+        query += " AND id IN (SELECT post_id FROM post_tag WHERE tag = ?)"
+        args = append(args, tag)
+    }
+    if !after.IsZero() {
+        query += " AND (date < ? OR (date = ? AND id < ?))"
+        date := after.Date.UTC().Format(cursorDateFormat)
+        args = append(args, date, date, after.Id)
+    }
+    rows, err := s.query(query+" ORDER BY date DESC, id DESC LIMIT ?", append(args, limit)...)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from post table: %v", err)
+    }
+    defer rows.Close()
+    posts := []Post{}
+    for rows.Next() {
+        var post Post
+        var editedAt sql.NullTime
+        err = rows.Scan(&post.Content, &post.Author, &post.Date, &post.Likes, &post.Dislikes, &post.NumComments,
+            &post.Hidden, &post.HiddenBy, &editedAt, &post.EditedBy, &post.Id)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        post.EditedAt = editedAt.Time
+        posts = append(posts, post)
+    }
+    return posts, nil
+}
+
+// Get comments for a given post
+func (s *sqlStore) GetComments(id string) ([]Comment, error) {
+    postID, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    var comments []Comment
+    rows, err := s.query("SELECT content, author, date, likes, dislikes, hidden, hidden_by, edited_at, edited_by, id FROM comment WHERE post_id = ? AND deleted_at IS NULL ORDER BY date DESC, id DESC",
+        postID)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from comment table: %v", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var comment Comment
+        var editedAt sql.NullTime
+        err = rows.Scan(&comment.Content, &comment.Author, &comment.Date, &comment.Likes, &comment.Dislikes,
+            &comment.Hidden, &comment.HiddenBy, &editedAt, &comment.EditedBy, &comment.Id)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        comment.EditedAt = editedAt.Time
+        comments = append(comments, comment)
+    }
+    return comments, nil
+}
+
+// Gets up to limit comments on a post, newest first, following a cursor
+func (s *sqlStore) GetCommentsAfter(postID string, after Cursor, limit int) ([]Comment, error) {
+    n, err := parseID(postID)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT content, author, date, likes, dislikes, hidden, hidden_by, edited_at, edited_by, id FROM comment WHERE post_id = ? AND deleted_at IS NULL"
+    args := []interface{}{n}
+    if !after.IsZero() {
+        query += " AND (date < ? OR (date = ? AND id < ?))"
+        date := after.Date.UTC().Format(cursorDateFormat)
+        args = append(args, date, date, after.Id)
+    }
+    rows, err := s.query(query+" ORDER BY date DESC, id DESC LIMIT ?", append(args, limit)...)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from comment table: %v", err)
+    }
+    defer rows.Close()
+    comments := []Comment{}
+    for rows.Next() {
+        var comment Comment
+        var editedAt sql.NullTime
+        err = rows.Scan(&comment.Content, &comment.Author, &comment.Date, &comment.Likes, &comment.Dislikes,
+            &comment.Hidden, &comment.HiddenBy, &editedAt, &comment.EditedBy, &comment.Id)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        comment.EditedAt = editedAt.Time
+        comments = append(comments, comment)
+    }
+    return comments, nil
+}
+
+// Replaces the hashtags of a post, created at the time the post was written
+func (s *sqlStore) SetTags(postID string, tags []string, createdAt time.Time) error {
+    n, err := parseID(postID)
+    if err != nil {
+        return err
+    }
+    tx, stmts, err := s.begin(
+        "DELETE FROM post_tag WHERE post_id = ?",
+        "INSERT INTO post_tag (post_id, tag, created_at) VALUES (?, ?, ?)")
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = stmts[0].Exec(n)
+    for _, tag := range tags {
+        if err == nil {
+            _, err = stmts[1].Exec(n, tag, createdAt.UTC().Truncate(time.Second))
+        }
+    }
+    if err != nil {
+        return fmt.Errorf("Error updating post_tag table: %v", err)
+    }
+    return tx.Commit()
+}
+
+// Counts the visible posts using each hashtag since a time, or ever when it is
+// zero. Returns the limit most used tags, or all of them when limit is zero.
+func (s *sqlStore) GetTags(since time.Time, limit int) ([]TagCount, error) {
+    query := "SELECT t.tag, COUNT(*) AS n FROM post_tag t JOIN post p ON p.id = t.post_id WHERE p.deleted_at IS NULL AND p.hidden = ?"
+    args := []interface{}{false}
+    if !since.IsZero() {
+        query += " AND t.created_at >= ?"
+        args = append(args, since.UTC().Truncate(time.Second))
+    }
+    query += " GROUP BY t.tag ORDER BY n DESC, t.tag"
+    if limit > 0 {
+        query += " LIMIT ?"
+        args = append(args, limit)
+    }
+    rows, err := s.query(query, args...)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from post_tag table: %v", err)
+    }
+    defer rows.Close()
+    tags := []TagCount{}
+    for rows.Next() {
+        var tag TagCount
+        err = rows.Scan(&tag.Tag, &tag.Count)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        tags = append(tags, tag)
+    }
+    return tags, nil
+}
+
+// Resolves names against the user table and records the users a post or comment
+// mentions. Returns the users that were not mentioned in it before.
+func (s *sqlStore) AddMentions(entity Entity, id string, usernames []string) ([]string, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    mentioned := []string{}
+    for _, name := range usernames {
+        var username string
+        err = s.queryRow("SELECT username FROM user WHERE username = ?", name).Scan(&username)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return mentioned, fmt.Errorf("Error retrieving from user table: %v", err)
+        }
+        var count int
+        err = s.queryRow("SELECT COUNT(*) FROM mention WHERE entity = ? AND entity_id = ? AND username = ?",
+            entity.name, entityID, username).Scan(&count)
+        if err != nil {
+            return mentioned, fmt.Errorf("Error retrieving from mention table: %v", err)
+        }
+        if count > 0 {
+            continue
+        }
+        _, err = s.exec("INSERT INTO mention (entity, entity_id, username) VALUES (?, ?, ?)",
+            entity.name, entityID, username)
+        if err != nil {
+            return mentioned, fmt.Errorf("Error inserting into mention table: %v", err)
+        }
+        mentioned = append(mentioned, username)
+    }
+    return mentioned, nil
+}
+
+// Returns the users mentioned in a post or comment, ordered by name
+func (s *sqlStore) GetMentions(entity Entity, id string) ([]string, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.query("SELECT username FROM mention WHERE entity = ? AND entity_id = ? ORDER BY username",
+        entity.name, entityID)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from mention table: %v", err)
+    }
+    defer rows.Close()
+    mentions := []string{}
+    for rows.Next() {
+        var username string
+        err = rows.Scan(&username)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        mentions = append(mentions, username)
+    }
+    return mentions, nil
+}
+
+// Stores a notification, created now
+func (s *sqlStore) AddNotification(notification Notification) error {
+    entityID, err := parseID(notification.EntityId)
+    if err != nil {
+        return err
+    }
+    postID, err := parseID(notification.PostId)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("INSERT INTO notification (username, kind, actor, entity, entity_id, post_id, detail, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+        notification.Username, notification.Kind, notification.Actor, notification.Entity.name, entityID, postID,
+        notification.Detail, now())
+    if err != nil {
+        return fmt.Errorf("Error inserting into notification table: %v", err)
+    }
+    return nil
+}
+
+// Columns read into a Notification, in scanNotification order
+const notificationColumns = "id, username, kind, actor, entity, entity_id, post_id, detail, created_at, read_at"
+
+// Scans a row selected with notificationColumns
+func scanNotification(row interface{ Scan(...interface{}) error }) (Notification, error) {
+    var notification Notification
+    var id, entityID, postID int64
+    var entity string
+    var readAt sql.NullTime
+    err := row.Scan(&id, &notification.Username, &notification.Kind, &notification.Actor, &entity,
+        &entityID, &postID, &notification.Detail, &notification.CreatedAt, &readAt)
+    notification.Id = strconv.FormatInt(id, 10)
+    notification.Entity, _ = ParseEntity(entity)
+    notification.EntityId = strconv.FormatInt(entityID, 10)
+    notification.PostId = strconv.FormatInt(postID, 10)
+    notification.ReadAt = readAt.Time
+    return notification, err
+}
+
+// Returns a user's most recent notifications, newest first, only unread ones if unread is set
+func (s *sqlStore) GetNotifications(username string, unread bool, limit int) ([]Notification, error) {
+    query := "SELECT "+notificationColumns+" FROM notification WHERE username = ?"
+    if unread {
+        query += " AND read_at IS NULL"
+    }
+    rows, err := s.query(query+" ORDER BY id DESC LIMIT ?", username, limit)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from notification table: %v", err)
+    }
+    defer rows.Close()
+    notifications := []Notification{}
+    for rows.Next() {
+        notification, err := scanNotification(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        notifications = append(notifications, notification)
+    }
+    return notifications, rows.Err()
+}
+
+// Counts a user's unread notifications
+func (s *sqlStore) CountUnread(username string) (int, error) {
+    var count int
+    err := s.queryRow("SELECT COUNT(*) FROM notification WHERE username = ? AND read_at IS NULL", username).Scan(&count)
+    if err != nil {
+        return 0, fmt.Errorf("Error retrieving from notification table: %v", err)
+    }
+    return count, nil
+}
+
+// Marks one of a user's notifications read at readAt, if it is unread
+func (s *sqlStore) ReadNotification(username string, id string, readAt time.Time) error {
+    n, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    var count int
+    err = s.queryRow("SELECT COUNT(*) FROM notification WHERE id = ? AND username = ?", n, username).Scan(&count)
+    if err != nil {
+        return fmt.Errorf("Error retrieving from notification table: %v", err)
+    }
+    if count == 0 {
+        return fmt.Errorf("Notification %s does not exist", id)
+    }
+    _, err = s.exec("UPDATE notification SET read_at = ? WHERE id = ? AND read_at IS NULL", readAt, n)
+    if err != nil {
+        return fmt.Errorf("Error updating notification table: %v", err)
+    }
+    return nil
+}
+
+// Marks every unread notification of a user read at readAt
+func (s *sqlStore) ReadNotifications(username string, readAt time.Time) error {
+    _, err := s.exec("UPDATE notification SET read_at = ? WHERE username = ? AND read_at IS NULL",
+        readAt, username)
+    if err != nil {
+        return fmt.Errorf("Error updating notification table: %v", err)
+    }
+    return nil
+}
+
+// Permanently deletes notifications created before a time
+func (s *sqlStore) PruneNotifications(before time.Time) (int64, error) {
+    result, err := s.exec("DELETE FROM notification WHERE created_at < ?", before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("Error deleting from notification table: %v", err)
+    }
+    return result.RowsAffected()
+}
+
+// Returns the kinds of notification a user turned on or off
+func (s *sqlStore) GetNotificationPreferences(username string) (map[string]bool, error) {
+    rows, err := s.query("SELECT kind, enabled FROM notification_preference WHERE username = ?", username)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from notification_preference table: %v", err)
+    }
+    defer rows.Close()
+    preferences := make(map[string]bool)
+    for rows.Next() {
+        var kind string
+        var enabled bool
+        err = rows.Scan(&kind, &enabled)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        preferences[kind] = enabled
+    }
+    return preferences, rows.Err()
+}
+
+// Turns a kind of notification on or off for a user
+func (s *sqlStore) SetNotificationPreference(username string, kind string, enabled bool) error {
+    tx, stmts, err := s.begin(
+        "DELETE FROM notification_preference WHERE username = ? AND kind = ?",
+        "INSERT INTO notification_preference (username, kind, enabled) VALUES (?, ?, ?)")
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = stmts[0].Exec(username, kind)
+    if err == nil {
+        _, err = stmts[1].Exec(username, kind, enabled)
+    }
+    if err != nil {
+        return fmt.Errorf("Error updating notification_preference table: %v", err)
+    }
+    return tx.Commit()
+}
+
+// Finds up to limit posts and comments matching a search, best match first.
+// MySQL uses its FULLTEXT indexes, other databases the in-process index.
+func (s *sqlStore) Search(q SearchQuery, limit int) ([]SearchResult, error) {
+    if s.index != nil {
+        return s.index.search(q, limit, s.searchDocs)
+    }
+
+    // Boolean mode requires every word and phrase. Words shorter than InnoDB's
+    // minimum token size are not indexed and would never match, so are left out.
+    var against []string
+    for _, term := range q.Terms {
+        if len(term) >= 3 {
+            against = append(against, "+"+term)
+        }
+    }
+    for _, phrase := range q.Phrases {
+        against = append(against, "+\""+phrase+"\"")
+    }
+    if len(against) == 0 && q.Author == "" {
+        return []SearchResult{}, nil
+    }
+
+    // Each part of the query is one of a fixed set of strings, so statements
+    // can still be prepared once
+    var parts [2]string
+    var args [2][]interface{}
+    for i, table := range []string{"post", "comment"} {
+        t := table[:1]
+        columns := "'"+table+"', "+t+".id, "+t+".id, "+t+".author, "+t+".content, "+t+".date, "+t+".hidden, "
+        from := "FROM post p"
+        where := " WHERE p.deleted_at IS NULL"
+        if table == "comment" {
+            columns = "'comment', c.id, c.post_id, c.author, c.content, c.date, c.hidden OR p.hidden, "
+            from = "FROM comment c JOIN post p ON p.id = c.post_id"
+            where += " AND c.deleted_at IS NULL"
+        }
+        score := "0"
+        if len(against) > 0 {
+            score = "MATCH("+t+".content, "+t+".author) AGAINST (? IN BOOLEAN MODE)"
+            where += " AND "+score
+            args[i] = append(args[i], strings.Join(against, " "), strings.Join(against, " "))
+        }
+        if q.Author != "" {
+            where += " AND "+t+".author = ?"
+            args[i] = append(args[i], q.Author)
+        }
+        if !q.Before.IsZero() {
+            where += " AND "+t+".date < ?"
+            args[i] = append(args[i], q.Before)
+        }
+        if !q.After.IsZero() {
+            where += " AND "+t+".date >= ?"
+            args[i] = append(args[i], q.After)
+        }
+        parts[i] = "SELECT "+columns+score+" AS score "+from+where
+    }
+    rows, err := s.query(parts[0]+" UNION ALL "+parts[1]+" ORDER BY score DESC, date DESC LIMIT ?",
+        append(append(args[0], args[1]...), limit)...)
+    if err != nil {
+        return nil, fmt.Errorf("Error searching posts and comments: %v", err)
+    }
+    defer rows.Close()
+    results := []SearchResult{}
+    for rows.Next() {
+        var result SearchResult
+        var entity string
+        err = rows.Scan(&entity, &result.Id, &result.PostId, &result.Author, &result.Content, &result.Date,
+            &result.Hidden, &result.Score)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        result.Entity, _ = ParseEntity(entity)
+        results = append(results, result)
+    }
+    return results, nil
+}
+
+// Reads every post and comment outside the trash into search documents
+func (s *sqlStore) searchDocs() ([]searchDoc, error) {
+    var docs []searchDoc
+    queries := map[Entity]string{
+        PostEntity: "SELECT id, id, author, content, date, hidden FROM post WHERE deleted_at IS NULL",
+        CommentEntity: "SELECT c.id, c.post_id, c.author, c.content, c.date, c.hidden FROM comment c JOIN post p ON p.id = c.post_id WHERE c.deleted_at IS NULL AND p.deleted_at IS NULL",
+    }
+    for entity, query := range queries {
+        rows, err := s.query(query)
+        if err != nil {
+            return nil, fmt.Errorf("Error retrieving from %s table: %v", entity, err)
+        }
+        for rows.Next() {
+            doc := searchDoc{entity: entity}
+            err = rows.Scan(&doc.id, &doc.postID, &doc.author, &doc.content, &doc.date, &doc.hidden)
+            if err != nil {
+                rows.Close()
+                return nil, fmt.Errorf("Error reading data: %v", err)
+            }
+            docs = append(docs, doc)
+        }
+        rows.Close()
+    }
+    return docs, nil
+}
+
+// Retrieves a post with a given id
+func (s *sqlStore) GetPost(id string) (Post, error) {
+    var post Post
+    postID, err := parseID(id)
+    if err != nil {
+        return post, err
+    }
+    var editedAt sql.NullTime
+    err = s.queryRow("SELECT content, author, date, likes, dislikes, numcomments, hidden, hidden_by, edited_at, edited_by, id FROM post WHERE id = ? AND deleted_at IS NULL", postID).
+        Scan(&post.Content, &post.Author, &post.Date, &post.Likes, &post.Dislikes, &post.NumComments, &post.Hidden, &post.HiddenBy,
+            &editedAt, &post.EditedBy, &post.Id)
+    post.EditedAt = editedAt.Time
+    if err == sql.ErrNoRows {
+        return post, fmt.Errorf("Post %s does not exist.", id)
+    }
+    if err != nil {
+        return post, fmt.Errorf("Error retrieving from post table: %v", err)
+    }
+    return post, nil
+}
+
+// Retrieves a comment with a given id
+func (s *sqlStore) GetComment(id string) (Comment, error) {
+    var comment Comment
+    commentID, err := parseID(id)
+    if err != nil {
+        return comment, err
+    }
+    var editedAt sql.NullTime
+    err = s.queryRow("SELECT content, author, date, likes, dislikes, hidden, hidden_by, edited_at, edited_by, id FROM comment WHERE id = ? AND deleted_at IS NULL", commentID).
+        Scan(&comment.Content, &comment.Author, &comment.Date, &comment.Likes, &comment.Dislikes, &comment.Hidden, &comment.HiddenBy,
+            &editedAt, &comment.EditedBy, &comment.Id)
+    comment.EditedAt = editedAt.Time
+    if err == sql.ErrNoRows {
+        return comment, fmt.Errorf("Comment %s does not exist.", id)
+    }
+    if err != nil {
+        return comment, fmt.Errorf("Error retrieving from comment table: %v", err)
+    }
+    return comment, nil
+}
+
+// Gets the author of a post or comment
+func (s *sqlStore) GetAuthor(entity Entity, id string) (string, error) {
+    table, err := entity.table()
+    if err != nil {
+        return "", err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return "", err
+    }
+    var author string
+    err = s.queryRow("SELECT author FROM "+table+" WHERE id = ? AND deleted_at IS NULL", entityID).Scan(&author)
+    if err == sql.ErrNoRows {
+        return "", fmt.Errorf("%s with id:%s does not exist", entity, id)
+    }
+    if err != nil {
+        return "", fmt.Errorf("Error reading from author rows: %v", err)
+    }
+    return author, nil
+}
+
+// Gets the post id from a comment id
+func (s *sqlStore) GetPostIDFromCommentID(commentID string) (string, error) {
+    id, err := parseID(commentID)
+    if err != nil {
+        return "", err
+    }
+    var postID string
+    err = s.queryRow("SELECT post_id FROM comment WHERE id = ?", id).Scan(&postID)
+    if err == sql.ErrNoRows {
+        return "", fmt.Errorf("Comment %s cannot be linked to a post", commentID)
+    }
+    if err != nil {
+        return "", fmt.Errorf("Error reading from comment rows: %v", err)
+    }
+    return postID, nil
+}
+
+// Returns the number of likes associate with a post or comment
+func (s *sqlStore) GetLikes(entity Entity, id string) (int, error) {
+    table, err := entity.table()
+    if err != nil {
+        return 0, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return 0, err
+    }
+    var numLikes int
+    err = s.queryRow("SELECT likes FROM "+table+" WHERE id = ? AND deleted_at IS NULL", entityID).Scan(&numLikes)
+    if err == sql.ErrNoRows {
+        return 0, fmt.Errorf("%s with id:%s not found", entity, id)
+    }
+    if err != nil {
+        return 0, fmt.Errorf("Error reading from %s row: %v", entity, err)
+    }
+    return numLikes, nil
+}
+
+// Adds a user's emoji reaction to a post or comment, doing nothing if they already reacted with it
+func (s *sqlStore) AddReaction(username string, entity Entity, id string, emoji string) error {
+    // Also checks that the entity exists
+    _, err := s.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    entityID, _ := parseID(id)
+    var n int
+    err = s.queryRow("SELECT COUNT(*) FROM emoji_reaction WHERE username = ? AND entity = ? AND entity_id = ? AND emoji = ?",
+        username, entity.name, entityID, emoji).Scan(&n)
+    if err != nil || n > 0 {
+        return err
+    }
+    _, err = s.exec("INSERT INTO emoji_reaction (username, entity, entity_id, emoji, created_at) VALUES (?, ?, ?, ?, ?)",
+        username, entity.name, entityID, emoji, now())
+    if err != nil {
+        return fmt.Errorf("Error inserting into emoji_reaction table: %v", err)
+    }
+    return nil
+}
+
+// Removes a user's emoji reaction from a post or comment
+func (s *sqlStore) RemoveReaction(username string, entity Entity, id string, emoji string) error {
+    if _, err := entity.table(); err != nil {
+        return err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("DELETE FROM emoji_reaction WHERE username = ? AND entity = ? AND entity_id = ? AND emoji = ?",
+        username, entity.name, entityID, emoji)
+    if err != nil {
+        return fmt.Errorf("Error deleting from emoji_reaction table: %v", err)
+    }
+    return nil
+}
+
+// Returns the emoji reactions to a post or comment, in the order each emoji was first used
+func (s *sqlStore) GetReactions(entity Entity, id string) ([]Reaction, error) {
+    if _, err := entity.table(); err != nil {
+        return nil, err
+    }
+    entityID, err := parseID(id)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.query("SELECT username, emoji FROM emoji_reaction WHERE entity = ? AND entity_id = ? ORDER BY created_at, username",
+        entity.name, entityID)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from emoji_reaction table: %v", err)
+    }
+    defer rows.Close()
+    var users, emoji []string
+    for rows.Next() {
+        var user, e string
+        err = rows.Scan(&user, &e)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        users = append(users, user)
+        emoji = append(emoji, e)
+    }
+    return groupReactions(users, emoji), nil
+}
+
+// Hides or shows a post or comment, recording who hid it
+func (s *sqlStore) SetHidden(entity Entity, id string, hidden bool, actor string) error {
+    table, err := entity.table()
+    if err != nil {
+        return err
+    }
+    // Also checks that the entity exists
+    _, err = s.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    if !hidden {
+        actor = ""
+    }
+    entityID, _ := parseID(id)
+    _, err = s.exec("UPDATE "+table+" SET hidden = ?, hidden_by = ? WHERE id = ?", hidden, actor, entityID)
+    if err != nil {
+        return fmt.Errorf("Error updating %s: %v", entity, err)
+    }
+    s.index.setHidden(entity, id, hidden)
+    return nil
+}
+
+// Records a moderation action
+func (s *sqlStore) AddModerationEntry(entry ModerationEntry) error {
+    _, err := s.exec("INSERT INTO moderation_log (actor, action, entity, entity_id, author, detail, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        entry.Actor, entry.Action, entry.Entity, entry.EntityId, entry.Author, entry.Detail, now())
+    if err != nil {
+        return fmt.Errorf("Error inserting into moderation_log table: %v", err)
+    }
+    return nil
+}
+
+// Returns the most recent moderation actions, newest first
+func (s *sqlStore) GetModerationLog(limit int) ([]ModerationEntry, error) {
+    rows, err := s.query("SELECT id, actor, action, entity, entity_id, author, detail, created_at FROM moderation_log ORDER BY id DESC LIMIT ?",
+        limit)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from moderation_log table: %v", err)
+    }
+    defer rows.Close()
+    var entries []ModerationEntry
+    for rows.Next() {
+        var entry ModerationEntry
+        var id int64
+        err = rows.Scan(&id, &entry.Actor, &entry.Action, &entry.Entity, &entry.EntityId,
+            &entry.Author, &entry.Detail, &entry.CreatedAt)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading from moderation_log rows: %v", err)
+        }
+        entry.Id = strconv.FormatInt(id, 10)
+        entries = append(entries, entry)
+    }
+    return entries, rows.Err()
+}
+
+// Gets people
+func (s *sqlStore) Getpeople()([]Person, error) {
+    var people []Person
+
+    rows, err := s.query("SELECT first, last, color FROM person")
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from person table: %v", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var person Person
+        err = rows.Scan(&person.First, &person.Last, &person.Color)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        people = append(people, person)
+    }
+    return people, nil
+}
+
+// Adds a person
+func (s *sqlStore) Addperson(person Person) error {
+    _, err := s.exec("INSERT INTO person (first, last, color) VALUES (?, ?, ?)",
+        person.First, person.Last, person.Color)
+    if err != nil {
+        return fmt.Errorf("Error inserting into person table: %v", err)
+    }
+    return nil
+}
+
+// Adds an event to the outbox, returning its id
+func (s *sqlStore) AddOutboxEvent(e Event) (int64, error) {
+    entityID, err := parseID(e.EntityId)
+    if err != nil {
+        return 0, err
+    }
+    postID, err := parseID(e.PostId)
+    if err != nil {
+        return 0, err
+    }
+    result, err := s.exec("INSERT INTO event_outbox (type, entity, entity_id, post_id, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+        e.Type, e.Entity.name, entityID, postID, e.Actor, e.Date.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("Error inserting into event_outbox table: %v", err)
+    }
+    return result.LastInsertId()
+}
+
+// Gets up to limit events from the outbox with ids after after, in order of id
+func (s *sqlStore) GetOutboxEvents(after int64, limit int) ([]Event, error) {
+    rows, err := s.query("SELECT id, type, entity, entity_id, post_id, actor, created_at FROM event_outbox WHERE id > ? ORDER BY id LIMIT ?",
+        after, limit)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from event_outbox table: %v", err)
+    }
+    defer rows.Close()
+    events := []Event{}
+    for rows.Next() {
+        var e Event
+        var entity string
+        var entityID, postID int64
+        err = rows.Scan(&e.Id, &e.Type, &entity, &entityID, &postID, &e.Actor, &e.Date)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        e.Entity, _ = ParseEntity(entity)
+        e.EntityId = strconv.FormatInt(entityID, 10)
+        e.PostId = strconv.FormatInt(postID, 10)
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
+
+// Returns the id of the last event added to the outbox, 0 if there are none
+func (s *sqlStore) LastOutboxEventID() (int64, error) {
+    var id sql.NullInt64
+    err := s.queryRow("SELECT MAX(id) FROM event_outbox").Scan(&id)
+    if err != nil {
+        return 0, fmt.Errorf("Error retrieving from event_outbox table: %v", err)
+    }
+    return id.Int64, nil
+}
+
+// Deletes the outbox events published before a time
+func (s *sqlStore) PruneOutbox(before time.Time) (int64, error) {
+    result, err := s.exec("DELETE FROM event_outbox WHERE created_at < ?", before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("Error deleting from event_outbox table: %v", err)
+    }
+    return result.RowsAffected()
+}
+
+// Columns read into a Webhook, in scanWebhook order
+const webhookColumns = "id, username, url, secret, events, enabled, failures, created_at, disabled_at"
+
+// Scans a row selected with webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+    var webhook Webhook
+    var id int64
+    var events string
+    var disabledAt sql.NullTime
+    err := row.Scan(&id, &webhook.Username, &webhook.URL, &webhook.Secret, &events, &webhook.Enabled,
+        &webhook.Failures, &webhook.CreatedAt, &disabledAt)
+    webhook.Id = strconv.FormatInt(id, 10)
+    webhook.Events = strings.Fields(events)
+    webhook.DisabledAt = disabledAt.Time
+    return webhook, err
+}
+
+// Returns a time for a nullable column, NULL when it is zero
+func nullTime(t time.Time) sql.NullTime {
+    return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// Registers a webhook, returning its id
+func (s *sqlStore) AddWebhook(webhook Webhook) (string, error) {
+    result, err := s.exec("INSERT INTO webhook (username, url, secret, events, enabled, failures, created_at) VALUES (?, ?, ?, ?, ?, 0, ?)",
+        webhook.Username, webhook.URL, webhook.Secret, strings.Join(webhook.Events, " "), webhook.Enabled,
+        webhook.CreatedAt.UTC())
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into webhook table: %v", err)
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return "", err
+    }
+    return strconv.FormatInt(id, 10), nil
+}
+
+// Retrieves a webhook with a given id
+func (s *sqlStore) GetWebhook(id string) (Webhook, error) {
+    webhookID, err := parseID(id)
+    if err != nil {
+        return Webhook{}, err
+    }
+    webhook, err := scanWebhook(s.queryRow("SELECT "+webhookColumns+" FROM webhook WHERE id = ?", webhookID))
+    if err == sql.ErrNoRows {
+        return webhook, fmt.Errorf("Webhook %s does not exist.", id)
+    }
+    if err != nil {
+        return webhook, fmt.Errorf("Error retrieving from webhook table: %v", err)
+    }
+    return webhook, nil
+}
+
+// Lists a user's webhooks, or every webhook when username is empty, oldest first
+func (s *sqlStore) GetWebhooks(username string) ([]Webhook, error) {
+    rows, err := s.query("SELECT "+webhookColumns+" FROM webhook WHERE ? = '' OR username = ? ORDER BY id",
+        username, username)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from webhook table: %v", err)
+    }
+    defer rows.Close()
+    webhooks := []Webhook{}
+    for rows.Next() {
+        webhook, err := scanWebhook(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        webhooks = append(webhooks, webhook)
+    }
+    return webhooks, rows.Err()
+}
+
+// Saves the URL, events, state and failure count of a webhook
+func (s *sqlStore) UpdateWebhook(webhook Webhook) error {
+    id, err := parseID(webhook.Id)
+    if err != nil {
+        return err
+    }
+    result, err := s.exec("UPDATE webhook SET url = ?, events = ?, enabled = ?, failures = ?, disabled_at = ? WHERE id = ?",
+        webhook.URL, strings.Join(webhook.Events, " "), webhook.Enabled, webhook.Failures, nullTime(webhook.DisabledAt), id)
+    if err != nil {
+        return fmt.Errorf("Error updating webhook table: %v", err)
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        // MySQL counts rows changed, so check an unchanged webhook exists
+        _, err = s.GetWebhook(webhook.Id)
+        return err
+    }
+    return nil
+}
+
+// Counts a failure against a webhook and disables it at limit failures in a row
+func (s *sqlStore) RecordWebhookFailure(id string, limit int, now time.Time) (bool, error) {
+    webhookID, err := parseID(id)
+    if err != nil {
+        return false, err
+    }
+    result, err := s.exec("UPDATE webhook SET failures = failures + 1 WHERE id = ?", webhookID)
+    if err != nil {
+        return false, fmt.Errorf("Error updating webhook table: %v", err)
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        return false, fmt.Errorf("Webhook %s does not exist.", id)
+    }
+    // Re-enabling in between resets the failures, leaving the webhook enabled
+    result, err = s.exec("UPDATE webhook SET enabled = ?, disabled_at = ? WHERE id = ? AND enabled AND failures >= ?",
+        false, nullTime(now), webhookID, limit)
+    if err != nil {
+        return false, fmt.Errorf("Error updating webhook table: %v", err)
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// Forgets a webhook's failures
+func (s *sqlStore) ResetWebhookFailures(id string) error {
+    webhookID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("UPDATE webhook SET failures = 0 WHERE id = ?", webhookID)
+    if err != nil {
+        return fmt.Errorf("Error updating webhook table: %v", err)
+    }
+    return nil
+}
+
+// Deletes a webhook and its deliveries
+func (s *sqlStore) DeleteWebhook(id string) error {
+    webhookID, err := parseID(id)
+    if err != nil {
+        return err
+    }
+    tx, stmts, err := s.begin(
+        "DELETE FROM webhook_delivery WHERE webhook_id = ?",
+        "DELETE FROM webhook WHERE id = ?")
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = stmts[0].Exec(webhookID)
+    if err != nil {
+        return fmt.Errorf("Error deleting from webhook_delivery table: %v", err)
+    }
+    result, err := stmts[1].Exec(webhookID)
+    if err != nil {
+        return fmt.Errorf("Error deleting from webhook table: %v", err)
+    }
+    if n, err := result.RowsAffected(); err != nil || n == 0 {
+        return fmt.Errorf("Webhook %s does not exist.", id)
+    }
+    return tx.Commit()
+}
+
+// Columns read into a WebhookDelivery, in scanWebhookDelivery order
+const deliveryColumns = "id, webhook_id, event, payload, status, attempts, next_attempt_at, response_code, error, created_at, delivered_at"
+
+// Scans a row selected with deliveryColumns
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+    var delivery WebhookDelivery
+    var id, webhookID int64
+    var deliveredAt sql.NullTime
+    err := row.Scan(&id, &webhookID, &delivery.Event, &delivery.Payload, &delivery.Status, &delivery.Attempts,
+        &delivery.NextAttemptAt, &delivery.ResponseCode, &delivery.Error, &delivery.CreatedAt, &deliveredAt)
+    delivery.Id = strconv.FormatInt(id, 10)
+    delivery.WebhookId = strconv.FormatInt(webhookID, 10)
+    delivery.DeliveredAt = deliveredAt.Time
+    return delivery, err
+}
+
+// Queues a delivery, returning its id
+func (s *sqlStore) AddWebhookDelivery(delivery WebhookDelivery) (string, error) {
+    webhookID, err := parseID(delivery.WebhookId)
+    if err != nil {
+        return "", err
+    }
+    result, err := s.exec("INSERT INTO webhook_delivery (webhook_id, event, payload, status, attempts, next_attempt_at, response_code, error, created_at) VALUES (?, ?, ?, ?, 0, ?, 0, '', ?)",
+        webhookID, delivery.Event, delivery.Payload, delivery.Status, delivery.NextAttemptAt.UTC(), delivery.CreatedAt.UTC())
+    if err != nil {
+        return "", fmt.Errorf("Error inserting into webhook_delivery table: %v", err)
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return "", err
+    }
+    return strconv.FormatInt(id, 10), nil
+}
+
+// Retrieves a delivery with a given id
+func (s *sqlStore) GetWebhookDelivery(id string) (WebhookDelivery, error) {
+    deliveryID, err := parseID(id)
+    if err != nil {
+        return WebhookDelivery{}, err
+    }
+    delivery, err := scanWebhookDelivery(s.queryRow("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE id = ?", deliveryID))
+    if err == sql.ErrNoRows {
+        return delivery, fmt.Errorf("Delivery %s does not exist.", id)
+    }
+    if err != nil {
+        return delivery, fmt.Errorf("Error retrieving from webhook_delivery table: %v", err)
+    }
+    return delivery, nil
+}
+
+// Returns up to limit of a webhook's deliveries, newest first
+func (s *sqlStore) GetWebhookDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+    id, err := parseID(webhookID)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.query("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", id, limit)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from webhook_delivery table: %v", err)
+    }
+    defer rows.Close()
+    deliveries := []WebhookDelivery{}
+    for rows.Next() {
+        delivery, err := scanWebhookDelivery(rows)
+        if err != nil {
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        deliveries = append(deliveries, delivery)
+    }
+    return deliveries, rows.Err()
+}
+
+// Claims up to limit pending deliveries due by due, for enabled webhooks, by
+// putting their next attempt off until until. A delivery is only claimed by the
+// replica whose update finds it still due, so each attempt is made once.
+func (s *sqlStore) ClaimWebhookDeliveries(due time.Time, until time.Time, limit int) ([]WebhookDelivery, error) {
+    rows, err := s.query("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE status = ? AND next_attempt_at <= ? AND webhook_id IN (SELECT id FROM webhook WHERE enabled) ORDER BY next_attempt_at, id LIMIT ?",
+        DeliveryPending, due.UTC(), limit)
+    if err != nil {
+        return nil, fmt.Errorf("Error retrieving from webhook_delivery table: %v", err)
+    }
+    var candidates []WebhookDelivery
+    for rows.Next() {
+        delivery, err := scanWebhookDelivery(rows)
+        if err != nil {
+            rows.Close()
+            return nil, fmt.Errorf("Error reading data: %v", err)
+        }
+        candidates = append(candidates, delivery)
+    }
+    rows.Close()
+    claimed := []WebhookDelivery{}
+    for _, delivery := range candidates {
+        id, _ := parseID(delivery.Id)
+        result, err := s.exec("UPDATE webhook_delivery SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at <= ?",
+            until.UTC(), id, DeliveryPending, due.UTC())
+        if err != nil {
+            return claimed, fmt.Errorf("Error updating webhook_delivery table: %v", err)
+        }
+        if n, err := result.RowsAffected(); err == nil && n == 1 {
+            delivery.NextAttemptAt = until
+            claimed = append(claimed, delivery)
+        }
+    }
+    return claimed, nil
+}
+
+// Saves the status and outcome of the last attempt of a delivery
+func (s *sqlStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+    id, err := parseID(delivery.Id)
+    if err != nil {
+        return err
+    }
+    _, err = s.exec("UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?, response_code = ?, error = ?, delivered_at = ? WHERE id = ?",
+        delivery.Status, delivery.Attempts, delivery.NextAttemptAt.UTC(), delivery.ResponseCode, delivery.Error,
+        nullTime(delivery.DeliveredAt), id)
+    if err != nil {
+        return fmt.Errorf("Error updating webhook_delivery table: %v", err)
+    }
+    return nil
+}
+
+// Deletes deliveries created before a time that are no longer pending
+func (s *sqlStore) PruneWebhookDeliveries(before time.Time) (int64, error) {
+    result, err := s.exec("DELETE FROM webhook_delivery WHERE status <> ? AND created_at < ?", DeliveryPending, before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("Error deleting from webhook_delivery table: %v", err)
+    }
+    return result.RowsAffected()
+}
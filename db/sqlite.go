@@ -0,0 +1,37 @@
+package db
+
+import (
+    "fmt"
+    "database/sql"
+    _ "github.com/mattn/go-sqlite3"
+    "gitlab.sas.com/lomich/kind-app/db/migrations"
+)
+
+// Opens an embedded SQLite database at path
+func openSQLite(path string) (*sql.DB, error) {
+    conn, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1&_busy_timeout=5000")
+    if err != nil {
+        return nil, fmt.Errorf("Can't open database %s: %v", path, err)
+    }
+    // SQLite allows a single writer, serialize access through one connection
+    conn.SetMaxOpenConns(1)
+    return conn, nil
+}
+
+// Opens an embedded SQLite database at path, for development outside of Kind
+func NewSQLiteStore(path string) (Store, error) {
+    conn, err := openSQLite(path)
+    if err != nil {
+        return nil, err
+    }
+    err = migrate(conn, migrations.SQLite)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    s := newSQLStore(conn)
+    // SQLite is searched through an in-process index rather than FTS, which
+    // needs go-sqlite3 built with the sqlite_fts5 tag
+    s.index = newSearchIndex()
+    return s, nil
+}
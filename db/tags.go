@@ -0,0 +1,117 @@
+package db
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "strings"
+    "unicode"
+)
+
+// Longest hashtag that is stored, longer ones are ignored
+const MaxTagLength = 50
+
+// Number of posts using a hashtag
+type TagCount struct {
+    Tag string
+    Count int
+}
+
+func tagRune(r rune) bool {
+    return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Lower cases a hashtag, without its #, and checks that it is valid: letters,
+// digits and underscores, not only digits so issue numbers such as #12 are not tags
+func NormalizeTag(tag string) (string, error) {
+    tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+    if tag == "" || len(tag) > MaxTagLength {
+        return "", fmt.Errorf("Tags must be between 1 and %d characters", MaxTagLength)
+    }
+    digits := true
+    for _, r := range tag {
+        if !tagRune(r) {
+            return "", fmt.Errorf("Tags may only contain letters, digits and underscores")
+        }
+        digits = digits && unicode.IsDigit(r)
+    }
+    if digits {
+        return "", fmt.Errorf("Tags must contain a letter")
+    }
+    return tag, nil
+}
+
+// Returns the distinct hashtags in content, in order of first use. A # only
+// starts a tag at the beginning of a word, so C# or page#anchor are not tags.
+func ParseTags(content string) []string {
+    tags := []string{}
+    seen := make(map[string]bool)
+    runes := []rune(content)
+    for i := 0; i < len(runes); i++ {
+        if runes[i] != '#' || (i > 0 && (tagRune(runes[i-1]) || runes[i-1] == '#')) {
+            continue
+        }
+        end := i + 1
+        for end < len(runes) && tagRune(runes[end]) {
+            end++
+        }
+        tag, err := NormalizeTag(string(runes[i+1:end]))
+        if err == nil && !seen[tag] {
+            seen[tag] = true
+            tags = append(tags, tag)
+        }
+        i = end - 1
+    }
+    return tags
+}
+
+// Gets up to limit posts using a hashtag, newest first, following the page
+// cursor. Returns the cursor of the next page, empty on the last page.
+func GetTagPostsPage(tag string, cursor string, limit int) ([]Post, string, error) {
+    tag, err := NormalizeTag(tag)
+    if err != nil {
+        return nil, "", err
+    }
+    return postsPage(tag, cursor, limit)
+}
+
+// Lists every hashtag with the number of visible posts using it, most used first
+func GetTags() ([]TagCount, error) {
+    return store.GetTags(time.Time{}, 0)
+}
+
+// Lists up to limit hashtags used most by visible posts written in the last window
+func GetTrendingTags(window time.Duration, limit int) ([]TagCount, error) {
+    return store.GetTags(time.Now().Add(-window), limit)
+}
+
+// Stores the hashtags of every post outside the trash, for posts written before
+// tags were kept. Returns the number of posts with tags.
+func RebuildTags() (int, error) {
+    posts, err := store.GetAllPosts()
+    if err != nil {
+        return 0, err
+    }
+    tagged := 0
+    for _, post := range posts {
+        tags := ParseTags(post.Content)
+        err = store.SetTags(post.Id, tags, post.Date)
+        if err != nil {
+            return tagged, err
+        }
+        if len(tags) > 0 {
+            tagged++
+        }
+    }
+    return tagged, nil
+}
+
+// Orders tag counts by count, then name
+func sortTags(tags []TagCount) {
+    sort.Slice(tags, func(i, j int) bool {
+        if tags[i].Count != tags[j].Count {
+            return tags[i].Count > tags[j].Count
+        }
+        return tags[i].Tag < tags[j].Tag
+    })
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "encoding/json"
+)
+
+// Every event type a webhook may be sent
+var WebhookEvents = []string{PostCreated, PostUpdated, PostDeleted, CommentCreated, CommentUpdated, CommentDeleted}
+
+// Statuses of a webhook delivery
+const (
+    // Waiting for its first or next attempt
+    DeliveryPending = "pending"
+    // Accepted by the endpoint with a 2xx response
+    DeliveryDelivered = "delivered"
+    // Given up on after too many attempts
+    DeliveryFailed = "failed"
+)
+
+// Endpoint a user registered to be sent events. Events are the types sent and
+// Failures the failed attempts since the last success.
+type Webhook struct {
+    Id string
+    Username string
+    URL string
+    // Key the payloads are signed with
+    Secret string
+    Events []string
+    Enabled bool
+    Failures int
+    CreatedAt time.Time
+    // Zero unless the webhook was disabled for failing
+    DisabledAt time.Time
+}
+
+// Reports whether the webhook is sent events of a type
+func (w Webhook) Subscribes(event string) bool {
+    for _, e := range w.Events {
+        if e == event {
+            return true
+        }
+    }
+    return false
+}
+
+// Event queued for a webhook, with the outcome of its last attempt
+type WebhookDelivery struct {
+    Id string
+    WebhookId string
+    Event string
+    // JSON body sent to the endpoint
+    Payload string
+    Status string
+    Attempts int
+    NextAttemptAt time.Time
+    // Status code of the last response, 0 when there was none
+    ResponseCode int
+    // Why the last attempt failed
+    Error string
+    CreatedAt time.Time
+    // Zero until delivered
+    DeliveredAt time.Time
+}
+
+// Body of a webhook request
+type webhookPayload struct {
+    Event string `json:"event"`
+    Entity string `json:"entity"`
+    EntityId int64 `json:"entity_id"`
+    PostId int64 `json:"post_id"`
+    Actor string `json:"actor,omitempty"`
+    Date string `json:"date"`
+    // Link to the post
+    URL string `json:"url"`
+    // The post or comment created or updated
+    Post *webhookContent `json:"post,omitempty"`
+    Comment *webhookContent `json:"comment,omitempty"`
+}
+
+// Post or comment in a webhook payload. The content of hidden ones is left out.
+type webhookContent struct {
+    Id int64 `json:"id"`
+    Author string `json:"author"`
+    Content string `json:"content,omitempty"`
+    Date string `json:"date"`
+    Hidden bool `json:"hidden"`
+}
+
+// Checks that events are webhook event types and removes duplicates
+func ValidWebhookEvents(events []string) ([]string, error) {
+    var valid []string
+    seen := make(map[string]bool)
+    for _, event := range events {
+        known := false
+        for _, e := range WebhookEvents {
+            known = known || e == event
+        }
+        if !known {
+            return nil, fmt.Errorf("Unknown event %q", event)
+        }
+        if !seen[event] {
+            seen[event] = true
+            valid = append(valid, event)
+        }
+    }
+    if len(valid) == 0 {
+        return nil, fmt.Errorf("At least one event is required")
+    }
+    return valid, nil
+}
+
+// Builds the payload sent to webhooks for an event, with the post or comment
+// created or updated as it is now
+func buildWebhookPayload(e Event) (string, error) {
+    payload := webhookPayload{
+        Event: e.Type,
+        Entity: e.Entity.name,
+        EntityId: parseIDOrZero(e.EntityId),
+        PostId: parseIDOrZero(e.PostId),
+        Actor: e.Actor,
+        Date: e.Date.UTC().Format(time.RFC3339),
+        URL: "https://localhost/?post="+e.PostId,
+    }
+    if strings.HasSuffix(e.Type, ".created") || strings.HasSuffix(e.Type, ".updated") {
+        if e.Entity == PostEntity {
+            post, err := store.GetPost(e.EntityId)
+            if err != nil {
+                return "", err
+            }
+            payload.Post = newWebhookContent(post.Id, post.Author, post.Content, post.Date, post.Hidden)
+        } else {
+            comment, err := store.GetComment(e.EntityId)
+            if err != nil {
+                return "", err
+            }
+            payload.Comment = newWebhookContent(comment.Id, comment.Author, comment.Content, comment.Date, comment.Hidden)
+        }
+    }
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+func newWebhookContent(id string, author string, content string, date time.Time, hidden bool) *webhookContent {
+    c := &webhookContent{
+        Id: parseIDOrZero(id),
+        Author: author,
+        Content: content,
+        Date: date.UTC().Format(time.RFC3339),
+        Hidden: hidden,
+    }
+    if hidden {
+        c.Content = ""
+    }
+    return c
+}
+
+func parseIDOrZero(id string) int64 {
+    n, _ := parseID(id)
+    return n
+}
+
+// Queues an event for every enabled webhook sent its type
+func queueWebhooks(e Event) error {
+    webhooks, err := store.GetWebhooks("")
+    if err != nil {
+        return err
+    }
+    payload := ""
+    for _, webhook := range webhooks {
+        if !webhook.Enabled || !webhook.Subscribes(e.Type) {
+            continue
+        }
+        if payload == "" {
+            payload, err = buildWebhookPayload(e)
+            if err != nil {
+                return err
+            }
+        }
+        _, err = store.AddWebhookDelivery(WebhookDelivery{
+            WebhookId: webhook.Id,
+            Event: e.Type,
+            Payload: payload,
+            Status: DeliveryPending,
+            NextAttemptAt: e.Date,
+            CreatedAt: e.Date,
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Registers a webhook, returning its id
+func AddWebhook(webhook Webhook) (string, error) {
+    webhook.CreatedAt = now()
+    return store.AddWebhook(webhook)
+}
+
+// Retrieves a webhook with a given id
+func GetWebhook(id string) (Webhook, error) {
+    return store.GetWebhook(id)
+}
+
+// Lists a user's webhooks, or every webhook when username is empty, oldest first
+func GetWebhooks(username string) ([]Webhook, error) {
+    return store.GetWebhooks(username)
+}
+
+// Saves the URL, events, state and failure count of a webhook
+func UpdateWebhook(webhook Webhook) error {
+    return store.UpdateWebhook(webhook)
+}
+
+// Counts a failed delivery attempt against a webhook, disabling it once it has
+// failed limit times in a row. Reports whether this failure disabled it. Only
+// touches the failure count and state, so changes made by the owner meanwhile stay.
+func RecordWebhookFailure(id string, limit int) (bool, error) {
+    return store.RecordWebhookFailure(id, limit, now())
+}
+
+// Forgets a webhook's failures after a successful delivery
+func ResetWebhookFailures(id string) error {
+    return store.ResetWebhookFailures(id)
+}
+
+// Deletes a webhook and its deliveries
+func DeleteWebhook(id string) error {
+    return store.DeleteWebhook(id)
+}
+
+// Queues a delivery, returning its id
+func AddWebhookDelivery(delivery WebhookDelivery) (string, error) {
+    return store.AddWebhookDelivery(delivery)
+}
+
+// Retrieves a delivery with a given id
+func GetWebhookDelivery(id string) (WebhookDelivery, error) {
+    return store.GetWebhookDelivery(id)
+}
+
+// Returns up to limit of a webhook's deliveries, newest first. A limit of 0
+// uses the default page size.
+func GetWebhookDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+    limit, err := pageSize(limit)
+    if err != nil {
+        return nil, err
+    }
+    return store.GetWebhookDeliveries(webhookID, limit)
+}
+
+// Claims up to limit pending deliveries that are due, for enabled webhooks, by
+// putting their next attempt off until until, so other replicas leave them alone
+func ClaimWebhookDeliveries(until time.Time, limit int) ([]WebhookDelivery, error) {
+    return store.ClaimWebhookDeliveries(now(), until.UTC().Truncate(time.Second), limit)
+}
+
+// Saves the status and outcome of the last attempt of a delivery
+func UpdateWebhookDelivery(delivery WebhookDelivery) error {
+    return store.UpdateWebhookDelivery(delivery)
+}
+
+// Permanently deletes deliveries created before a time that are no longer pending
+func PruneWebhookDeliveries(before time.Time) (int64, error) {
+    return store.PruneWebhookDeliveries(before)
+}
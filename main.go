@@ -1,8 +1,14 @@
 package main
 
 import (
+    "os"
     "log"
     "fmt"
+    "net"
+    "time"
+    "strconv"
+    "strings"
+    "net/url"
     "net/http"
     "text/template"
     "gitlab.sas.com/lomich/kind-app/db"
@@ -13,7 +19,38 @@ import (
 type HTMLData struct {
     People []db.Person
     Posts []db.Post
+    Sessions []security.SessionInfo
+    Tokens []security.PersonalTokenInfo
+    Scopes []string
+    NewToken string
+    Error string
     Username string
+    CanModerate bool
+    IsAdmin bool
+    ReactionEmoji []string
+    Trash []db.TrashItem
+    TrashDays int
+    // Cursor of the next page of posts, and of each post's next page of comments
+    NextCursor string
+    CommentsCursors map[string]string
+    ShowComments bool
+    Query string
+    Results []db.SearchResult
+    // Hashtag of a tag page, and the tags trending in the sidebar
+    Tag string
+    Trending []db.TagCount
+    TrendingHours int
+    Notifications []db.Notification
+    // Number of unread notifications, shown as a badge in the nav bar
+    Unread int
+    Preferences map[string]bool
+    NotificationKinds []string
+    Webhooks []security.WebhookInfo
+    WebhookEvents []string
+    // Webhook whose delivery log is shown, and the secret of one just registered
+    Webhook security.WebhookInfo
+    Deliveries []security.DeliveryInfo
+    NewSecret string
 }
 
 type HTTPError struct {
@@ -34,6 +71,15 @@ func getSessionID(r *http.Request) string {
     return cookie.Value
 }
 
+// Describes the client making a request, for the session list
+func clientInfo(r *http.Request) security.Client {
+    ip, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        ip = r.RemoteAddr
+    }
+    return security.Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
 // Checks for cookie to see if authenticated, otherwise directs to login
 func isAuthenticated(r *http.Request) bool {
     uuid := getSessionID(r)
@@ -54,23 +100,106 @@ func index(w http.ResponseWriter, r *http.Request) {
         http.Redirect(w, r, "https://localhost/login", 303)
         return
     }
+    feed(w, r, "")
+}
 
-    var data HTMLData
-    posts, err := db.GetAllPosts()
+// Streams post, comment and reaction events to the web pages, see api.ServeEvents
+func stream(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    api.ServeEvents(w, r)
+}
+
+// Opens a WebSocket with the viewers of the post in ?post=, see api.ServeLive
+func live(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
     if err != nil {
         fmt.Println(err)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
-    var postsWithComments []db.Post
-    for _, post := range posts {
-        comments, _ := db.GetComments(post.Id)
-        post.Comments = comments
-        postsWithComments = append(postsWithComments, post)
+    api.ServeLive(w, r, username, r.URL.Query().Get("post"))
+}
+
+// Serve index.html with the posts using the hashtag in /tag/{name}
+func tagPage(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    tag, err := db.NormalizeTag(strings.TrimPrefix(r.URL.Path, "/tag/"))
+    if err != nil {
+        http.NotFound(w, r)
+        return
     }
-    data.Posts = postsWithComments
+    feed(w, r, tag)
+}
+
+// Renders index.html with a page of posts, only those using tag unless it is empty
+func feed(w http.ResponseWriter, r *http.Request, tag string) {
+    var data HTMLData
+    var posts []db.Post
+    var err error
     data.Username, _ = db.GetUsername(getSessionID(r))
+    data.CommentsCursors = make(map[string]string)
+    if id := r.URL.Query().Get("post"); id != "" {
+        // A single post with a later page of its comments, for "Load more" on comments
+        var post db.Post
+        post, err = db.GetPost(id)
+        if err == nil {
+            post.Comments, data.CommentsCursors[id], err = db.GetCommentsPage(id, r.URL.Query().Get("comments"), 0)
+        }
+        posts = []db.Post{post}
+        data.ShowComments = true
+    } else {
+        if tag == "" {
+            posts, data.NextCursor, err = db.GetPostsPage(r.URL.Query().Get("cursor"), 0)
+        } else {
+            posts, data.NextCursor, err = db.GetTagPostsPage(tag, r.URL.Query().Get("cursor"), 0)
+        }
+        for i := range posts {
+            if err == nil {
+                posts[i].Comments, data.CommentsCursors[posts[i].Id], err = db.GetCommentsPage(posts[i].Id, "", 0)
+            }
+        }
+    }
+    if err != nil {
+        fmt.Println(err)
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    data.Posts = security.VisiblePosts(data.Username, posts)
+    err = db.MarkVotes(data.Username, data.Posts)
+    if err == nil {
+        err = db.LoadReactions(data.Username, data.Posts)
+    }
+    if err == nil {
+        err = db.LoadMentions(data.Posts)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.Unread, err = db.CountUnread(data.Username)
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.Tag = tag
+    data.Trending, err = security.TrendingTags()
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.TrendingHours = int(security.TrendingWindow.Hours())
+    data.ReactionEmoji = security.ReactionEmoji
+    data.CanModerate = security.Can(data.Username, security.PermHideContent)
+    data.IsAdmin = security.Can(data.Username, security.PermManageUsers)
 
-    t, _ := template.ParseFiles("assets/index.html")
+    t, _ := template.New("index.html").Funcs(template.FuncMap{"tags": db.ParseTags, "mentions": db.LinkMentions}).ParseFiles("assets/index.html")
     t.Execute(w, data)
 }
 
@@ -91,6 +220,7 @@ func view(w http.ResponseWriter, r *http.Request) {
 func createUser(w http.ResponseWriter, r *http.Request) {
     if isAuthenticated(r) {
         redirectHTTP(w, r)
+        return
     }
     if r.Method == "GET" {
         t, _ := template.ParseFiles("assets/createuser.html")
@@ -117,6 +247,7 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 func login(w http.ResponseWriter, r *http.Request) {
     if isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/", 303)
+        return
     }
     if r.Method == "GET" {
         t, _ := template.ParseFiles("assets/login.html")
@@ -125,7 +256,7 @@ func login(w http.ResponseWriter, r *http.Request) {
     if r.Method == "POST" {
         username := r.FormValue("username")
         password := r.FormValue("password")
-        uuid, err := security.Authenticate(username, password)
+        uuid, err := security.Authenticate(username, password, clientInfo(r))
         if err != nil {
             fmt.Println(err)
             httpError := HTTPError{
@@ -138,7 +269,11 @@ func login(w http.ResponseWriter, r *http.Request) {
             c := &http.Cookie{
                 Name: "sessionid",
                 Value: uuid,
-                MaxAge: 0,
+                Path: "/",
+                MaxAge: int(security.SessionMaxAge.Seconds()),
+                Secure: true,
+                HttpOnly: true,
+                SameSite: http.SameSiteLaxMode,
             }
             http.SetCookie(w, c)
             http.Redirect(w, r, "https://localhost", 303)
@@ -150,19 +285,412 @@ func login(w http.ResponseWriter, r *http.Request) {
 func logout(w http.ResponseWriter, r *http.Request) {
     if !isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/login", 303)
+        return
     }
     uuid := getSessionID(r)
     err := security.RemoveSession(uuid)
     if err != nil {
         fmt.Println(err)
     }
+    http.SetCookie(w, &http.Cookie{Name: "sessionid", Path: "/", MaxAge: -1})
     http.Redirect(w, r, "https://localhost/login", 303)
 }
 
+// Serve sessions.html, listing the user's active sessions
+func sessions(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    uuid := getSessionID(r)
+    username, err := db.GetUsername(uuid)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+
+    if r.Method == "POST" {
+        // Revoke a single session, or every session but this one
+        if r.FormValue("all") != "" {
+            err = security.RevokeSessions(username, uuid)
+        } else {
+            err = security.RevokeSession(username, r.FormValue("id"))
+        }
+        if err != nil {
+            fmt.Println(err)
+        }
+        http.Redirect(w, r, "https://localhost/sessions", 303)
+        return
+    }
+
+    var data HTMLData
+    data.Username = username
+    data.Sessions, err = security.ListSessions(username, uuid)
+    if err != nil {
+        fmt.Println(err)
+    }
+    t, _ := template.ParseFiles("assets/sessions.html")
+    t.Execute(w, data)
+}
+
+// Deletes a post or comment written by the user, or by anybody for moderators
+func deleteContent(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Redirect(w, r, "https://localhost", 303)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err == nil {
+        err = security.DeleteContent(username, entity, r.FormValue("id"))
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    http.Redirect(w, r, "https://localhost", 303)
+}
+
+// Edits a post or comment, for its author or moderators
+func editContent(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Redirect(w, r, "https://localhost", 303)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err == nil {
+        err = security.EditContent(username, entity, r.FormValue("id"), r.FormValue("content"))
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    http.Redirect(w, r, "https://localhost", 303)
+}
+
+// Lists the user's deleted posts and comments and restores them
+func trash(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    var data HTMLData
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    data.Username = username
+    if r.Method == "POST" {
+        entity, err := db.ParseEntity(r.FormValue("entity"))
+        if err == nil {
+            err = security.RestoreContent(username, entity, r.FormValue("id"))
+        }
+        if err != nil {
+            data.Error = err.Error()
+        }
+    }
+    data.Trash, err = security.ListTrash(username)
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.TrashDays = int(security.TrashRetention.Hours() / 24)
+    t, _ := template.ParseFiles("assets/trash.html")
+    t.Execute(w, data)
+}
+
+// Serve notifications.html, the user's inbox and notification settings. Posting
+// marks one or all notifications read or saves the settings, and following a
+// notification marks it read on the way to the post.
+func notifications(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    var data HTMLData
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    data.Username = username
+
+    if id := r.URL.Query().Get("open"); id != "" {
+        err = db.ReadNotification(username, id)
+        if err != nil {
+            fmt.Println(err)
+        }
+        http.Redirect(w, r, "https://localhost/?post="+url.QueryEscape(r.URL.Query().Get("post"))+
+            "#"+url.PathEscape(r.URL.Query().Get("at")), 303)
+        return
+    }
+    if r.Method == "POST" {
+        switch {
+        case r.FormValue("preferences") != "":
+            for _, kind := range db.NotificationKinds {
+                if err == nil {
+                    err = db.SetNotificationPreference(username, kind, r.FormValue(kind) != "")
+                }
+            }
+        case r.FormValue("all") != "":
+            err = db.ReadNotifications(username)
+        default:
+            err = db.ReadNotification(username, r.FormValue("id"))
+        }
+        if err != nil {
+            fmt.Println(err)
+        }
+        http.Redirect(w, r, "https://localhost/notifications", 303)
+        return
+    }
+
+    data.Notifications, err = db.GetNotifications(username, false, db.MaxPageSize)
+    if err == nil {
+        data.Unread, err = db.CountUnread(username)
+    }
+    if err == nil {
+        data.Preferences, err = db.GetNotificationPreferences(username)
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    data.NotificationKinds = db.NotificationKinds
+    t, _ := template.ParseFiles("assets/notifications.html")
+    t.Execute(w, data)
+}
+
+// Searches posts and comments
+func search(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    var data HTMLData
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    data.Username = username
+    data.Query = r.URL.Query().Get("q")
+    if data.Query != "" {
+        data.Results, err = security.Search(username, data.Query, 50)
+        if err != nil {
+            data.Error = err.Error()
+        }
+    }
+    t, _ := template.ParseFiles("assets/search.html")
+    t.Execute(w, data)
+}
+
+// Hides or shows a post or comment, for moderators
+func hideContent(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Redirect(w, r, "https://localhost", 303)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err == nil {
+        err = security.SetHidden(username, entity, r.FormValue("id"), r.FormValue("hidden") != "0")
+    }
+    if err != nil {
+        fmt.Println(err)
+    }
+    http.Redirect(w, r, "https://localhost", 303)
+}
+
+// Lists, creates and revokes the user's personal access tokens
+func tokens(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+
+    var data HTMLData
+    data.Username = username
+    data.Scopes = security.Scopes
+    if r.Method == "POST" {
+        if id := r.FormValue("id"); id != "" {
+            err = security.RevokePersonalToken(username, id)
+            if err != nil {
+                fmt.Println(err)
+            }
+            http.Redirect(w, r, "https://localhost/tokens", 303)
+            return
+        }
+
+        // Create a token, shown on this response only
+        r.ParseForm()
+        days, _ := strconv.Atoi(r.FormValue("days"))
+        if days < 0 || days > 1000 {
+            days = -1
+        }
+        ttl := time.Duration(days) * 24 * time.Hour
+        data.NewToken, _, err = security.CreatePersonalToken(username, r.FormValue("name"), r.Form["scope"], ttl)
+        if err != nil {
+            data.Error = err.Error()
+        }
+    }
+
+    data.Tokens, err = security.ListPersonalTokens(username)
+    if err != nil {
+        fmt.Println(err)
+    }
+    t, _ := template.ParseFiles("assets/tokens.html")
+    t.Execute(w, data)
+}
+
+// Lists, registers, disables and deletes the user's webhooks, and shows the
+// delivery log of one with ?id=
+func webhooks(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    username, err := db.GetUsername(getSessionID(r))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+
+    var data HTMLData
+    data.Username = username
+    data.WebhookEvents = db.WebhookEvents
+    if r.Method == "POST" {
+        id := r.FormValue("id")
+        switch r.FormValue("action") {
+        case "create":
+            r.ParseForm()
+            // Register a webhook, its secret shown on this response only
+            data.NewSecret, _, err = security.CreateWebhook(username, r.FormValue("url"), r.Form["event"])
+            if err != nil {
+                data.Error = err.Error()
+            }
+        case "enable", "disable":
+            enabled := r.FormValue("action") == "enable"
+            _, err = security.UpdateWebhook(username, id, "", nil, &enabled)
+        case "delete":
+            err = security.DeleteWebhook(username, id)
+            id = ""
+        case "redeliver":
+            _, err = security.Redeliver(username, id, r.FormValue("delivery"))
+        }
+        if data.NewSecret == "" && data.Error == "" {
+            if err != nil {
+                fmt.Println(err)
+            }
+            if id != "" {
+                http.Redirect(w, r, "https://localhost/webhooks?id="+url.QueryEscape(id), 303)
+            } else {
+                http.Redirect(w, r, "https://localhost/webhooks", 303)
+            }
+            return
+        }
+    }
+
+    if id := r.URL.Query().Get("id"); id != "" {
+        data.Webhook, err = security.GetWebhook(username, id)
+        if err == nil {
+            data.Deliveries, err = security.ListDeliveries(username, id, 0)
+        }
+        if err != nil {
+            data.Error = err.Error()
+        }
+    }
+    data.Webhooks, err = security.ListWebhooks(username, false)
+    if err != nil {
+        fmt.Println(err)
+    }
+    t, _ := template.ParseFiles("assets/webhooks.html")
+    t.Execute(w, data)
+}
+
+// Sends the webhook deliveries that are due, as soon as a batch is done while
+// there are more
+func deliverWebhooks() {
+    for range time.Tick(5 * time.Second) {
+        for {
+            n, err := security.DeliverWebhooks()
+            if err != nil {
+                fmt.Println("Error delivering webhooks:", err)
+            }
+            if n == 0 {
+                break
+            }
+        }
+    }
+}
+
+// Periodically deletes expired sessions and API tokens
+func purgeSessions() {
+    for range time.Tick(10 * time.Minute) {
+        n, err := security.PurgeExpiredSessions()
+        if err != nil {
+            fmt.Println("Error purging sessions:", err)
+        } else if n > 0 {
+            fmt.Println("Purged", n, "expired sessions")
+        }
+        n, err = security.PurgeExpiredTokens()
+        if err != nil {
+            fmt.Println("Error purging API tokens:", err)
+        } else if n > 0 {
+            fmt.Println("Purged", n, "expired API tokens")
+        }
+        n, err = security.PurgeTrash()
+        if err != nil {
+            fmt.Println("Error purging trash:", err)
+        } else if n > 0 {
+            fmt.Println("Purged", n, "posts and comments from the trash")
+        }
+        n, err = security.PruneNotifications()
+        if err != nil {
+            fmt.Println("Error pruning notifications:", err)
+        } else if n > 0 {
+            fmt.Println("Pruned", n, "old notifications")
+        }
+        n, err = security.PruneWebhookDeliveries()
+        if err != nil {
+            fmt.Println("Error pruning webhook deliveries:", err)
+        } else if n > 0 {
+            fmt.Println("Pruned", n, "old webhook deliveries")
+        }
+    }
+}
+
 // Creates a new post
 func post(w http.ResponseWriter, r *http.Request) {
     if !isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/login", 303)
+        return
     }
     uuid := getSessionID(r)
     author, err := db.GetUsername(uuid)
@@ -182,6 +710,7 @@ func post(w http.ResponseWriter, r *http.Request) {
 func comment(w http.ResponseWriter, r *http.Request) {
     if !isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/login", 303)
+        return
     }
     uuid := getSessionID(r)
     author, err := db.GetUsername(uuid)
@@ -198,37 +727,229 @@ func comment(w http.ResponseWriter, r *http.Request) {
     http.Redirect(w, r, "https://localhost", 303)
 }
 
-// Likes a post/comment
+// Likes a post/comment, or takes back the user's like
 func like(w http.ResponseWriter, r *http.Request) {
     if !isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err != nil {
+        fmt.Println(err)
+        http.Redirect(w, r, "https://localhost", 303)
+        return
     }
-    entity  := r.URL.Query().Get("entity")
-    id  := r.URL.Query().Get("id")
-    err := db.Like(entity, id)
+    id := r.FormValue("id")
+    username, _ := db.GetUsername(getSessionID(r))
+    _, err = db.Like(username, entity, id)
     if err != nil {
         fmt.Println(err)
     }
     http.Redirect(w, r, "https://localhost", 303)
 }
 
-// Dislikes a post/comment
+// Dislikes a post/comment, or takes back the user's dislike
 func dislike(w http.ResponseWriter, r *http.Request) {
     if !isAuthenticated(r) {
         http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err != nil {
+        fmt.Println(err)
+        http.Redirect(w, r, "https://localhost", 303)
+        return
+    }
+    id := r.FormValue("id")
+    username, _ := db.GetUsername(getSessionID(r))
+    _, err = db.Dislike(username, entity, id)
+    if err != nil {
+        fmt.Println(err)
+    }
+    http.Redirect(w, r, "https://localhost", 303)
+}
+
+// Adds or, with remove set, removes the user's emoji reaction to a post/comment
+func react(w http.ResponseWriter, r *http.Request) {
+    if !isAuthenticated(r) {
+        http.Redirect(w, r, "https://localhost/login", 303)
+        return
+    }
+    if r.Method != "POST" {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    entity, err := db.ParseEntity(r.FormValue("entity"))
+    if err != nil {
+        fmt.Println(err)
+        http.Redirect(w, r, "https://localhost", 303)
+        return
+    }
+    username, _ := db.GetUsername(getSessionID(r))
+    if r.FormValue("remove") != "" {
+        err = security.Unreact(username, entity, r.FormValue("id"), r.FormValue("emoji"))
+    } else {
+        err = security.React(username, entity, r.FormValue("id"), r.FormValue("emoji"))
     }
-    entity  := r.URL.Query().Get("entity")
-    id  := r.URL.Query().Get("id")
-    err := db.Dislike(entity, id)
     if err != nil {
         fmt.Println(err)
     }
     http.Redirect(w, r, "https://localhost", 303)
 }
 
+// Registers the web application's handlers
+func routes() *http.ServeMux {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", index)
+    mux.HandleFunc("/createuser", createUser)
+    mux.HandleFunc("/login", login)
+    mux.HandleFunc("/logout", logout)
+    mux.HandleFunc("/post", post)
+    mux.HandleFunc("/comment", comment)
+    mux.HandleFunc("/like", like)
+    mux.HandleFunc("/dislike", dislike)
+    mux.HandleFunc("/react", react)
+    mux.HandleFunc("/delete", deleteContent)
+    mux.HandleFunc("/edit", editContent)
+    mux.HandleFunc("/trash", trash)
+    mux.HandleFunc("/search", search)
+    mux.HandleFunc("/tag/", tagPage)
+    mux.HandleFunc("/notifications", notifications)
+    mux.HandleFunc("/stream", stream)
+    mux.HandleFunc("/live", live)
+    mux.HandleFunc("/hide", hideContent)
+    mux.HandleFunc("/view", view)
+    mux.HandleFunc("/sessions", sessions)
+    mux.HandleFunc("/tokens", tokens)
+    mux.HandleFunc("/webhooks", webhooks)
+    mux.HandleFunc("/admin", adminUsers)
+    mux.HandleFunc("/admin/content", adminContent)
+    return mux
+}
+
+// Runs the migrate status|up|down [steps] command
+func migrate(args []string) error {
+    if len(args) == 0 {
+        return fmt.Errorf("Usage: %s migrate status|up|down [steps]", os.Args[0])
+    }
+    m, closeDB, err := db.OpenMigrator()
+    if err != nil {
+        return err
+    }
+    defer closeDB()
+
+    switch args[0] {
+    case "status":
+        statuses, err := m.Status()
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%-8s %-30s %-10s %s\n", "VERSION", "NAME", "STATUS", "APPLIED AT")
+        for _, s := range statuses {
+            state, appliedAt := "pending", ""
+            if s.Applied {
+                state, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+            }
+            if s.Modified {
+                state = "modified"
+            }
+            fmt.Printf("%-8d %-30s %-10s %s\n", s.Version, s.Name, state, appliedAt)
+        }
+    case "up":
+        n, err := m.Up()
+        if err != nil {
+            return err
+        }
+        fmt.Println("Applied", n, "migration(s)")
+    case "down":
+        steps := 1
+        if len(args) > 1 {
+            steps, err = strconv.Atoi(args[1])
+            if err != nil || steps < 1 {
+                return fmt.Errorf("Invalid number of steps %q", args[1])
+            }
+        }
+        n, err := m.Down(steps)
+        if err != nil {
+            return err
+        }
+        fmt.Println("Rolled back", n, "migration(s)")
+    default:
+        return fmt.Errorf("Unknown migrate command %q, expected status, up or down", args[0])
+    }
+    return nil
+}
+
+// Runs the tags rebuild command, storing the hashtags of posts written before
+// tags were kept
+func tags(args []string) error {
+    if len(args) != 1 || args[0] != "rebuild" {
+        return fmt.Errorf("Usage: %s tags rebuild", os.Args[0])
+    }
+    err := db.Conn()
+    if err != nil {
+        return err
+    }
+    defer db.Default().Close()
+    n, err := db.RebuildTags()
+    if err != nil {
+        return err
+    }
+    fmt.Println("Tagged", n, "post(s)")
+    return nil
+}
+
+// Runs the role subcommand, used to appoint the first admin
+func setRole(args []string) error {
+    if len(args) != 2 {
+        return fmt.Errorf("Usage: %s role <username> user|moderator|admin", os.Args[0])
+    }
+    err := db.Conn()
+    if err != nil {
+        return err
+    }
+    defer db.Default().Close()
+    err = security.SetRole("", args[0], args[1])
+    if err != nil {
+        return err
+    }
+    fmt.Println(args[0], "is now", args[1])
+    return nil
+}
+
 // Serve application
 func main() {
 
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        err := migrate(os.Args[2:])
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "role" {
+        err := setRole(os.Args[2:])
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "tags" {
+        err := tags(os.Args[2:])
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
     fmt.Println("Starting Application...")
 
     // Connect to database
@@ -236,19 +957,16 @@ func main() {
     if err != nil {
         log.Fatal(err)
     }
+    err = db.ConnBroadcaster()
+    if err != nil {
+        log.Fatal(err)
+    }
 
     // Listen for http/s requests
     fmt.Println("Serving Application...")
-    http.HandleFunc("/", index)
-    http.HandleFunc("/createuser", createUser)
-    http.HandleFunc("/login", login)
-    http.HandleFunc("/logout", logout)
-    http.HandleFunc("/post", post)
-    http.HandleFunc("/comment", comment)
-    http.HandleFunc("/like", like)
-    http.HandleFunc("/dislike", dislike)
-    http.HandleFunc("/view", view)
+    go purgeSessions()
+    go deliverWebhooks()
     go http.ListenAndServe(":80", http.HandlerFunc(redirectHTTP))
     go api.StartAPI()
-    log.Fatal(http.ListenAndServeTLS(":443", "security/server.pem", "security/server.key", nil))
+    log.Fatal(http.ListenAndServeTLS(":443", "security/server.pem", "security/server.key", routes()))
 }
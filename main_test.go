@@ -0,0 +1,202 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "net/url"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "gitlab.sas.com/lomich/kind-app/security"
+)
+
+// Classic SQL injection payloads thrown at every route
+var payloads = []string{
+    "' OR '1'='1",
+    "' OR 1=1 --",
+    "admin'--",
+    "1 OR 1=1",
+    "1' OR '1'='1",
+    "1; DROP TABLE post; --",
+    "1'; DROP TABLE user; --",
+    "'; DELETE FROM session; --",
+    "post SET likes=9999 WHERE 1=1; --",
+    "1 UNION SELECT username, password, salt, 1, 1, 1 FROM user --",
+}
+
+// Opens a fresh SQLite store with user alice, her session and one post
+func setup(t *testing.T) (session string, postID string) {
+    s, err := db.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    db.Use(s)
+
+    err = security.Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    session, err = security.Authenticate("alice", "password", security.Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    postID, err = db.AddPost("original post", "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return session, postID
+}
+
+// Sends a request to the web application, optionally with a session cookie
+func do(method string, target string, form url.Values, session string) *httptest.ResponseRecorder {
+    var r *http.Request
+    if form != nil {
+        r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    } else {
+        r = httptest.NewRequest(method, target, nil)
+    }
+    if session != "" {
+        r.AddCookie(&http.Cookie{Name: "sessionid", Value: session})
+    }
+    w := httptest.NewRecorder()
+    routes().ServeHTTP(w, r)
+    return w
+}
+
+// Fails if alice, her session or her post were changed
+func assertIntact(t *testing.T, session string, postID string, payload string) {
+    t.Helper()
+    if hash, _, err := db.GetCreds("alice"); err != nil || hash == "" {
+        t.Fatalf("payload %q: user table changed: %v", payload, err)
+    }
+    if valid, err := db.ValidSession(session); err != nil || !valid {
+        t.Fatalf("payload %q: session table changed: %v", payload, err)
+    }
+    post, err := db.GetPost(postID)
+    if err != nil || post.Content != "original post" || post.Likes != 0 || post.NumComments != 0 {
+        t.Fatalf("payload %q: post table changed: %+v %v", payload, post, err)
+    }
+}
+
+func TestRoutesRejectInjectionPayloads(t *testing.T) {
+    session, postID := setup(t)
+
+    for _, p := range payloads {
+        // Session cookie
+        w := do("GET", "/", nil, p)
+        if w.Code != http.StatusSeeOther || !strings.HasSuffix(w.Header().Get("Location"), "/login") {
+            t.Errorf("GET / with sessionid %q was not redirected to login: %d", p, w.Code)
+        }
+
+        // Login form
+        for _, form := range []url.Values{
+            {"username": {p}, "password": {p}},
+            {"username": {"alice"}, "password": {p}},
+            {"username": {p}, "password": {"password"}},
+        } {
+            w = do("POST", "/login", form, "")
+            if len(w.Result().Cookies()) != 0 {
+                t.Errorf("POST /login with %v set a session cookie", form)
+            }
+        }
+
+        // Like and dislike parameters
+        for _, path := range []string{"/like", "/dislike"} {
+            for _, query := range []url.Values{
+                {"entity": {p}, "id": {postID}},
+                {"entity": {"post"}, "id": {p}},
+                {"entity": {"comment"}, "id": {p}},
+            } {
+                do("POST", path, query, session)
+            }
+        }
+        assertIntact(t, session, postID, p)
+
+        // Comment on a post id payload
+        do("POST", "/comment", url.Values{"postid": {p}, "content": {"comment"}}, session)
+        assertIntact(t, session, postID, p)
+
+        // Content is stored verbatim
+        do("POST", "/post", url.Values{"content": {p}}, session)
+        posts, err := db.GetAllPosts()
+        if err != nil || len(posts) != 2 || posts[0].Content != p {
+            t.Fatalf("POST /post with %q stored %+v, %v", p, posts, err)
+        }
+        db.DeletePost(posts[0].Id)
+
+        // Registration stores the payload as a literal username
+        do("POST", "/createuser", url.Values{"username": {p}, "password": {p}}, "")
+        if _, err := security.Authenticate(p, p, security.Client{}); err != nil {
+            t.Errorf("user %q could not log in after registering: %v", p, err)
+        }
+        assertIntact(t, session, postID, p)
+    }
+}
+
+func TestReactionsRequirePOST(t *testing.T) {
+    session, postID := setup(t)
+    form := url.Values{"entity": {"post"}, "id": {postID}, "emoji": {"👍"}}
+
+    w := do("GET", "/react?"+form.Encode(), nil, session)
+    if w.Code != http.StatusMethodNotAllowed {
+        t.Errorf("GET /react returned %d", w.Code)
+    }
+    reactions, err := db.GetReactions(db.PostEntity, postID)
+    if err != nil || len(reactions) != 0 {
+        t.Fatalf("GET /react reacted: %+v %v", reactions, err)
+    }
+
+    do("POST", "/react", form, session)
+    reactions, err = db.GetReactions(db.PostEntity, postID)
+    if err != nil || len(reactions) != 1 || reactions[0].Emoji != "👍" {
+        t.Fatalf("POST /react stored %+v, %v", reactions, err)
+    }
+    form.Set("remove", "1")
+    do("POST", "/react", form, session)
+    reactions, err = db.GetReactions(db.PostEntity, postID)
+    if err != nil || len(reactions) != 0 {
+        t.Errorf("POST /react with remove left %+v, %v", reactions, err)
+    }
+}
+
+func TestVotesRequirePOST(t *testing.T) {
+    session, postID := setup(t)
+    commentID, err := db.AddComment("original comment", "alice", postID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, path := range []string{"/like", "/dislike"} {
+        for _, query := range []url.Values{
+            {"entity": {"post"}, "id": {postID}},
+            {"entity": {"comment"}, "id": {commentID}},
+        } {
+            w := do("GET", path+"?"+query.Encode(), nil, session)
+            if w.Code != http.StatusMethodNotAllowed {
+                t.Errorf("GET %s returned %d", path, w.Code)
+            }
+        }
+    }
+    post, err := db.GetPost(postID)
+    if err != nil || post.Likes != 0 || post.Dislikes != 0 {
+        t.Fatalf("GET voted on the post: %+v %v", post, err)
+    }
+    comment, err := db.GetComment(commentID)
+    if err != nil || comment.Likes != 0 || comment.Dislikes != 0 {
+        t.Fatalf("GET voted on the comment: %+v %v", comment, err)
+    }
+
+    do("POST", "/like", url.Values{"entity": {"post"}, "id": {postID}}, session)
+    do("POST", "/dislike", url.Values{"entity": {"comment"}, "id": {commentID}}, session)
+    post, err = db.GetPost(postID)
+    if err != nil || post.Likes != 1 || post.Dislikes != 0 {
+        t.Errorf("POST /like stored %+v, %v", post, err)
+    }
+    comment, err = db.GetComment(commentID)
+    if err != nil || comment.Likes != 0 || comment.Dislikes != 1 {
+        t.Errorf("POST /dislike stored %+v, %v", comment, err)
+    }
+}
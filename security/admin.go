@@ -0,0 +1,150 @@
+package security
+
+import (
+    "fmt"
+    "encoding/base64"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Number of users on a page of ListUsers
+const UsersPerPage = 50
+
+// User as shown in the admin console
+type UserInfo struct {
+    Username string `json:"username"`
+    Role string `json:"role"`
+    Locked bool `json:"locked"`
+}
+
+// Checks that actor may administer users
+func requireAdmin(actor string) error {
+    if !Can(actor, PermManageUsers) {
+        return ErrPermissionDenied
+    }
+    return nil
+}
+
+// Records an admin action on a user's account
+func logUserAction(actor string, action string, username string, detail string) error {
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: action,
+        Entity: "user",
+        EntityId: username,
+        Author: username,
+        Detail: detail,
+    })
+}
+
+// Lists users whose name contains search, page starting at 0
+func ListUsers(actor string, search string, page int) ([]UserInfo, error) {
+    err := requireAdmin(actor)
+    if err != nil {
+        return nil, err
+    }
+    if page < 0 {
+        page = 0
+    }
+    users, err := db.GetUsers(search, UsersPerPage, page * UsersPerPage)
+    if err != nil {
+        return nil, err
+    }
+    infos := []UserInfo{}
+    for _, user := range users {
+        infos = append(infos, UserInfo{Username: user.Username, Role: user.Role, Locked: user.Locked})
+    }
+    return infos, nil
+}
+
+// Locks or unlocks a user. Locking ends all of their sessions and API tokens.
+func SetLocked(actor string, username string, locked bool) error {
+    err := requireAdmin(actor)
+    if err != nil {
+        return err
+    }
+    if locked && actor == username {
+        return fmt.Errorf("Admins cannot lock themselves out")
+    }
+    err = db.SetLocked(username, locked)
+    if err != nil {
+        return err
+    }
+    action := "unlock"
+    if locked {
+        action = "lock"
+        err = endAccess(username)
+        if err != nil {
+            return err
+        }
+    }
+    return logUserAction(actor, action, username, "")
+}
+
+// Replaces a user's password with a random one, returned for the admin to pass
+// on, ends all of their sessions and API tokens and deletes their personal
+// access tokens
+func ResetPassword(actor string, username string) (string, error) {
+    err := requireAdmin(actor)
+    if err != nil {
+        return "", err
+    }
+    if _, err = db.GetUser(username); err != nil {
+        return "", err
+    }
+    b, err := randomBytes(12)
+    if err != nil {
+        return "", err
+    }
+    password := base64.RawURLEncoding.EncodeToString(b)
+    hash, err := hashPassword(password)
+    if err != nil {
+        return "", err
+    }
+    err = db.UpdatePassword(username, hash)
+    if err != nil {
+        return "", err
+    }
+    err = endAccess(username)
+    if err == nil {
+        err = RevokePersonalTokens(username)
+    }
+    if err != nil {
+        return "", err
+    }
+    return password, logUserAction(actor, "reset-password", username, "")
+}
+
+// Ends all of a user's sessions and API tokens
+func LogoutUser(actor string, username string) error {
+    err := requireAdmin(actor)
+    if err != nil {
+        return err
+    }
+    if _, err = db.GetUser(username); err != nil {
+        return err
+    }
+    err = endAccess(username)
+    if err != nil {
+        return err
+    }
+    return logUserAction(actor, "logout", username, "")
+}
+
+// Deletes a user's sessions and revokes their JWTs. Personal access tokens are
+// kept but rejected while the user is locked.
+func endAccess(username string) error {
+    err := db.DeleteSessions(username)
+    if err != nil {
+        return err
+    }
+    return RevokeTokens(username)
+}
+
+// Returns the most recent moderation and admin actions
+func ModerationLog(actor string, limit int) ([]db.ModerationEntry, error) {
+    err := requireAdmin(actor)
+    if err != nil {
+        return nil, err
+    }
+    return db.GetModerationLog(limit)
+}
@@ -0,0 +1,10 @@
+#! /bin/bash
+
+# Generate an Ed25519 API token signing key named after today's date.
+# Older keys in the secret keep verifying tokens until they are removed.
+mkdir -p ./security/jwt
+openssl genpkey -algorithm ed25519 -out ./security/jwt/$(date +%Y%m%d).pem
+
+# Create or update the secret mounted by config/app.yml
+kubectl create secret generic jwt-keys --from-file=./security/jwt \
+    --dry-run=client -o yaml | kubectl apply -f -
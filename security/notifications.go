@@ -0,0 +1,14 @@
+package security
+
+import (
+    "time"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// How long notifications are kept, read or not, set with NOTIFICATION_RETENTION
+var NotificationRetention = envDuration("NOTIFICATION_RETENTION", 90 * 24 * time.Hour)
+
+// Permanently deletes notifications older than NotificationRetention
+func PruneNotifications() (int64, error) {
+    return db.PruneNotifications(time.Now().Add(-NotificationRetention))
+}
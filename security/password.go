@@ -0,0 +1,270 @@
+package security
+
+import (
+    "os"
+    "fmt"
+    "strings"
+    "crypto/rand"
+    "crypto/sha512"
+    "crypto/subtle"
+    "encoding/base64"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/crypto/scrypt"
+)
+
+// Hasher produces and verifies self-describing password hashes in PHC string format
+type Hasher interface {
+    // Name of the algorithm, also the PHC identifier
+    Name() string
+    // Hashes a password with a fresh random salt
+    Hash(password string) (string, error)
+    // Reports whether password matches an encoded hash produced by this algorithm
+    Verify(password string, encoded string) (bool, error)
+    // Reports whether an encoded hash of this algorithm uses outdated parameters
+    NeedsRehash(encoded string) bool
+}
+
+// Hashers that can verify stored passwords, keyed by name
+var hashers = map[string]Hasher{
+    "argon2id": Argon2id{Memory: 19 * 1024, Time: 2, Threads: 1},
+    "bcrypt": Bcrypt{Cost: bcrypt.DefaultCost},
+    "scrypt": Scrypt{LogN: 15, R: 8, P: 1},
+}
+
+// Hasher used for new passwords, selected with PASSWORD_HASHER
+var passwordHasher = defaultHasher()
+
+func defaultHasher() Hasher {
+    if h, ok := hashers[os.Getenv("PASSWORD_HASHER")]; ok {
+        return h
+    }
+    return hashers["argon2id"]
+}
+
+// Sets the hasher used for new passwords
+func SetHasher(h Hasher) {
+    hashers[h.Name()] = h
+    passwordHasher = h
+}
+
+// Returns the name of the algorithm that produced an encoded hash. Hashes
+// without a leading $ are legacy salted SHA-512.
+func algorithm(encoded string) string {
+    if !strings.HasPrefix(encoded, "$") {
+        return "sha512"
+    }
+    id := strings.SplitN(encoded[1:], "$", 2)[0]
+    switch id {
+    case "2a", "2b", "2y":
+        return "bcrypt"
+    }
+    return id
+}
+
+// Hashes a new password with the configured hasher
+func hashPassword(password string) (string, error) {
+    return passwordHasher.Hash(password)
+}
+
+// Checks a password against a stored hash. The salt is only used by legacy hashes.
+// rehash is true when the password matched and the hash should be upgraded.
+func verifyPassword(password string, encoded string, salt []byte) (ok bool, rehash bool, err error) {
+    name := algorithm(encoded)
+    if name == "sha512" {
+        return verifyLegacy(password, encoded, salt), true, nil
+    }
+    h, known := hashers[name]
+    if !known {
+        return false, false, fmt.Errorf("Unknown password hash algorithm %q", name)
+    }
+    ok, err = h.Verify(password, encoded)
+    if err != nil || !ok {
+        return false, false, err
+    }
+    return true, name != passwordHasher.Name() || h.NeedsRehash(encoded), nil
+}
+
+// Verifies a legacy single iteration SHA-512 over password+salt
+func verifyLegacy(password string, encoded string, salt []byte) bool {
+    hasher := sha512.New()
+    hasher.Write([]byte(password))
+    hasher.Write(salt)
+    hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+    return subtle.ConstantTimeCompare([]byte(hash), []byte(encoded)) == 1
+}
+
+// Returns n random bytes
+func randomBytes(n int) ([]byte, error) {
+    b := make([]byte, n)
+    _, err := rand.Read(b)
+    if err != nil {
+        return nil, fmt.Errorf("Error creating salt: %v", err)
+    }
+    return b, nil
+}
+
+var b64 = base64.RawStdEncoding
+
+// Argon2id with memory in KiB
+type Argon2id struct {
+    Memory uint32
+    Time uint32
+    Threads uint8
+}
+
+func (a Argon2id) Name() string {
+    return "argon2id"
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+    salt, err := randomBytes(16)
+    if err != nil {
+        return "", err
+    }
+    key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, 32)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+        a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Parses $argon2id$v=19$m=..,t=..,p=..$salt$hash
+func (a Argon2id) decode(encoded string) (params Argon2id, salt []byte, key []byte, err error) {
+    parts := strings.Split(encoded, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id hash")
+    }
+    var version int
+    _, err = fmt.Sscanf(parts[2], "v=%d", &version)
+    if err != nil || version != argon2.Version {
+        return params, nil, nil, fmt.Errorf("Unsupported argon2id version")
+    }
+    _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id parameters: %v", err)
+    }
+    // argon2 panics rather than erroring on these
+    if params.Time < 1 || params.Threads < 1 || params.Memory < 8 * uint32(params.Threads) {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id parameters")
+    }
+    salt, err = b64.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id salt: %v", err)
+    }
+    key, err = b64.DecodeString(parts[5])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id hash: %v", err)
+    }
+    if len(salt) == 0 || len(key) == 0 {
+        return params, nil, nil, fmt.Errorf("Invalid argon2id hash")
+    }
+    return params, salt, key, nil
+}
+
+func (a Argon2id) Verify(password string, encoded string) (bool, error) {
+    params, salt, key, err := a.decode(encoded)
+    if err != nil {
+        return false, err
+    }
+    other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+    return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+    params, _, _, err := a.decode(encoded)
+    return err != nil || params != a
+}
+
+// Bcrypt, stored in its native $2b$ modular crypt format
+type Bcrypt struct {
+    Cost int
+}
+
+func (b Bcrypt) Name() string {
+    return "bcrypt"
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+    if err != nil {
+        return "", fmt.Errorf("Error hashing password: %v", err)
+    }
+    return string(hash), nil
+}
+
+func (b Bcrypt) Verify(password string, encoded string) (bool, error) {
+    err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+    if err == bcrypt.ErrMismatchedHashAndPassword {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+    cost, err := bcrypt.Cost([]byte(encoded))
+    return err != nil || cost != b.Cost
+}
+
+// Scrypt with N = 2^LogN
+type Scrypt struct {
+    LogN uint8
+    R int
+    P int
+}
+
+func (s Scrypt) Name() string {
+    return "scrypt"
+}
+
+func (s Scrypt) Hash(password string) (string, error) {
+    salt, err := randomBytes(16)
+    if err != nil {
+        return "", err
+    }
+    key, err := scrypt.Key([]byte(password), salt, 1<<s.LogN, s.R, s.P, 32)
+    if err != nil {
+        return "", fmt.Errorf("Error hashing password: %v", err)
+    }
+    return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", s.LogN, s.R, s.P,
+        b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Parses $scrypt$ln=..,r=..,p=..$salt$hash
+func (s Scrypt) decode(encoded string) (params Scrypt, salt []byte, key []byte, err error) {
+    parts := strings.Split(encoded, "$")
+    if len(parts) != 5 || parts[1] != "scrypt" {
+        return params, nil, nil, fmt.Errorf("Invalid scrypt hash")
+    }
+    _, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P)
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid scrypt parameters: %v", err)
+    }
+    salt, err = b64.DecodeString(parts[3])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid scrypt salt: %v", err)
+    }
+    key, err = b64.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("Invalid scrypt hash: %v", err)
+    }
+    if len(salt) == 0 || len(key) == 0 {
+        return params, nil, nil, fmt.Errorf("Invalid scrypt hash")
+    }
+    return params, salt, key, nil
+}
+
+func (s Scrypt) Verify(password string, encoded string) (bool, error) {
+    params, salt, key, err := s.decode(encoded)
+    if err != nil {
+        return false, err
+    }
+    other, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(key))
+    if err != nil {
+        return false, fmt.Errorf("Error hashing password: %v", err)
+    }
+    return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (s Scrypt) NeedsRehash(encoded string) bool {
+    params, _, _, err := s.decode(encoded)
+    return err != nil || params != s
+}
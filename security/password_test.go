@@ -0,0 +1,118 @@
+package security
+
+import (
+    "strings"
+    "testing"
+    "crypto/sha512"
+    "encoding/base64"
+    "gitlab.sas.com/lomich/kind-app/db"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Replaces the store with an empty in-memory one
+func useMemoryStore() {
+    db.Use(db.NewMemoryStore())
+}
+
+func TestHashersRoundTrip(t *testing.T) {
+    for _, h := range []Hasher{
+        Argon2id{Memory: 1024, Time: 1, Threads: 1},
+        Bcrypt{Cost: bcrypt.MinCost},
+        Scrypt{LogN: 10, R: 8, P: 1},
+    } {
+        encoded, err := h.Hash("correct horse")
+        if err != nil {
+            t.Fatalf("%s: %v", h.Name(), err)
+        }
+        if algorithm(encoded) != h.Name() {
+            t.Errorf("%s: hash %q is recognised as %s", h.Name(), encoded, algorithm(encoded))
+        }
+        ok, err := h.Verify("correct horse", encoded)
+        if err != nil || !ok {
+            t.Errorf("%s: password does not verify: %v", h.Name(), err)
+        }
+        ok, err = h.Verify("wrong horse", encoded)
+        if err != nil || ok {
+            t.Errorf("%s: wrong password verifies: %v", h.Name(), err)
+        }
+        if h.NeedsRehash(encoded) {
+            t.Errorf("%s: fresh hash needs rehashing", h.Name())
+        }
+
+        // Flip a character of the hash itself, keeping it valid base64
+        last := encoded[len(encoded)-2]
+        flipped := byte('A')
+        if last == 'A' {
+            flipped = 'B'
+        }
+        tampered := encoded[:len(encoded)-2]+string(flipped)+encoded[len(encoded)-1:]
+        ok, _ = h.Verify("correct horse", tampered)
+        if ok {
+            t.Errorf("%s: tampered hash %q verifies", h.Name(), tampered)
+        }
+    }
+}
+
+func TestMalformedHashesAreRejected(t *testing.T) {
+    for _, encoded := range []string{
+        "$",
+        "$argon2id",
+        "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+        "$argon2id$v=18$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+        "$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+        "$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+        "$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+        "$argon2id$v=19$m=1024,t=1,p=1$!!!$aGFzaA",
+        "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+        "$scrypt$ln=10,r=8$c2FsdA$aGFzaA",
+        "$scrypt$ln=0,r=8,p=1$c2FsdA$aGFzaA",
+        "$scrypt$ln=10,r=8,p=1$c2FsdA$!!!",
+        "$scrypt$ln=10,r=8,p=1$c2FsdA$",
+        "$2b$10$tooshort",
+        "$md5$abc",
+    } {
+        ok, _, err := verifyPassword("password", encoded, nil)
+        if ok || err == nil {
+            t.Errorf("Hash %q returned %v, %v", encoded, ok, err)
+        }
+    }
+}
+
+func TestLegacyHashIsUpgraded(t *testing.T) {
+    useMemoryStore()
+    salt := []byte("legacy salt")
+    hasher := sha512.New()
+    hasher.Write([]byte("password"))
+    hasher.Write(salt)
+    legacy := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+    err := db.Adduser(db.User{Username: "carol", Password: legacy, Salt: salt})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = VerifyCredentials("carol", "wrong")
+    if err == nil {
+        t.Fatal("Wrong password accepted for a legacy hash")
+    }
+    hash, _, _ := db.GetCreds("carol")
+    if hash != legacy {
+        t.Fatalf("Legacy hash changed after a failed login: %q", hash)
+    }
+
+    err = VerifyCredentials("carol", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    hash, _, _ = db.GetCreds("carol")
+    if !strings.HasPrefix(hash, "$"+passwordHasher.Name()+"$") {
+        t.Fatalf("Legacy hash was not upgraded, found %q", hash)
+    }
+    err = VerifyCredentials("carol", "password")
+    if err != nil {
+        t.Fatalf("Upgraded hash does not verify: %v", err)
+    }
+    ok, rehash, err := verifyPassword("password", hash, nil)
+    if !ok || rehash || err != nil {
+        t.Errorf("Upgraded hash returned %v, %v, %v", ok, rehash, err)
+    }
+}
@@ -0,0 +1,182 @@
+package security
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "encoding/base64"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Scopes a personal access token may carry
+const (
+    ScopePostsRead = "posts:read"
+    ScopePostsWrite = "posts:write"
+    ScopeCommentsWrite = "comments:write"
+    ScopeNotificationsRead = "notifications:read"
+    ScopeNotificationsWrite = "notifications:write"
+    ScopeWebhooksRead = "webhooks:read"
+    ScopeWebhooksWrite = "webhooks:write"
+    // Grants every scope, including managing the account's sessions and tokens
+    ScopeAdmin = "admin"
+)
+
+// Every valid scope, in display order
+var Scopes = []string{ScopePostsRead, ScopePostsWrite, ScopeCommentsWrite, ScopeNotificationsRead, ScopeNotificationsWrite,
+    ScopeWebhooksRead, ScopeWebhooksWrite, ScopeAdmin}
+
+// Prefix that tells personal access tokens apart from JWTs
+const PersonalTokenPrefix = "kat_"
+
+const (
+    // Lifetime of a personal access token when none is requested
+    DefaultPersonalTokenTTL = 90 * 24 * time.Hour
+    // Longest lifetime a personal access token may be given
+    MaxPersonalTokenTTL = 365 * 24 * time.Hour
+)
+
+// Personal access token as shown to its owner, never including the token itself
+type PersonalTokenInfo struct {
+    Id string `json:"id"`
+    Name string `json:"name"`
+    Scopes []string `json:"scopes"`
+    CreatedAt time.Time `json:"created_at"`
+    LastUsed *time.Time `json:"last_used"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+func personalTokenInfo(token db.PersonalToken) PersonalTokenInfo {
+    info := PersonalTokenInfo{
+        Id: token.Id,
+        Name: token.Name,
+        Scopes: strings.Fields(token.Scopes),
+        CreatedAt: token.CreatedAt,
+        ExpiresAt: token.ExpiresAt,
+    }
+    if !token.LastUsed.IsZero() {
+        lastUsed := token.LastUsed
+        info.LastUsed = &lastUsed
+    }
+    return info
+}
+
+// Reports whether granted includes scope. The admin scope includes every other scope.
+func HasScope(granted []string, scope string) bool {
+    for _, s := range granted {
+        if s == scope || s == ScopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+// Checks that scopes are known and removes duplicates
+func validScopes(scopes []string) ([]string, error) {
+    var valid []string
+    seen := make(map[string]bool)
+    for _, scope := range scopes {
+        known := false
+        for _, s := range Scopes {
+            known = known || s == scope
+        }
+        if !known {
+            return nil, fmt.Errorf("Unknown scope %q", scope)
+        }
+        if !seen[scope] {
+            seen[scope] = true
+            valid = append(valid, scope)
+        }
+    }
+    if len(valid) == 0 {
+        return nil, fmt.Errorf("At least one scope is required")
+    }
+    return valid, nil
+}
+
+// Creates a personal access token for username that expires after ttl, or
+// DefaultPersonalTokenTTL when ttl is zero. The token is only returned here.
+func CreatePersonalToken(username string, name string, scopes []string, ttl time.Duration) (string, PersonalTokenInfo, error) {
+    name = strings.TrimSpace(name)
+    if name == "" || len(name) > 50 {
+        return "", PersonalTokenInfo{}, fmt.Errorf("Token name must be between 1 and 50 characters")
+    }
+    scopes, err := validScopes(scopes)
+    if err != nil {
+        return "", PersonalTokenInfo{}, err
+    }
+    if ttl == 0 {
+        ttl = DefaultPersonalTokenTTL
+    }
+    if ttl < 0 || ttl > MaxPersonalTokenTTL {
+        return "", PersonalTokenInfo{}, fmt.Errorf("Tokens may not last longer than %d days", MaxPersonalTokenTTL / (24 * time.Hour))
+    }
+
+    b, err := randomBytes(32)
+    if err != nil {
+        return "", PersonalTokenInfo{}, err
+    }
+    token := PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+    stored := db.PersonalToken{
+        Name: name,
+        Username: username,
+        Hash: hashToken(token),
+        Scopes: strings.Join(scopes, " "),
+        ExpiresAt: time.Now().Add(ttl),
+    }
+    stored.Id, err = db.AddPersonalToken(stored)
+    if err != nil {
+        return "", PersonalTokenInfo{}, err
+    }
+    stored.CreatedAt = time.Now().UTC().Truncate(time.Second)
+    stored.ExpiresAt = stored.ExpiresAt.UTC().Truncate(time.Second)
+    return token, personalTokenInfo(stored), nil
+}
+
+// Lists a user's unexpired personal access tokens
+func ListPersonalTokens(username string) ([]PersonalTokenInfo, error) {
+    tokens, err := db.GetPersonalTokens(username)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    infos := []PersonalTokenInfo{}
+    for _, token := range tokens {
+        if now.Before(token.ExpiresAt) {
+            infos = append(infos, personalTokenInfo(token))
+        }
+    }
+    return infos, nil
+}
+
+// Deletes one of a user's personal access tokens
+func RevokePersonalToken(username string, id string) error {
+    return db.DeletePersonalToken(username, id)
+}
+
+// Deletes every personal access token of a user
+func RevokePersonalTokens(username string) error {
+    return db.DeletePersonalTokens(username)
+}
+
+// Returns the owner and scopes of a personal access token, recording its use
+func AuthenticatePersonalToken(token string) (string, []string, error) {
+    stored, err := db.GetPersonalToken(hashToken(token))
+    if err != nil {
+        return "", nil, fmt.Errorf("Personal token is invalid")
+    }
+    now := time.Now()
+    if !now.Before(stored.ExpiresAt) {
+        return "", nil, fmt.Errorf("Personal token has expired")
+    }
+    user, err := db.GetUser(stored.Username)
+    if err != nil || user.Locked {
+        return "", nil, fmt.Errorf("Account is locked")
+    }
+    if now.Sub(stored.LastUsed) >= touchInterval {
+        err = db.TouchPersonalToken(stored.Id, now)
+        if err != nil {
+            fmt.Println(err)
+        }
+    }
+    return stored.Username, strings.Fields(stored.Scopes), nil
+}
@@ -0,0 +1,27 @@
+package security
+
+import (
+    "fmt"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Emoji users may react with, in display order, set with REACTION_EMOJI as a space separated list
+var ReactionEmoji = envList("REACTION_EMOJI", []string{"👍", "🎉", "❤️", "😂", "👀"})
+
+// Adds a user's emoji reaction to a post or comment
+func React(username string, entity db.Entity, id string, emoji string) error {
+    allowed := false
+    for _, e := range ReactionEmoji {
+        allowed = allowed || e == emoji
+    }
+    if !allowed {
+        return fmt.Errorf("Unknown reaction %q", emoji)
+    }
+    return db.AddReaction(username, entity, id, emoji)
+}
+
+// Removes a user's emoji reaction from a post or comment. Reactions with emoji
+// that are no longer allowed can still be removed.
+func Unreact(username string, entity db.Entity, id string, emoji string) error {
+    return db.RemoveReaction(username, entity, id, emoji)
+}
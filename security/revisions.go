@@ -0,0 +1,100 @@
+package security
+
+import (
+    "fmt"
+    "strings"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Longest content that fits the post and comment tables
+const (
+    MaxPostLength = 1000
+    MaxCommentLength = 500
+)
+
+// Replaces the content of a post or comment. Authors may edit their own content;
+// anybody else needs PermEditAnyContent and the edit is recorded in the
+// moderation log. Every previous version is kept as a revision.
+func EditContent(actor string, entity db.Entity, id string, content string) error {
+    if strings.TrimSpace(content) == "" {
+        return fmt.Errorf("Content field cannot be empty")
+    }
+    limit := MaxPostLength
+    if entity == db.CommentEntity {
+        limit = MaxCommentLength
+    }
+    if len(content) > limit {
+        return fmt.Errorf("Content may not be longer than %d characters", limit)
+    }
+    author, err := db.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    owner := author == actor
+    if !owner && !Can(actor, PermEditAnyContent) {
+        return ErrPermissionDenied
+    }
+    previous, err := contentOf(entity, id)
+    if err != nil {
+        return err
+    }
+    if previous == content {
+        return nil
+    }
+    err = db.EditContent(entity, id, content, actor)
+    if err != nil || owner {
+        return err
+    }
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: "edit",
+        Entity: entity.String(),
+        EntityId: id,
+        Author: author,
+        Detail: previous,
+    })
+}
+
+// Returns every version of a post or comment, oldest first and ending with the
+// current one, if viewer may see it
+func Revisions(viewer string, entity db.Entity, id string) ([]db.Revision, error) {
+    var current db.Revision
+    var hidden bool
+    if entity == db.PostEntity {
+        post, err := db.GetPost(id)
+        if err != nil {
+            return nil, err
+        }
+        current = db.Revision{Content: post.Content, Editor: post.Author, CreatedAt: post.Date}
+        if !post.EditedAt.IsZero() {
+            current.Editor, current.CreatedAt = post.EditedBy, post.EditedAt
+        }
+        hidden = post.Hidden
+    } else {
+        comment, err := db.GetComment(id)
+        if err != nil {
+            return nil, err
+        }
+        current = db.Revision{Content: comment.Content, Editor: comment.Author, CreatedAt: comment.Date}
+        if !comment.EditedAt.IsZero() {
+            current.Editor, current.CreatedAt = comment.EditedBy, comment.EditedAt
+        }
+        postID, err := db.GetPostIDFromCommentID(id)
+        if err != nil {
+            return nil, err
+        }
+        post, err := db.GetPost(postID)
+        if err != nil {
+            return nil, err
+        }
+        hidden = comment.Hidden || post.Hidden
+    }
+    if hidden && !Can(viewer, PermViewHidden) {
+        return nil, fmt.Errorf("%s with id:%s does not exist", entity, id)
+    }
+    revisions, err := db.GetRevisions(entity, id)
+    if err != nil {
+        return nil, err
+    }
+    return append(revisions, current), nil
+}
@@ -0,0 +1,215 @@
+package security
+
+import (
+    "fmt"
+    "errors"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Roles a user may have, stored on the user table
+const (
+    RoleUser = "user"
+    RoleModerator = "moderator"
+    RoleAdmin = "admin"
+)
+
+// Every valid role, in order of increasing privilege
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// Something a role allows beyond acting on the user's own content
+type Permission string
+
+const (
+    // Delete posts and comments written by anybody
+    PermDeleteAnyContent Permission = "content:delete-any"
+    // Edit posts and comments written by anybody
+    PermEditAnyContent Permission = "content:edit-any"
+    // Hide and unhide posts and comments
+    PermHideContent Permission = "content:hide"
+    // See hidden posts and comments
+    PermViewHidden Permission = "content:view-hidden"
+    // Change other users' roles
+    PermManageRoles Permission = "users:manage-roles"
+    // Use the admin console to lock, log out and reset the passwords of users
+    PermManageUsers Permission = "users:manage"
+    // Restore posts and comments written by anybody from the trash
+    PermRestoreAnyContent Permission = "content:restore-any"
+    // See and change the webhooks registered by anybody
+    PermManageWebhooks Permission = "webhooks:manage-any"
+)
+
+// Permissions granted by each role
+var rolePermissions = map[string][]Permission{
+    RoleUser: {},
+    RoleModerator: {PermDeleteAnyContent, PermEditAnyContent, PermHideContent, PermViewHidden},
+    RoleAdmin: {PermDeleteAnyContent, PermEditAnyContent, PermHideContent, PermViewHidden, PermManageRoles, PermManageUsers, PermRestoreAnyContent, PermManageWebhooks},
+}
+
+// Returned when a user lacks the permission for an action
+var ErrPermissionDenied = errors.New("You do not have permission to do that")
+
+// Reports whether a user's role grants a permission
+func Can(username string, perm Permission) bool {
+    role, err := db.GetRole(username)
+    if err != nil {
+        return false
+    }
+    for _, p := range rolePermissions[role] {
+        if p == perm {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns a user's role
+func Role(username string) (string, error) {
+    return db.GetRole(username)
+}
+
+// Changes a user's role. actor must be allowed to manage roles, or empty when
+// the change comes from the command line.
+func SetRole(actor string, username string, role string) error {
+    if _, ok := rolePermissions[role]; !ok {
+        return fmt.Errorf("Unknown role %q", role)
+    }
+    if actor != "" && !Can(actor, PermManageRoles) {
+        return ErrPermissionDenied
+    }
+    if actor == username && role != RoleAdmin {
+        return fmt.Errorf("Admins cannot remove their own admin role")
+    }
+    previous, err := db.GetRole(username)
+    if err != nil {
+        return err
+    }
+    err = db.SetRole(username, role)
+    if err != nil {
+        return err
+    }
+    if actor == "" {
+        actor = "(command line)"
+    }
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: "role",
+        Entity: "user",
+        EntityId: username,
+        Author: username,
+        Detail: previous+" -> "+role,
+    })
+}
+
+// Moves a post or comment to the trash. Authors may delete their own content and
+// post authors the comments on their posts; anybody else needs PermDeleteAnyContent
+// and the deletion is recorded in the moderation log.
+func DeleteContent(actor string, entity db.Entity, id string) error {
+    author, err := db.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    owner := author == actor
+    if !owner && entity == db.CommentEntity {
+        postID, err := db.GetPostIDFromCommentID(id)
+        if err != nil {
+            return err
+        }
+        postAuthor, err := db.GetAuthor(db.PostEntity, postID)
+        if err != nil {
+            return err
+        }
+        owner = postAuthor == actor
+    }
+    if !owner && !Can(actor, PermDeleteAnyContent) {
+        return ErrPermissionDenied
+    }
+
+    detail := ""
+    if !owner {
+        detail, err = contentOf(entity, id)
+        if err != nil {
+            return err
+        }
+    }
+    err = db.TrashContent(entity, id, actor)
+    if err != nil || owner {
+        return err
+    }
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: "delete",
+        Entity: entity.String(),
+        EntityId: id,
+        Author: author,
+        Detail: detail,
+    })
+}
+
+// Hides or shows a post or comment for everyone without PermViewHidden
+func SetHidden(actor string, entity db.Entity, id string, hidden bool) error {
+    if !Can(actor, PermHideContent) {
+        return ErrPermissionDenied
+    }
+    author, err := db.GetAuthor(entity, id)
+    if err != nil {
+        return err
+    }
+    err = db.SetHidden(entity, id, hidden, actor)
+    if err != nil {
+        return err
+    }
+    action := "hide"
+    if !hidden {
+        action = "unhide"
+    }
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: action,
+        Entity: entity.String(),
+        EntityId: id,
+        Author: author,
+    })
+}
+
+// Returns the content of a post or comment, kept in the log when it is deleted
+func contentOf(entity db.Entity, id string) (string, error) {
+    if entity == db.PostEntity {
+        post, err := db.GetPost(id)
+        return post.Content, err
+    }
+    comment, err := db.GetComment(id)
+    return comment.Content, err
+}
+
+// Removes hidden posts and comments that username may not see
+func VisiblePosts(username string, posts []db.Post) []db.Post {
+    if Can(username, PermViewHidden) {
+        return posts
+    }
+    visible := []db.Post{}
+    for _, post := range posts {
+        if !post.Hidden {
+            post.Comments = unhidden(post.Comments)
+            visible = append(visible, post)
+        }
+    }
+    return visible
+}
+
+// Removes hidden comments that username may not see
+func VisibleComments(username string, comments []db.Comment) []db.Comment {
+    if Can(username, PermViewHidden) {
+        return comments
+    }
+    return unhidden(comments)
+}
+
+func unhidden(comments []db.Comment) []db.Comment {
+    visible := []db.Comment{}
+    for _, comment := range comments {
+        if !comment.Hidden {
+            visible = append(visible, comment)
+        }
+    }
+    return visible
+}
@@ -0,0 +1,181 @@
+package security
+
+import (
+    "time"
+    "testing"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Creates users named after their roles
+func createRoleUsers(t *testing.T) {
+    for _, role := range Roles {
+        err := Createuser(role, "password")
+        if err == nil {
+            err = db.SetRole(role, role)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestRolePermissions(t *testing.T) {
+    useMemoryStore()
+    createRoleUsers(t)
+    for _, c := range []struct {
+        perm Permission
+        user bool
+        moderator bool
+        admin bool
+    }{
+        {PermDeleteAnyContent, false, true, true},
+        {PermEditAnyContent, false, true, true},
+        {PermHideContent, false, true, true},
+        {PermViewHidden, false, true, true},
+        {PermManageRoles, false, false, true},
+        {PermManageUsers, false, false, true},
+        {PermRestoreAnyContent, false, false, true},
+        {PermManageWebhooks, false, false, true},
+    } {
+        for role, want := range map[string]bool{RoleUser: c.user, RoleModerator: c.moderator, RoleAdmin: c.admin} {
+            if Can(role, c.perm) != want {
+                t.Errorf("%s: Can(%s) is %v", role, c.perm, !want)
+            }
+        }
+        if Can("nobody", c.perm) {
+            t.Errorf("Unknown user has %s", c.perm)
+        }
+    }
+}
+
+func TestRoleBoundaries(t *testing.T) {
+    useMemoryStore()
+    createRoleUsers(t)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    postID, err := db.AddPost("alice's post", "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, c := range []struct {
+        name string
+        action func(actor string) error
+        user bool
+        moderator bool
+        admin bool
+    }{
+        {"hide", func(actor string) error { return SetHidden(actor, db.PostEntity, postID, true) }, false, true, true},
+        {"unhide", func(actor string) error { return SetHidden(actor, db.PostEntity, postID, false) }, false, true, true},
+        {"edit", func(actor string) error { return EditContent(actor, db.PostEntity, postID, "edited by "+actor) }, false, true, true},
+        {"set role", func(actor string) error { return SetRole(actor, "alice", RoleUser) }, false, false, true},
+        {"list users", func(actor string) error { _, err := ListUsers(actor, "", 0); return err }, false, false, true},
+        {"lock", func(actor string) error { return SetLocked(actor, "alice", true) }, false, false, true},
+        {"unlock", func(actor string) error { return SetLocked(actor, "alice", false) }, false, false, true},
+        {"log out", func(actor string) error { return LogoutUser(actor, "alice") }, false, false, true},
+        {"moderation log", func(actor string) error { _, err := ModerationLog(actor, 10); return err }, false, false, true},
+    } {
+        for _, role := range Roles {
+            want := map[string]bool{RoleUser: c.user, RoleModerator: c.moderator, RoleAdmin: c.admin}[role]
+            err := c.action(role)
+            if want && err != nil {
+                t.Errorf("%s by %s failed: %v", c.name, role, err)
+            }
+            if !want && err != ErrPermissionDenied {
+                t.Errorf("%s by %s returned %v", c.name, role, err)
+            }
+        }
+    }
+
+    err = SetLocked(RoleAdmin, RoleAdmin, true)
+    if err == nil {
+        t.Error("Admin locked themselves out")
+    }
+    err = SetRole(RoleAdmin, RoleAdmin, RoleUser)
+    if err == nil {
+        t.Error("Admin removed their own admin role")
+    }
+}
+
+func TestLockedUsersAreShutOut(t *testing.T) {
+    useMemoryStore()
+    createRoleUsers(t)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, _, err := CreatePersonalToken("alice", "ci", []string{ScopePostsRead}, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    session, err := Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = SetLocked(RoleAdmin, "alice", true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = Authenticate("alice", "password", Client{})
+    if err == nil {
+        t.Error("Locked user logged in")
+    }
+    _, _, err = AuthenticatePersonalToken(token)
+    if err == nil {
+        t.Error("Locked user's personal token was accepted")
+    }
+    ok, _ := IsAuthenticated(session)
+    if ok {
+        t.Error("Locked user's session was kept")
+    }
+
+    err = SetLocked(RoleAdmin, "alice", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Errorf("Unlocked user cannot log in: %v", err)
+    }
+    username, _, err := AuthenticatePersonalToken(token)
+    if err != nil || username != "alice" {
+        t.Errorf("Unlocked user's personal token returned %q: %v", username, err)
+    }
+}
+
+func TestPasswordResetEndsAllAccess(t *testing.T) {
+    useMemoryStore()
+    createRoleUsers(t)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, _, err := CreatePersonalToken("alice", "ci", []string{ScopePostsRead}, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    session, err := Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    password, err := ResetPassword(RoleAdmin, "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ok, _ := IsAuthenticated(session); ok {
+        t.Error("Session survived the password reset")
+    }
+    if _, _, err = AuthenticatePersonalToken(token); err == nil {
+        t.Error("Personal token survived the password reset")
+    }
+    if _, err = Authenticate("alice", "password", Client{}); err == nil {
+        t.Error("Old password still works after the reset")
+    }
+    if _, err = Authenticate("alice", password, Client{}); err != nil {
+        t.Errorf("Temporary password is not accepted: %v", err)
+    }
+}
@@ -0,0 +1,20 @@
+package security
+
+import (
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Searches the posts and comments viewer may see, see db.Search for the query syntax
+func Search(viewer string, q string, limit int) ([]db.SearchResult, error) {
+    results, err := db.Search(q, limit)
+    if err != nil || Can(viewer, PermViewHidden) {
+        return results, err
+    }
+    visible := []db.SearchResult{}
+    for _, result := range results {
+        if !result.Hidden {
+            visible = append(visible, result)
+        }
+    }
+    return visible, nil
+}
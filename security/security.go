@@ -2,68 +2,120 @@ package security
 
 import (
     "fmt"
+    "time"
     "gitlab.sas.com/lomich/kind-app/db"
-    "crypto/rand"
-    "crypto/sha512"
-    "encoding/base64"
 )
 
-// Hashes a salted password with SHA512 and returns encoded result
-func hashPassword(password string, salt []byte) string {
-    hasher := sha512.New()
-    passwordBytes := []byte(password)
-    passwordBytes = append(passwordBytes, salt...)
-    hasher.Write(passwordBytes)
-    hash := hasher.Sum(nil)
-    return base64.URLEncoding.EncodeToString(hash)
+// Authenticates a user's credentials and starts a new session for client
+func Authenticate(username string, password string, client Client) (string, error) {
+    err := VerifyCredentials(username, password)
+    if err != nil {
+        return "", err
+    }
+    uuid, err := startSession(username, client)
+    if err != nil {
+        return "", fmt.Errorf("Error creating session: %v", err)
+    }
+    return uuid, nil
 }
 
-// Authenticates a user's credentials
-func Authenticate(username string, password string) (string, error) {
+// Checks a user's credentials without starting a session
+func VerifyCredentials(username string, password string) error {
     hash, salt, err := db.GetCreds(username)
     if err != nil {
-        return "", err
+        return err
+    }
+    ok, rehash, err := verifyPassword(password, hash, salt)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return fmt.Errorf("Password is incorrect")
+    }
+    user, err := db.GetUser(username)
+    if err != nil {
+        return err
+    }
+    if user.Locked {
+        return fmt.Errorf("Account is locked")
     }
-    hashedPassword := hashPassword(password, salt)
 
-    if hashedPassword != hash {
-        return "", fmt.Errorf("Password is incorrect")
+    // Upgrade legacy or outdated hashes now that the password is known
+    if rehash {
+        newHash, err := hashPassword(password)
+        if err == nil {
+            err = db.UpdatePassword(username, newHash)
+        }
+        if err != nil {
+            fmt.Println("Error upgrading password hash for "+username+":", err)
+        }
     }
-    uuid, err := db.AddSession(username)
+    return nil
+}
+
+// Changes a user's password after checking the current one, then revokes all
+// of their API and personal access tokens and ends every session but session,
+// which may be empty
+func ChangePassword(username string, current string, password string, session string) error {
+    err := VerifyCredentials(username, current)
     if err != nil {
-        return "", fmt.Errorf("Error creating session. ", err)
+        return err
     }
-    return uuid, nil
+    hash, err := hashPassword(password)
+    if err != nil {
+        return err
+    }
+    err = db.UpdatePassword(username, hash)
+    if err != nil {
+        return err
+    }
+    err = RevokeTokens(username)
+    if err != nil {
+        return err
+    }
+    err = RevokePersonalTokens(username)
+    if err != nil {
+        return err
+    }
+    return RevokeSessions(username, session)
 }
 
-// Determines if a user is authenticated or not
+// Determines if a session is authenticated, ending it once it has expired
 func IsAuthenticated(uuid string) (bool, error) {
-    return db.ValidSession(uuid)
+    session, err := db.GetSession(uuid)
+    if err != nil {
+        // Session does not exist
+        return false, nil
+    }
+    now := time.Now()
+    if expired(session, now) {
+        return false, db.DeleteSession(uuid)
+    }
+    if now.Sub(session.LastSeen) >= touchInterval {
+        err = db.TouchSession(uuid, now)
+        if err != nil {
+            fmt.Println(err)
+        }
+    }
+    return true, nil
 }
 
 // Removes a session given a uuid
 func RemoveSession(uuid string) error {
-    username, err := db.GetUsername(uuid)
-    if err != nil {
-        return err
-    }
-    return db.DeleteSession(username)
+    return db.DeleteSession(uuid)
 }
 
 // Creates a new user
 func Createuser(username string, password string) error {
-    hash, salt, _ := db.GetCreds(username)
+    hash, _, _ := db.GetCreds(username)
     if hash != "" {
         return fmt.Errorf("User already exists")
     }
 
-    salt = make([]byte, 16)
-    _, err := rand.Read(salt)
+    hash, err := hashPassword(password)
     if err != nil {
-        return fmt.Errorf("Error creating salt: ", err)
+        return err
     }
-
-    hash = hashPassword(password, salt)
-    user := db.User{username, hash, salt}
+    user := db.User{Username: username, Password: hash}
     return db.Adduser(user)
 }
@@ -0,0 +1,153 @@
+package security
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "strings"
+    "crypto/sha256"
+    "encoding/hex"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+var (
+    // Sessions unused for this long are ended, set with SESSION_IDLE_TIMEOUT
+    SessionIdleTimeout = envDuration("SESSION_IDLE_TIMEOUT", 24 * time.Hour)
+    // Sessions end this long after login regardless of use, set with SESSION_MAX_AGE
+    SessionMaxAge = envDuration("SESSION_MAX_AGE", 7 * 24 * time.Hour)
+)
+
+// How stale last_seen may get before a request updates it
+const touchInterval = time.Minute
+
+// Reads a duration such as "30m" or "12h" from the environment
+func envDuration(name string, fallback time.Duration) time.Duration {
+    value := os.Getenv(name)
+    if value == "" {
+        return fallback
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d <= 0 {
+        fmt.Println("Ignoring invalid "+name+":", value)
+        return fallback
+    }
+    return d
+}
+
+// Reads a space separated list from the environment
+func envList(name string, fallback []string) []string {
+    values := strings.Fields(os.Getenv(name))
+    if len(values) == 0 {
+        return fallback
+    }
+    return values
+}
+
+// Details of the client logging in, recorded with the session
+type Client struct {
+    UserAgent string
+    IP string
+}
+
+// Session as shown to its owner. Id is a handle derived from the session
+// uuid so that listing sessions never reveals the cookie value.
+type SessionInfo struct {
+    Id string `json:"id"`
+    CreatedAt time.Time `json:"created_at"`
+    LastSeen time.Time `json:"last_seen"`
+    ExpiresAt time.Time `json:"expires_at"`
+    UserAgent string `json:"user_agent"`
+    IP string `json:"ip"`
+    Current bool `json:"current"`
+}
+
+// Derives the public handle of a session uuid
+func sessionHandle(uuid string) string {
+    sum := sha256.Sum256([]byte(uuid))
+    return hex.EncodeToString(sum[:8])
+}
+
+// Reports whether a session has passed its absolute or idle timeout
+func expired(session db.Session, now time.Time) bool {
+    return !now.Before(session.ExpiresAt) || now.Sub(session.LastSeen) >= SessionIdleTimeout
+}
+
+// Starts a new session for an authenticated user, alongside any existing ones
+func startSession(username string, client Client) (string, error) {
+    userAgent := client.UserAgent
+    if len(userAgent) > 255 {
+        userAgent = userAgent[:255]
+    }
+    return db.AddSession(db.Session{
+        Username: username,
+        ExpiresAt: time.Now().Add(SessionMaxAge),
+        UserAgent: userAgent,
+        IP: client.IP,
+    })
+}
+
+// Lists a user's active sessions, marking the one with uuid current
+func ListSessions(username string, current string) ([]SessionInfo, error) {
+    sessions, err := db.GetSessions(username)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    infos := []SessionInfo{}
+    for _, session := range sessions {
+        if expired(session, now) {
+            continue
+        }
+        infos = append(infos, SessionInfo{
+            Id: sessionHandle(session.Id),
+            CreatedAt: session.CreatedAt,
+            LastSeen: session.LastSeen,
+            ExpiresAt: session.ExpiresAt,
+            UserAgent: session.UserAgent,
+            IP: session.IP,
+            Current: session.Id == current,
+        })
+    }
+    return infos, nil
+}
+
+// Ends one of a user's sessions given its handle
+func RevokeSession(username string, handle string) error {
+    sessions, err := db.GetSessions(username)
+    if err != nil {
+        return err
+    }
+    for _, session := range sessions {
+        if sessionHandle(session.Id) == handle {
+            return db.DeleteSession(session.Id)
+        }
+    }
+    return fmt.Errorf("Session %s does not exist", handle)
+}
+
+// Ends all of a user's sessions except the one with uuid except, which may be empty
+func RevokeSessions(username string, except string) error {
+    if except == "" {
+        return db.DeleteSessions(username)
+    }
+    sessions, err := db.GetSessions(username)
+    if err != nil {
+        return err
+    }
+    for _, session := range sessions {
+        if session.Id == except {
+            continue
+        }
+        err = db.DeleteSession(session.Id)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Deletes every expired session
+func PurgeExpiredSessions() (int64, error) {
+    now := time.Now()
+    return db.DeleteExpiredSessions(now, now.Add(-SessionIdleTimeout))
+}
@@ -0,0 +1,77 @@
+package security
+
+import (
+    "time"
+    "testing"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+func TestSessionExpiry(t *testing.T) {
+    now := time.Now()
+    for _, c := range []struct {
+        name string
+        lastSeen time.Duration
+        expiresAt time.Duration
+        expired bool
+    }{
+        {"fresh", 0, SessionMaxAge, false},
+        {"recently used", -time.Minute, time.Hour, false},
+        {"just inside idle timeout", -SessionIdleTimeout + time.Second, time.Hour, false},
+        {"idle", -SessionIdleTimeout, time.Hour, true},
+        {"long idle", -2 * SessionIdleTimeout, time.Hour, true},
+        {"past max age", 0, 0, true},
+        {"long past max age", 0, -time.Hour, true},
+        {"idle and past max age", -SessionIdleTimeout, -time.Hour, true},
+    } {
+        session := db.Session{LastSeen: now.Add(c.lastSeen), ExpiresAt: now.Add(c.expiresAt)}
+        if expired(session, now) != c.expired {
+            t.Errorf("%s: expired is %v", c.name, !c.expired)
+        }
+    }
+}
+
+func TestExpiredSessionsAreEnded(t *testing.T) {
+    useMemoryStore()
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    active, err := Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    old, err := db.AddSession(db.Session{Username: "alice", ExpiresAt: time.Now().Add(-time.Minute)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    sessions, err := ListSessions("alice", active)
+    if err != nil || len(sessions) != 1 || !sessions[0].Current {
+        t.Fatalf("Expected only the active session, found %+v: %v", sessions, err)
+    }
+
+    ok, err := IsAuthenticated(active)
+    if !ok || err != nil {
+        t.Errorf("Active session is not authenticated: %v", err)
+    }
+    ok, err = IsAuthenticated(old)
+    if ok || err != nil {
+        t.Errorf("Session past its max age is authenticated: %v", err)
+    }
+    if _, err = db.GetSession(old); err == nil {
+        t.Error("Session past its max age was not deleted")
+    }
+
+    // Every session is idle with a timeout this short
+    timeout := SessionIdleTimeout
+    SessionIdleTimeout = time.Nanosecond
+    defer func() { SessionIdleTimeout = timeout }()
+    purged, err := PurgeExpiredSessions()
+    if err != nil || purged != 1 {
+        t.Errorf("Purged %d idle sessions: %v", purged, err)
+    }
+    ok, _ = IsAuthenticated(active)
+    if ok {
+        t.Error("Idle session is authenticated")
+    }
+}
@@ -0,0 +1,17 @@
+package security
+
+import (
+    "time"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// How far back trending tags are counted, set with TRENDING_WINDOW
+var TrendingWindow = envDuration("TRENDING_WINDOW", 24 * time.Hour)
+
+// Number of trending tags shown
+const TrendingLimit = 10
+
+// Lists the tags used by the most posts written within TrendingWindow
+func TrendingTags() ([]db.TagCount, error) {
+    return db.GetTrendingTags(TrendingWindow, TrendingLimit)
+}
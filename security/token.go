@@ -0,0 +1,137 @@
+package security
+
+import (
+    "fmt"
+    "time"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/base64"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+var (
+    // Lifetime of API access tokens, set with ACCESS_TOKEN_TTL
+    AccessTokenTTL = envDuration("ACCESS_TOKEN_TTL", 15 * time.Minute)
+    // Lifetime of API refresh tokens, set with REFRESH_TOKEN_TTL
+    RefreshTokenTTL = envDuration("REFRESH_TOKEN_TTL", 30 * 24 * time.Hour)
+)
+
+// Refresh tokens are only stored as their sha256
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// Stores a refresh token for username, paired with the access token accessJTI
+func addRefreshToken(username string, family string, accessJTI string) (string, error) {
+    b, err := randomBytes(32)
+    if err != nil {
+        return "", err
+    }
+    token := base64.RawURLEncoding.EncodeToString(b)
+    err = db.AddRefreshToken(db.RefreshToken{
+        Id: hashToken(token),
+        Family: family,
+        Username: username,
+        AccessJTI: accessJTI,
+        ExpiresAt: time.Now().Add(RefreshTokenTTL),
+    })
+    if err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// Issues the first refresh token of a new login. accessJTI is the id of the
+// access token issued alongside it, revoked together with the refresh token.
+// The family of tokens rotated from this one is named after that first jti.
+func NewRefreshToken(username string, accessJTI string) (string, error) {
+    return addRefreshToken(username, accessJTI, accessJTI)
+}
+
+// Exchanges a refresh token for a new one paired with accessJTI and returns the
+// owner. Each refresh token works once: presenting a used token revokes every
+// token rotated from the same login, since it has probably been stolen.
+func RotateRefreshToken(token string, accessJTI string) (username string, next string, err error) {
+    current, err := db.GetRefreshToken(hashToken(token))
+    if err != nil {
+        return "", "", fmt.Errorf("Refresh token is invalid")
+    }
+    if !time.Now().Before(current.ExpiresAt) {
+        return "", "", fmt.Errorf("Refresh token has expired")
+    }
+    fresh, err := db.UseRefreshToken(current.Id)
+    if err != nil {
+        return "", "", err
+    }
+    if !fresh {
+        err = revokeFamily(current.Username, current.Family)
+        if err != nil {
+            fmt.Println(err)
+        }
+        return "", "", fmt.Errorf("Refresh token has already been used")
+    }
+    next, err = addRefreshToken(current.Username, current.Family, accessJTI)
+    if err != nil {
+        return "", "", err
+    }
+    return current.Username, next, nil
+}
+
+// Revokes a refresh token along with every token rotated from the same login
+func RevokeRefreshToken(token string) error {
+    current, err := db.GetRefreshToken(hashToken(token))
+    if err != nil {
+        return fmt.Errorf("Refresh token is invalid")
+    }
+    return revokeFamily(current.Username, current.Family)
+}
+
+// Revokes the access tokens paired with a family of refresh tokens, then deletes them
+func revokeFamily(username string, family string) error {
+    tokens, err := db.GetRefreshTokens(username)
+    if err != nil {
+        return err
+    }
+    for _, token := range tokens {
+        if token.Family != family {
+            continue
+        }
+        // Access tokens never outlive the refresh token issued with them
+        err = db.RevokeToken(token.AccessJTI, token.ExpiresAt)
+        if err != nil {
+            return err
+        }
+    }
+    return db.DeleteRefreshTokenFamily(family)
+}
+
+// Revokes every API token of a user
+func RevokeTokens(username string) error {
+    tokens, err := db.GetRefreshTokens(username)
+    if err != nil {
+        return err
+    }
+    for _, token := range tokens {
+        err = db.RevokeToken(token.AccessJTI, token.ExpiresAt)
+        if err != nil {
+            return err
+        }
+    }
+    return db.DeleteRefreshTokens(username)
+}
+
+// Revokes a single access token until it expires
+func RevokeAccessToken(jti string, expiresAt time.Time) error {
+    return db.RevokeToken(jti, expiresAt)
+}
+
+// Determines if an access token has been revoked
+func TokenRevoked(jti string) (bool, error) {
+    return db.TokenRevoked(jti)
+}
+
+// Deletes expired refresh tokens and revocations
+func PurgeExpiredTokens() (int64, error) {
+    return db.DeleteExpiredTokens(time.Now())
+}
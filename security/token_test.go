@@ -0,0 +1,135 @@
+package security
+
+import (
+    "testing"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+    useMemoryStore()
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    first, err := NewRefreshToken("alice", "jti-1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := NewRefreshToken("alice", "other-login")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    username, second, err := RotateRefreshToken(first, "jti-2")
+    if err != nil || username != "alice" {
+        t.Fatalf("First rotation returned %q: %v", username, err)
+    }
+    _, third, err := RotateRefreshToken(second, "jti-3")
+    if err != nil {
+        t.Fatalf("Second rotation failed: %v", err)
+    }
+    for _, jti := range []string{"jti-1", "jti-2", "jti-3"} {
+        revoked, err := TokenRevoked(jti)
+        if err != nil || revoked {
+            t.Fatalf("%s is revoked before any reuse: %v", jti, err)
+        }
+    }
+
+    // Replaying a rotated token looks like theft
+    _, _, err = RotateRefreshToken(first, "jti-4")
+    if err == nil {
+        t.Fatal("Rotated refresh token was accepted again")
+    }
+    tokens, err := db.GetRefreshTokens("alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, token := range tokens {
+        if token.Family == "jti-1" {
+            t.Errorf("Refresh token of the reused family is kept: %+v", token)
+        }
+    }
+    if len(tokens) != 1 || tokens[0].Family != "other-login" {
+        t.Errorf("Expected only the other login's refresh token, found %+v", tokens)
+    }
+    for _, jti := range []string{"jti-1", "jti-2", "jti-3"} {
+        revoked, err := TokenRevoked(jti)
+        if err != nil || !revoked {
+            t.Errorf("Access token %s of the reused family is not revoked: %v", jti, err)
+        }
+    }
+
+    _, _, err = RotateRefreshToken(third, "jti-5")
+    if err == nil {
+        t.Error("Latest refresh token of the reused family still rotates")
+    }
+    revoked, _ := TokenRevoked("other-login")
+    if revoked {
+        t.Error("Access token of another login was revoked")
+    }
+    _, _, err = RotateRefreshToken(other, "other-login-2")
+    if err != nil {
+        t.Errorf("Refresh token of another login was revoked: %v", err)
+    }
+}
+
+func TestChangePasswordEndsAllOtherAccess(t *testing.T) {
+    useMemoryStore()
+    for _, username := range []string{"alice", "bob"} {
+        err := Createuser(username, "password")
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    refresh, err := NewRefreshToken("alice", "jti-1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    personal, _, err := CreatePersonalToken("alice", "ci", []string{ScopePostsRead}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bobPersonal, _, err := CreatePersonalToken("bob", "ci", []string{ScopePostsRead}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    current, err := Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := Authenticate("alice", "password", Client{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = ChangePassword("alice", "wrong", "new password", current)
+    if err == nil {
+        t.Fatal("Password was changed without the current password")
+    }
+    err = ChangePassword("alice", "password", "new password", current)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, _, err = RotateRefreshToken(refresh, "jti-2"); err == nil {
+        t.Error("Refresh token survived the password change")
+    }
+    if revoked, _ := TokenRevoked("jti-1"); !revoked {
+        t.Error("Access token survived the password change")
+    }
+    if _, _, err = AuthenticatePersonalToken(personal); err == nil {
+        t.Error("Personal token survived the password change")
+    }
+    if ok, _ := IsAuthenticated(other); ok {
+        t.Error("Other session survived the password change")
+    }
+    if ok, _ := IsAuthenticated(current); !ok {
+        t.Error("Session that changed the password was ended")
+    }
+    if _, _, err = AuthenticatePersonalToken(bobPersonal); err != nil {
+        t.Errorf("Another user's personal token was revoked: %v", err)
+    }
+    if err = VerifyCredentials("alice", "new password"); err != nil {
+        t.Errorf("New password is not accepted: %v", err)
+    }
+}
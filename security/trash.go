@@ -0,0 +1,48 @@
+package security
+
+import (
+    "time"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// How long deleted posts and comments stay in the trash, set with TRASH_RETENTION
+var TrashRetention = envDuration("TRASH_RETENTION", 30 * 24 * time.Hour)
+
+// Lists the trash viewer may restore: their own deleted content, or everything
+// for users with PermRestoreAnyContent
+func ListTrash(viewer string) ([]db.TrashItem, error) {
+    if Can(viewer, PermRestoreAnyContent) {
+        return db.GetTrash("")
+    }
+    return db.GetTrash(viewer)
+}
+
+// Takes a post or comment out of the trash. Authors may restore their own
+// content; anybody else needs PermRestoreAnyContent and the restore is recorded
+// in the moderation log.
+func RestoreContent(actor string, entity db.Entity, id string) error {
+    item, err := db.GetTrashItem(entity, id)
+    if err != nil {
+        return err
+    }
+    owner := item.Author == actor
+    if !owner && !Can(actor, PermRestoreAnyContent) {
+        return ErrPermissionDenied
+    }
+    err = db.RestoreContent(entity, id)
+    if err != nil || owner {
+        return err
+    }
+    return db.AddModerationEntry(db.ModerationEntry{
+        Actor: actor,
+        Action: "restore",
+        Entity: entity.String(),
+        EntityId: id,
+        Author: item.Author,
+    })
+}
+
+// Permanently deletes posts and comments that have been in the trash longer than TrashRetention
+func PurgeTrash() (int64, error) {
+    return db.PurgeTrash(time.Now().Add(-TrashRetention))
+}
@@ -0,0 +1,425 @@
+package security
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "syscall"
+    "strings"
+    "net/url"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/base64"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+const (
+    // Most webhooks a user may register
+    MaxWebhooks = 10
+    // Attempts made to send a delivery before it fails
+    WebhookMaxAttempts = 8
+    // Wait before the second attempt, doubled for each one after
+    WebhookRetryDelay = 30 * time.Second
+    // Failed attempts in a row, across deliveries, that disable a webhook
+    WebhookFailureLimit = 20
+    // Time allowed for an endpoint to respond
+    webhookTimeout = 10 * time.Second
+    // Deliveries sent by one call of DeliverWebhooks
+    webhookBatch = 10
+    // Time a claimed delivery is left to the replica that claimed it
+    webhookLease = 5 * time.Minute
+)
+
+// How long deliveries that are no longer pending are kept, set with WEBHOOK_LOG_RETENTION
+var WebhookLogRetention = envDuration("WEBHOOK_LOG_RETENTION", 30 * 24 * time.Hour)
+
+// Whether webhooks may be sent to loopback and private addresses, such as a
+// CI server in the cluster. Set WEBHOOK_ALLOW_PRIVATE to true to allow them.
+var webhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+
+// Webhook as shown to its owner, never including its secret
+type WebhookInfo struct {
+    Id string `json:"id"`
+    Username string `json:"username"`
+    URL string `json:"url"`
+    Events []string `json:"events"`
+    Enabled bool `json:"enabled"`
+    Failures int `json:"failures"`
+    CreatedAt time.Time `json:"created_at"`
+    DisabledAt *time.Time `json:"disabled_at,omitempty"`
+}
+
+func webhookInfo(webhook db.Webhook) WebhookInfo {
+    info := WebhookInfo{
+        Id: webhook.Id,
+        Username: webhook.Username,
+        URL: webhook.URL,
+        Events: webhook.Events,
+        Enabled: webhook.Enabled,
+        Failures: webhook.Failures,
+        CreatedAt: webhook.CreatedAt,
+    }
+    if !webhook.DisabledAt.IsZero() {
+        disabledAt := webhook.DisabledAt
+        info.DisabledAt = &disabledAt
+    }
+    return info
+}
+
+// Delivery of an event to a webhook, for the delivery log
+type DeliveryInfo struct {
+    Id string `json:"id"`
+    WebhookId string `json:"webhook_id"`
+    Event string `json:"event"`
+    Payload string `json:"payload"`
+    Status string `json:"status"`
+    Attempts int `json:"attempts"`
+    NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+    ResponseCode int `json:"response_code"`
+    Error string `json:"error,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+    DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+func deliveryInfo(delivery db.WebhookDelivery) DeliveryInfo {
+    info := DeliveryInfo{
+        Id: delivery.Id,
+        WebhookId: delivery.WebhookId,
+        Event: delivery.Event,
+        Payload: delivery.Payload,
+        Status: delivery.Status,
+        Attempts: delivery.Attempts,
+        ResponseCode: delivery.ResponseCode,
+        Error: delivery.Error,
+        CreatedAt: delivery.CreatedAt,
+    }
+    if delivery.Status == db.DeliveryPending {
+        next := delivery.NextAttemptAt
+        info.NextAttemptAt = &next
+    }
+    if !delivery.DeliveredAt.IsZero() {
+        deliveredAt := delivery.DeliveredAt
+        info.DeliveredAt = &deliveredAt
+    }
+    return info
+}
+
+// Checks that a webhook URL is an absolute http or https URL
+func validWebhookURL(rawURL string) (string, error) {
+    rawURL = strings.TrimSpace(rawURL)
+    u, err := url.Parse(rawURL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(rawURL) > 2000 {
+        return "", fmt.Errorf("Webhook URL must be an http or https URL of at most 2000 characters")
+    }
+    return rawURL, nil
+}
+
+// Gets a webhook that actor owns, or any webhook if actor may manage them all.
+// Other users' webhooks are reported missing.
+func ownedWebhook(actor string, id string) (db.Webhook, error) {
+    webhook, err := db.GetWebhook(id)
+    if err != nil {
+        return webhook, err
+    }
+    if webhook.Username != actor && !Can(actor, PermManageWebhooks) {
+        return webhook, fmt.Errorf("Webhook %s does not exist.", id)
+    }
+    return webhook, nil
+}
+
+// Registers a webhook sending events of the given types to rawURL. The secret
+// its payloads are signed with is only returned here.
+func CreateWebhook(username string, rawURL string, events []string) (string, WebhookInfo, error) {
+    rawURL, err := validWebhookURL(rawURL)
+    if err != nil {
+        return "", WebhookInfo{}, err
+    }
+    events, err = db.ValidWebhookEvents(events)
+    if err != nil {
+        return "", WebhookInfo{}, err
+    }
+    existing, err := db.GetWebhooks(username)
+    if err != nil {
+        return "", WebhookInfo{}, err
+    }
+    if len(existing) >= MaxWebhooks {
+        return "", WebhookInfo{}, fmt.Errorf("Users may register at most %d webhooks", MaxWebhooks)
+    }
+
+    b, err := randomBytes(32)
+    if err != nil {
+        return "", WebhookInfo{}, err
+    }
+    secret := base64.RawURLEncoding.EncodeToString(b)
+    webhook := db.Webhook{
+        Username: username,
+        URL: rawURL,
+        Secret: secret,
+        Events: events,
+        Enabled: true,
+    }
+    webhook.Id, err = db.AddWebhook(webhook)
+    if err != nil {
+        return "", WebhookInfo{}, err
+    }
+    webhook.CreatedAt = time.Now().UTC().Truncate(time.Second)
+    return secret, webhookInfo(webhook), nil
+}
+
+// Lists a user's webhooks, or every user's when all is set and they may manage them
+func ListWebhooks(username string, all bool) ([]WebhookInfo, error) {
+    if all {
+        if !Can(username, PermManageWebhooks) {
+            return nil, ErrPermissionDenied
+        }
+        username = ""
+    }
+    webhooks, err := db.GetWebhooks(username)
+    if err != nil {
+        return nil, err
+    }
+    infos := []WebhookInfo{}
+    for _, webhook := range webhooks {
+        infos = append(infos, webhookInfo(webhook))
+    }
+    return infos, nil
+}
+
+// Returns one of the webhooks actor may manage
+func GetWebhook(actor string, id string) (WebhookInfo, error) {
+    webhook, err := ownedWebhook(actor, id)
+    if err != nil {
+        return WebhookInfo{}, err
+    }
+    return webhookInfo(webhook), nil
+}
+
+// Changes the URL or events of a webhook when they are not empty, and enables or
+// disables it when enabled is not nil. Enabling it forgets its failures.
+func UpdateWebhook(actor string, id string, rawURL string, events []string, enabled *bool) (WebhookInfo, error) {
+    webhook, err := ownedWebhook(actor, id)
+    if err != nil {
+        return WebhookInfo{}, err
+    }
+    if rawURL != "" {
+        webhook.URL, err = validWebhookURL(rawURL)
+        if err != nil {
+            return WebhookInfo{}, err
+        }
+    }
+    if events != nil {
+        webhook.Events, err = db.ValidWebhookEvents(events)
+        if err != nil {
+            return WebhookInfo{}, err
+        }
+    }
+    if enabled != nil {
+        if *enabled && !webhook.Enabled {
+            webhook.Failures = 0
+            webhook.DisabledAt = time.Time{}
+        }
+        webhook.Enabled = *enabled
+    }
+    err = db.UpdateWebhook(webhook)
+    if err != nil {
+        return WebhookInfo{}, err
+    }
+    return webhookInfo(webhook), nil
+}
+
+// Deletes a webhook and its delivery log
+func DeleteWebhook(actor string, id string) error {
+    _, err := ownedWebhook(actor, id)
+    if err != nil {
+        return err
+    }
+    return db.DeleteWebhook(id)
+}
+
+// Lists up to limit of a webhook's most recent deliveries, newest first
+func ListDeliveries(actor string, id string, limit int) ([]DeliveryInfo, error) {
+    _, err := ownedWebhook(actor, id)
+    if err != nil {
+        return nil, err
+    }
+    deliveries, err := db.GetWebhookDeliveries(id, limit)
+    if err != nil {
+        return nil, err
+    }
+    infos := []DeliveryInfo{}
+    for _, delivery := range deliveries {
+        infos = append(infos, deliveryInfo(delivery))
+    }
+    return infos, nil
+}
+
+// Queues the payload of one of a webhook's deliveries to be sent again, as a new delivery
+func Redeliver(actor string, id string, deliveryID string) (DeliveryInfo, error) {
+    _, err := ownedWebhook(actor, id)
+    if err != nil {
+        return DeliveryInfo{}, err
+    }
+    delivery, err := db.GetWebhookDelivery(deliveryID)
+    if err != nil || delivery.WebhookId != id {
+        return DeliveryInfo{}, fmt.Errorf("Delivery %s does not exist.", deliveryID)
+    }
+    created := time.Now().UTC().Truncate(time.Second)
+    redelivery := db.WebhookDelivery{
+        WebhookId: id,
+        Event: delivery.Event,
+        Payload: delivery.Payload,
+        Status: db.DeliveryPending,
+        NextAttemptAt: created,
+        CreatedAt: created,
+    }
+    redelivery.Id, err = db.AddWebhookDelivery(redelivery)
+    if err != nil {
+        return DeliveryInfo{}, err
+    }
+    return deliveryInfo(redelivery), nil
+}
+
+// Returned when a webhook URL resolves to an address it may not be sent to
+var errPrivateAddress = errors.New("Webhooks may not be sent to loopback or private addresses")
+
+// Refuses connections to loopback, private and link-local addresses unless
+// allowed. Checked on the resolved address, so DNS cannot point around it.
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+    if webhookAllowPrivate {
+        return nil
+    }
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsUnspecified() || ip.IsMulticast() {
+        return errPrivateAddress
+    }
+    return nil
+}
+
+var webhookClient = &http.Client{
+    Timeout: webhookTimeout,
+    Transport: &http.Transport{
+        DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}).DialContext,
+        TLSHandshakeTimeout: webhookTimeout,
+        MaxIdleConnsPerHost: 2,
+    },
+}
+
+// Signs a payload with a webhook's secret, as sent in X-Kind-Signature-256
+func SignWebhookPayload(secret string, payload []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(payload)
+    return "sha256="+hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends a delivery to its webhook, returning the response status code
+func sendWebhook(webhook db.Webhook, delivery db.WebhookDelivery) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+    defer cancel()
+    payload := []byte(delivery.Payload)
+    req, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(payload))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "kind-app-webhooks")
+    req.Header.Set("X-Kind-Event", delivery.Event)
+    req.Header.Set("X-Kind-Delivery", delivery.Id)
+    req.Header.Set("X-Kind-Signature-256", SignWebhookPayload(webhook.Secret, payload))
+    resp, err := webhookClient.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64 * 1024))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return resp.StatusCode, fmt.Errorf("Endpoint responded %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
+
+// Returns the wait before the attempt after the given number of attempts
+func webhookBackoff(attempts int) time.Duration {
+    delay := WebhookRetryDelay
+    for i := 1; i < attempts; i++ {
+        delay *= 2
+    }
+    return delay
+}
+
+// Makes one attempt at a delivery, recording the outcome on the delivery and its
+// webhook. The delivery is retried later or fails, and the webhook is disabled
+// after WebhookFailureLimit failures in a row.
+func attemptDelivery(delivery db.WebhookDelivery) error {
+    webhook, err := db.GetWebhook(delivery.WebhookId)
+    if err != nil {
+        return err
+    }
+    code, err := sendWebhook(webhook, delivery)
+    now := time.Now().UTC().Truncate(time.Second)
+    delivery.Attempts++
+    delivery.ResponseCode = code
+    delivery.Error = ""
+    if err == nil {
+        delivery.Status = db.DeliveryDelivered
+        delivery.DeliveredAt = now
+        if webhook.Failures > 0 {
+            err = db.ResetWebhookFailures(webhook.Id)
+            if err != nil {
+                fmt.Println(err)
+            }
+        }
+        return db.UpdateWebhookDelivery(delivery)
+    }
+
+    delivery.Error = err.Error()
+    if len(delivery.Error) > 255 {
+        delivery.Error = delivery.Error[:255]
+    }
+    if delivery.Attempts >= WebhookMaxAttempts {
+        delivery.Status = db.DeliveryFailed
+    } else {
+        delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+    }
+    // The owner may have changed the webhook during the attempt, so only its
+    // failure count and state are updated
+    disabled, err := db.RecordWebhookFailure(webhook.Id, WebhookFailureLimit)
+    if err != nil {
+        fmt.Println(err)
+    }
+    if disabled {
+        fmt.Println("Disabled webhook", webhook.Id, "after", WebhookFailureLimit, "failed attempts in a row")
+    }
+    return db.UpdateWebhookDelivery(delivery)
+}
+
+// Sends the deliveries that are due, returning the number attempted
+func DeliverWebhooks() (int, error) {
+    deliveries, err := db.ClaimWebhookDeliveries(time.Now().Add(webhookLease), webhookBatch)
+    if err != nil {
+        return 0, err
+    }
+    for _, delivery := range deliveries {
+        err = attemptDelivery(delivery)
+        if err != nil {
+            fmt.Println("Error delivering webhook:", err)
+        }
+    }
+    return len(deliveries), nil
+}
+
+// Permanently deletes deliveries older than WebhookLogRetention that are no longer pending
+func PruneWebhookDeliveries() (int64, error) {
+    return db.PruneWebhookDeliveries(time.Now().Add(-WebhookLogRetention))
+}
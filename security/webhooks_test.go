@@ -0,0 +1,335 @@
+package security
+
+import (
+    "io"
+    "time"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "gitlab.sas.com/lomich/kind-app/db"
+)
+
+// Request received by a test endpoint
+type receivedWebhook struct {
+    header http.Header
+    body []byte
+}
+
+// Starts an endpoint that records the webhooks it receives and responds with *status
+func webhookEndpoint(t *testing.T, status *int32) (*httptest.Server, chan receivedWebhook) {
+    received := make(chan receivedWebhook, 100)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        received <- receivedWebhook{r.Header, body}
+        w.WriteHeader(int(atomic.LoadInt32(status)))
+    }))
+    t.Cleanup(server.Close)
+    return server, received
+}
+
+// Lets webhooks reach the test endpoint on the loopback address
+func allowPrivate(t *testing.T, allow bool) {
+    previous := webhookAllowPrivate
+    webhookAllowPrivate = allow
+    t.Cleanup(func() { webhookAllowPrivate = previous })
+}
+
+// Makes a pending delivery due now rather than after its backoff
+func makeDue(t *testing.T, id string) {
+    t.Helper()
+    delivery, err := db.GetWebhookDelivery(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    delivery.NextAttemptAt = time.Now().Add(-time.Second).UTC().Truncate(time.Second)
+    err = db.UpdateWebhookDelivery(delivery)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Returns the only delivery of a webhook
+func onlyDelivery(t *testing.T, webhookID string) db.WebhookDelivery {
+    t.Helper()
+    deliveries, err := db.GetWebhookDeliveries(webhookID, 0)
+    if err != nil || len(deliveries) != 1 {
+        t.Fatalf("Expected one delivery, found %+v: %v", deliveries, err)
+    }
+    return deliveries[0]
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+    // RFC 4231 test case 2
+    signature := SignWebhookPayload("Jefe", []byte("what do ya want for nothing?"))
+    if signature != "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+        t.Errorf("Unexpected signature %s", signature)
+    }
+    if SignWebhookPayload("other", []byte("what do ya want for nothing?")) == signature {
+        t.Error("Signature does not depend on the secret")
+    }
+}
+
+func TestWebhookBackoff(t *testing.T) {
+    for attempts, delay := range map[int]time.Duration{
+        1: 30 * time.Second,
+        2: time.Minute,
+        3: 2 * time.Minute,
+        4: 4 * time.Minute,
+        7: 32 * time.Minute,
+    } {
+        if webhookBackoff(attempts) != delay {
+            t.Errorf("Backoff after %d attempts is %v, expected %v", attempts, webhookBackoff(attempts), delay)
+        }
+    }
+}
+
+func TestWebhookDialControl(t *testing.T) {
+    refused := []string{
+        "127.0.0.1:80",
+        "127.1.2.3:8080",
+        "[::1]:443",
+        "10.0.0.1:443",
+        "172.16.5.4:443",
+        "192.168.1.1:80",
+        "169.254.169.254:80",
+        "0.0.0.0:80",
+        "[::]:80",
+        "[fd00::1]:443",
+        "[fe80::1]:443",
+        "[::ffff:127.0.0.1]:80",
+        "[::ffff:10.0.0.1]:80",
+        "[::ffff:169.254.169.254]:80",
+        "224.0.0.1:80",
+    }
+    allowed := []string{"93.184.216.34:443", "8.8.8.8:80", "[2606:4700:4700::1111]:443"}
+
+    allowPrivate(t, false)
+    for _, address := range refused {
+        if err := webhookDialControl("tcp", address, nil); err != errPrivateAddress {
+            t.Errorf("%s was not refused: %v", address, err)
+        }
+    }
+    for _, address := range allowed {
+        if err := webhookDialControl("tcp", address, nil); err != nil {
+            t.Errorf("%s was refused: %v", address, err)
+        }
+    }
+
+    allowPrivate(t, true)
+    for _, address := range append(refused, allowed...) {
+        if err := webhookDialControl("tcp", address, nil); err != nil {
+            t.Errorf("%s was refused with WEBHOOK_ALLOW_PRIVATE: %v", address, err)
+        }
+    }
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+    useMemoryStore()
+    status := int32(http.StatusOK)
+    server, received := webhookEndpoint(t, &status)
+    allowPrivate(t, true)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    secret, webhook, err := CreateWebhook("alice", server.URL, []string{db.PostCreated})
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = db.AddPost("hello", "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    n, err := DeliverWebhooks()
+    if err != nil || n != 1 {
+        t.Fatalf("Delivered %d webhooks: %v", n, err)
+    }
+    request := <-received
+    delivery := onlyDelivery(t, webhook.Id)
+    if request.header.Get("X-Kind-Signature-256") != SignWebhookPayload(secret, request.body) {
+        t.Errorf("Signature %q does not match the body", request.header.Get("X-Kind-Signature-256"))
+    }
+    if request.header.Get("X-Kind-Event") != db.PostCreated || request.header.Get("X-Kind-Delivery") != delivery.Id {
+        t.Errorf("Unexpected headers %v", request.header)
+    }
+    if string(request.body) != delivery.Payload || !strings.Contains(delivery.Payload, "hello") {
+        t.Errorf("Body %s is not the payload %s", request.body, delivery.Payload)
+    }
+    if delivery.Status != db.DeliveryDelivered || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusOK {
+        t.Errorf("Delivery was not recorded as delivered: %+v", delivery)
+    }
+}
+
+func TestWebhookPrivateAddressesAreRefused(t *testing.T) {
+    useMemoryStore()
+    status := int32(http.StatusOK)
+    server, received := webhookEndpoint(t, &status)
+    allowPrivate(t, false)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, webhook, err := CreateWebhook("alice", server.URL, []string{db.PostCreated})
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.AddPost("hello", "alice")
+
+    DeliverWebhooks()
+    delivery := onlyDelivery(t, webhook.Id)
+    if delivery.Status != db.DeliveryPending || !strings.Contains(delivery.Error, errPrivateAddress.Error()) {
+        t.Errorf("Delivery to %s was not refused: %+v", server.URL, delivery)
+    }
+    select {
+    case <-received:
+        t.Error("Endpoint on the loopback address received the webhook")
+    default:
+    }
+}
+
+func TestWebhookRetriesThenFails(t *testing.T) {
+    useMemoryStore()
+    status := int32(http.StatusInternalServerError)
+    server, _ := webhookEndpoint(t, &status)
+    allowPrivate(t, true)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, webhook, err := CreateWebhook("alice", server.URL, []string{db.PostCreated})
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.AddPost("hello", "alice")
+
+    for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+        start := time.Now()
+        n, err := DeliverWebhooks()
+        if err != nil || n != 1 {
+            t.Fatalf("Attempt %d sent %d deliveries: %v", attempt, n, err)
+        }
+        delivery := onlyDelivery(t, webhook.Id)
+        if delivery.Attempts != attempt || delivery.ResponseCode != http.StatusInternalServerError || delivery.Error == "" {
+            t.Fatalf("Attempt %d was not recorded: %+v", attempt, delivery)
+        }
+        if attempt == WebhookMaxAttempts {
+            if delivery.Status != db.DeliveryFailed {
+                t.Fatalf("Delivery has not failed after %d attempts: %+v", attempt, delivery)
+            }
+            break
+        }
+        wait := delivery.NextAttemptAt.Sub(start)
+        if delivery.Status != db.DeliveryPending || wait < webhookBackoff(attempt) - 2 * time.Second || wait > webhookBackoff(attempt) + time.Second {
+            t.Fatalf("Attempt %d is retried after %v, expected %v: %+v", attempt, wait, webhookBackoff(attempt), delivery)
+        }
+        n, _ = DeliverWebhooks()
+        if n != 0 {
+            t.Fatalf("Delivery was retried before its backoff after attempt %d", attempt)
+        }
+        makeDue(t, delivery.Id)
+    }
+    n, _ := DeliverWebhooks()
+    if n != 0 {
+        t.Error("Failed delivery was sent again")
+    }
+
+    // Failures were counted against the webhook, and success forgets them
+    stored, _ := db.GetWebhook(webhook.Id)
+    if stored.Failures != WebhookMaxAttempts || !stored.Enabled {
+        t.Errorf("Expected %d failures, found %+v", WebhookMaxAttempts, stored)
+    }
+    atomic.StoreInt32(&status, http.StatusNoContent)
+    db.AddPost("again", "alice")
+    DeliverWebhooks()
+    stored, _ = db.GetWebhook(webhook.Id)
+    if stored.Failures != 0 {
+        t.Errorf("Failures were kept after a delivery: %+v", stored)
+    }
+}
+
+func TestWebhookIsDisabledAfterFailureLimit(t *testing.T) {
+    useMemoryStore()
+    status := int32(http.StatusBadGateway)
+    server, _ := webhookEndpoint(t, &status)
+    allowPrivate(t, true)
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, webhook, err := CreateWebhook("alice", server.URL, []string{db.PostCreated})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Each post queues a delivery, so the failures span several deliveries
+    for failures := 1; failures <= WebhookFailureLimit; failures++ {
+        db.AddPost("post", "alice")
+        deliveries, _ := db.GetWebhookDeliveries(webhook.Id, 100)
+        for _, delivery := range deliveries {
+            if delivery.Status == db.DeliveryPending {
+                makeDue(t, delivery.Id)
+            }
+        }
+        // Only one attempt is made per round so failures are counted one at a time
+        delivery, err := db.ClaimWebhookDeliveries(time.Now().Add(webhookLease), 1)
+        if err != nil || len(delivery) != 1 {
+            t.Fatalf("Claimed %+v: %v", delivery, err)
+        }
+        err = attemptDelivery(delivery[0])
+        if err != nil {
+            t.Fatal(err)
+        }
+        stored, _ := db.GetWebhook(webhook.Id)
+        if stored.Failures != failures || stored.Enabled != (failures < WebhookFailureLimit) {
+            t.Fatalf("After %d failures the webhook is %+v", failures, stored)
+        }
+    }
+    stored, _ := db.GetWebhook(webhook.Id)
+    if stored.DisabledAt.IsZero() {
+        t.Errorf("Disabled webhook has no disabled time: %+v", stored)
+    }
+    db.AddPost("ignored", "alice")
+    n, _ := DeliverWebhooks()
+    if n != 0 {
+        t.Errorf("Disabled webhook was sent %d deliveries", n)
+    }
+
+    // Enabling it again forgets the failures
+    enabled := true
+    info, err := UpdateWebhook("alice", webhook.Id, "", nil, &enabled)
+    if err != nil || !info.Enabled || info.Failures != 0 || info.DisabledAt != nil {
+        t.Errorf("Enabled webhook is %+v: %v", info, err)
+    }
+}
+
+func TestWebhookDeliveriesAreLeased(t *testing.T) {
+    useMemoryStore()
+    err := Createuser("alice", "password")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, _, err = CreateWebhook("alice", "https://example.com/hook", []string{db.PostCreated})
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.AddPost("hello", "alice")
+
+    claimed, err := db.ClaimWebhookDeliveries(time.Now().Add(webhookLease), webhookBatch)
+    if err != nil || len(claimed) != 1 {
+        t.Fatalf("Claimed %+v: %v", claimed, err)
+    }
+    again, err := db.ClaimWebhookDeliveries(time.Now().Add(webhookLease), webhookBatch)
+    if err != nil || len(again) != 0 {
+        t.Fatalf("Leased delivery was claimed again: %+v %v", again, err)
+    }
+
+    // A replica that claimed it and never reported back loses it when the lease ends
+    makeDue(t, claimed[0].Id)
+    again, err = db.ClaimWebhookDeliveries(time.Now().Add(webhookLease), webhookBatch)
+    if err != nil || len(again) != 1 || again[0].Id != claimed[0].Id {
+        t.Fatalf("Delivery was not claimed after its lease ended: %+v %v", again, err)
+    }
+}